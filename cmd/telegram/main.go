@@ -2,16 +2,16 @@
 package main
 
 import (
-	"database/sql"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
 	"uranus/internal/background"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
 	"uranus/internal/telegram"
 	"uranus/pkg/logger"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -34,15 +34,22 @@ func main() {
 	ownerID := config.GetInt64("id")
 	dataSourceName := config.GetString("dsn")
 
-	os.MkdirAll(filepath.Dir(dataSourceName), os.ModeDir)
-	db, err := sql.Open("sqlite3", dataSourceName)
+	// SQLite 的数据库文件所在的目录不存在时创建
+	if storage.Driver(dataSourceName) == storage.DriverSQLite {
+		os.MkdirAll(filepath.Dir(dataSourceName), os.ModeDir)
+	}
+	db, err := storage.Open(dataSourceName)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	defer db.Close()
 
+	if err := migration.Migrate(db); err != nil {
+		logrus.Fatal(err)
+	}
+
 	telegramWorker := telegram.NewWorker(token, ownerID)
-	processWorker := background.NewProcessWorker(db)
+	processWorker := background.NewProcessWorker(db, background.IngestConfig{})
 
 	if err := telegram.SetStandaloneMode(db); err != nil {
 		logrus.Fatal(err)
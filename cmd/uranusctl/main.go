@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"uranus/internal/ctl"
+	"uranus/pkg/logger"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: uranusctl [options] <command> [args]\n\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	ctl.Usage(os.Stderr)
+}
+
+func main() {
+	logger.InitLogrusFormat()
+	// 直连模式下 web 模块的日志只输出错误,避免与命令的输出混在一起
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	// 配置文件可选,环境变量优先于配置文件,例如 URANUS_TOKEN
+	config := viper.New()
+	config.SetConfigName("uranusctl")
+	config.SetConfigType("yaml")
+	config.AddConfigPath("/etc/hackernel")
+	config.SetEnvPrefix("uranus")
+	config.AutomaticEnv()
+	config.SetDefault("server", "https://127.0.0.1")
+	config.SetDefault("dsn", "/var/lib/hackernel/web.db?cache=shared&mode=rwc&_journal_mode=WAL")
+	config.SetDefault("backup", "/var/lib/hackernel/backup")
+	if err := config.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			logrus.Fatal(err)
+		}
+	}
+
+	options := ctl.Options{}
+	flag.StringVar(&options.Server, "server", config.GetString("server"), "uranus-web address, unix:/path for Unix Domain Socket")
+	flag.StringVar(&options.Token, "token", config.GetString("token"), "API token")
+	flag.BoolVar(&options.Insecure, "insecure", config.GetBool("insecure"), "skip TLS certificate verification")
+	flag.StringVar(&options.DSN, "dsn", config.GetString("dsn"), "database used when uranus-web is not running")
+	flag.StringVar(&options.Backup, "backup", config.GetString("backup"), "backup directory used when uranus-web is not running")
+	flag.BoolVar(&options.Local, "local", false, "access database and hackernel directly")
+	flag.BoolVar(&options.JSON, "json", false, "print JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.Arg(0) == "help" {
+		usage()
+		return
+	}
+	command, args := ctl.Lookup(flag.Args())
+	if command == nil {
+		usage()
+		os.Exit(2)
+	}
+
+	client, err := ctl.Connect(options, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	context := &ctl.Context{Client: client, JSON: options.JSON, In: os.Stdin, Out: os.Stdout, Err: os.Stderr}
+	err = command.Run(context, args)
+	switch {
+	case err == nil:
+	case errors.Is(err, ctl.ErrUsage):
+		fmt.Fprintf(os.Stderr, "Usage: uranusctl %s %s\n", command.Name, command.Args)
+		os.Exit(2)
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
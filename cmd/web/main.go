@@ -2,16 +2,19 @@
 package main
 
 import (
-	"database/sql"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
+	"time"
 	"uranus/internal/background"
+	"uranus/internal/backup"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
 	"uranus/internal/web"
 	"uranus/pkg/logger"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -20,7 +23,7 @@ func main() {
 	logger.InitLogrusFormat()
 
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	config := viper.New()
 	config.SetConfigName("web")
@@ -30,19 +33,53 @@ func main() {
 		logrus.Fatal(err)
 	}
 
-	listen := config.GetString("listen")
+	webConfig := readWebConfig(config)
+	listen := webConfig.Listen
 	dataSourceName := config.GetString("dsn")
-	os.MkdirAll(filepath.Dir(dataSourceName), os.ModeDir)
-	db, err := sql.Open("sqlite3", dataSourceName)
+	// SQLite 的数据库文件所在的目录不存在时创建
+	if storage.Driver(dataSourceName) == storage.DriverSQLite {
+		os.MkdirAll(filepath.Dir(dataSourceName), os.ModeDir)
+	}
+	db, err := storage.Open(dataSourceName)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	defer db.Close()
 
-	processWorker := background.NewProcessWorker(db)
-	fileWorker := background.NewFileWorker(db)
+	// 数据库结构比当前程序新时拒绝启动
+	if err := migration.Migrate(db); err != nil {
+		logrus.Fatal(err)
+	}
+
+	backgroundConfig := readBackgroundConfig(config)
+	processWorker := background.NewProcessWorker(db, backgroundConfig.ingest)
+	fileWorker := background.NewFileWorker(db, backgroundConfig.ingest)
 	netWorker := background.NewNetWorker(db)
-	webWorker := web.NewWorker(listen, db)
+	janitorWorker := background.NewJanitorWorker(db, backgroundConfig.archive)
+	backupWorker := backup.NewWorker(db, webConfig.Backup, backgroundConfig.backupInterval, backgroundConfig.backupKeep)
+	webWorker := web.NewWorker(webConfig, db)
+	// 重新读取配置文件,配置文件或证书有误时继续使用原来的配置.监听地址等配置需要重启服务才能生效
+	webWorker.OnReload(func() error {
+		if err := config.ReadInConfig(); err != nil {
+			return err
+		}
+		if err := webWorker.Apply(readWebConfig(config)); err != nil {
+			return err
+		}
+		next := readBackgroundConfig(config)
+		if err := backupWorker.Configure(next.backupInterval, next.backupKeep); err != nil {
+			return err
+		}
+		processWorker.SetIngestConfig(next.ingest)
+		fileWorker.SetIngestConfig(next.ingest)
+		janitorWorker.SetArchive(next.archive)
+		return nil
+	})
+	webWorker.AddBackground("process", processWorker)
+	webWorker.AddBackground("file", fileWorker)
+	webWorker.AddBackground("net", netWorker)
+	webWorker.AddBackground("janitor", janitorWorker)
+	webWorker.AddBackground("backup", backupWorker)
 
 	if err := processWorker.Init(); err != nil {
 		logrus.Fatal(err)
@@ -56,6 +93,14 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	if err := janitorWorker.Init(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err := backupWorker.Init(); err != nil {
+		logrus.Fatal(err)
+	}
+
 	if err := webWorker.Init(); err != nil {
 		logrus.Fatal(err)
 	}
@@ -72,13 +117,28 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	if err := janitorWorker.Start(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err := backupWorker.Start(); err != nil {
+		logrus.Fatal(err)
+	}
+
 	if err := webWorker.Start(); err != nil {
 		logrus.Fatal(err)
 	}
 
 	logrus.Info("listen: ", listen)
 
+	// SIGHUP 与控制接口相同,重新读取配置文件
 	sig := <-sigchan
+	for sig == syscall.SIGHUP {
+		if err := webWorker.Reload(); err != nil {
+			logrus.Error(err)
+		}
+		sig = <-sigchan
+	}
 	logrus.Info(sig)
 
 	if err := webWorker.Stop(); err != nil {
@@ -96,4 +156,60 @@ func main() {
 	if err := netWorker.Stop(); err != nil {
 		logrus.Error(err)
 	}
+
+	if err := janitorWorker.Stop(); err != nil {
+		logrus.Error(err)
+	}
+
+	if err := backupWorker.Stop(); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func readWebConfig(config *viper.Viper) web.Config {
+	socketMode, err := strconv.ParseUint(config.GetString("socket.mode"), 8, 32)
+	if err != nil {
+		socketMode = 0660
+	}
+	return web.Config{
+		Listen:         config.GetString("listen"),
+		SocketMode:     os.FileMode(socketMode),
+		SocketGroup:    config.GetString("socket.group"),
+		TrustedProxies: config.GetStringSlice("proxies"),
+		BasePath:       config.GetString("base"),
+		Backup:         config.GetString("backup.dir"),
+		TLS: web.TLSConfig{
+			Cert:     config.GetString("tls.cert"),
+			Key:      config.GetString("tls.key"),
+			ClientCA: config.GetString("tls.ca"),
+			Redirect: config.GetString("tls.redirect"),
+		},
+	}
+}
+
+// backgroundConfig 后台模块的配置,重新加载时生效
+type backgroundConfig struct {
+	ingest         background.IngestConfig
+	archive        string
+	backupInterval time.Duration
+	backupKeep     int
+}
+
+func readBackgroundConfig(config *viper.Viper) backgroundConfig {
+	return backgroundConfig{
+		ingest:         readIngestConfig(config),
+		archive:        config.GetString("retention.archive"),
+		backupInterval: time.Duration(config.GetInt("backup.interval")) * time.Second,
+		backupKeep:     config.GetInt("backup.keep"),
+	}
+}
+
+// readIngestConfig 没有配置的项使用默认值
+func readIngestConfig(config *viper.Viper) background.IngestConfig {
+	return background.IngestConfig{
+		QueueSize:     config.GetInt("ingest.queue"),
+		Workers:       config.GetInt("ingest.workers"),
+		BatchSize:     config.GetInt("ingest.batch"),
+		FlushInterval: time.Duration(config.GetInt("ingest.flush")) * time.Millisecond,
+	}
 }
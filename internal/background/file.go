@@ -2,11 +2,11 @@
 package background
 
 import (
-	"database/sql"
 	"encoding/json"
 	"sync"
 	"time"
 	"uranus/internal/config"
+	"uranus/internal/storage"
 	"uranus/pkg/connector"
 	"uranus/pkg/file"
 	"uranus/pkg/watchdog"
@@ -14,40 +14,52 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	sqlCreateFilePolicyTable       = `create table if not exists file_policy(id integer primary key autoincrement, path text not null, fsid integer, ino integer, perm integer not null, timestamp integer not null, status integer not null)`
-	sqlCreateFileEventTable        = `create table if not exists file_event(id integer primary key autoincrement, path text not null, fsid integer, ino integer, perm integer not null, timestamp integer not null, policy integer not null, status integer not null)`
-	sqlQueryFilePolicy             = `select id,path,fsid,ino,perm from file_policy`
-	sqlUpdateFilePolicyFsidInoById = `update file_policy set fsid=?,ino=?,timestamp=? where id=?`
-	sqlUpdateFilePolicyStatusById  = `update file_policy set status=? where id=?`
-	sqlQueryFilePolicyIdByFsidIno  = `select id from file_policy where fsid=? and ino=? and status=0`
-	sqlInsertFileEvent             = `insert into file_event(path,fsid,ino,perm,timestamp,policy,status) values(?,?,?,?,?,?,?)`
-)
-
 type FileWorker struct {
-	db *sql.DB
+	db       *storage.DB
+	policies storage.FileRepository
+
+	running  bool
+	wg       sync.WaitGroup
+	conn     connector.Connector
+	config   *config.Config
+	dog      *watchdog.Watchdog
+	ingest   *ingest
+	limiter  *policyLimiter
+	follower *follower
+	// 关闭后汇总协程写入全部限流汇总并退出
+	summaryStop chan struct{}
+	summaries   sync.WaitGroup
+}
 
-	running bool
-	wg      sync.WaitGroup
-	conn    connector.Connector
-	config  *config.Config
-	dog     *watchdog.Watchdog
+const defaultFileEventDedupWindow = 60
+
+// FileEventSettings 文件事件的去重和限流设置
+type FileEventSettings struct {
+	// 路径,权限和策略相同的未读事件在窗口秒数内合并为一行, 0 表示不合并
+	DedupWindow int `json:"dedupWindow" binding:"min=0"`
+	// 每条策略每分钟最多新增的事件行数, 0 表示不限制
+	RateLimit int `json:"rateLimit" binding:"min=0"`
 }
 
-func NewFileWorker(db *sql.DB) *FileWorker {
+// LoadFileEventSettings 默认合并 60 秒内的相同事件,不限流
+func LoadFileEventSettings(c *config.Config) FileEventSettings {
+	return FileEventSettings{
+		DedupWindow: integer(c, config.FileEventDedupWindow, defaultFileEventDedupWindow),
+		RateLimit:   integer(c, config.FileEventRateLimit, 0),
+	}
+}
+
+func NewFileWorker(db *storage.DB, queue IngestConfig) *FileWorker {
 	worker := FileWorker{
-		db: db,
+		db:       db,
+		policies: storage.NewFileRepository(db),
+		limiter:  newPolicyLimiter(),
 	}
+	worker.ingest = newIngest("file", queue, worker.handleFileEvent, worker.writeFileEvents)
 	return &worker
 }
 
 func (w *FileWorker) Init() (err error) {
-	err = w.initDB()
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-
 	w.config, err = config.New(w.db)
 	if err != nil {
 		return
@@ -66,13 +78,13 @@ func (w *FileWorker) Init() (err error) {
 
 	switch status {
 	case file.StatusEnable:
-		if ok := file.Enable(); !ok {
+		if err = file.Enable(); err != nil {
 			err = file.ErrorEnable
 			logrus.Error(err)
 			return
 		}
 	default:
-		if ok := file.Disable(); !ok {
+		if err = file.Disable(); err != nil {
 			err = file.ErrorDisable
 			logrus.Error(err)
 			return
@@ -100,40 +112,81 @@ func (w *FileWorker) Start() (err error) {
 		return
 	}
 
+	w.dog = watchdog.New(10*time.Second, func() {
+		logrus.Error("osinfo::report timeout")
+	})
+	w.limiter = newPolicyLimiter()
+	w.ingest.start()
+	w.summaryStop = make(chan struct{})
+	w.summaries.Add(1)
+	go w.summarize(w.summaryStop)
 	w.wg.Add(1)
 	go w.run()
+
+	// 无法监听时策略仍然生效,只是文件被替换后需要重启模块
+	w.follower, err = newFollower(w)
+	if err != nil {
+		logrus.Errorf("follow file policy failed: %v", err)
+		err = nil
+		return
+	}
+	w.follower.start()
 	return
 }
 
 func (w *FileWorker) Stop() (err error) {
-	err = w.conn.Send(`{"type":"user::msg::unsub","section":"kernel::proc::report"}`)
-	if err != nil {
-		return
+	// 先停止监听,避免清空策略后又重新设置
+	if w.follower != nil {
+		w.follower.stop()
+		w.follower = nil
 	}
-	err = w.conn.Send(`{"type":"user::msg::unsub","section":"osinfo::report"}`)
-	if err != nil {
-		return
+
+	// 通知 hackernel 失败时仍然释放协程,写入队列和连接,返回第一个错误
+	errs := []error{
+		w.conn.Send(`{"type":"user::msg::unsub","section":"kernel::file::report"}`),
+		w.conn.Send(`{"type":"user::msg::unsub","section":"osinfo::report"}`),
 	}
 
-	if ok := file.Disable(); !ok {
+	if err := file.Disable(); err != nil {
 		logrus.Error("file protection disable failed")
-		return
+		errs = append(errs, err)
 	}
 
-	if ok := file.ClearPolicy(); !ok {
+	if err := file.ClearPolicy(); err != nil {
 		logrus.Error("file protection clear failed")
-		return
+		errs = append(errs, err)
 	}
 
 	time.Sleep(time.Second)
 	w.running = false
-	err = w.conn.Shutdown(time.Now())
-	if err != nil {
-		return
-	}
+	errs = append(errs, w.conn.Shutdown(time.Now()))
 	w.wg.Wait()
+	w.ingest.stop()
+	// 队列中的事件写入之后再写入汇总
+	if w.summaryStop != nil {
+		close(w.summaryStop)
+		w.summaries.Wait()
+		w.summaryStop = nil
+	}
+	if w.dog != nil {
+		w.dog.Stop()
+	}
 	w.conn.Close()
-	return
+	return firstError(errs)
+}
+
+// Alive 返回是否在 watchdog 的周期内收到过 hackernel 的消息
+func (w *FileWorker) Alive() bool {
+	return w.running && w.dog != nil && w.dog.Alive()
+}
+
+func (w *FileWorker) IngestStats() IngestStats {
+	return w.ingest.state()
+}
+
+// SetIngestConfig 修改写入队列的设置,运行中时重建队列,不影响 hackernel 的订阅
+func (w *FileWorker) SetIngestConfig(queue IngestConfig) {
+	w.ingest.reconfigure(queue)
 }
 
 func (w *FileWorker) handleMsg(msg string) {
@@ -152,19 +205,20 @@ func (w *FileWorker) handleMsg(msg string) {
 	}
 	switch event.Type {
 	case "kernel::file::report":
-		err = w.handleFileEvent(event.Path, event.Fsid, event.Ino, event.Perm)
-		if err != nil {
-			logrus.Error(err)
-		}
+		w.ingest.push(event.Path, file.Event{
+			Path:      event.Path,
+			Fsid:      event.Fsid,
+			Ino:       event.Ino,
+			Perm:      event.Perm,
+			Timestamp: time.Now().Unix(),
+			Status:    file.StatusEventUnread,
+		})
 	default:
 	}
 }
 
 func (w *FileWorker) run() {
 	defer w.wg.Done()
-	w.dog = watchdog.New(10*time.Second, func() {
-		logrus.Error("osinfo::report timeout")
-	})
 	for w.running {
 		msg, err := w.conn.Recv()
 
@@ -178,55 +232,19 @@ func (w *FileWorker) run() {
 			continue
 		}
 		w.dog.Kick()
-		go w.handleMsg(msg)
-	}
-}
-
-func (w *FileWorker) initDB() (err error) {
-	_, err = w.db.Exec(sqlCreateFilePolicyTable)
-	if err != nil {
-		logrus.Error(err)
-		return
+		w.handleMsg(msg)
 	}
-
-	_, err = w.db.Exec(sqlCreateFileEventTable)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-
-	return
 }
 
 func (w *FileWorker) setPolicyThenGetExceptionPolicies() (policies []file.Policy, err error) {
-	stmt, err := w.db.Prepare(sqlQueryFilePolicy)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query()
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		policy := file.Policy{}
-		fsid := uint64(0)
-		ino := uint64(0)
-		status := int(0)
-
-		err = rows.Scan(&policy.ID, &policy.Path, &policy.Fsid, &policy.Ino, &policy.Perm)
-		if err != nil {
-			logrus.Error(err)
-			return
+	err = w.policies.ScanPolicyLimitOffset(-1, 0, func(policy file.Policy) error {
+		// 目录和通配符策略由子策略生效
+		if policy.Kind != file.KindFile {
+			return nil
 		}
-
-		fsid, ino, status, err = file.SetPolicy(policy.Path, policy.Perm, file.FlagNew)
+		fsid, ino, status, err := file.SetPolicy(policy.Path, policy.Perm, file.FlagNew)
 		if err != nil {
-			logrus.Error(err)
-			return
+			return err
 		}
 		if policy.Fsid != fsid || policy.Ino != ino || policy.Status != status {
 			policy.Fsid = fsid
@@ -234,11 +252,10 @@ func (w *FileWorker) setPolicyThenGetExceptionPolicies() (policies []file.Policy
 			policy.Status = status
 			policies = append(policies, policy)
 		}
-	}
-	err = rows.Err()
+		return nil
+	})
 	if err != nil {
 		logrus.Error(err)
-		return
 	}
 	return
 }
@@ -261,81 +278,218 @@ func (w *FileWorker) initFilePolicy() (err error) {
 			return
 		}
 	}
+	// 停止期间新增和删除的文件
+	if err = ExpandFilePolicies(w.policies); err != nil {
+		logrus.Error(err)
+	}
 	return
 }
 
 func (w *FileWorker) updateFilePolcyFsidInoById(fsid, ino, id uint64) (err error) {
-	stmt, err := w.db.Prepare(sqlUpdateFilePolicyFsidInoById)
+	ok, err := w.policies.UpdatePolicyFsidInoById(fsid, ino, id)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
-	defer stmt.Close()
-	result, err := stmt.Exec(int64(fsid), int64(ino), time.Now().Unix(), id)
-	if err != nil {
-		logrus.Error(err)
-		return
+	if !ok {
+		logrus.Errorf("id=%d, fsid=%d, ino=%d, not updated", id, fsid, ino)
 	}
-	affected, err := result.RowsAffected()
+	return
+}
+
+func (w *FileWorker) updateFilePolcyStatusById(status int, id uint64) (err error) {
+	ok, err := w.policies.UpdatePolicyStatusById(status, id)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
-	if affected != 1 {
-		logrus.Errorf("id=%d, fsid=%d, ino=%d, affected=%d", id, fsid, ino, affected)
+	if !ok {
+		logrus.Errorf("id=%d, status=%d, not updated", id, status)
 	}
 	return
 }
 
-func (w *FileWorker) updateFilePolcyStatusById(status int, id uint64) (err error) {
-	stmt, err := w.db.Prepare(sqlUpdateFilePolicyStatusById)
+// handleFileEvent 在处理协程中查询事件对应的策略
+func (w *FileWorker) handleFileEvent(item interface{}) (event interface{}, ok bool) {
+	e := item.(file.Event)
+	policyId, err := w.policies.QueryPolicyIdByFsidIno(e.Fsid, e.Ino)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
-	defer stmt.Close()
-	result, err := stmt.Exec(status, id)
-	if err != nil {
-		logrus.Error(err)
+	e.Policy = uint64(policyId)
+	return e, true
+}
+
+// writeFileEvents 每一批读取一次设置,修改后不需要重启模块
+func (w *FileWorker) writeFileEvents(events []interface{}) (err error) {
+	batch := make([]file.Event, 0, len(events))
+	for _, event := range events {
+		batch = append(batch, event.(file.Event))
+	}
+	settings := LoadFileEventSettings(w.config)
+
+	// 限流的计数在事务提交后才生效,写入失败时恢复
+	w.limiter.mutex.Lock()
+	defer w.limiter.mutex.Unlock()
+	w.limiter.begin()
+	err = w.policies.InsertEvents(batch, int64(settings.DedupWindow), func(e file.Event) bool {
+		return w.limiter.allow(e, settings.RateLimit)
+	})
+	w.limiter.end(err == nil)
+	return
+}
+
+// summarize 定期把已经结束的一分钟内的限流次数写入汇总事件,停止时写入全部
+func (w *FileWorker) summarize(stop <-chan struct{}) {
+	defer w.summaries.Done()
+	ticker := time.NewTicker(fileEventSummaryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.writeSummaries(w.limiter.flush(time.Now().Unix(), false))
+		case <-stop:
+			w.writeSummaries(w.limiter.flush(time.Now().Unix(), true))
+			return
+		}
+	}
+}
+
+// writeSummaries 写入失败时放回限流器,下一次重试
+func (w *FileWorker) writeSummaries(summaries []file.Event) {
+	if len(summaries) == 0 {
 		return
 	}
-	affected, err := result.RowsAffected()
-	if err != nil {
+	if err := w.policies.InsertEvents(summaries, 0, nil); err != nil {
 		logrus.Error(err)
+		w.limiter.restore(summaries)
 		return
 	}
-	if affected != 1 {
-		logrus.Errorf("id=%d, status=%d, affected=%d", id, status, affected)
+	for _, e := range summaries {
+		logrus.Warnf("file policy %d: suppressed %d events between %s and %s", e.Policy, e.Count,
+			time.Unix(e.First, 0).Format(time.RFC3339), time.Unix(e.Timestamp, 0).Format(time.RFC3339))
 	}
-	return
 }
 
-func (w *FileWorker) handleFileEvent(path string, fsid, ino uint64, perm int) (err error) {
-	stmt, err := w.db.Prepare(sqlQueryFilePolicyIdByFsidIno)
-	if err != nil {
-		logrus.Error(err)
-		return
+// 每隔多久检查一次已经结束的限流窗口
+const fileEventSummaryInterval = 10 * time.Second
+
+// policyLimiter 按分钟统计每条策略新增的事件行数.写入协程和汇总协程都会访问,
+// 写入一批事件期间一直持有锁
+type policyLimiter struct {
+	mutex   sync.Mutex
+	windows map[uint64]*policyWindow
+	// 已经结束并且有访问被限流的窗口,等待写入汇总事件
+	ended []file.Event
+
+	// 当前一批事件修改之前的窗口, nil 表示之前不存在
+	saved map[uint64]*policyWindow
+	// 当前一批事件开始之前 ended 的长度
+	endedSaved int
+}
+
+type policyWindow struct {
+	start int64
+	count int
+	// 第一次被限流的访问,汇总事件使用它的路径和权限
+	summary file.Event
+}
+
+func newPolicyLimiter() *policyLimiter {
+	return &policyLimiter{windows: map[uint64]*policyWindow{}}
+}
+
+// begin 开始一批事件,调用方持有锁
+func (l *policyLimiter) begin() {
+	l.saved = map[uint64]*policyWindow{}
+	l.endedSaved = len(l.ended)
+}
+
+// end commit 为 false 时恢复这一批事件修改之前的窗口,调用方持有锁
+func (l *policyLimiter) end(commit bool) {
+	if !commit {
+		for policy, window := range l.saved {
+			if window == nil {
+				delete(l.windows, policy)
+			} else {
+				l.windows[policy] = window
+			}
+		}
+		l.ended = l.ended[:l.endedSaved]
 	}
-	defer stmt.Close()
+	l.saved = nil
+}
 
-	policyId := int64(0)
-	err = stmt.QueryRow(int64(fsid), int64(ino)).Scan(&policyId)
-	if err != nil {
-		logrus.Error(err)
-		return
+// allow 超出限制的访问次数记录在窗口中,窗口结束后由汇总协程写入,调用方持有锁
+func (l *policyLimiter) allow(e file.Event, limit int) bool {
+	window, ok := l.windows[e.Policy]
+	if _, saved := l.saved[e.Policy]; !saved && l.saved != nil {
+		if ok {
+			copied := *window
+			l.saved[e.Policy] = &copied
+		} else {
+			l.saved[e.Policy] = nil
+		}
 	}
 
-	stmt, err = w.db.Prepare(sqlInsertFileEvent)
-	if err != nil {
-		logrus.Error(err)
-		return
+	minute := e.Timestamp / 60 * 60
+	if !ok || minute > window.start {
+		if ok {
+			l.close(window)
+		}
+		window = &policyWindow{start: minute}
+		l.windows[e.Policy] = window
+	}
+	if limit > 0 && window.count >= limit {
+		if window.summary.Count == 0 {
+			logrus.Warnf("file policy %d: more than %d events per minute, suppressing", e.Policy, limit)
+			window.summary = file.Event{
+				Path:   e.Path,
+				Fsid:   e.Fsid,
+				Ino:    e.Ino,
+				Perm:   e.Perm,
+				Policy: e.Policy,
+				Status: file.StatusEventUnread,
+				First:  window.start,
+				Kind:   file.EventKindSuppressed,
+			}
+		}
+		window.summary.Count += e.Count
+		if e.Timestamp > window.summary.Timestamp {
+			window.summary.Timestamp = e.Timestamp
+		}
+		return false
 	}
-	defer stmt.Close()
+	window.count++
+	return true
+}
 
-	_, err = stmt.Exec(path, int(fsid), int(ino), perm, time.Now().Unix(), policyId, file.StatusEventUnread)
-	if err != nil {
-		logrus.Error(err)
-		return
+// close 结束窗口,有访问被限流时等待写入汇总
+func (l *policyLimiter) close(window *policyWindow) {
+	if window.summary.Count > 0 {
+		l.ended = append(l.ended, window.summary)
+	}
+}
+
+// flush 返回已经结束的窗口的汇总事件, all 为 true 时结束全部窗口.
+// 结束的窗口不再保留,限流器占用的内存不随策略数量增长
+func (l *policyLimiter) flush(now int64, all bool) (summaries []file.Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for policy, window := range l.windows {
+		if all || window.start+60 <= now {
+			l.close(window)
+			delete(l.windows, policy)
+		}
 	}
+	summaries, l.ended = l.ended, nil
 	return
 }
+
+// restore 放回写入失败的汇总事件
+func (l *policyLimiter) restore(summaries []file.Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ended = append(summaries, l.ended...)
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"testing"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/pkg/file"
+)
+
+// 写入失败时恢复限流计数,窗口结束后写入一行汇总事件
+func TestFileEventRateLimitSummary(t *testing.T) {
+	db := newTestDB(t)
+	c, err := config.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetInteger(config.FileEventRateLimit, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetInteger(config.FileEventDedupWindow, 0); err != nil {
+		t.Fatal(err)
+	}
+	w := &FileWorker{db: db, policies: storage.NewFileRepository(db), config: c, limiter: newPolicyLimiter()}
+
+	start := int64(1700000040)
+	batch := []interface{}{}
+	for i := int64(0); i < 5; i++ {
+		batch = append(batch, file.Event{Path: "/etc/shadow", Perm: 2, Policy: 7, Timestamp: start + i})
+	}
+
+	w.limiter.mutex.Lock()
+	w.limiter.begin()
+	for _, e := range batch {
+		w.limiter.allow(e.(file.Event), 2)
+	}
+	w.limiter.end(false)
+	w.limiter.mutex.Unlock()
+	if summaries := w.limiter.flush(start, true); len(summaries) != 0 || len(w.limiter.windows) != 0 {
+		t.Fatalf("rollback: summaries=%+v windows=%d", summaries, len(w.limiter.windows))
+	}
+
+	if err := w.writeFileEvents(batch); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, `select count(*) from file_event`); n != 2 {
+		t.Fatalf("events=%d", n)
+	}
+
+	// 窗口结束之前不写入汇总
+	if summaries := w.limiter.flush(start+59, false); len(summaries) != 0 {
+		t.Fatalf("summaries=%+v", summaries)
+	}
+	w.writeSummaries(w.limiter.flush(start+60, false))
+	events, err := w.policies.QueryEventLimitOffset(-1, 0)
+	if err != nil || len(events) != 3 {
+		t.Fatalf("events=%+v err=%v", events, err)
+	}
+	summary := events[2]
+	if summary.Kind != file.EventKindSuppressed || summary.Count != 3 || summary.Policy != 7 || summary.First != start || summary.Timestamp != start+4 {
+		t.Fatalf("summary=%+v", summary)
+	}
+	if len(w.limiter.windows) != 0 {
+		t.Fatalf("windows=%d", len(w.limiter.windows))
+	}
+}
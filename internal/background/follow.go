@@ -0,0 +1,373 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"uranus/pkg/file"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 编辑器替换文件时会连续产生多个事件,最后一个事件之后等待一段时间再重新设置策略
+	followDelay = 500 * time.Millisecond
+	// 定时从数据库同步策略,同时检查 inotify 没有发现的变化,例如所在目录被删除后重新创建.
+	// 目录和通配符策略只在无法完全监听时定时展开,其他情况由 inotify 事件触发
+	followRefreshInterval = 10 * time.Second
+)
+
+// follower 监听文件策略所在的目录.策略按 fsid 和 ino 生效,文件被替换,删除或重新创建后
+// 重新向 hackernel 设置策略,并更新 file_policy 中的 fsid, ino 和状态.
+// 目录和通配符策略匹配的文件增加或删除后重新展开
+type follower struct {
+	worker  *FileWorker
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	// 以下字段只在 run 协程中使用
+	dirs      map[string]bool
+	policies  map[string][]file.Policy
+	pending   map[string]time.Time
+	patterns  map[uint64]file.Policy
+	expanding map[uint64]time.Time
+	// 最近一次展开时目录和通配符策略需要监听的目录
+	patternDirs map[uint64][]string
+}
+
+func newFollower(worker *FileWorker) (f *follower, err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	f = &follower{
+		worker:      worker,
+		watcher:     watcher,
+		done:        make(chan struct{}),
+		dirs:        map[string]bool{},
+		policies:    map[string][]file.Policy{},
+		pending:     map[string]time.Time{},
+		patterns:    map[uint64]file.Policy{},
+		expanding:   map[uint64]time.Time{},
+		patternDirs: map[uint64][]string{},
+	}
+	return
+}
+
+func (f *follower) start() {
+	f.refresh()
+	f.wg.Add(1)
+	go f.run()
+}
+
+func (f *follower) stop() {
+	close(f.done)
+	f.wg.Wait()
+	f.watcher.Close()
+}
+
+func (f *follower) run() {
+	defer f.wg.Done()
+	refresh := time.NewTicker(followRefreshInterval)
+	defer refresh.Stop()
+	check := time.NewTicker(followDelay / 2)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			f.handle(event)
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Error(err)
+		case <-refresh.C:
+			f.refresh()
+		case now := <-check.C:
+			for path, last := range f.pending {
+				if now.Sub(last) < followDelay {
+					continue
+				}
+				delete(f.pending, path)
+				f.follow(path)
+			}
+			expanded := false
+			for id, last := range f.expanding {
+				if now.Sub(last) < followDelay {
+					continue
+				}
+				delete(f.expanding, id)
+				f.expand(id)
+				expanded = true
+			}
+			// 监听新增的子策略和子目录,新建的空目录也需要监听
+			if expanded {
+				f.load()
+			}
+		}
+	}
+}
+
+// handle 只关心改变文件 inode 的事件,原地修改文件内容不影响策略
+func (f *follower) handle(event fsnotify.Event) {
+	path := filepath.Clean(event.Name)
+	if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return
+	}
+	if _, ok := f.policies[path]; ok {
+		f.pending[path] = time.Now()
+	}
+	for id, pattern := range f.patterns {
+		if patternMatch(pattern, path) {
+			f.expanding[id] = time.Now()
+		}
+	}
+	// 监听的目录被删除或移走后 inotify 不再上报,重新创建后由 refresh 恢复监听
+	if f.dirs[path] && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		f.watcher.Remove(path)
+		delete(f.dirs, path)
+		for name := range f.policies {
+			if filepath.Dir(name) == path {
+				f.pending[name] = time.Now()
+			}
+		}
+	}
+}
+
+// refresh 同步数据库中的策略,展开新增的策略和无法完全监听的策略:
+// 目录不存在,超出展开数量,通配符在目录中或有目录没有监听成功
+func (f *follower) refresh() {
+	f.load()
+	expanded := false
+	for id, pattern := range f.patterns {
+		if dirs, ok := f.patternDirs[id]; ok && pattern.Status == file.StatusPolicyNormal && f.watching(dirs) {
+			continue
+		}
+		f.expand(id)
+		expanded = true
+	}
+	if expanded {
+		f.load()
+	}
+}
+
+// expand 展开失败时不记录目录,下一次 refresh 重试
+func (f *follower) expand(id uint64) {
+	_, _, dirs, err := expandFilePolicy(f.worker.policies, id)
+	if err != nil {
+		logrus.Error(err)
+		delete(f.patternDirs, id)
+		return
+	}
+	f.patternDirs[id] = dirs
+}
+
+func (f *follower) watching(dirs []string) bool {
+	if len(dirs) == 0 {
+		return false
+	}
+	for _, dir := range dirs {
+		if !f.dirs[dir] {
+			return false
+		}
+	}
+	return true
+}
+
+// load 从数据库同步需要监听的目录,通过 API 添加和删除的策略在这里生效
+func (f *follower) load() {
+	policies := map[string][]file.Policy{}
+	patterns := map[uint64]file.Policy{}
+	err := f.worker.policies.ScanPolicyLimitOffset(-1, 0, func(policy file.Policy) error {
+		if policy.Kind != file.KindFile {
+			patterns[policy.ID] = policy
+			return nil
+		}
+		path := filepath.Clean(policy.Path)
+		policies[path] = append(policies[path], policy)
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	f.policies = policies
+	f.patterns = patterns
+
+	dirs := map[string]bool{}
+	for id, list := range f.patternDirs {
+		if _, ok := patterns[id]; !ok {
+			delete(f.patternDirs, id)
+			continue
+		}
+		for _, dir := range list {
+			dirs[dir] = true
+		}
+	}
+	for path, list := range policies {
+		dirs[filepath.Dir(path)] = true
+		if f.changed(path, list) {
+			if _, ok := f.pending[path]; !ok {
+				f.pending[path] = time.Now()
+			}
+		}
+	}
+	for dir := range f.dirs {
+		if !dirs[dir] {
+			f.watcher.Remove(dir)
+			delete(f.dirs, dir)
+		}
+	}
+	for dir := range dirs {
+		if f.dirs[dir] {
+			continue
+		}
+		// 目录不存在时等待下一次 refresh
+		if err := f.watcher.Add(dir); err == nil {
+			f.dirs[dir] = true
+		}
+	}
+}
+
+// changed 比较文件当前的 inode 和策略中保存的 inode,文件重新出现或被替换时返回 true.
+// 与其他策略冲突的策略保持原状态,避免覆盖其他策略的权限
+func (f *follower) changed(path string, policies []file.Policy) bool {
+	info, err := os.Stat(path)
+	for _, policy := range policies {
+		if err != nil {
+			if policy.Status == file.StatusPolicyNormal {
+				return true
+			}
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		switch policy.Status {
+		case file.StatusPolicyFileNotExist:
+			return true
+		case file.StatusPolicyNormal:
+			if ok && stat.Ino != policy.Ino {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// follow 重新设置路径上的策略,策略以数据库中当前的权限为准
+func (f *follower) follow(path string) {
+	for _, cached := range f.policies[path] {
+		policy, err := f.worker.policies.QueryPolicyById(int(cached.ID))
+		if err != nil {
+			// 策略已经被删除
+			continue
+		}
+		fsid, ino, status, err := file.SetPolicy(policy.Path, policy.Perm, file.FlagAny)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if fsid == policy.Fsid && ino == policy.Ino && status == policy.Status {
+			continue
+		}
+		if policy.Status == file.StatusPolicyNormal {
+			f.clearStale(policy)
+		}
+
+		if err = f.worker.updateFilePolcyFsidInoById(fsid, ino, policy.ID); err != nil {
+			continue
+		}
+		if err = f.worker.updateFilePolcyStatusById(status, policy.ID); err != nil {
+			continue
+		}
+		kind := file.EventKindReapplied
+		switch {
+		case status == file.StatusPolicyNormal && policy.Status != file.StatusPolicyNormal:
+			logrus.Warnf("file policy %d: %s appeared with ino %d, protection re-applied", policy.ID, policy.Path, ino)
+		case status == file.StatusPolicyNormal:
+			logrus.Warnf("file policy %d: %s changed from ino %d to %d, protection re-applied", policy.ID, policy.Path, policy.Ino, ino)
+		case status == file.StatusPolicyFileNotExist:
+			kind = file.EventKindRemoved
+			logrus.Warnf("file policy %d: %s was removed, protection resumes when it is recreated", policy.ID, policy.Path)
+		default:
+			kind = file.EventKindReapplyFailed
+			logrus.Warnf("file policy %d: %s changed, re-apply protection failed with status %d", policy.ID, policy.Path, status)
+		}
+		f.alert(policy, fsid, ino, kind)
+	}
+	f.refreshPolicies(path)
+}
+
+// clearStale 清除原来的 inode 上的策略. hackernel 只能按路径设置策略,编辑器的备份文件和重命名的文件
+// 通常在同一个目录中,按 inode 查找.移到其他目录的文件找不到,它的策略在文件防护模块重启清空策略时删除
+func (f *follower) clearStale(policy file.Policy) {
+	dir := filepath.Dir(policy.Path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if path == policy.Path || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Ino != policy.Ino {
+			continue
+		}
+		// 该路径有自己的策略时由它的策略决定权限
+		if _, ok := f.policies[path]; ok {
+			return
+		}
+		if _, _, _, err = file.SetPolicy(path, 0, file.FlagAny); err != nil {
+			logrus.Error(err)
+			return
+		}
+		logrus.Infof("file policy %d: cleared protection of the previous ino %d at %s", policy.ID, policy.Ino, path)
+		return
+	}
+	// 被删除的文件同样找不到
+	logrus.Infof("file policy %d: previous ino %d of %s was removed or moved to another directory, its protection is kept until file protection restarts",
+		policy.ID, policy.Ino, policy.Path)
+}
+
+// alert 告警作为未读的文件事件写入,与访问事件一起查询.告警不经过写入队列,也不受限流影响
+func (f *follower) alert(policy file.Policy, fsid, ino uint64, kind int) {
+	event := file.Event{
+		Path:      policy.Path,
+		Fsid:      fsid,
+		Ino:       ino,
+		Perm:      policy.Perm,
+		Timestamp: time.Now().Unix(),
+		Policy:    policy.ID,
+		Status:    file.StatusEventUnread,
+		Kind:      kind,
+	}
+	if err := f.worker.policies.InsertEvents([]file.Event{event}, 0, nil); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// refreshPolicies 更新缓存的策略,避免 refresh 之前重复设置
+func (f *follower) refreshPolicies(path string) {
+	list := f.policies[path]
+	for i := range list {
+		policy, err := f.worker.policies.QueryPolicyById(int(list[i].ID))
+		if err == nil {
+			list[i] = policy
+		}
+	}
+}
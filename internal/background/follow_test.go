@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"uranus/internal/storage"
+	"uranus/pkg/file"
+)
+
+func inode(t *testing.T, path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+// replace 与编辑器保存文件相同,写入临时文件后替换原文件
+func replace(t *testing.T, path string) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("replaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowerChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	touch(t, path)
+	f := &follower{}
+	policy := func(status int, ino uint64) []file.Policy {
+		return []file.Policy{{Path: path, Ino: ino, Status: status}}
+	}
+
+	ino := inode(t, path)
+	if f.changed(path, policy(file.StatusPolicyNormal, ino)) {
+		t.Error("unchanged file reported as changed")
+	}
+	// 与其他策略冲突的策略保持原状态
+	if f.changed(path, policy(file.StatusPolicyConflict, 0)) {
+		t.Error("conflict policy reported as changed")
+	}
+
+	replace(t, path)
+	if inode(t, path) == ino {
+		t.Skip("file system reused the inode")
+	}
+	if !f.changed(path, policy(file.StatusPolicyNormal, ino)) {
+		t.Error("replaced file not reported")
+	}
+
+	ino = inode(t, path)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !f.changed(path, policy(file.StatusPolicyNormal, ino)) {
+		t.Error("removed file not reported")
+	}
+	if f.changed(path, policy(file.StatusPolicyFileNotExist, 0)) {
+		t.Error("missing file reported again")
+	}
+
+	touch(t, path)
+	if !f.changed(path, policy(file.StatusPolicyFileNotExist, 0)) {
+		t.Error("recreated file not reported")
+	}
+}
+
+// 重新设置策略后更新策略的 inode 和状态,并写入告警事件
+func TestFollowerAlert(t *testing.T) {
+	fakeHackernel(t)
+	files := storage.NewFileRepository(newTestDB(t))
+	path := filepath.Join(t.TempDir(), "passwd")
+	touch(t, path)
+	if err := files.InsertPolicy(path, 1, inode(t, path), 2, file.StatusPolicyNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFollower(&FileWorker{policies: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.watcher.Close()
+	f.load()
+
+	steps := []struct {
+		name   string
+		change func()
+		status int
+		kind   int
+	}{
+		{"replace", func() { replace(t, path) }, file.StatusPolicyNormal, file.EventKindReapplied},
+		{"remove", func() { os.Remove(path) }, file.StatusPolicyFileNotExist, file.EventKindRemoved},
+		{"recreate", func() { touch(t, path) }, file.StatusPolicyNormal, file.EventKindReapplied},
+	}
+	for i, step := range steps {
+		step.change()
+		if !f.changed(path, f.policies[path]) {
+			t.Fatalf("%s: change not detected", step.name)
+		}
+		f.follow(path)
+
+		policies, err := files.QueryPolicyLimitOffset(-1, 0)
+		if err != nil || len(policies) != 1 {
+			t.Fatalf("%s: policies=%v err=%v", step.name, policies, err)
+		}
+		if policies[0].Status != step.status {
+			t.Errorf("%s: policy status=%d", step.name, policies[0].Status)
+		}
+		if step.status == file.StatusPolicyNormal && policies[0].Ino != inode(t, path) {
+			t.Errorf("%s: policy ino=%d", step.name, policies[0].Ino)
+		}
+
+		events, err := files.QueryEventLimitOffset(-1, 0)
+		if err != nil || len(events) != i+1 {
+			t.Fatalf("%s: events=%v err=%v", step.name, events, err)
+		}
+		event := events[i]
+		if event.Kind != step.kind || event.Status != file.StatusEventUnread || event.Policy != policies[0].ID || event.Path != path {
+			t.Errorf("%s: event=%+v", step.name, event)
+		}
+	}
+
+	// 没有变化时不重复告警
+	f.follow(path)
+	if events, _ := files.QueryEventLimitOffset(-1, 0); len(events) != len(steps) {
+		t.Errorf("%d events after follow without change", len(events))
+	}
+}
+
+// 文件被重命名后原来的 inode 不再受保护,新文件重新设置策略
+func TestFollowerClearStale(t *testing.T) {
+	h := fakeHackernel(t)
+	files := storage.NewFileRepository(newTestDB(t))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "passwd")
+	touch(t, path)
+	fsid, ino, _, err := file.SetPolicy(path, 2, file.FlagNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.InsertPolicy(path, fsid, ino, 2, file.StatusPolicyNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFollower(&FileWorker{policies: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.watcher.Close()
+	f.load()
+
+	// 编辑器先把原文件重命名为备份,再写入新文件
+	if err := os.Rename(path, path+"~"); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, path)
+	f.follow(path)
+	if perm, ok := h.inode(ino); !ok || perm != 0 {
+		t.Errorf("backup: perm=%d ok=%v", perm, ok)
+	}
+	replaced := inode(t, path)
+	if perm, _ := h.inode(replaced); perm != 2 {
+		t.Errorf("new file: perm=%d", perm)
+	}
+
+	// 文件被移走且没有新文件时同样清除
+	if err := os.Rename(path, filepath.Join(dir, "passwd.moved")); err != nil {
+		t.Fatal(err)
+	}
+	f.follow(path)
+	if perm, ok := h.inode(replaced); !ok || perm != 0 {
+		t.Errorf("moved: perm=%d ok=%v", perm, ok)
+	}
+	if perm, _ := h.perm(path + "~"); perm != 0 {
+		t.Errorf("backup protected again: perm=%d", perm)
+	}
+}
@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultIngestQueueSize     = 4096
+	defaultIngestWorkers       = 4
+	defaultIngestBatchSize     = 256
+	defaultIngestFlushInterval = 200 * time.Millisecond
+	// 队列满时最多每分钟输出一次警告
+	ingestWarnInterval = time.Minute
+)
+
+// IngestConfig 事件写入队列的设置,为 0 的项使用默认值
+type IngestConfig struct {
+	// 等待处理的消息数量上限,队列满时暂停接收 hackernel 的消息
+	QueueSize int
+	// 处理消息的协程数量
+	Workers int
+	// 每个事务最多写入的事件数量
+	BatchSize int
+	// 不足一批的事件最多等待多久写入
+	FlushInterval time.Duration
+}
+
+func (c IngestConfig) withDefault() IngestConfig {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultIngestQueueSize
+	}
+	if c.Workers <= 0 {
+		c.Workers = defaultIngestWorkers
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultIngestBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultIngestFlushInterval
+	}
+	return c
+}
+
+// IngestStats 事件写入队列的运行状态,计数从模块启动时开始
+type IngestStats struct {
+	Capacity int `json:"capacity"`
+	// 队列中等待处理的事件数量
+	Queued   int    `json:"queued"`
+	Received uint64 `json:"received"`
+	Written  uint64 `json:"written"`
+	// 处理或写入失败而丢弃的事件数量
+	Dropped uint64 `json:"dropped"`
+	// 队列满时接收等待的次数和总毫秒数
+	Blocked      uint64 `json:"blocked"`
+	BlockedTotal int64  `json:"blockedTotal"`
+	Batches      uint64 `json:"batches"`
+	// 最近一次写入的事件数量和耗时毫秒数
+	LastBatch    int     `json:"lastBatch"`
+	LastDuration float64 `json:"lastDuration"`
+}
+
+// ingest 有界的事件写入流水线.接收协程按 key 把消息分配到固定数量的处理协程,
+// 相同 key 的消息由同一个协程按顺序处理,处理结果由一个协程批量写入数据库
+type ingest struct {
+	name    string
+	config  IngestConfig
+	handle  func(item interface{}) (event interface{}, ok bool)
+	write   func(events []interface{}) error
+	workers sync.WaitGroup
+	writer  sync.WaitGroup
+	// 修改设置时持有写锁,重建队列期间 push 等待
+	resize sync.RWMutex
+
+	// 以下字段在 start 时重新创建,读取时需要加锁
+	mutex   sync.Mutex
+	running bool
+	shards  []chan interface{}
+	events  chan interface{}
+	stats   IngestStats
+	warned  time.Time
+}
+
+// newIngest handle 在处理协程中执行,返回 false 时丢弃该消息; write 在写入协程中执行
+func newIngest(name string, config IngestConfig, handle func(item interface{}) (interface{}, bool), write func(events []interface{}) error) *ingest {
+	return &ingest{
+		name:   name,
+		config: config.withDefault(),
+		handle: handle,
+		write:  write,
+	}
+}
+
+// start 重新创建队列并清空计数,模块重启时调用
+func (i *ingest) start() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.running {
+		return
+	}
+
+	size := i.config.QueueSize / i.config.Workers
+	if size == 0 {
+		size = 1
+	}
+	i.shards = make([]chan interface{}, i.config.Workers)
+	i.events = make(chan interface{}, i.config.BatchSize)
+	i.stats = IngestStats{Capacity: size * i.config.Workers}
+	i.running = true
+
+	for n := range i.shards {
+		i.shards[n] = make(chan interface{}, size)
+		i.workers.Add(1)
+		go i.work(i.shards[n], i.events)
+	}
+	i.writer.Add(1)
+	go i.flush(i.events)
+}
+
+// stop 等待队列中的事件全部写入后返回,调用后不能再 push
+func (i *ingest) stop() {
+	i.mutex.Lock()
+	running := i.running
+	i.running = false
+	i.mutex.Unlock()
+	if !running {
+		return
+	}
+
+	for _, shard := range i.shards {
+		close(shard)
+	}
+	i.workers.Wait()
+	close(i.events)
+	i.writer.Wait()
+}
+
+// reconfigure 修改设置,运行中时等待队列中的事件全部写入后按新的设置重建队列,计数重新开始
+func (i *ingest) reconfigure(config IngestConfig) {
+	i.resize.Lock()
+	defer i.resize.Unlock()
+
+	config = config.withDefault()
+	i.mutex.Lock()
+	running := i.running
+	changed := config != i.config
+	i.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	i.stop()
+	i.mutex.Lock()
+	i.config = config
+	i.mutex.Unlock()
+	if running {
+		i.start()
+	}
+	logrus.Infof("%s ingest queue reconfigured", i.name)
+}
+
+// push 队列满时阻塞,直到处理协程取走消息
+func (i *ingest) push(key string, item interface{}) {
+	i.resize.RLock()
+	defer i.resize.RUnlock()
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := i.shards[h.Sum32()%uint32(len(i.shards))]
+
+	i.mutex.Lock()
+	i.stats.Received++
+	i.mutex.Unlock()
+
+	select {
+	case shard <- item:
+		return
+	default:
+	}
+
+	start := time.Now()
+	shard <- item
+	blocked := time.Since(start)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.stats.Blocked++
+	i.stats.BlockedTotal += blocked.Milliseconds()
+	if time.Since(i.warned) > ingestWarnInterval {
+		i.warned = time.Now()
+		logrus.Warnf("%s ingest queue is full, waited %s", i.name, blocked)
+	}
+}
+
+func (i *ingest) work(shard <-chan interface{}, events chan<- interface{}) {
+	defer i.workers.Done()
+	for item := range shard {
+		event, ok := i.handle(item)
+		if !ok {
+			i.mutex.Lock()
+			i.stats.Dropped++
+			i.mutex.Unlock()
+			continue
+		}
+		events <- event
+	}
+}
+
+func (i *ingest) flush(events <-chan interface{}) {
+	defer i.writer.Done()
+	ticker := time.NewTicker(i.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]interface{}, 0, i.config.BatchSize)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				i.commit(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= i.config.BatchSize {
+				batch = i.commit(batch)
+			}
+		case <-ticker.C:
+			batch = i.commit(batch)
+		}
+	}
+}
+
+// commit 写入失败时丢弃这一批事件,不阻塞后续的写入
+func (i *ingest) commit(batch []interface{}) []interface{} {
+	if len(batch) == 0 {
+		return batch
+	}
+	start := time.Now()
+	err := i.write(batch)
+	duration := time.Since(start)
+	if err != nil {
+		logrus.Errorf("%s ingest write %d events failed: %v", i.name, len(batch), err)
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if err != nil {
+		i.stats.Dropped += uint64(len(batch))
+	} else {
+		i.stats.Written += uint64(len(batch))
+	}
+	i.stats.Batches++
+	i.stats.LastBatch = len(batch)
+	i.stats.LastDuration = float64(duration.Microseconds()) / 1000
+	return batch[:0]
+}
+
+func (i *ingest) state() IngestStats {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	stats := i.stats
+	for _, shard := range i.shards {
+		stats.Queued += len(shard)
+	}
+	return stats
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ingestItem struct {
+	key string
+	n   int
+}
+
+// 相同 key 的事件按接收顺序写入, stop 返回前队列中的事件全部写入
+func TestIngestOrderAndDrain(t *testing.T) {
+	const (
+		keys  = 5
+		count = 201
+	)
+
+	var mutex sync.Mutex
+	written := []ingestItem{}
+	handle := func(item interface{}) (interface{}, bool) {
+		// 每个 key 丢弃十分之一的事件
+		return item, item.(ingestItem).n%10 != 9
+	}
+	write := func(events []interface{}) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, event := range events {
+			written = append(written, event.(ingestItem))
+		}
+		return nil
+	}
+	// 队列很小, push 会阻塞;写入间隔很长,只有凑满一批或者 stop 时才写入
+	i := newIngest("test", IngestConfig{QueueSize: 8, Workers: 3, BatchSize: 7, FlushInterval: time.Hour}, handle, write)
+	i.start()
+	for n := 0; n < count; n++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("key-%d", k)
+			i.push(key, ingestItem{key: key, n: n})
+		}
+	}
+	i.stop()
+
+	last := map[string]int{}
+	for _, item := range written {
+		if previous, ok := last[item.key]; ok && item.n <= previous {
+			t.Fatalf("%s: %d written after %d", item.key, item.n, previous)
+		}
+		last[item.key] = item.n
+	}
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		if last[key] != count-1 {
+			t.Errorf("%s: last=%d", key, last[key])
+		}
+	}
+
+	dropped := keys * (count / 10)
+	stats := i.state()
+	if stats.Received != keys*count || stats.Written != uint64(keys*count-dropped) || stats.Dropped != uint64(dropped) || stats.Queued != 0 {
+		t.Errorf("stats=%+v", stats)
+	}
+	if len(written) != keys*count-dropped {
+		t.Errorf("written=%d", len(written))
+	}
+
+	// 重新启动时清空计数,写入失败的一批计为丢弃
+	i.write = func(events []interface{}) error { return fmt.Errorf("disk full") }
+	i.start()
+	i.push("key-0", ingestItem{key: "key-0", n: 0})
+	i.stop()
+	if stats := i.state(); stats.Received != 1 || stats.Written != 0 || stats.Dropped != 1 {
+		t.Errorf("restart stats=%+v", stats)
+	}
+}
+
+// 运行中修改设置时先写入旧队列中的事件,相同 key 的事件仍然按顺序写入
+func TestIngestReconfigure(t *testing.T) {
+	var mutex sync.Mutex
+	written := []int{}
+	handle := func(item interface{}) (interface{}, bool) { return item, true }
+	write := func(events []interface{}) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, event := range events {
+			written = append(written, event.(int))
+		}
+		return nil
+	}
+	i := newIngest("test", IngestConfig{QueueSize: 4, Workers: 1, BatchSize: 3, FlushInterval: time.Hour}, handle, write)
+	i.start()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 500; n++ {
+			i.push("key", n)
+		}
+	}()
+	i.reconfigure(IngestConfig{QueueSize: 64, Workers: 4, BatchSize: 16, FlushInterval: time.Hour})
+	<-done
+	i.stop()
+
+	if len(written) != 500 {
+		t.Fatalf("written=%d", len(written))
+	}
+	for n, value := range written {
+		if value != n {
+			t.Fatalf("written[%d]=%d", n, value)
+		}
+	}
+	if i.config.Workers != 4 || len(i.shards) != 4 {
+		t.Errorf("workers=%d shards=%d", i.config.Workers, len(i.shards))
+	}
+}
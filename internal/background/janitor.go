@@ -0,0 +1,596 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sqlSelectPrunable    = `select * from %s where %s order by id limit ?`
+	sqlDeletePruned      = `delete from %s where id in (%s)`
+	sqlCountRows         = `select count(*) from %s`
+	sqlQueryAutoVacuum   = `pragma auto_vacuum`
+	sqlSetAutoVacuum     = `pragma auto_vacuum=incremental`
+	sqlVacuum            = `vacuum`
+	sqlFreelistCount     = `pragma freelist_count`
+	sqlIncrementalVacuum = `pragma incremental_vacuum`
+)
+
+const (
+	defaultRetentionInterval  = 3600
+	defaultRetentionBatchSize = 1000
+	// 登录失败事件默认保留 90 天,避免暴力破解时无限增长
+	defaultLoginEventMaxAge = 90 * 24 * 3600
+	// auto_vacuum 为 incremental 时的值
+	autoVacuumIncremental = 2
+)
+
+var errArchiveNotConfigured = errors.New("archive directory is not configured")
+
+// RetentionPolicy 单个事件表的保留策略
+type RetentionPolicy struct {
+	// 保留的秒数, 0 表示不限制
+	MaxAge int `json:"maxAge" binding:"min=0"`
+	// 保留的最大行数, 0 表示不限制
+	MaxRows int `json:"maxRows" binding:"min=0"`
+	// 不删除未读的事件,进程事件中在防御模式下被拦截且待确认的命令视为未读.审计日志没有未读状态
+	KeepUnread bool `json:"keepUnread"`
+}
+
+type RetentionSettings struct {
+	// 自动清理的间隔秒数, 0 表示只在手动触发时清理
+	Interval int `json:"interval" binding:"min=0"`
+	// 每个事务最多删除的行数
+	BatchSize int `json:"batchSize" binding:"min=1,max=100000"`
+	// 删除前把事件写入压缩的 NDJSON 文件
+	Archive bool            `json:"archive"`
+	File    RetentionPolicy `json:"file"`
+	Process RetentionPolicy `json:"process"`
+	// 登录失败事件和管理操作的审计日志
+	Login RetentionPolicy `json:"login"`
+	Audit RetentionPolicy `json:"audit"`
+}
+
+func integer(c *config.Config, key string, fallback int) int {
+	value, err := c.GetInteger(key)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// LoadRetentionSettings 没有设置过的项使用默认值,默认只删除 90 天前的登录失败事件
+func LoadRetentionSettings(c *config.Config) RetentionSettings {
+	return RetentionSettings{
+		Interval:  integer(c, config.RetentionInterval, defaultRetentionInterval),
+		BatchSize: integer(c, config.RetentionBatchSize, defaultRetentionBatchSize),
+		Archive:   integer(c, config.RetentionArchive, 0) != 0,
+		File: RetentionPolicy{
+			MaxAge:     integer(c, config.FileEventMaxAge, 0),
+			MaxRows:    integer(c, config.FileEventMaxRows, 0),
+			KeepUnread: integer(c, config.FileEventKeepUnread, 1) != 0,
+		},
+		Process: RetentionPolicy{
+			MaxAge:     integer(c, config.ProcessEventMaxAge, 0),
+			MaxRows:    integer(c, config.ProcessEventMaxRows, 0),
+			KeepUnread: integer(c, config.ProcessEventKeepUnread, 1) != 0,
+		},
+		Login: RetentionPolicy{
+			MaxAge:     integer(c, config.LoginEventMaxAge, defaultLoginEventMaxAge),
+			MaxRows:    integer(c, config.LoginEventMaxRows, 0),
+			KeepUnread: integer(c, config.LoginEventKeepUnread, 0) != 0,
+		},
+		Audit: RetentionPolicy{
+			MaxAge:  integer(c, config.AuditLogMaxAge, 0),
+			MaxRows: integer(c, config.AuditLogMaxRows, 0),
+		},
+	}
+}
+
+type retentionTable struct {
+	name string
+	// 可以删除的行,信任和不信任的命令是进程策略,不能删除
+	prunable string
+	// 开启 KeepUnread 时保留的行,必须是 prunable 的子集,否则全部保留
+	unread string
+	policy func(settings RetentionSettings) RetentionPolicy
+}
+
+var retentionTables = []retentionTable{
+	{name: "file_event", prunable: "1=1", unread: "status=0",
+		policy: func(settings RetentionSettings) RetentionPolicy { return settings.File }},
+	{name: "process_event", prunable: "status=0", unread: "judge=2",
+		policy: func(settings RetentionSettings) RetentionPolicy { return settings.Process }},
+	{name: "login_event", prunable: "1=1", unread: "status=0",
+		policy: func(settings RetentionSettings) RetentionPolicy { return settings.Login }},
+	{name: "audit_log", prunable: "1=1", unread: "1=0",
+		policy: func(settings RetentionSettings) RetentionPolicy { return settings.Audit }},
+}
+
+type RetentionTableState struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+	// 最近一次清理和启动以来删除的行数
+	Pruned int64 `json:"pruned"`
+	Total  int64 `json:"total"`
+	// 最近一次生成的归档文件
+	Archive string `json:"archive"`
+}
+
+type JanitorState struct {
+	Running bool `json:"running"`
+	// 正在清理
+	Pruning bool  `json:"pruning"`
+	LastRun int64 `json:"lastRun"`
+	// 下一次自动清理的时间, 0 表示没有计划
+	NextRun int64 `json:"nextRun"`
+	// 最近一次清理的耗时,单位毫秒
+	Duration int64  `json:"duration"`
+	Error    string `json:"error"`
+	// 最近一次清理后回收的数据库页数
+	Reclaimed int64                 `json:"reclaimed"`
+	Tables    []RetentionTableState `json:"tables"`
+}
+
+// JanitorWorker 按保留策略分批删除过期的事件,并回收数据库文件的空闲空间
+type JanitorWorker struct {
+	db *storage.DB
+	// 归档文件的目录,为空时不能开启归档
+	archive string
+
+	running bool
+	wg      sync.WaitGroup
+	config  *config.Config
+	stop    chan struct{}
+	trigger chan struct{}
+
+	mutex sync.Mutex
+	state JanitorState
+	// 完整的 VACUUM 和清理后的增量回收不能同时执行
+	vacuuming sync.Mutex
+}
+
+func NewJanitorWorker(db *storage.DB, archive string) *JanitorWorker {
+	worker := JanitorWorker{
+		db:      db,
+		archive: archive,
+	}
+	return &worker
+}
+
+// SetArchive 修改归档文件的目录,下一次清理时生效
+func (w *JanitorWorker) SetArchive(archive string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.archive = archive
+}
+
+func (w *JanitorWorker) archiveDir() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.archive
+}
+
+func (w *JanitorWorker) Init() (err error) {
+	w.config, err = config.New(w.db)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.state.Tables == nil {
+		for _, table := range retentionTables {
+			w.state.Tables = append(w.state.Tables, RetentionTableState{Table: table.name})
+		}
+	}
+	return
+}
+
+func (w *JanitorWorker) Start() (err error) {
+	w.stop = make(chan struct{})
+	w.trigger = make(chan struct{}, 1)
+	w.running = true
+	w.wg.Add(1)
+	go w.run()
+	return
+}
+
+func (w *JanitorWorker) Stop() (err error) {
+	if !w.running {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+	w.running = false
+	return
+}
+
+// Alive 清理不依赖 hackernel,启动后始终可用
+func (w *JanitorWorker) Alive() bool {
+	return w.running
+}
+
+// Trigger 立即开始一次清理,正在清理时忽略
+func (w *JanitorWorker) Trigger() bool {
+	if !w.running {
+		return false
+	}
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// State 返回最近一次清理的结果
+func (w *JanitorWorker) State() JanitorState {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	state := w.state
+	state.Running = w.running
+	state.Tables = append([]RetentionTableState{}, w.state.Tables...)
+	return state
+}
+
+func (w *JanitorWorker) run() {
+	defer w.wg.Done()
+	for {
+		// 每次等待前重新读取间隔,修改设置后在下一次清理时生效
+		settings := LoadRetentionSettings(w.config)
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		next := int64(0)
+		if settings.Interval > 0 {
+			interval := time.Duration(settings.Interval) * time.Second
+			timer = time.NewTimer(interval)
+			timeout = timer.C
+			next = time.Now().Add(interval).Unix()
+		}
+		w.mutex.Lock()
+		w.state.NextRun = next
+		w.mutex.Unlock()
+
+		select {
+		case <-w.stop:
+		case <-w.trigger:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		w.prune()
+	}
+}
+
+func (w *JanitorWorker) prune() {
+	w.mutex.Lock()
+	w.state.Pruning = true
+	w.mutex.Unlock()
+
+	start := time.Now()
+	settings := LoadRetentionSettings(w.config)
+	tables := make([]RetentionTableState, len(retentionTables))
+	var failure error
+	for i, table := range retentionTables {
+		tables[i].Table = table.name
+		pruned, archive, err := w.pruneTable(table, settings, start)
+		if err != nil {
+			logrus.Errorf("prune %s: %v", table.name, err)
+			if failure == nil {
+				failure = fmt.Errorf("%s: %w", table.name, err)
+			}
+		}
+		tables[i].Pruned = pruned
+		tables[i].Archive = archive
+		if err := w.db.QueryRow(fmt.Sprintf(sqlCountRows, table.name)).Scan(&tables[i].Rows); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	pruned := int64(0)
+	for _, table := range tables {
+		pruned += table.Pruned
+	}
+	// 没有删除任何行时不需要回收
+	reclaimed := int64(0)
+	if pruned > 0 {
+		var err error
+		if reclaimed, err = w.vacuum(); err != nil {
+			logrus.Errorf("vacuum: %v", err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for i := range tables {
+		if i < len(w.state.Tables) {
+			tables[i].Total = w.state.Tables[i].Total
+			if tables[i].Archive == "" {
+				tables[i].Archive = w.state.Tables[i].Archive
+			}
+		}
+		tables[i].Total += tables[i].Pruned
+		if tables[i].Pruned != 0 {
+			logrus.Infof("pruned %d rows from %s", tables[i].Pruned, tables[i].Table)
+		}
+	}
+	w.state.Tables = tables
+	w.state.Pruning = false
+	w.state.LastRun = start.Unix()
+	w.state.Duration = time.Since(start).Milliseconds()
+	w.state.Reclaimed = reclaimed
+	w.state.Error = ""
+	if failure != nil {
+		w.state.Error = failure.Error()
+	}
+}
+
+// pruneTable 先删除超过保留时间的事件,再删除超出数量的最早的事件
+func (w *JanitorWorker) pruneTable(table retentionTable, settings RetentionSettings, now time.Time) (pruned int64, archive string, err error) {
+	policy := table.policy(settings)
+	if policy.MaxAge == 0 && policy.MaxRows == 0 {
+		return
+	}
+
+	var writer *archiver
+	if settings.Archive {
+		dir := w.archiveDir()
+		if dir == "" {
+			err = errArchiveNotConfigured
+			return
+		}
+		writer = &archiver{path: filepath.Join(dir, fmt.Sprintf("%s-%s.ndjson.gz", table.name, now.Format("20060102150405")))}
+		defer func() {
+			if closeErr := writer.close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			if writer.file != nil {
+				archive = writer.path
+			}
+		}()
+	}
+
+	filter := table.prunable
+	if policy.KeepUnread {
+		filter += " and not (" + table.unread + ")"
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := now.Unix() - int64(policy.MaxAge)
+		for n := int64(settings.BatchSize); n == int64(settings.BatchSize); {
+			n, err = w.pruneBatch(table.name, filter+" and timestamp<?", settings.BatchSize, writer, cutoff)
+			pruned += n
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if policy.MaxRows > 0 {
+		rows := int64(0)
+		if err = w.db.QueryRow(fmt.Sprintf(sqlCountRows, table.name)).Scan(&rows); err != nil {
+			return
+		}
+		for excess := rows - int64(policy.MaxRows); excess > 0; {
+			limit := int64(settings.BatchSize)
+			if excess < limit {
+				limit = excess
+			}
+			n := int64(0)
+			n, err = w.pruneBatch(table.name, filter, int(limit), writer)
+			pruned += n
+			excess -= n
+			if err != nil {
+				return
+			}
+			// 剩余的事件都不能删除
+			if n == 0 {
+				break
+			}
+		}
+	}
+	return
+}
+
+// pruneBatch 先写入归档再删除,归档失败时不删除
+func (w *JanitorWorker) pruneBatch(table, filter string, limit int, writer *archiver, args ...interface{}) (n int64, err error) {
+	rows, err := w.db.Query(fmt.Sprintf(sqlSelectPrunable, table, filter), append(args, limit)...)
+	if err != nil {
+		return
+	}
+	records, ids, err := scanRecords(rows)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	if writer != nil {
+		if err = writer.write(records); err != nil {
+			return
+		}
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	result, err := tx.Exec(fmt.Sprintf(sqlDeletePruned, table, placeholders), ids...)
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return result.RowsAffected()
+}
+
+// scanRecords 按列名读取整行,用于归档
+func scanRecords(rows *sql.Rows) (records []map[string]interface{}, ids []interface{}, err error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return
+		}
+		record := map[string]interface{}{}
+		for i, column := range columns {
+			// process_event 的 cmd 为 blob
+			if bytes, ok := values[i].([]byte); ok {
+				values[i] = string(bytes)
+			}
+			record[column] = values[i]
+			if column == "id" {
+				ids = append(ids, values[i])
+			}
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	return
+}
+
+// vacuum 回收删除后的空闲页.数据库没有切换到 incremental 模式时不回收,空闲页留给之后的写入使用
+func (w *JanitorWorker) vacuum() (reclaimed int64, err error) {
+	// PostgreSQL 由 autovacuum 回收空间
+	if w.db.Postgres() {
+		return
+	}
+	w.vacuuming.Lock()
+	defer w.vacuuming.Unlock()
+	conn, err := w.db.Conn(context.Background())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	mode := 0
+	if err = conn.QueryRowContext(context.Background(), sqlQueryAutoVacuum).Scan(&mode); err != nil {
+		return
+	}
+	if mode != autoVacuumIncremental {
+		logrus.Debug("auto vacuum is not incremental, skip vacuum")
+		return
+	}
+
+	before := int64(0)
+	if err = conn.QueryRowContext(context.Background(), sqlFreelistCount).Scan(&before); err != nil || before == 0 {
+		return
+	}
+	// 每执行一步回收一页,需要读取全部结果
+	rows, err := conn.QueryContext(context.Background(), sqlIncrementalVacuum)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	after := int64(0)
+	if err = conn.QueryRowContext(context.Background(), sqlFreelistCount).Scan(&after); err != nil {
+		return
+	}
+	reclaimed = before - after
+	return
+}
+
+// Compact 将数据库切换到 incremental 模式并执行一次完整的 VACUUM,之后每次清理后回收空闲页.
+// VACUUM 期间其他写入会等待,并且临时需要与数据库文件大小相当的磁盘空间,只由管理员手动执行
+func (w *JanitorWorker) Compact() (reclaimed int64, err error) {
+	if w.db.Postgres() {
+		return
+	}
+	w.vacuuming.Lock()
+	defer w.vacuuming.Unlock()
+	// 修改 auto_vacuum 和 VACUUM 需要在同一个连接中执行
+	conn, err := w.db.Conn(context.Background())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if err = conn.QueryRowContext(context.Background(), sqlFreelistCount).Scan(&reclaimed); err != nil {
+		return
+	}
+	logrus.Info("switching database to incremental auto vacuum")
+	if _, err = conn.ExecContext(context.Background(), sqlSetAutoVacuum); err != nil {
+		return
+	}
+	_, err = conn.ExecContext(context.Background(), sqlVacuum)
+	return
+}
+
+// archiver 第一次写入时创建文件,每批写入后刷新到磁盘再删除数据库中的记录
+type archiver struct {
+	path    string
+	file    *os.File
+	gzip    *gzip.Writer
+	encoder *json.Encoder
+}
+
+func (a *archiver) write(records []map[string]interface{}) (err error) {
+	if a.file == nil {
+		if err = os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+			return
+		}
+		if a.file, err = os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return
+		}
+		a.gzip = gzip.NewWriter(a.file)
+		a.encoder = json.NewEncoder(a.gzip)
+	}
+	for _, record := range records {
+		if err = a.encoder.Encode(record); err != nil {
+			return
+		}
+	}
+	if err = a.gzip.Flush(); err != nil {
+		return
+	}
+	return a.file.Sync()
+}
+
+func (a *archiver) close() (err error) {
+	if a.file == nil {
+		return
+	}
+	if err = a.gzip.Close(); err != nil {
+		a.file.Close()
+		return
+	}
+	return a.file.Close()
+}
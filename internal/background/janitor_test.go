@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+)
+
+func newTestDB(t *testing.T) *storage.DB {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db") + "?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func count(t *testing.T, db *storage.DB, query string) (n int) {
+	if err := db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// 只设置保留时间,其他项使用默认值
+func TestJanitorPruneDefaults(t *testing.T) {
+	db := newTestDB(t)
+	c, err := config.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetInteger(config.FileEventMaxAge, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetInteger(config.ProcessEventMaxAge, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetInteger(config.LoginEventMaxAge, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetInteger(config.AuditLogMaxAge, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Unix() - 3600
+	statements := []string{
+		// 已读和未读的文件事件
+		`insert into file_event(path,fsid,ino,perm,timestamp,policy,status) values('/a',1,1,1,?,1,1)`,
+		`insert into file_event(path,fsid,ino,perm,timestamp,policy,status) values('/b',1,1,1,?,1,0)`,
+		// 审计模式下待确认,防御模式下被拦截待确认,不信任和信任的命令
+		`insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values('audit','/','/bin/a','a',1,1,0,?)`,
+		`insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values('defense','/','/bin/b','b',1,2,0,?)`,
+		`insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values('untrusted','/','/bin/c','c',1,1,1,?)`,
+		`insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values('trusted','/','/bin/d','d',1,1,2,?)`,
+		// 登录失败事件默认不保留未读
+		`insert into login_event(username,addr,agent,timestamp,locked,status) values('admin','127.0.0.1','curl',?,0,0)`,
+		`insert into audit_log(timestamp,username,token,addr,method,route,path,status,changes,error) values(?,'admin',0,'127.0.0.1','PUT','/users','/users',0,'','')`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := NewJanitorWorker(db, "")
+	if err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	w.prune()
+
+	state := w.State()
+	if state.Error != "" {
+		t.Fatal(state.Error)
+	}
+	for _, table := range state.Tables {
+		if table.Pruned != 1 {
+			t.Errorf("%s: pruned=%d", table.Table, table.Pruned)
+		}
+	}
+	if n := count(t, db, `select count(*) from file_event where path='/a'`); n != 0 {
+		t.Errorf("read file event kept")
+	}
+	if n := count(t, db, `select count(*) from file_event where path='/b'`); n != 1 {
+		t.Errorf("unread file event pruned")
+	}
+	if n := count(t, db, `select count(*) from process_event where cmd='audit'`); n != 0 {
+		t.Errorf("audited process event kept")
+	}
+	if n := count(t, db, `select count(*) from process_event where cmd in ('defense','untrusted','trusted')`); n != 3 {
+		t.Errorf("blocked or judged process events pruned: %d left", n)
+	}
+}
+
+// 清理不会切换 auto_vacuum,只有手动整理后才回收空闲页
+func TestJanitorCompact(t *testing.T) {
+	db := newTestDB(t)
+	c, err := config.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewJanitorWorker(db, "")
+	if err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+	insert := func() {
+		old := time.Now().Unix() - 3600
+		for i := 0; i < 500; i++ {
+			if _, err := db.Exec(`insert into file_event(path,fsid,ino,perm,timestamp,policy,status) values(?,1,1,1,?,1,1)`,
+				fmt.Sprintf("/%d/%s", i, strings.Repeat("x", 200)), old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mode := func() int {
+		return count(t, db, `pragma auto_vacuum`)
+	}
+
+	// 默认不删除任何事件,也不修改数据库
+	insert()
+	w.prune()
+	if state := w.State(); state.Error != "" || state.Reclaimed != 0 || mode() != 0 {
+		t.Fatalf("retention off: error=%q reclaimed=%d auto_vacuum=%d", state.Error, state.Reclaimed, mode())
+	}
+
+	if err := c.SetInteger(config.FileEventMaxAge, 60); err != nil {
+		t.Fatal(err)
+	}
+	w.prune()
+	if state := w.State(); state.Error != "" || state.Reclaimed != 0 || mode() != 0 {
+		t.Fatalf("before compact: error=%q reclaimed=%d auto_vacuum=%d", state.Error, state.Reclaimed, mode())
+	}
+	if free := count(t, db, `pragma freelist_count`); free == 0 {
+		t.Fatal("no free pages after prune")
+	}
+
+	reclaimed, err := w.Compact()
+	if err != nil || reclaimed == 0 {
+		t.Fatalf("compact: reclaimed=%d err=%v", reclaimed, err)
+	}
+	if mode() != autoVacuumIncremental || count(t, db, `pragma freelist_count`) != 0 {
+		t.Fatalf("after compact: auto_vacuum=%d", mode())
+	}
+
+	insert()
+	w.prune()
+	if state := w.State(); state.Error != "" || state.Reclaimed == 0 {
+		t.Errorf("after compact: error=%q reclaimed=%d", state.Error, state.Reclaimed)
+	}
+}
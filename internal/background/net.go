@@ -2,11 +2,11 @@
 package background
 
 import (
-	"database/sql"
 	"encoding/json"
 	"sync"
 	"time"
 	"uranus/internal/config"
+	"uranus/internal/storage"
 	"uranus/pkg/connector"
 	"uranus/pkg/net"
 	"uranus/pkg/watchdog"
@@ -14,13 +14,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	sqlCreateNetPolicyTable = `create table if not exists net_policy(id integer primary key autoincrement, priority int8, addr_src_begin text, addr_src_end text, addr_dst_begin text, addr_dst_end text, protocol_begin int, protocol_end int, port_src_begin int, port_src_end int, port_dst_begin int, port_dst_end int, flags int, response int)`
-	sqlQueryNetPolicy       = `select id,priority,addr_src_begin,addr_src_end,addr_dst_begin,addr_dst_end,protocol_begin,protocol_end,port_src_begin,port_src_end,port_dst_begin,port_dst_end,flags,response from net_policy`
-)
-
 type NetWorker struct {
-	db *sql.DB
+	db       *storage.DB
+	policies storage.NetRepository
 
 	running bool
 	wg      sync.WaitGroup
@@ -29,19 +25,15 @@ type NetWorker struct {
 	dog     *watchdog.Watchdog
 }
 
-func NewNetWorker(db *sql.DB) *NetWorker {
+func NewNetWorker(db *storage.DB) *NetWorker {
 	worker := NetWorker{
-		db: db,
+		db:       db,
+		policies: storage.NewNetRepository(db),
 	}
 	return &worker
 }
 
 func (w *NetWorker) Init() (err error) {
-	err = w.initDB()
-	if err != nil {
-		return
-	}
-
 	w.config, err = config.New(w.db)
 	if err != nil {
 		logrus.Error(err)
@@ -61,13 +53,13 @@ func (w *NetWorker) Init() (err error) {
 
 	switch status {
 	case net.StatusEnable:
-		if ok := net.Enable(); !ok {
+		if err = net.Enable(); err != nil {
 			err = net.ErrorEnable
 			logrus.Error(err)
 			return
 		}
 	default:
-		if ok := net.Disable(); !ok {
+		if err = net.Disable(); err != nil {
 			err = net.ErrorDisable
 			logrus.Error(err)
 			return
@@ -90,77 +82,47 @@ func (w *NetWorker) Start() (err error) {
 		return
 	}
 
+	w.dog = watchdog.New(10*time.Second, func() {
+		logrus.Error("osinfo::report timeout")
+	})
 	w.wg.Add(1)
 	go w.run()
 	return
 }
 
+// Stop 通知 hackernel 失败时仍然释放协程和连接,返回第一个错误
 func (w *NetWorker) Stop() (err error) {
-	err = w.conn.Send(`{"type":"user::msg::unsub","section":"osinfo::report"}`)
-	if err != nil {
-		return
+	errs := []error{
+		w.conn.Send(`{"type":"user::msg::unsub","section":"osinfo::report"}`),
 	}
 
-	if ok := net.ClearPolicy(); !ok {
+	if err := net.ClearPolicy(); err != nil {
 		logrus.Error(net.ErrorClearPolicy)
+		errs = append(errs, err)
 	}
 
 	time.Sleep(time.Second)
 	w.running = false
-	err = w.conn.Shutdown(time.Now())
-	if err != nil {
-		return
-	}
+	errs = append(errs, w.conn.Shutdown(time.Now()))
 	w.wg.Wait()
+	if w.dog != nil {
+		w.dog.Stop()
+	}
 	w.conn.Close()
-	return
+	return firstError(errs)
 }
 
-func (w *NetWorker) initDB() (err error) {
-	_, err = w.db.Exec(sqlCreateNetPolicyTable)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-
-	return
+// Alive 返回是否在 watchdog 的周期内收到过 hackernel 的消息
+func (w *NetWorker) Alive() bool {
+	return w.running && w.dog != nil && w.dog.Alive()
 }
 
 func (w *NetWorker) initNetPolicy() (err error) {
-	stmt, err := w.db.Prepare(sqlQueryNetPolicy)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query()
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		policy := net.Policy{}
-		err = rows.Scan(&policy.ID, &policy.Priority,
-			&policy.Addr.Src.Begin, &policy.Addr.Src.End,
-			&policy.Addr.Dst.Begin, &policy.Addr.Dst.End,
-			&policy.Protocol.Begin, &policy.Protocol.End,
-			&policy.Port.Src.Begin, &policy.Port.Src.End,
-			&policy.Port.Dst.Begin, &policy.Port.Dst.End,
-			&policy.Flags, &policy.Response)
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-		if ok := net.AddPolicy(policy); !ok {
-			logrus.Error(err)
-			return
-		}
-	}
-	err = rows.Err()
+	err = w.policies.ScanPolicyLimitOffset(-1, 0, func(policy net.Policy) error {
+		return net.AddPolicy(policy)
+	})
 	if err != nil {
 		logrus.Error(err)
-		return
 	}
 	return
 }
@@ -182,9 +144,6 @@ func (w *NetWorker) handleMsg(msg string) {
 
 func (w *NetWorker) run() {
 	defer w.wg.Done()
-	w.dog = watchdog.New(10*time.Second, func() {
-		logrus.Error("osinfo::report timeout")
-	})
 	for w.running {
 		msg, err := w.conn.Recv()
 
@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"uranus/internal/storage"
+	"uranus/pkg/file"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPatternExpansion 一条目录或通配符策略最多展开的文件数量,超出时只保护前面的文件
+	maxPatternExpansion = 4096
+	// maxPatternDirs 一条目录策略最多监听的目录数量,超出时其他目录中的文件由定时展开发现
+	maxPatternDirs = 1024
+)
+
+var errPatternTooLarge = errors.New("too many files")
+
+// 后台监听和 Web 接口都会修改子策略,同一时间只允许一个协程展开
+var patternMutex sync.Mutex
+
+// AddFilePattern 新增目录或通配符策略并立即展开,展开失败时删除已经写入的策略,返回的 id 为 0
+func AddFilePattern(files storage.FileRepository, path string, kind, perm int) (id int64, err error) {
+	id, err = files.InsertPattern(filepath.Clean(path), kind, perm, file.StatusPolicyNormal)
+	if err != nil {
+		return 0, err
+	}
+	if _, _, err = ExpandFilePolicy(files, uint64(id)); err != nil {
+		if cleanup := DeleteFilePattern(files, uint64(id)); cleanup != nil {
+			logrus.Errorf("file policy %d: delete after failed expansion: %v", id, cleanup)
+		}
+		return 0, err
+	}
+	return
+}
+
+// UpdateFilePattern 修改目录或通配符策略和全部子策略的权限
+func UpdateFilePattern(files storage.FileRepository, id uint64, perm int) (err error) {
+	patternMutex.Lock()
+	defer patternMutex.Unlock()
+
+	parent, err := files.QueryPolicyById(int(id))
+	if err != nil {
+		return
+	}
+	children, err := files.QueryPolicyByParentLimitOffset(id, -1, 0)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		fsid, ino, status, err := file.SetPolicy(child.Path, perm, file.FlagUpdate)
+		if err != nil {
+			return err
+		}
+		if err = files.UpdatePolicyById(fsid, ino, perm, status, int(child.ID)); err != nil {
+			return err
+		}
+	}
+	return files.UpdatePolicyById(0, 0, perm, parent.Status, int(id))
+}
+
+// DeleteFilePattern 删除目录或通配符策略和全部子策略
+func DeleteFilePattern(files storage.FileRepository, id uint64) (err error) {
+	patternMutex.Lock()
+	defer patternMutex.Unlock()
+
+	children, err := files.QueryPolicyByParentLimitOffset(id, -1, 0)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		if _, _, _, err = file.SetPolicy(child.Path, 0, file.FlagAny); err != nil {
+			return
+		}
+	}
+	if err = files.DeletePolicyByParent(id); err != nil {
+		return
+	}
+	return files.DeletePolicyById(int(id))
+}
+
+// ExpandFilePolicies 展开全部目录和通配符策略,模块启动时调用
+func ExpandFilePolicies(files storage.FileRepository) (err error) {
+	patterns := []uint64{}
+	err = files.ScanPolicyByParentLimitOffset(0, -1, 0, func(policy file.Policy) error {
+		if policy.Kind != file.KindFile {
+			patterns = append(patterns, policy.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, id := range patterns {
+		if _, _, err = ExpandFilePolicy(files, id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ExpandFilePolicy 为新匹配的文件增加子策略,删除不再匹配的子策略.
+// 已经单独保护或被其他策略展开的文件不重复设置
+func ExpandFilePolicy(files storage.FileRepository, id uint64) (added, removed int, err error) {
+	added, removed, _, err = expandFilePolicy(files, id)
+	return
+}
+
+// expandFilePolicy 同时返回展开时遍历到的需要监听的目录
+func expandFilePolicy(files storage.FileRepository, id uint64) (added, removed int, dirs []string, err error) {
+	patternMutex.Lock()
+	defer patternMutex.Unlock()
+
+	parent, err := files.QueryPolicyById(int(id))
+	if err != nil || parent.Kind == file.KindFile {
+		return
+	}
+	paths, dirs, status := matchPattern(parent)
+
+	children := map[string]file.Policy{}
+	err = files.ScanPolicyByParentLimitOffset(parent.ID, -1, 0, func(policy file.Policy) error {
+		children[policy.Path] = policy
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	protected, err := files.QueryPolicyPathsByPaths(parent.ID, paths)
+	if err != nil {
+		return
+	}
+
+	matched := map[string]bool{}
+	for _, path := range paths {
+		matched[path] = true
+		if _, ok := children[path]; ok || protected[path] {
+			continue
+		}
+		fsid, ino, s, err := file.SetPolicy(path, parent.Perm, file.FlagNew)
+		if err != nil {
+			return added, removed, dirs, err
+		}
+		if err = files.InsertChildPolicy(parent.ID, path, fsid, ino, parent.Perm, s); err != nil {
+			return added, removed, dirs, err
+		}
+		added++
+	}
+	// 文件被删除或移走后不再匹配,移走的文件仍然按 inode 受保护,直到模块重启
+	for path, child := range children {
+		if matched[path] {
+			continue
+		}
+		if _, _, _, err = file.SetPolicy(path, 0, file.FlagAny); err != nil {
+			return
+		}
+		if err = files.DeletePolicyById(int(child.ID)); err != nil {
+			return
+		}
+		removed++
+	}
+
+	if status != parent.Status {
+		if err = files.UpdatePolicyById(0, 0, parent.Perm, status, int(parent.ID)); err != nil {
+			return
+		}
+	}
+	if added > 0 || removed > 0 {
+		logrus.Infof("file policy %d: %s expanded, %d added, %d removed", parent.ID, parent.Path, added, removed)
+	}
+	return
+}
+
+// matchPattern 返回策略当前匹配的普通文件和需要监听的目录.目录策略监听全部子目录,
+// 通配符策略监听不含通配符的上级目录,其他目录中新增的文件由定时展开发现.
+// 目录不存在时状态为 StatusPolicyFileNotExist,超出 maxPatternExpansion 或
+// maxPatternDirs 时状态为 StatusPolicyUnknown
+func matchPattern(policy file.Policy) (paths, dirs []string, status int) {
+	status = file.StatusPolicyNormal
+	switch policy.Kind {
+	case file.KindDirectory:
+		err := filepath.WalkDir(policy.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == policy.Path {
+					return err
+				}
+				// 无法读取的子目录跳过
+				return nil
+			}
+			if d.IsDir() {
+				if len(dirs) >= maxPatternDirs {
+					return errPatternTooLarge
+				}
+				dirs = append(dirs, path)
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if len(paths) >= maxPatternExpansion {
+				return errPatternTooLarge
+			}
+			paths = append(paths, path)
+			return nil
+		})
+		if err == errPatternTooLarge {
+			status = file.StatusPolicyUnknown
+		} else if err != nil {
+			status = file.StatusPolicyFileNotExist
+		}
+	case file.KindGlob:
+		if dir := filepath.Dir(policy.Path); !hasMeta(dir) {
+			dirs = append(dirs, dir)
+		}
+		matches, _ := filepath.Glob(policy.Path)
+		for _, path := range matches {
+			info, err := os.Lstat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if len(paths) >= maxPatternExpansion {
+				status = file.StatusPolicyUnknown
+				break
+			}
+			paths = append(paths, path)
+		}
+	}
+	if status == file.StatusPolicyUnknown {
+		logrus.Warnf("file policy %d: %s matches more than %d files or %d directories, only the first are protected",
+			policy.ID, policy.Path, maxPatternExpansion, maxPatternDirs)
+	}
+	return
+}
+
+// patternMatch 判断新增或删除的路径是否可能改变策略展开的结果
+func patternMatch(policy file.Policy, path string) bool {
+	switch policy.Kind {
+	case file.KindDirectory:
+		return path == policy.Path || strings.HasPrefix(path, strings.TrimSuffix(policy.Path, "/")+"/")
+	case file.KindGlob:
+		ok, _ := filepath.Match(policy.Path, path)
+		return ok
+	}
+	return false
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
@@ -0,0 +1,382 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package background
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"uranus/internal/storage"
+	"uranus/pkg/file"
+)
+
+// hackernel 模拟 hackernel 设置文件策略,按文件当前的 inode 返回结果
+type hackernel struct {
+	mutex sync.Mutex
+	// 每个路径和 inode 最近一次设置的权限
+	perms  map[string]int
+	inodes map[uint64]int
+}
+
+func (h *hackernel) perm(path string) (perm int, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	perm, ok = h.perms[path]
+	return
+}
+
+func (h *hackernel) inode(ino uint64) (perm int, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	perm, ok = h.inodes[ino]
+	return
+}
+
+func fakeHackernel(t *testing.T) *hackernel {
+	const name = "/tmp/hackernel.sock"
+	if _, err := os.Stat(name); err == nil {
+		t.Skip("hackernel is running")
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	h := &hackernel{perms: map[string]int{}, inodes: map[uint64]int{}}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+		os.Remove(name)
+	})
+
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUnix(buffer)
+			if err != nil {
+				return
+			}
+			request := struct {
+				Path string `json:"path"`
+				Perm int    `json:"perm"`
+			}{}
+			json.Unmarshal(buffer[:n], &request)
+			response := `{"code":-2}`
+			h.mutex.Lock()
+			h.perms[request.Path] = request.Perm
+			if info, err := os.Stat(request.Path); err == nil {
+				ino := info.Sys().(*syscall.Stat_t).Ino
+				h.inodes[ino] = request.Perm
+				response = fmt.Sprintf(`{"code":0,"fsid":1,"ino":%d}`, ino)
+			}
+			h.mutex.Unlock()
+			conn.WriteToUnix([]byte(response), addr)
+		}
+	}()
+	return h
+}
+
+func touch(t *testing.T, paths ...string) {
+	for _, path := range paths {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	directory := file.Policy{Kind: file.KindDirectory, Path: "/etc/ssh"}
+	glob := file.Policy{Kind: file.KindGlob, Path: "/etc/ssh/*_config"}
+	tests := []struct {
+		policy file.Policy
+		path   string
+		want   bool
+	}{
+		{directory, "/etc/ssh", true},
+		{directory, "/etc/ssh/sshd_config", true},
+		{directory, "/etc/ssh/sshd_config.d/local.conf", true},
+		{directory, "/etc/sshd", false},
+		{directory, "/etc", false},
+		{glob, "/etc/ssh/sshd_config", true},
+		{glob, "/etc/ssh/sshd_config.d", false},
+		{glob, "/etc/ssh/sshd_config.d/local_config", false},
+		{glob, "/etc/ssh", false},
+		{file.Policy{Kind: file.KindFile, Path: "/etc/ssh/sshd_config"}, "/etc/ssh/sshd_config", false},
+	}
+	for _, test := range tests {
+		if got := patternMatch(test.policy, test.path); got != test.want {
+			t.Errorf("patternMatch(%s, %s) = %v", test.policy.Path, test.path, got)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	root := t.TempDir()
+	touch(t,
+		filepath.Join(root, "a.conf"),
+		filepath.Join(root, "b.txt"),
+		filepath.Join(root, "sub", "c.conf"),
+		filepath.Join(root, "sub", "deep", "d.conf"),
+	)
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a.conf"), filepath.Join(root, "link.conf")); err != nil {
+		t.Fatal(err)
+	}
+	join := func(names ...string) (paths []string) {
+		for _, name := range names {
+			paths = append(paths, filepath.Join(root, name))
+		}
+		return
+	}
+
+	tests := []struct {
+		name   string
+		kind   int
+		path   string
+		paths  []string
+		dirs   []string
+		status int
+	}{
+		{"directory", file.KindDirectory, root,
+			join("a.conf", "b.txt", "sub/c.conf", "sub/deep/d.conf"), join("", "empty", "sub", "sub/deep"), file.StatusPolicyNormal},
+		{"subdirectory", file.KindDirectory, filepath.Join(root, "sub"),
+			join("sub/c.conf", "sub/deep/d.conf"), join("sub", "sub/deep"), file.StatusPolicyNormal},
+		{"missing directory", file.KindDirectory, filepath.Join(root, "missing"),
+			nil, nil, file.StatusPolicyFileNotExist},
+		{"glob", file.KindGlob, filepath.Join(root, "*.conf"),
+			join("a.conf"), join(""), file.StatusPolicyNormal},
+		{"glob matching directories", file.KindGlob, filepath.Join(root, "s*"),
+			nil, join(""), file.StatusPolicyNormal},
+		{"glob in directory", file.KindGlob, filepath.Join(root, "*", "*.conf"),
+			join("sub/c.conf"), nil, file.StatusPolicyNormal},
+		{"glob without match", file.KindGlob, filepath.Join(root, "missing", "*"),
+			nil, join("missing"), file.StatusPolicyNormal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths, dirs, status := matchPattern(file.Policy{Kind: test.kind, Path: test.path})
+			sort.Strings(paths)
+			sort.Strings(dirs)
+			if !reflect.DeepEqual(paths, test.paths) {
+				t.Errorf("paths = %v, want %v", paths, test.paths)
+			}
+			if !reflect.DeepEqual(dirs, test.dirs) {
+				t.Errorf("dirs = %v, want %v", dirs, test.dirs)
+			}
+			if status != test.status {
+				t.Errorf("status = %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestMatchPatternLimits(t *testing.T) {
+	t.Run("files", func(t *testing.T) {
+		root := t.TempDir()
+		for i := 0; i <= maxPatternExpansion; i++ {
+			touch(t, filepath.Join(root, fmt.Sprint(i)))
+		}
+		paths, _, status := matchPattern(file.Policy{Kind: file.KindDirectory, Path: root})
+		if len(paths) != maxPatternExpansion || status != file.StatusPolicyUnknown {
+			t.Errorf("directory: %d paths, status %d", len(paths), status)
+		}
+		paths, _, status = matchPattern(file.Policy{Kind: file.KindGlob, Path: filepath.Join(root, "*")})
+		if len(paths) != maxPatternExpansion || status != file.StatusPolicyUnknown {
+			t.Errorf("glob: %d paths, status %d", len(paths), status)
+		}
+	})
+
+	t.Run("directories", func(t *testing.T) {
+		root := t.TempDir()
+		// 根目录也需要监听
+		for i := 0; i < maxPatternDirs; i++ {
+			if err := os.Mkdir(filepath.Join(root, fmt.Sprint(i)), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, dirs, status := matchPattern(file.Policy{Kind: file.KindDirectory, Path: root})
+		if len(dirs) != maxPatternDirs || status != file.StatusPolicyUnknown {
+			t.Errorf("%d dirs, status %d", len(dirs), status)
+		}
+	})
+}
+
+func children(t *testing.T, files storage.FileRepository, parent int64) (paths []string) {
+	policies, err := files.QueryPolicyByParentLimitOffset(uint64(parent), -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range policies {
+		paths = append(paths, policy.Path)
+	}
+	sort.Strings(paths)
+	return
+}
+
+func TestExpandFilePolicy(t *testing.T) {
+	h := fakeHackernel(t)
+	files := storage.NewFileRepository(newTestDB(t))
+	root := t.TempDir()
+	a, b, c, d := filepath.Join(root, "a.conf"), filepath.Join(root, "b.conf"), filepath.Join(root, "sub", "c.conf"), filepath.Join(root, "sub", "d.txt")
+	touch(t, a, b, c, d)
+
+	// 单独保护的文件不重复展开
+	if err := files.InsertPolicy(b, 1, 1, 2, file.StatusPolicyNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	directory, err := AddFilePattern(files, filepath.Join(root, "sub"), file.KindDirectory, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := children(t, files, directory), []string{c, d}; !reflect.DeepEqual(got, want) {
+		t.Errorf("directory children = %v, want %v", got, want)
+	}
+
+	// 已经被目录策略展开的文件不重复展开
+	glob, err := AddFilePattern(files, filepath.Join(root, "*", "*.conf"), file.KindGlob, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := children(t, files, glob); got != nil {
+		t.Errorf("glob children = %v", got)
+	}
+	glob, err = AddFilePattern(files, filepath.Join(root, "*.conf"), file.KindGlob, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := children(t, files, glob), []string{a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("glob children = %v, want %v", got, want)
+	}
+	if perm, _ := h.perm(a); perm != 4 {
+		t.Errorf("perm of %s = %d", a, perm)
+	}
+
+	// 删除的文件移除子策略并清除权限,新增的文件增加子策略
+	e := filepath.Join(root, "sub", "deep", "e")
+	if err := os.Remove(c); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, e)
+	added, removed, err := ExpandFilePolicy(files, uint64(directory))
+	if err != nil || added != 1 || removed != 1 {
+		t.Errorf("expand: added=%d removed=%d err=%v", added, removed, err)
+	}
+	if got, want := children(t, files, directory), []string{d, e}; !reflect.DeepEqual(got, want) {
+		t.Errorf("directory children = %v, want %v", got, want)
+	}
+	if perm, ok := h.perm(c); !ok || perm != 0 {
+		t.Errorf("perm of removed %s = %d", c, perm)
+	}
+
+	// 目录被删除后全部子策略移除,状态为文件不存在
+	if err := os.RemoveAll(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, removed, err := ExpandFilePolicy(files, uint64(directory)); err != nil || removed != 2 {
+		t.Errorf("expand removed directory: removed=%d err=%v", removed, err)
+	}
+	if policy, _ := files.QueryPolicyById(int(directory)); policy.Status != file.StatusPolicyFileNotExist {
+		t.Errorf("status = %d", policy.Status)
+	}
+
+	// 删除策略同时删除子策略
+	if err := DeleteFilePattern(files, uint64(glob)); err != nil {
+		t.Fatal(err)
+	}
+	if got := children(t, files, glob); got != nil {
+		t.Errorf("children after delete = %v", got)
+	}
+}
+
+func TestExpandFilePolicyLimit(t *testing.T) {
+	fakeHackernel(t)
+	files := storage.NewFileRepository(newTestDB(t))
+	root := t.TempDir()
+	for i := 0; i <= maxPatternExpansion; i++ {
+		touch(t, filepath.Join(root, fmt.Sprint(i)))
+	}
+
+	id, err := AddFilePattern(files, root, file.KindDirectory, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(children(t, files, id)); got != maxPatternExpansion {
+		t.Errorf("%d children", got)
+	}
+	if policy, _ := files.QueryPolicyById(int(id)); policy.Status != file.StatusPolicyUnknown {
+		t.Errorf("status = %d", policy.Status)
+	}
+}
+
+// hackernel 没有运行时展开失败,已经写入的策略被删除
+func TestAddFilePatternFailure(t *testing.T) {
+	if _, err := os.Stat("/tmp/hackernel.sock"); err == nil {
+		t.Skip("hackernel is running")
+	}
+	files := storage.NewFileRepository(newTestDB(t))
+	root := t.TempDir()
+	touch(t, filepath.Join(root, "a"))
+
+	id, err := AddFilePattern(files, root, file.KindDirectory, 1)
+	if err == nil || id != 0 {
+		t.Fatalf("id=%d err=%v", id, err)
+	}
+	if policies, err := files.QueryPolicyLimitOffset(-1, 0); err != nil || len(policies) != 0 {
+		t.Errorf("policies=%+v err=%v", policies, err)
+	}
+}
+
+// 新建的子目录和其中的文件由 inotify 事件触发展开,不需要等待定时展开
+func TestFollowerExpandOnEvent(t *testing.T) {
+	fakeHackernel(t)
+	files := storage.NewFileRepository(newTestDB(t))
+	root := t.TempDir()
+	touch(t, filepath.Join(root, "a"))
+	id, err := AddFilePattern(files, root, file.KindDirectory, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFollower(&FileWorker{policies: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.start()
+	defer f.stop()
+
+	if err := os.MkdirAll(filepath.Join(root, "new", "deeper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "a"), filepath.Join(root, "new", "deeper", "b")}
+	touch(t, want[1])
+	for deadline := time.Now().Add(followRefreshInterval / 2); !reflect.DeepEqual(children(t, files, id), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("children = %v, want %v", children(t, files, id), want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// 新目录已经监听,其中新增的文件同样由事件触发展开
+	want = append(want, filepath.Join(root, "new", "deeper", "c"))
+	touch(t, want[2])
+	for deadline := time.Now().Add(followRefreshInterval / 2); !reflect.DeepEqual(children(t, files, id), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("children = %v, want %v", children(t, files, id), want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -2,12 +2,12 @@
 package background
 
 import (
-	"database/sql"
 	"encoding/json"
 	"sync"
 	"syscall"
 	"time"
 	"uranus/internal/config"
+	"uranus/internal/storage"
 	"uranus/pkg/connector"
 	"uranus/pkg/process"
 	"uranus/pkg/watchdog"
@@ -15,37 +15,35 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	sqlCreateProcessTable    = `create table if not exists process_event(id integer primary key autoincrement, cmd blob not null unique, workdir text not null, binary text not null, argv text not null, count integer not null, judge integer not null, status integer not null)`
-	sqlCreateProcessCmdIndex = `create unique index if not exists process_cmd_idx on process_event (cmd)`
-	sqlUpdateProcessCount    = `update process_event set count=count+1,judge=?,status=? where cmd=?`
-	sqlInsertProcessEvent    = `insert into process_event(cmd,workdir,binary,argv,count,judge,status) values(?,?,?,?,1,?,?)`
-	sqlQueryAllowedProcesses = `select cmd from process_event where status=2`
-)
-
 type ProcessWorker struct {
-	db *sql.DB
+	db     *storage.DB
+	events storage.ProcessRepository
 
 	running bool
 	wg      sync.WaitGroup
 	conn    connector.Connector
 	config  *config.Config
 	dog     *watchdog.Watchdog
+	ingest  *ingest
+}
+
+// processReport 在接收协程中解析的上报,时间为接收的时间
+type processReport struct {
+	cmd       string
+	judge     int
+	timestamp int64
 }
 
-func NewProcessWorker(db *sql.DB) *ProcessWorker {
+func NewProcessWorker(db *storage.DB, queue IngestConfig) *ProcessWorker {
 	worker := ProcessWorker{
-		db: db,
+		db:     db,
+		events: storage.NewProcessRepository(db),
 	}
+	worker.ingest = newIngest("process", queue, worker.handleReport, worker.writeReports)
 	return &worker
 }
 
 func (w *ProcessWorker) Init() (err error) {
-	err = w.initDB()
-	if err != nil {
-		return
-	}
-
 	w.config, err = config.New(w.db)
 	if err != nil {
 		logrus.Error(err)
@@ -65,12 +63,12 @@ func (w *ProcessWorker) Init() (err error) {
 
 	switch status {
 	case process.StatusEnable:
-		if ok := process.Enable(); !ok {
+		if err = process.Enable(); err != nil {
 			err = process.ErrorEnable
 			return
 		}
 	default:
-		if ok := process.Disable(); !ok {
+		if err = process.Disable(); err != nil {
 			err = process.ErrorEnable
 			return
 		}
@@ -82,7 +80,7 @@ func (w *ProcessWorker) Init() (err error) {
 		judge = process.StatusJudgeDisable
 	}
 
-	if ok := process.UpdateJudge(judge); !ok {
+	if err = process.UpdateJudge(judge); err != nil {
 		err = process.ErrorUpdateJudge
 		return
 	}
@@ -106,134 +104,112 @@ func (w *ProcessWorker) Start() (err error) {
 		return
 	}
 
+	w.dog = watchdog.New(10*time.Second, func() {
+		logrus.Error("osinfo::report timeout")
+	})
+	w.ingest.start()
 	w.wg.Add(1)
 	go w.run()
 	return
 }
 
+// Stop 通知 hackernel 失败时仍然释放协程,写入队列和连接,返回第一个错误
 func (w *ProcessWorker) Stop() (err error) {
-	err = w.conn.Send(`{"type":"user::msg::unsub","section":"audit::proc::report"}`)
-	if err != nil {
-		return
-	}
-	err = w.conn.Send(`{"type":"user::msg::unsub","section":"osinfo::report"}`)
-	if err != nil {
-		return
+	errs := []error{
+		w.conn.Send(`{"type":"user::msg::unsub","section":"audit::proc::report"}`),
+		w.conn.Send(`{"type":"user::msg::unsub","section":"osinfo::report"}`),
 	}
 
-	if ok := process.Disable(); !ok {
+	if err := process.Disable(); err != nil {
 		logrus.Error("process protection disable failed")
-		return
+		errs = append(errs, err)
 	}
 
-	if ok := process.ClearPolicy(); !ok {
+	if err := process.ClearPolicy(); err != nil {
 		logrus.Error("process protection clear failed")
-		return
+		errs = append(errs, err)
 	}
 
 	time.Sleep(time.Second)
 	w.running = false
-	err = w.conn.Shutdown(time.Now())
-	if err != nil {
-		return
-	}
+	errs = append(errs, w.conn.Shutdown(time.Now()))
 	w.wg.Wait()
+	w.ingest.stop()
+	if w.dog != nil {
+		w.dog.Stop()
+	}
 	w.conn.Close()
-	return
+	return firstError(errs)
 }
 
-func (w *ProcessWorker) initDB() (err error) {
-	_, err = w.db.Exec(sqlCreateProcessTable)
-	if err != nil {
-		logrus.Error(err)
-		return
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	_, err = w.db.Exec(sqlCreateProcessCmdIndex)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
+// Alive 返回是否在 watchdog 的周期内收到过 hackernel 的消息
+func (w *ProcessWorker) Alive() bool {
+	return w.running && w.dog != nil && w.dog.Alive()
+}
 
-	return
+func (w *ProcessWorker) IngestStats() IngestStats {
+	return w.ingest.state()
+}
+
+// SetIngestConfig 修改写入队列的设置,运行中时重建队列,不影响 hackernel 的订阅
+func (w *ProcessWorker) SetIngestConfig(queue IngestConfig) {
+	w.ingest.reconfigure(queue)
 }
 
 func (w *ProcessWorker) initTrustedCmd() (err error) {
-	stmt, err := w.db.Prepare(sqlQueryAllowedProcesses)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query()
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		cmd := ""
-		err = rows.Scan(&cmd)
-		if err != nil {
-			return
-		}
+	err = w.events.ScanCmdByStatus(process.StatusTrusted, func(cmd string) error {
 		process.SetTrustedCmd(cmd)
-	}
-	err = rows.Err()
+		return nil
+	})
 	if err != nil {
 		logrus.Error(err)
-		return
 	}
 	return
 }
 
-func (w *ProcessWorker) updateCmd(cmd string, judge int) (err error) {
+// handleReport 在处理协程中执行,同一条命令的上报由同一个协程按顺序处理
+func (w *ProcessWorker) handleReport(item interface{}) (event interface{}, ok bool) {
+	report := item.(processReport)
 	status, err := w.config.GetInteger(config.ProcessCmdDefaultStatus)
 	if err != nil {
 		status = process.StatusPending
 	}
-	if status == process.StatusTrusted && judge != process.StatusJudgeDefense {
-		process.SetTrustedCmd(cmd)
+	if status == process.StatusTrusted && report.judge != process.StatusJudgeDefense {
+		process.SetTrustedCmd(report.cmd)
 	}
 
-	stmt, err := w.db.Prepare(sqlUpdateProcessCount)
+	workdir, binary, argv, err := process.SplitCmd(report.cmd)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
-	defer stmt.Close()
-	result, err := stmt.Exec(judge, status, cmd)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	affected, err := result.RowsAffected()
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-
-	if affected != 0 {
-		return
-	}
+	return storage.ProcessReport{
+		Cmd:       report.cmd,
+		Workdir:   workdir,
+		Binary:    binary,
+		Argv:      argv,
+		Judge:     report.judge,
+		Status:    status,
+		Timestamp: report.timestamp,
+	}, true
+}
 
-	stmt, err = w.db.Prepare(sqlInsertProcessEvent)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-	workdir, binary, argv, err := process.SplitCmd(cmd)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	_, err = stmt.Exec(cmd, workdir, binary, argv, judge, status)
-	if err != nil {
-		logrus.Error(err)
-		return
+// writeReports process_event 每条命令只保存一行,按小时单独统计执行次数
+func (w *ProcessWorker) writeReports(events []interface{}) (err error) {
+	reports := make([]storage.ProcessReport, 0, len(events))
+	for _, event := range events {
+		reports = append(reports, event.(storage.ProcessReport))
 	}
-	return
+	return w.events.InsertReports(reports)
 }
 
 func (w *ProcessWorker) handleMsg(msg string) {
@@ -251,19 +227,13 @@ func (w *ProcessWorker) handleMsg(msg string) {
 	}
 	switch event.Type {
 	case "audit::proc::report":
-		err = w.updateCmd(event.Cmd, event.Judge)
-		if err != nil {
-			logrus.Error(err)
-		}
+		w.ingest.push(event.Cmd, processReport{cmd: event.Cmd, judge: event.Judge, timestamp: time.Now().Unix()})
 	default:
 	}
 }
 
 func (w *ProcessWorker) run() {
 	defer w.wg.Done()
-	w.dog = watchdog.New(10*time.Second, func() {
-		logrus.Error("osinfo::report timeout")
-	})
 	for w.running {
 		msg, err := w.conn.Recv()
 
@@ -277,6 +247,6 @@ func (w *ProcessWorker) run() {
 			continue
 		}
 		w.dog.Kick()
-		go w.handleMsg(msg)
+		w.handleMsg(msg)
 	}
 }
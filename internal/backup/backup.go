@@ -0,0 +1,269 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	sqlIntegrityCheck      = `pragma integrity_check`
+	sqlJournalModeDelete   = `pragma journal_mode=delete`
+	sqlQueryMigrationTable = `select count(*) from sqlite_master where type='table' and name='schema_migration'`
+)
+
+// 备份文件的来源,只有定时备份会被轮转删除
+const (
+	KindManual    = "manual"
+	KindScheduled = "scheduled"
+	KindRestore   = "restore"
+)
+
+const timeLayout = "20060102150405.000"
+
+var (
+	ErrNotConfigured = errors.New("backup directory is not configured")
+	ErrInvalidName   = errors.New("invalid backup name")
+	ErrCorrupted     = errors.New("backup integrity check failed")
+	// PostgreSQL 使用 pg_dump 和 pg_restore 备份恢复
+	ErrUnsupported = errors.New("backup is only supported for sqlite, use pg_dump for postgres")
+)
+
+var namePattern = regexp.MustCompile(`^uranus-(manual|scheduled|restore)-([0-9]{14}\.[0-9]{3})\.db$`)
+
+type Info struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Size      int64  `json:"size"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Path 校验备份文件名,返回备份文件的路径
+func Path(dir, name string) (path string, err error) {
+	if dir == "" {
+		err = ErrNotConfigured
+		return
+	}
+	if !namePattern.MatchString(name) {
+		err = ErrInvalidName
+		return
+	}
+	path = filepath.Join(dir, name)
+	return
+}
+
+func stat(dir, name string) (info Info, err error) {
+	match := namePattern.FindStringSubmatch(name)
+	if match == nil {
+		err = ErrInvalidName
+		return
+	}
+	file, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		return
+	}
+	info = Info{Name: name, Kind: match[1], Size: file.Size(), Timestamp: file.ModTime().Unix()}
+	return
+}
+
+// Create 在数据库继续写入的同时生成一致的快照,先写入临时文件,完成后再重命名
+func Create(db *storage.DB, dir, kind string) (info Info, err error) {
+	if db.Postgres() {
+		err = ErrUnsupported
+		return
+	}
+	if dir == "" {
+		err = ErrNotConfigured
+		return
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	name := fmt.Sprintf("uranus-%s-%s.db", kind, time.Now().Format(timeLayout))
+	path := filepath.Join(dir, name)
+	temp := path + ".tmp"
+	defer os.Remove(temp)
+
+	if err = copyFile(db.DB, temp); err != nil {
+		return
+	}
+	if err = os.Chmod(temp, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(temp, path); err != nil {
+		return
+	}
+	return stat(dir, name)
+}
+
+func copyFile(db *sql.DB, path string) (err error) {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return
+	}
+	defer dest.Close()
+	if err = copyDatabase(dest, db); err != nil {
+		return
+	}
+	// 备份从 WAL 模式的数据库复制而来,切换回普通模式使备份只有一个文件
+	_, err = dest.Exec(sqlJournalModeDelete)
+	return
+}
+
+// copyDatabase 使用 SQLite 的在线备份接口把 src 的全部页复制到 dest
+func copyDatabase(dest, src *sql.DB) (err error) {
+	destConn, err := dest.Conn(context.Background())
+	if err != nil {
+		return
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(context.Background())
+	if err != nil {
+		return
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) (err error) {
+			destSqlite, ok := d.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("destination is not a sqlite3 connection")
+			}
+			srcSqlite, ok := s.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("source is not a sqlite3 connection")
+			}
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return
+			}
+			// 一次复制全部页, WAL 模式下复制期间不阻塞其他连接写入
+			if _, err = backup.Step(-1); err != nil {
+				backup.Finish()
+				return
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// List 按时间从新到旧返回备份目录中的备份
+func List(dir string) (infos []Info, err error) {
+	if dir == "" {
+		err = ErrNotConfigured
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Info{}, nil
+	}
+	if err != nil {
+		return
+	}
+	infos = []Info{}
+	for _, entry := range entries {
+		if entry.IsDir() || !namePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := stat(dir, entry.Name())
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	// 文件名中的时间精确到毫秒,按文件名排序即按创建时间排序
+	sort.Slice(infos, func(i, j int) bool {
+		return strings.SplitN(infos[i].Name, "-", 3)[2] > strings.SplitN(infos[j].Name, "-", 3)[2]
+	})
+	return
+}
+
+// Rotate 只保留最近的 keep 个定时备份, keep 为 0 时不删除
+func Rotate(dir string, keep int) (err error) {
+	if keep <= 0 {
+		return
+	}
+	infos, err := List(dir)
+	if err != nil {
+		return
+	}
+	kept := 0
+	for _, info := range infos {
+		if info.Kind != KindScheduled {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, info.Name)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Check 以只读方式打开备份,检查文件是否完整,以及是否由更新版本的程序创建
+func Check(path string) (err error) {
+	if _, err = os.Stat(path); err != nil {
+		return
+	}
+	db, err := storage.Open("file:" + path + "?mode=ro")
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	// 不是 SQLite 数据库的文件在读取时报错
+	result := ""
+	if err = db.QueryRow(sqlIntegrityCheck).Scan(&result); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	if result != "ok" {
+		return ErrCorrupted
+	}
+
+	count := 0
+	if err = db.QueryRow(sqlQueryMigrationTable).Scan(&count); err != nil || count == 0 {
+		return
+	}
+	version, err := migration.Version(db)
+	if err != nil {
+		return
+	}
+	if version > migration.Latest() {
+		return &migration.NewerSchemaError{Current: version, Latest: migration.Latest()}
+	}
+	return
+}
+
+// Restore 用备份替换 db 的全部内容后执行迁移.调用前需要停止写入数据库的后台模块
+func Restore(db *storage.DB, path string) (err error) {
+	if db.Postgres() {
+		return ErrUnsupported
+	}
+	if err = Check(path); err != nil {
+		return
+	}
+	src, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	if err = copyDatabase(db.DB, src); err != nil {
+		return
+	}
+	return migration.Migrate(db)
+}
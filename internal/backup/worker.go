@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package backup
+
+import (
+	"sync"
+	"time"
+	"uranus/internal/storage"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Worker 定时备份数据库,并删除超出数量的定时备份
+type Worker struct {
+	db       *storage.DB
+	dir      string
+	interval time.Duration
+	keep     int
+
+	running bool
+	wg      sync.WaitGroup
+	stop    chan struct{}
+}
+
+// NewWorker interval 为 0 时不执行定时备份
+func NewWorker(db *storage.DB, dir string, interval time.Duration, keep int) *Worker {
+	worker := Worker{
+		db:       db,
+		dir:      dir,
+		interval: interval,
+		keep:     keep,
+	}
+	return &worker
+}
+
+func (w *Worker) Init() (err error) {
+	if w.interval > 0 && w.db.Postgres() {
+		logrus.Warn("scheduled backup is disabled for postgres, use pg_dump instead")
+		w.interval = 0
+		return
+	}
+	if w.interval > 0 && w.dir == "" {
+		err = ErrNotConfigured
+		logrus.Error(err)
+	}
+	return
+}
+
+func (w *Worker) Start() (err error) {
+	w.stop = make(chan struct{})
+	w.running = true
+	if w.interval > 0 {
+		w.wg.Add(1)
+		go w.run()
+	}
+	return
+}
+
+func (w *Worker) Stop() (err error) {
+	if !w.running {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+	w.running = false
+	return
+}
+
+// Configure 修改定时备份的周期和保留数量,运行中时重新开始计时.
+// 需要定时备份但没有设置备份目录时返回错误,不修改原来的设置
+func (w *Worker) Configure(interval time.Duration, keep int) (err error) {
+	if interval > 0 && w.dir == "" && !w.db.Postgres() {
+		return ErrNotConfigured
+	}
+	if interval == w.interval && keep == w.keep {
+		return
+	}
+
+	running := w.running
+	if err = w.Stop(); err != nil {
+		return
+	}
+	w.interval = interval
+	w.keep = keep
+	if err = w.Init(); err != nil {
+		return
+	}
+	if running {
+		err = w.Start()
+	}
+	return
+}
+
+// Alive 备份不依赖 hackernel,启动后始终可用
+func (w *Worker) Alive() bool {
+	return w.running
+}
+
+func (w *Worker) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := Create(w.db, w.dir, KindScheduled)
+		if err != nil {
+			logrus.Errorf("scheduled backup: %v", err)
+			continue
+		}
+		logrus.Infof("database backed up to %s", info.Name)
+		if err = Rotate(w.dir, w.keep); err != nil {
+			logrus.Errorf("rotate backups: %v", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+	"uranus/internal/backup"
+)
+
+func backupCreate(c *Context, args []string) (err error) {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	info := backup.Info{}
+	if err = c.Client.Do(http.MethodPost, "/control/backup", nil, nil, &info); err != nil {
+		return
+	}
+	return c.printBackups(info, []backup.Info{info})
+}
+
+func backupList(c *Context, args []string) (err error) {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	infos := []backup.Info{}
+	if err = c.Client.Do(http.MethodGet, "/control/backups", nil, nil, &infos); err != nil {
+		return
+	}
+	return c.printBackups(infos, infos)
+}
+
+func (c *Context) printBackups(data interface{}, infos []backup.Info) error {
+	rows := [][]string{}
+	for _, info := range infos {
+		rows = append(rows, []string{info.Name, info.Kind, strconv.FormatInt(info.Size, 10),
+			time.Unix(info.Timestamp, 0).Format(time.RFC3339)})
+	}
+	return c.print(data, []string{"NAME", "KIND", "SIZE", "TIME"}, rows)
+}
+
+func backupDownload(c *Context, args []string) (err error) {
+	if len(args) != 1 && len(args) != 2 {
+		return ErrUsage
+	}
+	output := args[0]
+	if len(args) == 2 {
+		output = args[1]
+	}
+	// 先写入临时文件,下载失败时不留下不完整的备份
+	temp := output + ".tmp"
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer os.Remove(temp)
+	err = c.Client.Download("/control/backups/"+url.PathEscape(args[0]), nil, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(temp, output); err != nil {
+		return
+	}
+	return c.done("saved to %s", output)
+}
+
+// backupRestore uranus-web 运行时由 uranus-web 停止后台模块,恢复后重新发送策略
+func backupRestore(c *Context, args []string) (err error) {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	previous := backup.Info{}
+	if err = c.Client.Do(http.MethodPost, "/control/backups/"+url.PathEscape(args[0])+"/restore", nil, nil, &previous); err != nil {
+		return
+	}
+	if c.JSON {
+		return c.print(previous, nil, nil)
+	}
+	return c.done("restored from %s, previous database saved as %s", args[0], previous.Name)
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/user"
+	"strings"
+	"time"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web"
+	"uranus/internal/web/api"
+)
+
+const unixPrefix = "unix:"
+
+// Client 通过 uranus-web 的接口执行命令,直连模式下接口在进程内处理
+type Client struct {
+	http   *http.Client
+	server string
+	token  string
+	// 直连数据库时为 true
+	local bool
+}
+
+// StatusError 接口返回的非成功状态
+type StatusError struct {
+	Status  int
+	Message string
+	Data    json.RawMessage
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Status)
+}
+
+// NewRemote 连接 uranus-web, server 为 URL 或 unix: 开头的 Unix Domain Socket 路径
+func NewRemote(server, token string, insecure bool) *Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	}
+	if strings.HasPrefix(server, unixPrefix) {
+		path := strings.TrimPrefix(server, unixPrefix)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}
+		server = "http://localhost"
+	}
+	return &Client{
+		http:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+	}
+}
+
+// NewLocal 在 uranus-web 没有运行时直接访问数据库和 hackernel
+func NewLocal(dsn, backup string) (c *Client, err error) {
+	db, err := storage.Open(dsn)
+	if err != nil {
+		return
+	}
+	worker := web.NewWorker(web.Config{Backup: backup}, db)
+	if err = migration.Migrate(db); err == nil {
+		err = worker.Init()
+	}
+	if err != nil {
+		db.Close()
+		return
+	}
+	c = &Client{
+		http:   &http.Client{Transport: localTransport{handler: worker.Handler(), username: operator()}},
+		server: "http://localhost",
+		local:  true,
+	}
+	return
+}
+
+// 审计日志中记录执行命令的系统用户
+func operator() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return "uranusctl:" + name
+}
+
+type localTransport struct {
+	handler  http.Handler
+	username string
+}
+
+func (t localTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = api.WithLocal(request, t.username)
+	request.RemoteAddr = "127.0.0.1:0"
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, request)
+	return recorder.Result(), nil
+}
+
+// ping 检查 uranus-web 是否可以连接
+func (c *Client) ping() (err error) {
+	response, err := c.http.Get(c.server + "/healthz")
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	return
+}
+
+func unreachable(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+func (c *Client) request(method, path string, query url.Values, body io.Reader, contentType string) (response *http.Response, err error) {
+	target := c.server + api.Prefix + path
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(request)
+}
+
+// decode 解析接口统一的响应格式, data 为 nil 时忽略返回的数据
+func decode(response *http.Response, data interface{}) (err error) {
+	defer response.Body.Close()
+	result := struct {
+		Status  int             `json:"status"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}{}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%s: %w", response.Status, err)
+	}
+	if result.Status != 0 {
+		return &StatusError{Status: result.Status, Message: result.Message, Data: result.Data}
+	}
+	if data != nil && len(result.Data) != 0 {
+		err = json.Unmarshal(result.Data, data)
+	}
+	return
+}
+
+// Do 以 JSON 格式发送 body,并把返回的数据解析到 data
+func (c *Client) Do(method, path string, query url.Values, body, data interface{}) (err error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+	response, err := c.request(method, path, query, reader, "application/json")
+	if err != nil {
+		return
+	}
+	return decode(response, data)
+}
+
+// Download 把导出接口返回的文件写入 writer
+func (c *Client) Download(path string, query url.Values, writer io.Writer) (err error) {
+	response, err := c.request(http.MethodGet, path, query, nil, "")
+	if err != nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		return decode(response, nil)
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(writer, response.Body)
+	return
+}
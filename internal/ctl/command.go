@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var ErrUsage = errors.New("usage")
+
+type Options struct {
+	// uranus-web 的地址和 API 令牌
+	Server   string
+	Token    string
+	Insecure bool
+	// 直连模式使用的数据库和备份目录
+	DSN    string
+	Backup string
+	// 不连接 uranus-web,直接访问数据库和 hackernel
+	Local bool
+	// 以 JSON 格式输出
+	JSON bool
+}
+
+// Context 命令执行时的客户端和输入输出
+type Context struct {
+	Client *Client
+	JSON   bool
+
+	In  io.Reader
+	Out io.Writer
+	Err io.Writer
+
+	reader *bufio.Reader
+}
+
+type Command struct {
+	// 多个单词组成的命令名,例如 "file add"
+	Name    string
+	Args    string
+	Summary string
+	Run     func(c *Context, args []string) error
+}
+
+// Connect 优先连接 uranus-web,无法连接时回退到直连模式
+func Connect(options Options, stderr io.Writer) (client *Client, err error) {
+	if options.Local {
+		return NewLocal(options.DSN, options.Backup)
+	}
+
+	client = NewRemote(options.Server, options.Token, options.Insecure)
+	err = client.ping()
+	if err == nil {
+		if options.Token == "" {
+			err = errors.New("uranus-web is running, token is required (or use -local)")
+		}
+		return
+	}
+	if !unreachable(err) {
+		return
+	}
+	fmt.Fprintf(stderr, "warning: %s is unreachable, using database %s\n", options.Server, options.DSN)
+	return NewLocal(options.DSN, options.Backup)
+}
+
+// Lookup 按最长匹配查找命令,返回命令和剩余参数
+func Lookup(args []string) (command *Command, rest []string) {
+	for n := len(args); n > 0; n-- {
+		name := strings.Join(args[:n], " ")
+		for i := range commands {
+			if commands[i].Name == name {
+				return &commands[i], args[n:]
+			}
+		}
+	}
+	return nil, args
+}
+
+// Usage 输出全部命令
+func Usage(writer io.Writer) {
+	sorted := append([]Command{}, commands...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for _, command := range sorted {
+		fmt.Fprintf(table, "  %s %s\t%s\n", command.Name, command.Args, command.Summary)
+	}
+	table.Flush()
+}
+
+func (c *Context) flags(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(c.Err)
+	return flags
+}
+
+// print JSON 模式下输出 data,否则按表格输出
+func (c *Context) print(data interface{}, header []string, rows [][]string) error {
+	if c.JSON {
+		encoder := json.NewEncoder(c.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	}
+	table := tabwriter.NewWriter(c.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+	return table.Flush()
+}
+
+// done 没有返回数据的命令在 JSON 模式下输出空对象,方便脚本判断
+func (c *Context) done(format string, args ...interface{}) error {
+	if c.JSON {
+		_, err := fmt.Fprintln(c.Out, "{}")
+		return err
+	}
+	_, err := fmt.Fprintf(c.Out, format+"\n", args...)
+	return err
+}
+
+// open 读取参数指定的文件, - 表示标准输入
+func (c *Context) open(name string) (reader io.ReadCloser, err error) {
+	if name == "-" {
+		return io.NopCloser(c.In), nil
+	}
+	return os.Open(name)
+}
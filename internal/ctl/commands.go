@@ -0,0 +1,590 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"uranus/internal/web/policy"
+	"uranus/internal/web/process"
+	"uranus/internal/web/user"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+)
+
+var commands = []Command{
+	{Name: "module status", Summary: "show module status, process judge and default trust", Run: moduleStatus},
+	{Name: "module enable", Args: "<process|file|net>", Summary: "enable a module", Run: moduleSwitch(true)},
+	{Name: "module disable", Args: "<process|file|net>", Summary: "disable a module", Run: moduleSwitch(false)},
+	{Name: "judge", Args: "[disable|audit|defense]", Summary: "show or change process judge", Run: judge},
+	{Name: "process list", Args: "[-limit n] [-offset n]", Summary: "list process events", Run: processList},
+	{Name: "process trust", Args: "<id>...", Summary: "trust commands", Run: processTrust(statusTrusted)},
+	{Name: "process untrust", Args: "<id>...", Summary: "untrust commands", Run: processTrust(statusUntrusted)},
+	{Name: "file list", Args: "[-limit n] [-offset n]", Summary: "list file policies", Run: fileList},
+	{Name: "file add", Args: "<path> <perm>", Summary: "add a file policy", Run: fileAdd},
+	{Name: "file update", Args: "<id> <perm>", Summary: "update permission of a file policy", Run: fileUpdate},
+	{Name: "file delete", Args: "<id>...", Summary: "delete file policies", Run: fileDelete},
+	{Name: "net list", Args: "[-limit n] [-offset n]", Summary: "list net policies", Run: netList},
+	{Name: "net add", Args: "[flags]", Summary: "add a net policy, ranges are written as begin-end", Run: netAdd},
+	{Name: "net delete", Args: "<id>...", Summary: "delete net policies", Run: netDelete},
+	{Name: "events tail", Args: "[-type process,file,login] [-interval 2s]", Summary: "print new events until interrupted", Run: eventsTail},
+	{Name: "user list", Summary: "list users", Run: userList},
+	{Name: "user add", Args: "[-alias name] [-roles a,b] <username>", Summary: "add a user, password is read from stdin", Run: userAdd},
+	{Name: "user delete", Args: "<id>", Summary: "delete a user", Run: userDelete},
+	{Name: "user passwd", Args: "<username>", Summary: "change password of a user", Run: userPasswd},
+	{Name: "policy export", Args: "[-format yaml|json] [-o file]", Summary: "export the policy document", Run: policyExport},
+	{Name: "policy apply", Args: "[-dry-run] <file|->", Summary: "apply a policy document", Run: policyApply},
+	{Name: "backup create", Summary: "back up the database", Run: backupCreate},
+	{Name: "backup list", Summary: "list backups", Run: backupList},
+	{Name: "backup download", Args: "<name> [file]", Summary: "download a backup", Run: backupDownload},
+	{Name: "backup restore", Args: "<name>", Summary: "restore the database from a backup", Run: backupRestore},
+	{Name: "retention compact", Summary: "switch the database to incremental vacuum and rebuild it once", Run: retentionCompact},
+}
+
+const (
+	statusUntrusted = 1
+	statusTrusted   = 2
+)
+
+var (
+	moduleNames = []string{"process", "file", "net"}
+	judgeNames  = []string{"disable", "audit", "defense"}
+	trustNames  = []string{"pending", "untrusted", "trusted"}
+	switchNames = []string{"disabled", "enabled"}
+	// 文件事件的类型
+	fileKindNames = []string{"access", "reapplied", "removed", "failed"}
+)
+
+func name(names []string, value int) string {
+	if value >= 0 && value < len(names) {
+		return names[value]
+	}
+	return strconv.Itoa(value)
+}
+
+func index(names []string, value string) (int, bool) {
+	for i, name := range names {
+		if name == value {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func ids(args []string) (result []int, err error) {
+	if len(args) == 0 {
+		return nil, ErrUsage
+	}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %s", arg)
+		}
+		result = append(result, id)
+	}
+	return
+}
+
+// page 解析列表命令的分页参数
+func (c *Context) page(command string, args []string) (query url.Values, err error) {
+	flags := c.flags(command)
+	limit := flags.Int("limit", 100, "maximum number of rows, 0 for all")
+	offset := flags.Int("offset", 0, "number of rows to skip")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 0 {
+		return nil, ErrUsage
+	}
+	query = url.Values{}
+	query.Set("limit", strconv.Itoa(*limit))
+	query.Set("offset", strconv.Itoa(*offset))
+	return
+}
+
+type statusBody struct {
+	Status int `json:"status"`
+}
+
+type judgeBody struct {
+	Judge int `json:"judge"`
+}
+
+func moduleStatus(c *Context, args []string) (err error) {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	result := map[string]string{}
+	rows := [][]string{}
+	for _, module := range moduleNames {
+		body := statusBody{}
+		if err = c.Client.Do(http.MethodGet, "/modules/"+module, nil, nil, &body); err != nil {
+			return
+		}
+		result[module] = name(switchNames, body.Status)
+		rows = append(rows, []string{module, result[module]})
+	}
+
+	judge := judgeBody{}
+	if err = c.Client.Do(http.MethodGet, "/modules/process/judge", nil, nil, &judge); err != nil {
+		return
+	}
+	result["judge"] = name(judgeNames, judge.Judge)
+	// 默认信任状态没有设置过时接口返回错误
+	trust := statusBody{}
+	result["trust"] = "unset"
+	if err = c.Client.Do(http.MethodGet, "/modules/process/trust", nil, nil, &trust); err == nil {
+		result["trust"] = name(trustNames, trust.Status)
+	} else if !errors.As(err, new(*StatusError)) {
+		return
+	}
+	rows = append(rows, []string{"process judge", result["judge"]}, []string{"process trust", result["trust"]})
+	return c.print(result, []string{"MODULE", "STATUS"}, rows)
+}
+
+func moduleSwitch(enable bool) func(c *Context, args []string) error {
+	action := "disable"
+	if enable {
+		action = "enable"
+	}
+	return func(c *Context, args []string) (err error) {
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		if _, ok := index(moduleNames, args[0]); !ok {
+			return fmt.Errorf("unknown module: %s", args[0])
+		}
+		if err = c.Client.Do(http.MethodPost, "/modules/"+args[0]+"/"+action, nil, struct{}{}, nil); err != nil {
+			return
+		}
+		return c.done("%s module %sd", args[0], action)
+	}
+}
+
+func judge(c *Context, args []string) (err error) {
+	switch len(args) {
+	case 0:
+		body := judgeBody{}
+		if err = c.Client.Do(http.MethodGet, "/modules/process/judge", nil, nil, &body); err != nil {
+			return
+		}
+		return c.print(body, []string{"JUDGE"}, [][]string{{name(judgeNames, body.Judge)}})
+	case 1:
+		value, ok := index(judgeNames, args[0])
+		if !ok {
+			return fmt.Errorf("unknown judge: %s", args[0])
+		}
+		if err = c.Client.Do(http.MethodPut, "/modules/process/judge", nil, judgeBody{Judge: value}, nil); err != nil {
+			return
+		}
+		return c.done("process judge changed to %s", args[0])
+	}
+	return ErrUsage
+}
+
+func processList(c *Context, args []string) (err error) {
+	query, err := c.page("process list", args)
+	if err != nil {
+		return
+	}
+	events := []process.Event{}
+	if err = c.Client.Do(http.MethodGet, "/events/process", query, nil, &events); err != nil {
+		return
+	}
+	rows := [][]string{}
+	for _, event := range events {
+		rows = append(rows, processRow(event))
+	}
+	return c.print(events, []string{"ID", "STATUS", "JUDGE", "COUNT", "WORKDIR", "ARGV"}, rows)
+}
+
+func processRow(event process.Event) []string {
+	return []string{
+		strconv.FormatUint(event.ID, 10),
+		name(trustNames, int(event.Status)),
+		name(judgeNames, int(event.Judge)),
+		strconv.FormatUint(event.Count, 10),
+		event.Workdir,
+		event.Argv,
+	}
+}
+
+func processTrust(status int) func(c *Context, args []string) error {
+	return func(c *Context, args []string) (err error) {
+		list, err := ids(args)
+		if err != nil {
+			return
+		}
+		for _, id := range list {
+			if err = c.Client.Do(http.MethodPut, fmt.Sprintf("/policies/process/%d", id), nil, statusBody{Status: status}, nil); err != nil {
+				return fmt.Errorf("process %d: %w", id, err)
+			}
+		}
+		return c.done("%d command(s) marked as %s", len(list), name(trustNames, status))
+	}
+}
+
+func fileList(c *Context, args []string) (err error) {
+	query, err := c.page("file list", args)
+	if err != nil {
+		return
+	}
+	policies := []file.Policy{}
+	if err = c.Client.Do(http.MethodGet, "/policies/file", query, nil, &policies); err != nil {
+		return
+	}
+	rows := [][]string{}
+	for _, policy := range policies {
+		rows = append(rows, []string{
+			strconv.FormatUint(policy.ID, 10),
+			strconv.Itoa(policy.Perm),
+			strconv.Itoa(policy.Status),
+			time.Unix(policy.Timestamp, 0).Format(time.RFC3339),
+			policy.Path,
+		})
+	}
+	return c.print(policies, []string{"ID", "PERM", "STATUS", "UPDATED", "PATH"}, rows)
+}
+
+type filePolicyBody struct {
+	Path string `json:"path,omitempty"`
+	Perm int    `json:"perm"`
+}
+
+func fileAdd(c *Context, args []string) (err error) {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+	perm, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid perm: %s", args[1])
+	}
+	if err = c.Client.Do(http.MethodPost, "/policies/file", nil, filePolicyBody{Path: args[0], Perm: perm}, nil); err != nil {
+		return
+	}
+	return c.done("file policy added")
+}
+
+func fileUpdate(c *Context, args []string) (err error) {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid id: %s", args[0])
+	}
+	perm, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid perm: %s", args[1])
+	}
+	if err = c.Client.Do(http.MethodPut, fmt.Sprintf("/policies/file/%d", id), nil, filePolicyBody{Perm: perm}, nil); err != nil {
+		return
+	}
+	return c.done("file policy updated")
+}
+
+func fileDelete(c *Context, args []string) (err error) {
+	list, err := ids(args)
+	if err != nil {
+		return
+	}
+	for _, id := range list {
+		if err = c.Client.Do(http.MethodDelete, fmt.Sprintf("/policies/file/%d", id), nil, nil, nil); err != nil {
+			return fmt.Errorf("file policy %d: %w", id, err)
+		}
+	}
+	return c.done("%d file policy(s) deleted", len(list))
+}
+
+func netList(c *Context, args []string) (err error) {
+	query, err := c.page("net list", args)
+	if err != nil {
+		return
+	}
+	policies := []net.Policy{}
+	if err = c.Client.Do(http.MethodGet, "/policies/net", query, nil, &policies); err != nil {
+		return
+	}
+	rows := [][]string{}
+	for _, p := range policies {
+		rows = append(rows, []string{
+			strconv.FormatInt(p.ID, 10),
+			strconv.Itoa(int(p.Priority)),
+			p.Addr.Src.Begin + "-" + p.Addr.Src.End,
+			p.Addr.Dst.Begin + "-" + p.Addr.Dst.End,
+			fmt.Sprintf("%d-%d", p.Protocol.Begin, p.Protocol.End),
+			fmt.Sprintf("%d-%d", p.Port.Src.Begin, p.Port.Src.End),
+			fmt.Sprintf("%d-%d", p.Port.Dst.Begin, p.Port.Dst.End),
+			strconv.Itoa(int(p.Flags)),
+			strconv.FormatUint(uint64(p.Response), 10),
+		})
+	}
+	return c.print(policies, []string{"ID", "PRIORITY", "SRC", "DST", "PROTOCOL", "SPORT", "DPORT", "FLAGS", "RESPONSE"}, rows)
+}
+
+// split 把 begin-end 或单个值拆分为范围
+func split(value string) (begin, end string) {
+	if i := strings.LastIndex(value, "-"); i > 0 {
+		return value[:i], value[i+1:]
+	}
+	return value, value
+}
+
+func numberRange(name, value string, bits int) (begin, end uint64, err error) {
+	b, e := split(value)
+	if begin, err = strconv.ParseUint(b, 10, bits); err != nil {
+		return 0, 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	if end, err = strconv.ParseUint(e, 10, bits); err != nil {
+		return 0, 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return
+}
+
+func netAdd(c *Context, args []string) (err error) {
+	flags := c.flags("net add")
+	priority := flags.Int("priority", 0, "priority, -128 to 127")
+	src := flags.String("src", "0.0.0.0-255.255.255.255", "source address range")
+	dst := flags.String("dst", "0.0.0.0-255.255.255.255", "destination address range")
+	protocol := flags.String("protocol", "0-255", "protocol range")
+	sport := flags.String("sport", "0-65535", "source port range")
+	dport := flags.String("dport", "0-65535", "destination port range")
+	flag := flags.Int("flags", 0, "policy flags")
+	response := flags.Uint("response", 0, "response")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 0 || *priority < -128 || *priority > 127 {
+		return ErrUsage
+	}
+
+	policy := net.Policy{Priority: int8(*priority), Flags: int32(*flag), Response: uint32(*response)}
+	policy.Addr.Src.Begin, policy.Addr.Src.End = split(*src)
+	policy.Addr.Dst.Begin, policy.Addr.Dst.End = split(*dst)
+	begin, end, err := numberRange("protocol", *protocol, 8)
+	if err != nil {
+		return
+	}
+	policy.Protocol.Begin, policy.Protocol.End = uint8(begin), uint8(end)
+	if begin, end, err = numberRange("sport", *sport, 16); err != nil {
+		return
+	}
+	policy.Port.Src.Begin, policy.Port.Src.End = uint16(begin), uint16(end)
+	if begin, end, err = numberRange("dport", *dport, 16); err != nil {
+		return
+	}
+	policy.Port.Dst.Begin, policy.Port.Dst.End = uint16(begin), uint16(end)
+
+	if err = c.Client.Do(http.MethodPost, "/policies/net", nil, policy, nil); err != nil {
+		return
+	}
+	return c.done("net policy added")
+}
+
+func netDelete(c *Context, args []string) (err error) {
+	list, err := ids(args)
+	if err != nil {
+		return
+	}
+	for _, id := range list {
+		if err = c.Client.Do(http.MethodDelete, fmt.Sprintf("/policies/net/%d", id), nil, nil, nil); err != nil {
+			return fmt.Errorf("net policy %d: %w", id, err)
+		}
+	}
+	return c.done("%d net policy(s) deleted", len(list))
+}
+
+func userList(c *Context, args []string) (err error) {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	users := []user.User{}
+	if err = c.Client.Do(http.MethodGet, "/users", nil, nil, &users); err != nil {
+		return
+	}
+	rows := [][]string{}
+	for _, u := range users {
+		rows = append(rows, []string{strconv.FormatUint(u.UserID, 10), u.Username, u.AliasName, strings.Join(u.Roles, ",")})
+	}
+	return c.print(users, []string{"ID", "USERNAME", "ALIAS", "ROLES"}, rows)
+}
+
+type userBody struct {
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	AliasName   string   `json:"aliasName"`
+	Permissions string   `json:"permissions,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+}
+
+func userAdd(c *Context, args []string) (err error) {
+	flags := c.flags("user add")
+	alias := flags.String("alias", "", "display name, defaults to username")
+	roles := flags.String("roles", "", "comma separated roles")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		return ErrUsage
+	}
+
+	body := userBody{Username: flags.Arg(0), AliasName: *alias}
+	if body.AliasName == "" {
+		body.AliasName = body.Username
+	}
+	if *roles != "" {
+		body.Roles = strings.Split(*roles, ",")
+	}
+	if body.Password, err = c.readPassword(); err != nil {
+		return
+	}
+	if err = c.Client.Do(http.MethodPost, "/users", nil, body, nil); err != nil {
+		return
+	}
+	return c.done("user %s added", body.Username)
+}
+
+func userDelete(c *Context, args []string) (err error) {
+	list, err := ids(args)
+	if err != nil {
+		return
+	}
+	if len(list) != 1 {
+		return ErrUsage
+	}
+	if err = c.Client.Do(http.MethodDelete, fmt.Sprintf("/users/%d", list[0]), nil, nil, nil); err != nil {
+		return
+	}
+	return c.done("user %d deleted", list[0])
+}
+
+// userPasswd 更新接口需要完整的用户信息,先查询再修改密码,角色保持不变
+func userPasswd(c *Context, args []string) (err error) {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	users := []user.User{}
+	if err = c.Client.Do(http.MethodGet, "/users", nil, nil, &users); err != nil {
+		return
+	}
+	for _, u := range users {
+		if u.Username != args[0] {
+			continue
+		}
+		body := userBody{Username: u.Username, AliasName: u.AliasName, Permissions: u.Permissions}
+		if body.Password, err = c.readPassword(); err != nil {
+			return
+		}
+		if err = c.Client.Do(http.MethodPut, fmt.Sprintf("/users/%d", u.UserID), nil, body, nil); err != nil {
+			return
+		}
+		return c.done("password of %s changed", u.Username)
+	}
+	return fmt.Errorf("user not found: %s", args[0])
+}
+
+func policyExport(c *Context, args []string) (err error) {
+	flags := c.flags("policy export")
+	format := flags.String("format", policy.FormatYAML, "yaml or json")
+	output := flags.String("o", "-", "output file, - for stdout")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 0 {
+		return ErrUsage
+	}
+
+	writer := c.Out
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		writer = f
+	}
+	return c.Client.Download("/policies/document", url.Values{"format": {*format}}, writer)
+}
+
+func policyApply(c *Context, args []string) (err error) {
+	flags := c.flags("policy apply")
+	dryRun := flags.Bool("dry-run", false, "only show changes")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 1 {
+		return ErrUsage
+	}
+
+	reader, err := c.open(flags.Arg(0))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	query := url.Values{}
+	if *dryRun {
+		query.Set("dryRun", "true")
+	}
+	response, err := c.Client.request(http.MethodPut, "/policies/document", query, reader, "application/yaml")
+	if err != nil {
+		return
+	}
+	changes := []policy.Change{}
+	err = decode(response, &changes)
+
+	// 修改失败时也输出全部修改,每一项的执行结果和失败原因
+	var status *StatusError
+	if errors.As(err, &status) && len(status.Data) != 0 && status.Data[0] == '[' {
+		if decode := json.Unmarshal(status.Data, &changes); decode != nil {
+			return err
+		}
+	} else if err != nil {
+		return
+	}
+
+	rows := [][]string{}
+	for _, change := range changes {
+		rows = append(rows, []string{change.Target, change.Action, change.Key, value(change.Before), value(change.After), result(change, *dryRun)})
+	}
+	if printErr := c.print(changes, []string{"TARGET", "ACTION", "KEY", "BEFORE", "AFTER", "RESULT"}, rows); printErr != nil {
+		return printErr
+	}
+	if err == nil && !c.JSON && len(changes) == 0 {
+		fmt.Fprintln(c.Err, "no changes")
+	}
+	return
+}
+
+// result 失败后剩余的修改没有执行
+func result(change policy.Change, dryRun bool) string {
+	switch {
+	case dryRun:
+		return "-"
+	case change.Error != "":
+		return change.Error
+	case change.Applied:
+		return "applied"
+	}
+	return "skipped"
+}
+
+func value(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	if number, ok := v.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(content)
+}
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"uranus/internal/web/process"
+	"uranus/internal/web/user"
+	"uranus/pkg/file"
+)
+
+// 每次轮询最多读取的事件数量
+const tailBatch = 500
+
+// tailer 记录每种事件已经输出的位置
+type tailer interface {
+	// skip 跳过已有的事件
+	skip(c *Context) error
+	poll(c *Context) error
+}
+
+// tailEvent JSON 模式下每行输出一个事件
+type tailEvent struct {
+	Type  string      `json:"type"`
+	Event interface{} `json:"event"`
+}
+
+func (c *Context) emit(kind string, event interface{}, text string) error {
+	if c.JSON {
+		content, err := json.Marshal(tailEvent{Type: kind, Event: event})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.Out, string(content))
+		return err
+	}
+	_, err := fmt.Fprintf(c.Out, "%s %-7s %s\n", time.Now().Format(time.RFC3339), kind, text)
+	return err
+}
+
+// offsetTailer 进程和文件事件按插入顺序查询,根据偏移量读取新事件
+type offsetTailer struct {
+	path   string
+	offset int
+	// 解析并输出一页事件,返回事件数量
+	print func(c *Context, data json.RawMessage) (n int, err error)
+}
+
+func (t *offsetTailer) fetch(c *Context, print bool) (n int, err error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(tailBatch))
+	query.Set("offset", strconv.Itoa(t.offset))
+	data := json.RawMessage{}
+	if err = c.Client.Do(http.MethodGet, t.path, query, nil, &data); err != nil {
+		return
+	}
+	if print {
+		n, err = t.print(c, data)
+	} else {
+		events := []json.RawMessage{}
+		err = json.Unmarshal(data, &events)
+		n = len(events)
+	}
+	t.offset += n
+	return
+}
+
+func (t *offsetTailer) skip(c *Context) (err error) {
+	for n := tailBatch; n == tailBatch; {
+		if n, err = t.fetch(c, false); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (t *offsetTailer) poll(c *Context) (err error) {
+	for n := tailBatch; n == tailBatch; {
+		if n, err = t.fetch(c, true); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func printProcessEvents(c *Context, data json.RawMessage) (n int, err error) {
+	events := []process.Event{}
+	if err = json.Unmarshal(data, &events); err != nil {
+		return
+	}
+	for _, event := range events {
+		text := fmt.Sprintf("id=%d judge=%s status=%s workdir=%s argv=%s",
+			event.ID, name(judgeNames, int(event.Judge)), name(trustNames, int(event.Status)), event.Workdir, event.Argv)
+		if err = c.emit("process", event, text); err != nil {
+			return
+		}
+	}
+	return len(events), nil
+}
+
+func printFileEvents(c *Context, data json.RawMessage) (n int, err error) {
+	events := []file.Event{}
+	if err = json.Unmarshal(data, &events); err != nil {
+		return
+	}
+	for _, event := range events {
+		text := fmt.Sprintf("id=%d kind=%s perm=%d policy=%d path=%s", event.ID, name(fileKindNames, event.Kind), event.Perm, event.Policy, event.Path)
+		if err = c.emit("file", event, text); err != nil {
+			return
+		}
+	}
+	return len(events), nil
+}
+
+// loginTailer 登录事件按 ID 倒序查询,记录已经输出的最大 ID
+type loginTailer struct {
+	last uint64
+}
+
+func (t *loginTailer) latest(c *Context) (events []user.LoginEvent, err error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(tailBatch))
+	query.Set("offset", "0")
+	err = c.Client.Do(http.MethodGet, "/events/login", query, nil, &events)
+	return
+}
+
+func (t *loginTailer) skip(c *Context) (err error) {
+	events, err := t.latest(c)
+	if err == nil && len(events) != 0 {
+		t.last = events[0].ID
+	}
+	return
+}
+
+func (t *loginTailer) poll(c *Context) (err error) {
+	events, err := t.latest(c)
+	if err != nil {
+		return
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if event.ID <= t.last {
+			continue
+		}
+		text := fmt.Sprintf("id=%d username=%s addr=%s status=%d locked=%t", event.ID, event.Username, event.Addr, event.Status, event.Locked)
+		if err = c.emit("login", event, text); err != nil {
+			return
+		}
+		t.last = event.ID
+	}
+	return
+}
+
+// eventsTail 只输出启动之后产生的事件
+func eventsTail(c *Context, args []string) (err error) {
+	flags := c.flags("events tail")
+	types := flags.String("type", "process,file,login", "comma separated event types")
+	interval := flags.Duration("interval", 2*time.Second, "polling interval")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() != 0 || *interval <= 0 {
+		return ErrUsage
+	}
+
+	tailers := []tailer{}
+	for _, kind := range strings.Split(*types, ",") {
+		switch kind {
+		case "process":
+			tailers = append(tailers, &offsetTailer{path: "/events/process", print: printProcessEvents})
+		case "file":
+			tailers = append(tailers, &offsetTailer{path: "/events/file", print: printFileEvents})
+		case "login":
+			tailers = append(tailers, &loginTailer{})
+		default:
+			return fmt.Errorf("unknown event type: %s", kind)
+		}
+	}
+
+	for _, t := range tailers {
+		if err = t.skip(c); err != nil {
+			return
+		}
+	}
+	for {
+		time.Sleep(*interval)
+		for _, t := range tailers {
+			if err = t.poll(c); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"net/http"
+)
+
+// retentionCompact 整理期间 uranus-web 的写入会等待,数据库较大时可能需要较长时间
+func retentionCompact(c *Context, args []string) (err error) {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	response := struct {
+		Reclaimed int64 `json:"reclaimed"`
+	}{}
+	if err = c.Client.Do(http.MethodPost, "/retention/compact", nil, nil, &response); err != nil {
+		return
+	}
+	if c.JSON {
+		return c.print(response, nil, nil)
+	}
+	return c.done("database compacted, %d free pages reclaimed", response.Reclaimed)
+}
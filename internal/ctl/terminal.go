@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package ctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var errPasswordMismatch = errors.New("passwords do not match")
+
+// readLine 标准输入是终端时关闭回显
+func (c *Context) readLine(prompt string) (line string, err error) {
+	fmt.Fprint(c.Err, prompt)
+	if file, ok := c.In.(*os.File); ok {
+		fd := int(file.Fd())
+		if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+			silent := *termios
+			silent.Lflag &^= unix.ECHO
+			if err := unix.IoctlSetTermios(fd, unix.TCSETS, &silent); err == nil {
+				defer func() {
+					unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+					fmt.Fprintln(c.Err)
+				}()
+			}
+		}
+	}
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.In)
+	}
+	line, err = c.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readPassword 终端中输入两次确认,管道输入时只读取一行
+func (c *Context) readPassword() (password string, err error) {
+	if password, err = c.readLine("Password: "); err != nil {
+		return
+	}
+	file, ok := c.In.(*os.File)
+	if !ok {
+		return
+	}
+	if _, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS); err != nil {
+		return password, nil
+	}
+	again, err := c.readLine("Retype password: ")
+	if err != nil {
+		return
+	}
+	if again != password {
+		err = errPasswordMismatch
+	}
+	return
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package migration
+
+import (
+	"fmt"
+	"time"
+	"uranus/internal/storage"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sqlCreateMigrationTable = `create table if not exists schema_migration(version integer primary key, name text not null, timestamp integer not null)`
+	sqlQueryVersion         = `select coalesce(max(version),0) from schema_migration`
+	sqlInsertMigration      = `insert into schema_migration(version,name,timestamp) values(?,?,?)`
+)
+
+// Migration 一次数据库结构变更.已经发布的迁移不能修改,新的变更追加到 migrations 末尾
+type Migration struct {
+	Version int
+	Name    string
+	// 在同一个事务中依次执行, Postgres 为 PostgreSQL 中执行的等价语句
+	Statements []string
+	Postgres   []string
+}
+
+// NewerSchemaError 数据库由更新版本的程序迁移过,当前程序无法保证兼容
+type NewerSchemaError struct {
+	Current int
+	Latest  int
+}
+
+func (e *NewerSchemaError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than supported version %d", e.Current, e.Latest)
+}
+
+// Latest 返回当前程序支持的最新版本
+func Latest() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Version 返回数据库已经执行的最新迁移版本
+func Version(db *storage.DB) (version int, err error) {
+	err = db.QueryRow(sqlQueryVersion).Scan(&version)
+	return
+}
+
+// Migrate 在各模块初始化之前调用,依次执行数据库中还没有执行的迁移
+func Migrate(db *storage.DB) (err error) {
+	if _, err = db.Exec(sqlCreateMigrationTable); err != nil {
+		return
+	}
+	current, err := Version(db)
+	if err != nil {
+		return
+	}
+	if current > Latest() {
+		return &NewerSchemaError{Current: current, Latest: Latest()}
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err = apply(db, m); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		logrus.Infof("database schema migrated to version %d: %s", m.Version, m.Name)
+	}
+	return
+}
+
+func apply(db *storage.DB, m Migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	statements := m.Statements
+	if db.Postgres() {
+		statements = m.Postgres
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			return
+		}
+	}
+	if _, err = tx.Exec(sqlInsertMigration, m.Version, m.Name, time.Now().Unix()); err != nil {
+		return
+	}
+	return tx.Commit()
+}
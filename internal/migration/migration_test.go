@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package migration
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"uranus/internal/storage"
+)
+
+// 引入迁移之前各模块初始化时创建的表,与 ecace2c 中的语句相同
+var baselineStatements = []string{
+	`create table if not exists config(id integer primary key autoincrement, key text not null unique, integer integer, real real, text text)`,
+	`create table if not exists user(id integer primary key autoincrement, username text not null unique, salt text not null, password text not null, alias text, permissions text)`,
+	`create table if not exists process_event(id integer primary key autoincrement, cmd blob not null unique, workdir text not null, binary text not null, argv text not null, count integer not null, judge integer not null, status integer not null)`,
+	`create table if not exists file_policy(id integer primary key autoincrement, path text not null, fsid integer, ino integer, perm integer not null, timestamp integer not null, status integer not null)`,
+	`create table if not exists file_event(id integer primary key autoincrement, path text not null, fsid integer, ino integer, perm integer not null, timestamp integer not null, policy integer not null, status integer not null)`,
+	`create table if not exists net_policy(id integer primary key autoincrement, priority int8, addr_src_begin text, addr_src_end text, addr_dst_begin text, addr_dst_end text, protocol_begin int, protocol_end int, port_src_begin int, port_src_end int, port_dst_begin int, port_dst_end int, flags int, response int)`,
+
+	`insert into config(key,integer) values('file module status',1)`,
+	`insert into user(username,salt,password,alias,permissions) values('admin','salt','hash','A','{*}')`,
+	`insert into process_event(cmd,workdir,binary,argv,count,judge,status) values('ls','/','/bin/ls','ls',3,1,0)`,
+	`insert into file_policy(path,fsid,ino,perm,timestamp,status) values('/etc/passwd',1,2,2,100,1)`,
+	`insert into file_event(path,fsid,ino,perm,timestamp,policy,status) values('/etc/passwd',1,2,2,200,1,0)`,
+	`insert into net_policy(priority,addr_src_begin,protocol_begin,flags,response) values(1,'10.0.0.1',6,0,1)`,
+}
+
+func newTestDB(t *testing.T) *storage.DB {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "web.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func count(t *testing.T, db *storage.DB, query string, args ...interface{}) (n int) {
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// 已有的部署没有 schema_migration 表,迁移后保留原来的数据并添加新的列
+func TestMigrateBaseline(t *testing.T) {
+	db := newTestDB(t)
+	for _, statement := range baselineStatements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	version, err := Version(db)
+	if err != nil || version != Latest() {
+		t.Fatalf("version=%d err=%v", version, err)
+	}
+	if n := count(t, db, `select count(*) from schema_migration`); n != len(migrations) {
+		t.Errorf("schema_migration rows=%d", n)
+	}
+
+	columns := []struct {
+		table  string
+		column string
+	}{
+		{"process_event", "timestamp"},
+		{"file_event", "count"},
+		{"file_event", "first"},
+		{"file_event", "suppressed"},
+		{"file_event", "kind"},
+		{"file_policy", "kind"},
+		{"file_policy", "parent"},
+		{"token", "totp"},
+		{"session", "totp"},
+	}
+	for _, c := range columns {
+		if n := count(t, db, `select count(*) from pragma_table_info(?) where name=?`, c.table, c.column); n != 1 {
+			t.Errorf("%s.%s missing", c.table, c.column)
+		}
+	}
+
+	if n := count(t, db, `select count(*) from user where username='admin'`); n != 1 {
+		t.Errorf("user lost")
+	}
+	if n := count(t, db, `select count(*) from process_event where cmd='ls' and count=3 and timestamp>0`); n != 1 {
+		t.Errorf("process event timestamp not set")
+	}
+	if n := count(t, db, `select count(*) from file_event where first=200 and count=1 and kind=0`); n != 1 {
+		t.Errorf("file event first not set")
+	}
+	if n := count(t, db, `select count(*) from file_policy where kind=0 and parent=0`); n != 1 {
+		t.Errorf("file policy lost")
+	}
+	if n := count(t, db, `select count(*) from net_policy`); n != 1 {
+		t.Errorf("net policy lost")
+	}
+
+	// 再次执行时没有需要执行的迁移
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, `select count(*) from schema_migration`); n != len(migrations) {
+		t.Errorf("schema_migration rows=%d after second run", n)
+	}
+}
+
+// 数据库由更新版本的程序迁移过时拒绝启动,不修改数据库
+func TestMigrateNewerSchema(t *testing.T) {
+	db := newTestDB(t)
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(sqlInsertMigration, Latest()+1, "future", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Migrate(db)
+	var newer *NewerSchemaError
+	if !errors.As(err, &newer) || newer.Current != Latest()+1 || newer.Latest != Latest() {
+		t.Fatalf("err=%v", err)
+	}
+}
+
+// 迁移中的语句失败时回滚整个迁移,版本停留在上一个成功的迁移
+func TestMigrateRollback(t *testing.T) {
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	migrations = []Migration{
+		{Version: 1, Name: "first", Statements: []string{`create table a(id integer primary key)`}},
+		{Version: 2, Name: "broken", Statements: []string{
+			`create table b(id integer primary key)`,
+			`insert into a(id) values(1)`,
+			`alter table missing add column x integer`,
+		}},
+		{Version: 3, Name: "after", Statements: []string{`create table c(id integer primary key)`}},
+	}
+
+	db := newTestDB(t)
+	if err := Migrate(db); err == nil {
+		t.Fatal("broken migration succeeded")
+	}
+	if version, err := Version(db); err != nil || version != 1 {
+		t.Fatalf("version=%d err=%v", version, err)
+	}
+	for _, table := range []string{"b", "c"} {
+		if n := count(t, db, `select count(*) from sqlite_master where type='table' and name=?`, table); n != 0 {
+			t.Errorf("table %s created", table)
+		}
+	}
+	if n := count(t, db, `select count(*) from a`); n != 0 {
+		t.Errorf("insert not rolled back")
+	}
+
+	// 修复迁移后从失败的版本继续执行
+	migrations[1].Statements = migrations[1].Statements[:2]
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := Version(db); err != nil || version != 3 {
+		t.Fatalf("version=%d err=%v", version, err)
+	}
+}
@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package migration
+
+// migrations 按版本号递增排列
+var migrations = []Migration{
+	{
+		// 引入迁移之前各模块初始化时创建的表,已有的部署中这些表已经存在
+		Version: 1,
+		Name:    "baseline",
+		Statements: []string{
+			`create table if not exists config(id integer primary key autoincrement, key text not null unique, integer integer, real real, text text)`,
+
+			`create table if not exists user(id integer primary key autoincrement, username text not null unique, salt text not null, password text not null, alias text, permissions text)`,
+			`create table if not exists password_history(id integer primary key autoincrement, user integer not null, salt text not null, password text not null, timestamp integer not null)`,
+			`create table if not exists session(id integer primary key autoincrement, token text not null unique, user integer not null, addr text not null, agent text not null, created integer not null, accessed integer not null, totp integer not null default 0)`,
+			`create table if not exists role(id integer primary key autoincrement, name text not null unique, permissions text not null, builtin integer not null, totp integer not null default 0)`,
+			`create table if not exists user_role(user integer not null, role integer not null, primary key(user, role))`,
+			`create table if not exists login_event(id integer primary key autoincrement, username text not null, addr text not null, agent text not null, timestamp integer not null, locked integer not null, status integer not null)`,
+			`create table if not exists token(id integer primary key autoincrement, user integer not null, name text not null, token text not null unique, permissions text not null, created integer not null, expires integer not null, used integer not null)`,
+			`create table if not exists totp(user integer primary key, secret text not null, enabled integer not null, step integer not null)`,
+			`create table if not exists recovery_code(id integer primary key autoincrement, user integer not null, code text not null)`,
+
+			`create table if not exists audit_log(id integer primary key autoincrement, timestamp integer not null, username text not null, token integer not null, addr text not null, method text not null, route text not null, path text not null, status integer not null, changes text not null, hackernel integer, error text not null)`,
+			`create table if not exists health(id integer primary key, timestamp integer not null)`,
+
+			`create table if not exists process_event(id integer primary key autoincrement, cmd blob not null unique, workdir text not null, binary text not null, argv text not null, count integer not null, judge integer not null, status integer not null)`,
+			`create unique index if not exists process_cmd_idx on process_event (cmd)`,
+			`create table if not exists process_hourly(hour integer primary key, count integer not null)`,
+
+			`create table if not exists file_policy(id integer primary key autoincrement, path text not null, fsid integer, ino integer, perm integer not null, timestamp integer not null, status integer not null)`,
+			`create table if not exists file_event(id integer primary key autoincrement, path text not null, fsid integer, ino integer, perm integer not null, timestamp integer not null, policy integer not null, status integer not null)`,
+			`create index if not exists file_event_timestamp_idx on file_event (timestamp)`,
+
+			`create table if not exists net_policy(id integer primary key autoincrement, priority int8, addr_src_begin text, addr_src_end text, addr_dst_begin text, addr_dst_end text, protocol_begin int, protocol_end int, port_src_begin int, port_src_end int, port_dst_begin int, port_dst_end int, flags int, response int)`,
+		},
+		// PostgreSQL 中 user 和 binary 是保留字,命令按文本保存
+		Postgres: []string{
+			`create table if not exists config(id bigserial primary key, key text not null unique, integer bigint, real double precision, text text)`,
+
+			`create table if not exists "user"(id bigserial primary key, username text not null unique, salt text not null, password text not null, alias text, permissions text)`,
+			`create table if not exists password_history(id bigserial primary key, "user" bigint not null, salt text not null, password text not null, timestamp bigint not null)`,
+			`create table if not exists session(id bigserial primary key, token text not null unique, "user" bigint not null, addr text not null, agent text not null, created bigint not null, accessed bigint not null, totp integer not null default 0)`,
+			`create table if not exists role(id bigserial primary key, name text not null unique, permissions text not null, builtin integer not null, totp integer not null default 0)`,
+			`create table if not exists user_role("user" bigint not null, role bigint not null, primary key("user", role))`,
+			`create table if not exists login_event(id bigserial primary key, username text not null, addr text not null, agent text not null, timestamp bigint not null, locked integer not null, status integer not null)`,
+			`create table if not exists token(id bigserial primary key, "user" bigint not null, name text not null, token text not null unique, permissions text not null, created bigint not null, expires bigint not null, used bigint not null)`,
+			`create table if not exists totp("user" bigint primary key, secret text not null, enabled integer not null, step bigint not null)`,
+			`create table if not exists recovery_code(id bigserial primary key, "user" bigint not null, code text not null)`,
+
+			`create table if not exists audit_log(id bigserial primary key, timestamp bigint not null, username text not null, token bigint not null, addr text not null, method text not null, route text not null, path text not null, status integer not null, changes text not null, hackernel integer, error text not null)`,
+			`create table if not exists health(id bigserial primary key, timestamp bigint not null)`,
+
+			`create table if not exists process_event(id bigserial primary key, cmd text not null unique, workdir text not null, "binary" text not null, argv text not null, count bigint not null, judge integer not null, status integer not null)`,
+			`create unique index if not exists process_cmd_idx on process_event (cmd)`,
+			`create table if not exists process_hourly(hour bigint primary key, count bigint not null)`,
+
+			`create table if not exists file_policy(id bigserial primary key, path text not null, fsid bigint, ino bigint, perm integer not null, timestamp bigint not null, status integer not null)`,
+			`create table if not exists file_event(id bigserial primary key, path text not null, fsid bigint, ino bigint, perm integer not null, timestamp bigint not null, policy bigint not null, status integer not null)`,
+			`create index if not exists file_event_timestamp_idx on file_event (timestamp)`,
+
+			`create table if not exists net_policy(id bigserial primary key, priority smallint, addr_src_begin text, addr_src_end text, addr_dst_begin text, addr_dst_end text, protocol_begin integer, protocol_end integer, port_src_begin integer, port_src_end integer, port_dst_begin integer, port_dst_end integer, flags integer, response bigint)`,
+		},
+	},
+	{
+		// 最近一次执行的时间,用于按时间清理事件.已有的记录从升级时开始计算
+		Version: 2,
+		Name:    "process event timestamp",
+		Statements: []string{
+			`alter table process_event add column timestamp integer not null default 0`,
+			`update process_event set timestamp=strftime('%s','now')`,
+			`create index if not exists process_event_timestamp_idx on process_event (timestamp)`,
+		},
+		Postgres: []string{
+			`alter table process_event add column timestamp bigint not null default 0`,
+			`update process_event set timestamp=extract(epoch from now())::bigint`,
+			`create index if not exists process_event_timestamp_idx on process_event (timestamp)`,
+		},
+	},
+	{
+		// 文件事件去重后一行对应多次访问, timestamp 为最后一次访问的时间, first 为第一次访问的时间.
+		// suppressed 为该行之后因限流没有记录的访问次数
+		Version: 3,
+		Name:    "file event deduplication",
+		Statements: []string{
+			`alter table file_event add column count integer not null default 1`,
+			`alter table file_event add column first integer not null default 0`,
+			`alter table file_event add column suppressed integer not null default 0`,
+			`update file_event set first=timestamp`,
+			`create index if not exists file_event_policy_idx on file_event (policy, path)`,
+		},
+		Postgres: []string{
+			`alter table file_event add column count bigint not null default 1`,
+			`alter table file_event add column first bigint not null default 0`,
+			`alter table file_event add column suppressed bigint not null default 0`,
+			`update file_event set first=timestamp`,
+			`create index if not exists file_event_policy_idx on file_event (policy, path)`,
+		},
+	},
+	{
+		// 目录和通配符策略的 kind 不为 0, fsid 和 ino 为 0,展开的子策略中 parent 为所属策略的 id
+		Version: 4,
+		Name:    "file policy pattern",
+		Statements: []string{
+			`alter table file_policy add column kind integer not null default 0`,
+			`alter table file_policy add column parent integer not null default 0`,
+			`create index if not exists file_policy_parent_idx on file_policy (parent)`,
+		},
+		Postgres: []string{
+			`alter table file_policy add column kind integer not null default 0`,
+			`alter table file_policy add column parent bigint not null default 0`,
+			`create index if not exists file_policy_parent_idx on file_policy (parent)`,
+		},
+	},
+	{
+		// 策略跟踪重新设置策略时写入的告警, kind 为 0 的是 hackernel 上报的访问
+		Version:    5,
+		Name:       "file event kind",
+		Statements: []string{`alter table file_event add column kind integer not null default 0`},
+		Postgres:   []string{`alter table file_event add column kind integer not null default 0`},
+	},
+	{
+		// 合并文件事件时按以下列查找最近的一行, (policy, path) 是它的前缀,不再需要
+		Version: 6,
+		Name:    "file event merge index",
+		Statements: []string{
+			`create index if not exists file_event_merge_idx on file_event (policy, path, perm, kind, status, first)`,
+			`drop index if exists file_event_policy_idx`,
+		},
+		Postgres: []string{
+			`create index if not exists file_event_merge_idx on file_event (policy, path, perm, kind, status, first)`,
+			`drop index if exists file_event_policy_idx`,
+		},
+	},
+	{
+		// 展开目录和通配符策略时按路径查找已经保护的文件
+		Version:    7,
+		Name:       "file policy path index",
+		Statements: []string{`create index if not exists file_policy_path_idx on file_policy (path)`},
+		Postgres:   []string{`create index if not exists file_policy_path_idx on file_policy (path)`},
+	},
+	{
+		// 令牌创建时是否通过了两步验证,与会话相同,角色要求两步验证时未通过的令牌不能访问需要权限的接口.
+		// 已有的令牌视为未通过,角色要求两步验证的用户需要重新创建令牌
+		Version:    8,
+		Name:       "token totp",
+		Statements: []string{`alter table token add column totp integer not null default 0`},
+		Postgres:   []string{`alter table token add column totp integer not null default 0`},
+	},
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+const (
+	sqlInsertInteger = `insert into config(key,integer) values(?,?)`
+	sqlUpdateInteger = `update config set integer=? where key=?`
+	sqlQueryInteger  = `select integer from config where key=?`
+	sqlInsertReal    = `insert into config(key,real) values(?,?)`
+	sqlUpdateReal    = `update config set real=? where key=?`
+	sqlQueryReal     = `select real from config where key=?`
+	sqlInsertText    = `insert into config(key,text) values(?,?)`
+	sqlUpdateText    = `update config set text=? where key=?`
+	sqlQueryText     = `select text from config where key=?`
+)
+
+type configRepository struct {
+	db *DB
+}
+
+func NewConfigRepository(db *DB) ConfigRepository {
+	return &configRepository{db: db}
+}
+
+// set 先更新,没有更新任何行时插入
+func (r *configRepository) set(update, insert, key string, value interface{}) (err error) {
+	stmt, err := r.db.Prepare(update)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(value, key)
+	if err != nil {
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected != 0 {
+		return
+	}
+
+	stmt, err = r.db.Prepare(insert)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(key, value)
+	return
+}
+
+func (r *configRepository) get(query, key string, value interface{}) (err error) {
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(key).Scan(value)
+	return
+}
+
+func (r *configRepository) SetInteger(key string, value int) (err error) {
+	return r.set(sqlUpdateInteger, sqlInsertInteger, key, value)
+}
+
+func (r *configRepository) GetInteger(key string) (value int, err error) {
+	err = r.get(sqlQueryInteger, key, &value)
+	return
+}
+
+func (r *configRepository) SetReal(key string, value float64) (err error) {
+	return r.set(sqlUpdateReal, sqlInsertReal, key, value)
+}
+
+func (r *configRepository) GetReal(key string) (value float64, err error) {
+	err = r.get(sqlQueryReal, key, &value)
+	return
+}
+
+func (r *configRepository) SetText(key string, value string) (err error) {
+	return r.set(sqlUpdateText, sqlInsertText, key, value)
+}
+
+func (r *configRepository) GetText(key string) (value string, err error) {
+	err = r.get(sqlQueryText, key, &value)
+	return
+}
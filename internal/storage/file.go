@@ -0,0 +1,311 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"uranus/pkg/file"
+)
+
+const (
+	sqlInsertFilePolicy                   = `insert into file_policy(path,fsid,ino,perm,timestamp,status) values(?,?,?,?,?,?)`
+	sqlInsertFilePattern                  = `insert into file_policy(path,fsid,ino,perm,timestamp,status,kind,parent) values(?,0,0,?,?,?,?,0) returning id`
+	sqlInsertFileChildPolicy              = `insert into file_policy(path,fsid,ino,perm,timestamp,status,kind,parent) values(?,?,?,?,?,?,0,?)`
+	sqlUpdateFilePolicyById               = `update file_policy set fsid=?,ino=?,perm=?,timestamp=?,status=? where id=?`
+	sqlQueryFilePolicyById                = `select id,path,fsid,ino,perm,timestamp,status,kind,parent from file_policy where id=?`
+	sqlQueryFilePolicyLimitOffset         = `select id,path,fsid,ino,perm,timestamp,status,kind,parent from file_policy order by id limit ? offset ?`
+	sqlQueryFilePolicyByParentLimitOffset = `select id,path,fsid,ino,perm,timestamp,status,kind,parent from file_policy where parent=? order by id limit ? offset ?`
+	sqlQueryFilePolicyExpansion           = `select parent,status,count(*) from file_policy where parent<>0 group by parent,status`
+	sqlQueryFilePolicyPathByPaths         = `select path from file_policy where kind=0 and parent<>? and path in (%s)`
+	sqlQueryFilePolicyIdByFsidIno         = `select id from file_policy where fsid=? and ino=? and status=0`
+	sqlUpdateFilePolicyFsidInoById        = `update file_policy set fsid=?,ino=?,timestamp=? where id=?`
+	sqlUpdateFilePolicyStatusById         = `update file_policy set status=? where id=?`
+	sqlDeleteFilePolicyById               = `delete from file_policy where id=?`
+	sqlDeleteFilePolicyByParent           = `delete from file_policy where parent=?`
+	sqlInsertFileEvent                    = `insert into file_event(path,fsid,ino,perm,timestamp,policy,status,count,first,kind) values(?,?,?,?,?,?,?,?,?,?)`
+	sqlMergeFileEvent                     = `update file_event set count=count+?,timestamp=? where id=(select max(id) from file_event where path=? and perm=? and policy=? and status=? and kind=? and first>=?)`
+	sqlQueryFileEventLimitOffset          = `select id,path,fsid,ino,perm,timestamp,policy,status,count,first,suppressed,kind from file_event order by id limit ? offset ?`
+	sqlUpdateFileEventStatusById          = `update file_event set status=? where id=?`
+	sqlDeleteFileEventById                = `delete from file_event where id=?`
+)
+
+// maxQueryPaths 按路径查询时每条语句最多的参数数量,低版本 SQLite 最多支持 999 个参数
+const maxQueryPaths = 500
+
+type fileRepository struct {
+	db          *DB
+	insertEvent statement
+	mergeEvent  statement
+}
+
+func NewFileRepository(db *DB) FileRepository {
+	return &fileRepository{
+		db:          db,
+		insertEvent: statement{query: sqlInsertFileEvent},
+		mergeEvent:  statement{query: sqlMergeFileEvent},
+	}
+}
+
+// fsid 和 ino 按 int64 保存,与 SQLite 的 integer 和 PostgreSQL 的 bigint 一致
+func (r *fileRepository) InsertPolicy(path string, fsid, ino uint64, perm, status int) (err error) {
+	_, err = r.db.exec(sqlInsertFilePolicy, path, int64(fsid), int64(ino), perm, time.Now().Unix(), status)
+	return
+}
+
+// InsertPattern 目录和通配符策略本身不对应文件, fsid 和 ino 为 0
+func (r *fileRepository) InsertPattern(path string, kind, perm, status int) (id int64, err error) {
+	err = r.db.QueryRow(sqlInsertFilePattern, path, perm, time.Now().Unix(), status, kind).Scan(&id)
+	return
+}
+
+func (r *fileRepository) InsertChildPolicy(parent uint64, path string, fsid, ino uint64, perm, status int) (err error) {
+	_, err = r.db.exec(sqlInsertFileChildPolicy, path, int64(fsid), int64(ino), perm, time.Now().Unix(), status, int64(parent))
+	return
+}
+
+func (r *fileRepository) UpdatePolicyById(fsid, ino uint64, perm, status, id int) (err error) {
+	_, err = r.db.exec(sqlUpdateFilePolicyById, int64(fsid), int64(ino), perm, time.Now().Unix(), status, id)
+	return
+}
+
+func scanFilePolicy(row interface{ Scan(...interface{}) error }) (policy file.Policy, err error) {
+	var fsid, ino, parent int64
+	err = row.Scan(&policy.ID, &policy.Path, &fsid, &ino, &policy.Perm, &policy.Timestamp, &policy.Status, &policy.Kind, &parent)
+	policy.Fsid, policy.Ino, policy.Parent = uint64(fsid), uint64(ino), uint64(parent)
+	return
+}
+
+func (r *fileRepository) QueryPolicyById(id int) (policy file.Policy, err error) {
+	return scanFilePolicy(r.db.QueryRow(sqlQueryFilePolicyById, id))
+}
+
+func (r *fileRepository) QueryPolicyLimitOffset(limit, offset int) (policies []file.Policy, err error) {
+	err = r.ScanPolicyLimitOffset(limit, offset, func(policy file.Policy) error {
+		policies = append(policies, policy)
+		return nil
+	})
+	return
+}
+
+func (r *fileRepository) ScanPolicyLimitOffset(limit, offset int, handle func(policy file.Policy) error) (err error) {
+	return r.db.query(sqlQueryFilePolicyLimitOffset, func(rows *sql.Rows) error {
+		policy, err := scanFilePolicy(rows)
+		if err != nil {
+			return err
+		}
+		return handle(policy)
+	}, r.db.Limit(limit), offset)
+}
+
+func (r *fileRepository) QueryPolicyByParentLimitOffset(parent uint64, limit, offset int) (policies []file.Policy, err error) {
+	err = r.ScanPolicyByParentLimitOffset(parent, limit, offset, func(policy file.Policy) error {
+		policies = append(policies, policy)
+		return nil
+	})
+	return
+}
+
+func (r *fileRepository) ScanPolicyByParentLimitOffset(parent uint64, limit, offset int, handle func(policy file.Policy) error) (err error) {
+	return r.db.query(sqlQueryFilePolicyByParentLimitOffset, func(rows *sql.Rows) error {
+		policy, err := scanFilePolicy(rows)
+		if err != nil {
+			return err
+		}
+		return handle(policy)
+	}, int64(parent), r.db.Limit(limit), offset)
+}
+
+func (r *fileRepository) QueryPolicyPathsByPaths(parent uint64, paths []string) (protected map[string]bool, err error) {
+	protected = map[string]bool{}
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > maxQueryPaths {
+			n = maxQueryPaths
+		}
+		args := []interface{}{int64(parent)}
+		for _, path := range paths[:n] {
+			args = append(args, path)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", n), ",")
+		err = r.db.query(fmt.Sprintf(sqlQueryFilePolicyPathByPaths, placeholders), func(rows *sql.Rows) error {
+			path := ""
+			if err := rows.Scan(&path); err != nil {
+				return err
+			}
+			protected[path] = true
+			return nil
+		}, args...)
+		if err != nil {
+			return
+		}
+		paths = paths[n:]
+	}
+	return
+}
+
+func (r *fileRepository) QueryPolicyExpansions() (expansions map[uint64]file.Expansion, err error) {
+	expansions = map[uint64]file.Expansion{}
+	err = r.db.query(sqlQueryFilePolicyExpansion, func(rows *sql.Rows) error {
+		var parent int64
+		var status, count int
+		if err := rows.Scan(&parent, &status, &count); err != nil {
+			return err
+		}
+		expansion := expansions[uint64(parent)]
+		expansion.Total += count
+		switch status {
+		case file.StatusPolicyNormal:
+			expansion.Normal += count
+		case file.StatusPolicyConflict:
+			expansion.Conflict += count
+		case file.StatusPolicyFileNotExist:
+			expansion.NotExist += count
+		default:
+			expansion.Unknown += count
+		}
+		expansions[uint64(parent)] = expansion
+		return nil
+	})
+	return
+}
+
+func (r *fileRepository) QueryPolicyIdByFsidIno(fsid, ino uint64) (id int64, err error) {
+	err = r.db.QueryRow(sqlQueryFilePolicyIdByFsidIno, int64(fsid), int64(ino)).Scan(&id)
+	return
+}
+
+func (r *fileRepository) UpdatePolicyFsidInoById(fsid, ino, id uint64) (ok bool, err error) {
+	affected, err := r.db.exec(sqlUpdateFilePolicyFsidInoById, int64(fsid), int64(ino), time.Now().Unix(), id)
+	ok = affected == 1
+	return
+}
+
+func (r *fileRepository) UpdatePolicyStatusById(status int, id uint64) (ok bool, err error) {
+	affected, err := r.db.exec(sqlUpdateFilePolicyStatusById, status, id)
+	ok = affected == 1
+	return
+}
+
+func (r *fileRepository) DeletePolicyById(id int) (err error) {
+	_, err = r.db.exec(sqlDeleteFilePolicyById, id)
+	return
+}
+
+func (r *fileRepository) DeletePolicyByParent(parent uint64) (err error) {
+	_, err = r.db.exec(sqlDeleteFilePolicyByParent, int64(parent))
+	return
+}
+
+// mergeFileEvents 合并同一批中路径,权限,策略和类型相同的事件, Count 为 0 的事件视为一次访问
+func mergeFileEvents(events []file.Event) (merged []file.Event) {
+	type key struct {
+		path   string
+		perm   int
+		policy uint64
+		kind   int
+	}
+	index := map[key]int{}
+	for _, e := range events {
+		if e.Count == 0 {
+			e.Count = 1
+		}
+		if e.First == 0 {
+			e.First = e.Timestamp
+		}
+		k := key{path: e.Path, perm: e.Perm, policy: e.Policy, kind: e.Kind}
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(merged)
+			merged = append(merged, e)
+			continue
+		}
+		merged[i].Count += e.Count
+		if e.First < merged[i].First {
+			merged[i].First = e.First
+		}
+		if e.Timestamp > merged[i].Timestamp {
+			merged[i].Timestamp = e.Timestamp
+		}
+	}
+	return
+}
+
+// InsertEvents window 大于 0 时先在同一批中合并,再与窗口内的未读事件合并
+func (r *fileRepository) InsertEvents(events []file.Event, window int64, allow func(e file.Event) bool) (err error) {
+	insert, err := r.insertEvent.prepare(r.db)
+	if err != nil {
+		return
+	}
+	merge, err := r.mergeEvent.prepare(r.db)
+	if err != nil {
+		return
+	}
+
+	if window > 0 {
+		events = mergeFileEvents(events)
+	}
+	return r.db.transaction(func(tx *Tx) error {
+		insert, merge := tx.Stmt(insert), tx.Stmt(merge)
+		for _, e := range events {
+			if e.Count == 0 {
+				e.Count = 1
+			}
+			if e.First == 0 {
+				e.First = e.Timestamp
+			}
+			// 窗口内已经有相同的未读事件时只增加访问次数
+			if window > 0 {
+				result, err := merge.Exec(e.Count, e.Timestamp, e.Path, e.Perm, int64(e.Policy), e.Status, e.Kind, e.First-window)
+				if err != nil {
+					return err
+				}
+				affected, err := result.RowsAffected()
+				if err != nil {
+					return err
+				}
+				if affected != 0 {
+					continue
+				}
+			}
+			if allow != nil && !allow(e) {
+				continue
+			}
+			if _, err := insert.Exec(e.Path, int64(e.Fsid), int64(e.Ino), e.Perm, e.Timestamp, int64(e.Policy), e.Status, e.Count, e.First, e.Kind); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *fileRepository) QueryEventLimitOffset(limit, offset int) (events []file.Event, err error) {
+	err = r.ScanEventLimitOffset(limit, offset, func(e file.Event) error {
+		events = append(events, e)
+		return nil
+	})
+	return
+}
+
+func (r *fileRepository) ScanEventLimitOffset(limit, offset int, handle func(e file.Event) error) (err error) {
+	return r.db.query(sqlQueryFileEventLimitOffset, func(rows *sql.Rows) error {
+		e := file.Event{}
+		var fsid, ino int64
+		if err := rows.Scan(&e.ID, &e.Path, &fsid, &ino, &e.Perm, &e.Timestamp, &e.Policy, &e.Status, &e.Count, &e.First, &e.Suppressed, &e.Kind); err != nil {
+			return err
+		}
+		e.Fsid, e.Ino = uint64(fsid), uint64(ino)
+		return handle(e)
+	}, r.db.Limit(limit), offset)
+}
+
+func (r *fileRepository) UpdateEventStatusById(status, id int) (err error) {
+	_, err = r.db.exec(sqlUpdateFileEventStatusById, status, id)
+	return
+}
+
+func (r *fileRepository) DeleteEventById(id int) (err error) {
+	_, err = r.db.exec(sqlDeleteFileEventById, id)
+	return
+}
@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+import (
+	"database/sql"
+	"uranus/pkg/net"
+)
+
+const (
+	sqlInsertNetPolicy           = `insert into net_policy(priority,addr_src_begin,addr_src_end,addr_dst_begin,addr_dst_end,protocol_begin,protocol_end,port_src_begin,port_src_end,port_dst_begin,port_dst_end,flags,response) values(?,?,?,?,?,?,?,?,?,?,?,?,?) returning id`
+	sqlQueryNetPolicyById        = `select id,priority,addr_src_begin,addr_src_end,addr_dst_begin,addr_dst_end,protocol_begin,protocol_end,port_src_begin,port_src_end,port_dst_begin,port_dst_end,flags,response from net_policy where id=?`
+	sqlQueryNetPolicyLimitOffset = `select id,priority,addr_src_begin,addr_src_end,addr_dst_begin,addr_dst_end,protocol_begin,protocol_end,port_src_begin,port_src_end,port_dst_begin,port_dst_end,flags,response from net_policy order by id limit ? offset ?`
+	sqlDeleteNetPolicyById       = `delete from net_policy where id=?`
+)
+
+type netRepository struct {
+	db *DB
+}
+
+func NewNetRepository(db *DB) NetRepository {
+	return &netRepository{db: db}
+}
+
+// InsertPolicy PostgreSQL 不支持 LastInsertId,通过 returning 返回新的 id
+func (r *netRepository) InsertPolicy(policy *net.Policy) (id int64, err error) {
+	err = r.db.QueryRow(sqlInsertNetPolicy, policy.Priority,
+		policy.Addr.Src.Begin, policy.Addr.Src.End,
+		policy.Addr.Dst.Begin, policy.Addr.Dst.End,
+		policy.Protocol.Begin, policy.Protocol.End,
+		policy.Port.Src.Begin, policy.Port.Src.End,
+		policy.Port.Dst.Begin, policy.Port.Dst.End,
+		policy.Flags, policy.Response).Scan(&id)
+	return
+}
+
+func scanNetPolicy(row interface{ Scan(...interface{}) error }) (policy net.Policy, err error) {
+	err = row.Scan(&policy.ID, &policy.Priority,
+		&policy.Addr.Src.Begin, &policy.Addr.Src.End,
+		&policy.Addr.Dst.Begin, &policy.Addr.Dst.End,
+		&policy.Protocol.Begin, &policy.Protocol.End,
+		&policy.Port.Src.Begin, &policy.Port.Src.End,
+		&policy.Port.Dst.Begin, &policy.Port.Dst.End,
+		&policy.Flags, &policy.Response)
+	return
+}
+
+func (r *netRepository) QueryPolicyById(id int) (policy net.Policy, err error) {
+	return scanNetPolicy(r.db.QueryRow(sqlQueryNetPolicyById, id))
+}
+
+func (r *netRepository) QueryPolicyLimitOffset(limit, offset int) (policies []net.Policy, err error) {
+	err = r.ScanPolicyLimitOffset(limit, offset, func(policy net.Policy) error {
+		policies = append(policies, policy)
+		return nil
+	})
+	return
+}
+
+func (r *netRepository) ScanPolicyLimitOffset(limit, offset int, handle func(policy net.Policy) error) (err error) {
+	return r.db.query(sqlQueryNetPolicyLimitOffset, func(rows *sql.Rows) error {
+		policy, err := scanNetPolicy(rows)
+		if err != nil {
+			return err
+		}
+		return handle(policy)
+	}, r.db.Limit(limit), offset)
+}
+
+func (r *netRepository) DeletePolicyById(id int) (err error) {
+	_, err = r.db.exec(sqlDeleteNetPolicyById, id)
+	return
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// binary 在 PostgreSQL 中是保留字,需要加引号
+const (
+	sqlQueryProcessLimitOffset = `select id,workdir,"binary",argv,count,judge,status from process_event order by id limit ? offset ?`
+	sqlUpdateProcessStatus     = `update process_event set status=? where id=?`
+	sqlQueryProcessCmdById     = `select cmd,status from process_event where id=?`
+	sqlQueryProcessCmdByStatus = `select cmd from process_event where status=? order by id`
+	sqlUpdateProcessHourly     = `insert into process_hourly(hour,count) values(?,?) on conflict(hour) do update set count=process_hourly.count+excluded.count`
+	sqlUpsertProcessEvent      = `insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values(?,?,?,?,?,?,?,?) on conflict(cmd) do update set count=process_event.count+excluded.count,judge=excluded.judge,status=excluded.status,timestamp=excluded.timestamp`
+	sqlQueryProcessRules       = `select id,cmd,status from process_event where status<>0 order by id`
+	sqlUpsertProcessRule       = `insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values(?,?,?,?,0,0,?,?) on conflict(cmd) do update set status=excluded.status`
+)
+
+type processRepository struct {
+	db     *DB
+	hourly statement
+	upsert statement
+}
+
+func NewProcessRepository(db *DB) ProcessRepository {
+	return &processRepository{
+		db:     db,
+		hourly: statement{query: sqlUpdateProcessHourly},
+		upsert: statement{query: sqlUpsertProcessEvent},
+	}
+}
+
+func (r *processRepository) QueryEventLimitOffset(limit, offset int) (events []ProcessEvent, err error) {
+	err = r.ScanEventLimitOffset(limit, offset, func(e ProcessEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	return
+}
+
+func (r *processRepository) ScanEventLimitOffset(limit, offset int, handle func(e ProcessEvent) error) (err error) {
+	return r.db.query(sqlQueryProcessLimitOffset, func(rows *sql.Rows) error {
+		e := ProcessEvent{}
+		if err := rows.Scan(&e.ID, &e.Workdir, &e.Binary, &e.Argv, &e.Count, &e.Judge, &e.Status); err != nil {
+			return err
+		}
+		return handle(e)
+	}, r.db.Limit(limit), offset)
+}
+
+func (r *processRepository) QueryCmdById(id int) (cmd string, status int, err error) {
+	err = r.db.QueryRow(sqlQueryProcessCmdById, id).Scan(&cmd, &status)
+	return
+}
+
+func (r *processRepository) UpdateStatus(id uint64, status int) (ok bool, err error) {
+	affected, err := r.db.exec(sqlUpdateProcessStatus, status, id)
+	ok = affected == 1
+	return
+}
+
+func (r *processRepository) ScanCmdByStatus(status int, handle func(cmd string) error) (err error) {
+	return r.db.query(sqlQueryProcessCmdByStatus, func(rows *sql.Rows) error {
+		cmd := ""
+		if err := rows.Scan(&cmd); err != nil {
+			return err
+		}
+		return handle(cmd)
+	}, status)
+}
+
+func (r *processRepository) ScanRules(handle func(id uint64, cmd string, status int) error) (err error) {
+	return r.db.query(sqlQueryProcessRules, func(rows *sql.Rows) error {
+		var id uint64
+		var cmd string
+		var status int
+		if err := rows.Scan(&id, &cmd, &status); err != nil {
+			return err
+		}
+		return handle(id, cmd, status)
+	})
+}
+
+func (r *processRepository) UpsertRule(cmd, workdir, binary, argv string, status int, timestamp int64) (err error) {
+	_, err = r.db.exec(sqlUpsertProcessRule, cmd, workdir, binary, argv, status, timestamp)
+	return
+}
+
+// InsertReports 同一条命令的多次上报合并为一次更新,以最后一次上报的判定和状态为准.
+// 多台主机写入同一个数据库时按小时的顺序更新,避免事务之间互相等待
+func (r *processRepository) InsertReports(reports []ProcessReport) (err error) {
+	hourly := map[int64]int{}
+	hours := []int64{}
+	merged := []ProcessReport{}
+	index := map[string]int{}
+	for _, report := range reports {
+		hour := report.Timestamp / 3600 * 3600
+		if _, ok := hourly[hour]; !ok {
+			hours = append(hours, hour)
+		}
+		hourly[hour]++
+
+		if i, ok := index[report.Cmd]; ok {
+			report.Count = merged[i].Count + 1
+			merged[i] = report
+			continue
+		}
+		report.Count = 1
+		index[report.Cmd] = len(merged)
+		merged = append(merged, report)
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i] < hours[j] })
+
+	updateHourly, err := r.hourly.prepare(r.db)
+	if err != nil {
+		return
+	}
+	upsert, err := r.upsert.prepare(r.db)
+	if err != nil {
+		return
+	}
+	return r.db.transaction(func(tx *Tx) error {
+		stmt := tx.Stmt(updateHourly)
+		for _, hour := range hours {
+			if _, err := stmt.Exec(hour, hourly[hour]); err != nil {
+				return err
+			}
+		}
+		stmt = tx.Stmt(upsert)
+		for _, report := range merged {
+			if _, err := stmt.Exec(report.Cmd, report.Workdir, report.Binary, report.Argv, report.Count,
+				report.Judge, report.Status, report.Timestamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+import (
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+)
+
+// 各模块通过以下接口读写数据库, SQLite 和 PostgreSQL 共用同一套实现,
+// 方言的差异由 DB 处理.查询列表时 limit 为负数表示不限制数量
+
+type ConfigRepository interface {
+	GetInteger(key string) (value int, err error)
+	SetInteger(key string, value int) (err error)
+	GetReal(key string) (value float64, err error)
+	SetReal(key string, value float64) (err error)
+	GetText(key string) (value string, err error)
+	SetText(key string, value string) (err error)
+}
+
+type User struct {
+	UserID    uint64 `json:"userID"`
+	Username  string `json:"username"`
+	AliasName string `json:"aliasName"`
+	// 旧版的权限通配符,只对没有分配角色的用户生效
+	Permissions string   `json:"permissions"`
+	Roles       []string `json:"roles"`
+}
+
+type Role struct {
+	ID          uint64   `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Builtin     bool     `json:"builtin"`
+	// 分配了该角色的用户必须开启两步验证
+	RequireTotp bool `json:"requireTotp"`
+}
+
+type Session struct {
+	ID       uint64 `json:"id"`
+	UserID   uint64 `json:"userID"`
+	Username string `json:"username"`
+	Addr     string `json:"addr"`
+	Agent    string `json:"agent"`
+	Created  int64  `json:"created"`
+	Accessed int64  `json:"accessed"`
+	Current  bool   `json:"current"`
+	Totp     bool   `json:"totp"`
+}
+
+type Token struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	// 令牌的权限范围,为空表示与所属用户相同
+	Permissions []string `json:"permissions"`
+	Created     int64    `json:"created"`
+	// 过期时间, 0 表示永不过期
+	Expires int64 `json:"expires"`
+	// 最后一次使用的时间, 0 表示从未使用
+	Used int64 `json:"used"`
+	// 创建令牌的会话是否通过了两步验证
+	Totp bool `json:"totp"`
+}
+
+type LoginEvent struct {
+	ID        uint64 `json:"id"`
+	Username  string `json:"username"`
+	Addr      string `json:"addr"`
+	Agent     string `json:"agent"`
+	Timestamp int64  `json:"timestamp"`
+	Locked    bool   `json:"locked"`
+	Status    int    `json:"status"`
+}
+
+// Password 保存的密码哈希,计算和校验哈希由调用方完成
+type Password struct {
+	Salt string
+	Hash string
+}
+
+type UserRepository interface {
+	CountUser() (count int, err error)
+	InsertUser(username string, password Password, alias, permissions string) (err error)
+	QueryUserByUsername(username string) (user User, err error)
+	QueryUserById(id uint64) (user User, err error)
+	// ScanAllUser 逐行处理查询结果,角色列表先整体读出
+	ScanAllUser(handle func(user User) error) (err error)
+	// UpdateUser 在同一个事务中将原来的密码写入历史记录,只保留最近 keep 条,并删除用户的会话和令牌.
+	// password.Hash 为空时不修改密码,会话和令牌保持不变
+	UpdateUser(id uint64, username string, password Password, alias, permissions string, keep int, timestamp int64) (ok bool, err error)
+	// DeleteUser 同时删除用户的会话,角色,令牌,两步验证和历史密码
+	DeleteUser(id uint64) (ok bool, err error)
+
+	QueryPasswordByUsername(username string) (password Password, err error)
+	QueryPasswordById(id uint64) (password Password, err error)
+	UpdatePasswordByUsername(username string, password Password) (err error)
+	// QueryPasswordHistory 从新到旧返回最近 limit 个历史密码
+	QueryPasswordHistory(id uint64, limit int) (passwords []Password, err error)
+	// ArchivePassword 将当前密码写入历史记录,只保留最近 keep 条
+	ArchivePassword(id uint64, keep int, timestamp int64) (err error)
+
+	UpsertBuiltinRole(name string, permissions []string) (err error)
+	QueryAllRole() (roles []Role, err error)
+	QueryRoleById(id uint64) (role Role, err error)
+	QueryRoleByName(name string) (role Role, err error)
+	InsertRole(name string, permissions []string) (err error)
+	UpdateRole(id uint64, name string, permissions []string) (err error)
+	DeleteRole(id uint64) (err error)
+	UpdateRoleTotp(id uint64, required bool) (err error)
+	// QueryUserPermissions 返回用户所有角色的权限
+	QueryUserPermissions(id uint64) (permissions []string, err error)
+	QueryUserRoles(id uint64) (roles []string, err error)
+	ReplaceUserRoles(id uint64, roles []uint64) (err error)
+	// TotpRequired 检查用户是否有角色要求开启两步验证
+	TotpRequired(id uint64) (required bool, err error)
+
+	InsertSession(token string, user uint64, addr, agent string, now int64, totp bool) (err error)
+	QuerySessionByToken(token string) (session Session, user User, err error)
+	QueryAllSession() (sessions []Session, err error)
+	TouchSession(id uint64, now int64) (err error)
+	UpdateSessionTotp(id uint64) (err error)
+	DeleteSessionById(id uint64) (err error)
+	DeleteExpiredSession(accessed, created int64) (err error)
+	// TrimUserSession 只保留用户最近访问的 keep 个会话
+	TrimUserSession(user uint64, keep int) (err error)
+
+	// QueryTotp 查询用户的两步验证密钥,未绑定时 enabled 为 false
+	QueryTotp(id uint64) (secret string, enabled bool, step int64, err error)
+	UpsertTotp(id uint64, secret string) (err error)
+	// EnableTotp 开启两步验证,同时替换用户的恢复码
+	EnableTotp(id uint64, step int64, codes []string) (err error)
+	// UpdateTotpStep 记录最后一次使用的验证码步长,同一个验证码不能重复使用
+	UpdateTotpStep(id uint64, step int64) (ok bool, err error)
+	DeleteTotp(id uint64) (err error)
+	// ConsumeRecoveryCode 使用恢复码,成功后恢复码失效
+	ConsumeRecoveryCode(id uint64, code string) (ok bool, err error)
+	CountRecoveryCode(id uint64) (count int, err error)
+
+	// InsertToken totp 表示创建令牌的会话通过了两步验证
+	InsertToken(user uint64, name, token string, permissions []string, created, expires int64, totp bool) (id uint64, err error)
+	QueryTokenByHash(hash string) (token Token, user User, err error)
+	QueryUserTokens(user uint64) (tokens []Token, err error)
+	TouchToken(id uint64, now int64) (err error)
+	// DeleteToken 只能删除属于 user 的令牌
+	DeleteToken(id, user uint64) (err error)
+
+	InsertLoginEvent(username, addr, agent string, timestamp int64, locked bool) (err error)
+	QueryLoginEventLimitOffset(limit, offset int) (events []LoginEvent, err error)
+	UpdateLoginEventStatus(id uint64, status int) (err error)
+}
+
+type ProcessEvent struct {
+	ID      uint64 `json:"id"`
+	Workdir string `json:"workdir"`
+	Binary  string `json:"binary"`
+	Argv    string `json:"argv"`
+	Count   uint64 `json:"count"`
+	Judge   uint64 `json:"judge"`
+	Status  uint64 `json:"status"`
+}
+
+// ProcessReport hackernel 上报的一次命令执行, Count 由 InsertReports 合并时计算
+type ProcessReport struct {
+	Cmd       string
+	Workdir   string
+	Binary    string
+	Argv      string
+	Count     int
+	Judge     int
+	Status    int
+	Timestamp int64
+}
+
+type ProcessRepository interface {
+	QueryEventLimitOffset(limit, offset int) (events []ProcessEvent, err error)
+	// ScanEventLimitOffset 逐行处理查询结果,导出时不需要保存整个列表
+	ScanEventLimitOffset(limit, offset int, handle func(e ProcessEvent) error) (err error)
+	QueryCmdById(id int) (cmd string, status int, err error)
+	UpdateStatus(id uint64, status int) (ok bool, err error)
+	ScanCmdByStatus(status int, handle func(cmd string) error) (err error)
+	// ScanRules 逐条处理状态不为 0 的命令,即策略文档中的信任和阻止规则
+	ScanRules(handle func(id uint64, cmd string, status int) error) (err error)
+	// UpsertRule 已经上报过的命令只修改状态,没有上报过的命令新增一条执行次数为 0 的记录
+	UpsertRule(cmd, workdir, binary, argv string, status int, timestamp int64) (err error)
+	// InsertReports 在一个事务中写入一批上报,增加命令和所在小时的执行次数
+	InsertReports(reports []ProcessReport) (err error)
+}
+
+type FileRepository interface {
+	InsertPolicy(path string, fsid, ino uint64, perm, status int) (err error)
+	// InsertPattern 新增目录或通配符策略,子策略由 InsertChildPolicy 写入
+	InsertPattern(path string, kind, perm, status int) (id int64, err error)
+	InsertChildPolicy(parent uint64, path string, fsid, ino uint64, perm, status int) (err error)
+	UpdatePolicyById(fsid, ino uint64, perm, status, id int) (err error)
+	QueryPolicyById(id int) (policy file.Policy, err error)
+	// QueryPolicyLimitOffset 返回包括子策略在内的全部策略
+	QueryPolicyLimitOffset(limit, offset int) (policies []file.Policy, err error)
+	ScanPolicyLimitOffset(limit, offset int, handle func(policy file.Policy) error) (err error)
+	// QueryPolicyByParentLimitOffset parent 为 0 时返回没有所属策略的策略
+	QueryPolicyByParentLimitOffset(parent uint64, limit, offset int) (policies []file.Policy, err error)
+	ScanPolicyByParentLimitOffset(parent uint64, limit, offset int, handle func(policy file.Policy) error) (err error)
+	// QueryPolicyPathsByPaths 返回 paths 中已经被单独保护或被 parent 以外的策略展开的路径
+	QueryPolicyPathsByPaths(parent uint64, paths []string) (protected map[string]bool, err error)
+	// QueryPolicyExpansions 按所属策略统计子策略的状态
+	QueryPolicyExpansions() (expansions map[uint64]file.Expansion, err error)
+	// QueryPolicyIdByFsidIno 查询文件对应的正常状态的策略
+	QueryPolicyIdByFsidIno(fsid, ino uint64) (id int64, err error)
+	UpdatePolicyFsidInoById(fsid, ino, id uint64) (ok bool, err error)
+	UpdatePolicyStatusById(status int, id uint64) (ok bool, err error)
+	DeletePolicyById(id int) (err error)
+	DeletePolicyByParent(parent uint64) (err error)
+
+	// InsertEvents 在一个事务中写入一批事件.window 大于 0 时路径,权限和策略相同的未读事件
+	// 从第一次访问开始的 window 秒内合并为一行.新增一行前调用 allow,返回 false 时不记录该事件,
+	// 由调用方统计没有记录的访问次数并写入限流汇总事件.事务回滚时 allow 的结果同样作废
+	InsertEvents(events []file.Event, window int64, allow func(e file.Event) bool) (err error)
+	QueryEventLimitOffset(limit, offset int) (events []file.Event, err error)
+	ScanEventLimitOffset(limit, offset int, handle func(e file.Event) error) (err error)
+	UpdateEventStatusById(status, id int) (err error)
+	DeleteEventById(id int) (err error)
+}
+
+type NetRepository interface {
+	InsertPolicy(policy *net.Policy) (id int64, err error)
+	QueryPolicyById(id int) (policy net.Policy, err error)
+	QueryPolicyLimitOffset(limit, offset int) (policies []net.Policy, err error)
+	ScanPolicyLimitOffset(limit, offset int, handle func(policy net.Policy) error) (err error)
+	DeletePolicyById(id int) (err error)
+}
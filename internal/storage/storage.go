@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// DB 在 sql.DB 的基础上屏蔽 SQLite 和 PostgreSQL 的差异.
+// SQL 统一使用 ? 作为占位符,布尔参数按 0 和 1 保存
+type DB struct {
+	*sql.DB
+	driver string
+}
+
+// Driver 根据 dsn 选择数据库, postgres:// 开头时使用 PostgreSQL,否则为 SQLite 的文件路径
+func Driver(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return DriverPostgres
+	}
+	return DriverSQLite
+}
+
+func Open(dsn string) (db *DB, err error) {
+	driver := Driver(dsn)
+	raw, err := sql.Open(driver, dsn)
+	if err != nil {
+		return
+	}
+	db = &DB{DB: raw, driver: driver}
+	return
+}
+
+func (db *DB) Driver() string {
+	return db.driver
+}
+
+func (db *DB) Postgres() bool {
+	return db.driver == DriverPostgres
+}
+
+// Limit PostgreSQL 的 limit 不能为负数,不限制数量时使用 null
+func (db *DB) Limit(limit int) interface{} {
+	if limit < 0 && db.Postgres() {
+		return nil
+	}
+	return limit
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.rebind(query), db.convert(args)...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.rebind(query), db.convert(args)...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.rebind(query), db.convert(args)...)
+}
+
+func (db *DB) Prepare(query string) (*Stmt, error) {
+	stmt, err := db.DB.Prepare(db.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, db: db}, nil
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// exec 执行一条语句,返回影响的行数
+func (db *DB) exec(query string, args ...interface{}) (affected int64, err error) {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		return
+	}
+	return result.RowsAffected()
+}
+
+// query 逐行调用 scan 处理查询结果
+func (db *DB) query(query string, scan func(rows *sql.Rows) error, args ...interface{}) (err error) {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// transaction handle 返回错误时回滚
+func (db *DB) transaction(handle func(tx *Tx) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if err = handle(tx); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// rebind 把 ? 替换为 PostgreSQL 的 $1, $2 ...,跳过字符串中的问号
+func (db *DB) rebind(query string) string {
+	if !db.Postgres() || !strings.Contains(query, "?") {
+		return query
+	}
+	builder := strings.Builder{}
+	quoted := false
+	n := 0
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(c)
+	}
+	return builder.String()
+}
+
+// convert PostgreSQL 的 integer 列不接受布尔值
+func (db *DB) convert(args []interface{}) []interface{} {
+	if !db.Postgres() {
+		return args
+	}
+	for i, arg := range args {
+		if b, ok := arg.(bool); ok {
+			if b {
+				args[i] = 1
+			} else {
+				args[i] = 0
+			}
+		}
+	}
+	return args
+}
+
+type Stmt struct {
+	*sql.Stmt
+	db *DB
+}
+
+func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.Stmt.Exec(s.db.convert(args)...)
+}
+
+func (s *Stmt) Query(args ...interface{}) (*sql.Rows, error) {
+	return s.Stmt.Query(s.db.convert(args)...)
+}
+
+func (s *Stmt) QueryRow(args ...interface{}) *sql.Row {
+	return s.Stmt.QueryRow(s.db.convert(args)...)
+}
+
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.rebind(query), tx.db.convert(args)...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.rebind(query), tx.db.convert(args)...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.db.rebind(query), tx.db.convert(args)...)
+}
+
+func (tx *Tx) Prepare(query string) (*Stmt, error) {
+	stmt, err := tx.Tx.Prepare(tx.db.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, db: tx.db}, nil
+}
+
+// Stmt 在事务中使用已经准备好的语句,语句随事务结束关闭
+func (tx *Tx) Stmt(stmt *Stmt) *Stmt {
+	return &Stmt{Stmt: tx.Tx.Stmt(stmt.Stmt), db: tx.db}
+}
+
+// statement 第一次使用时准备语句,之后重复使用,准备失败时下次重试
+type statement struct {
+	query string
+	mutex sync.Mutex
+	stmt  *Stmt
+}
+
+func (s *statement) prepare(db *DB) (stmt *Stmt, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stmt == nil {
+		s.stmt, err = db.Prepare(s.query)
+	}
+	stmt = s.stmt
+	return
+}
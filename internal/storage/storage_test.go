@@ -0,0 +1,553 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+)
+
+// 同一组测试分别在 SQLite 和 PostgreSQL 上执行. PostgreSQL 的连接地址通过
+// URANUS_TEST_POSTGRES 指定,例如 scripts/test-postgres.sh 启动的本地实例,未设置时跳过
+func backends(t *testing.T, test func(t *testing.T, db *storage.DB)) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := storage.Open(filepath.Join(t.TempDir(), "web.db") + "?_journal_mode=WAL")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := migration.Migrate(db); err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("URANUS_TEST_POSTGRES")
+		if dsn == "" {
+			t.Skip("URANUS_TEST_POSTGRES is not set")
+		}
+		db, cleanup := openPostgres(t, dsn)
+		defer cleanup()
+		if err := migration.Migrate(db); err != nil {
+			t.Fatal(err)
+		}
+		test(t, db)
+	})
+}
+
+// openPostgres 每个测试使用单独的 schema,测试结束后删除
+func openPostgres(t *testing.T, dsn string) (db *storage.DB, cleanup func()) {
+	admin, err := storage.Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("uranus_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("create schema " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	if db, err = storage.Open(u.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup = func() {
+		db.Close()
+		if _, err := admin.Exec("drop schema " + schema + " cascade"); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	}
+	return
+}
+
+func TestMigrate(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		version, err := migration.Version(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != migration.Latest() {
+			t.Fatalf("version=%d latest=%d", version, migration.Latest())
+		}
+		// 重复执行时不做任何修改
+		if err := migration.Migrate(db); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestConfigRepository(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		config := storage.NewConfigRepository(db)
+
+		if _, err := config.GetInteger("test::integer"); err != sql.ErrNoRows {
+			t.Fatalf("err=%v", err)
+		}
+		for _, value := range []int{1, 2} {
+			if err := config.SetInteger("test::integer", value); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := config.GetInteger("test::integer"); err != nil || got != value {
+				t.Fatalf("got=%d err=%v", got, err)
+			}
+		}
+
+		if err := config.SetReal("test::real", 0.5); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := config.GetReal("test::real"); err != nil || got != 0.5 {
+			t.Fatalf("got=%f err=%v", got, err)
+		}
+
+		if err := config.SetText("test::text", "uranus"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := config.GetText("test::text"); err != nil || got != "uranus" {
+			t.Fatalf("got=%s err=%v", got, err)
+		}
+	})
+}
+
+func TestUserRepository(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		users := storage.NewUserRepository(db)
+		now := time.Now().Unix()
+
+		if err := users.InsertUser("alice", storage.Password{Hash: "h1"}, "Alice", ""); err != nil {
+			t.Fatal(err)
+		}
+		if count, err := users.CountUser(); err != nil || count != 1 {
+			t.Fatalf("count=%d err=%v", count, err)
+		}
+		user, err := users.QueryUserByUsername("alice")
+		if err != nil || user.AliasName != "Alice" {
+			t.Fatalf("user=%+v err=%v", user, err)
+		}
+
+		// 角色
+		if err := users.UpsertBuiltinRole("viewer", []string{"event:read"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.UpsertBuiltinRole("viewer", []string{"event:read", "policy:read"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.InsertRole("custom", []string{"module:read"}); err != nil {
+			t.Fatal(err)
+		}
+		viewer, err := users.QueryRoleByName("viewer")
+		if err != nil || !viewer.Builtin || len(viewer.Permissions) != 2 {
+			t.Fatalf("role=%+v err=%v", viewer, err)
+		}
+		custom, err := users.QueryRoleByName("custom")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := users.UpdateRoleTotp(custom.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.ReplaceUserRoles(user.UserID, []uint64{viewer.ID, custom.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if roles, err := users.QueryUserRoles(user.UserID); err != nil || len(roles) != 2 {
+			t.Fatalf("roles=%v err=%v", roles, err)
+		}
+		if permissions, err := users.QueryUserPermissions(user.UserID); err != nil || len(permissions) != 3 {
+			t.Fatalf("permissions=%v err=%v", permissions, err)
+		}
+		if required, err := users.TotpRequired(user.UserID); err != nil || !required {
+			t.Fatalf("required=%v err=%v", required, err)
+		}
+		if err := users.DeleteRole(custom.ID); err != nil {
+			t.Fatal(err)
+		}
+		if roles, err := users.QueryUserRoles(user.UserID); err != nil || len(roles) != 1 {
+			t.Fatalf("roles=%v err=%v", roles, err)
+		}
+
+		// 历史密码
+		for _, hash := range []string{"h2", "h3", "h4"} {
+			if err := users.ArchivePassword(user.UserID, 2, now); err != nil {
+				t.Fatal(err)
+			}
+			if err := users.UpdatePasswordByUsername("alice", storage.Password{Hash: hash}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if password, err := users.QueryPasswordById(user.UserID); err != nil || password.Hash != "h4" {
+			t.Fatalf("password=%+v err=%v", password, err)
+		}
+		passwords, err := users.QueryPasswordHistory(user.UserID, 10)
+		if err != nil || len(passwords) != 2 || passwords[0].Hash != "h3" {
+			t.Fatalf("passwords=%+v err=%v", passwords, err)
+		}
+
+		// 会话
+		if err := users.InsertSession("s1", user.UserID, "192.0.2.1", "test", now, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.InsertSession("s2", user.UserID, "192.0.2.1", "test", now+1, true); err != nil {
+			t.Fatal(err)
+		}
+		session, owner, err := users.QuerySessionByToken("s2")
+		if err != nil || !session.Totp || owner.Username != "alice" {
+			t.Fatalf("session=%+v user=%+v err=%v", session, owner, err)
+		}
+		if err := users.TrimUserSession(user.UserID, 1); err != nil {
+			t.Fatal(err)
+		}
+		if sessions, err := users.QueryAllSession(); err != nil || len(sessions) != 1 {
+			t.Fatalf("sessions=%+v err=%v", sessions, err)
+		}
+
+		// 两步验证
+		if err := users.UpsertTotp(user.UserID, "secret"); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.EnableTotp(user.UserID, 1, []string{"c1", "c2"}); err != nil {
+			t.Fatal(err)
+		}
+		if secret, enabled, _, err := users.QueryTotp(user.UserID); err != nil || !enabled || secret != "secret" {
+			t.Fatalf("secret=%s enabled=%v err=%v", secret, enabled, err)
+		}
+		if ok, err := users.UpdateTotpStep(user.UserID, 1); err != nil || ok {
+			t.Fatalf("step reused: ok=%v err=%v", ok, err)
+		}
+		if ok, err := users.UpdateTotpStep(user.UserID, 2); err != nil || !ok {
+			t.Fatalf("ok=%v err=%v", ok, err)
+		}
+		if ok, err := users.ConsumeRecoveryCode(user.UserID, "c1"); err != nil || !ok {
+			t.Fatalf("ok=%v err=%v", ok, err)
+		}
+		if ok, err := users.ConsumeRecoveryCode(user.UserID, "c1"); err != nil || ok {
+			t.Fatalf("code reused: ok=%v err=%v", ok, err)
+		}
+		if count, err := users.CountRecoveryCode(user.UserID); err != nil || count != 1 {
+			t.Fatalf("count=%d err=%v", count, err)
+		}
+
+		// 令牌
+		id, err := users.InsertToken(user.UserID, "t1", "hash", []string{"event:read"}, now, 0, true)
+		if err != nil || id == 0 {
+			t.Fatalf("id=%d err=%v", id, err)
+		}
+		token, owner, err := users.QueryTokenByHash("hash")
+		if err != nil || token.ID != id || owner.UserID != user.UserID || len(token.Permissions) != 1 || !token.Totp {
+			t.Fatalf("token=%+v user=%+v err=%v", token, owner, err)
+		}
+		if err := users.TouchToken(id, now); err != nil {
+			t.Fatal(err)
+		}
+		if tokens, err := users.QueryUserTokens(user.UserID); err != nil || len(tokens) != 1 || tokens[0].Used != now {
+			t.Fatalf("tokens=%+v err=%v", tokens, err)
+		}
+
+		// 登录事件
+		if err := users.InsertLoginEvent("alice", "192.0.2.1", "test", now, true); err != nil {
+			t.Fatal(err)
+		}
+		events, err := users.QueryLoginEventLimitOffset(-1, 0)
+		if err != nil || len(events) != 1 || !events[0].Locked {
+			t.Fatalf("events=%+v err=%v", events, err)
+		}
+
+		// 删除用户时一并删除关联的数据
+		if ok, err := users.DeleteUser(user.UserID); err != nil || !ok {
+			t.Fatalf("ok=%v err=%v", ok, err)
+		}
+		if _, _, err := users.QueryTokenByHash("hash"); err != sql.ErrNoRows {
+			t.Fatalf("err=%v", err)
+		}
+		if sessions, err := users.QueryAllSession(); err != nil || len(sessions) != 0 {
+			t.Fatalf("sessions=%+v err=%v", sessions, err)
+		}
+	})
+}
+
+func TestProcessRepository(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		events := storage.NewProcessRepository(db)
+		now := time.Now().Unix()
+
+		report := func(cmd string, judge int) storage.ProcessReport {
+			return storage.ProcessReport{Cmd: cmd, Workdir: "/", Binary: "/bin/" + cmd, Argv: cmd, Judge: judge, Timestamp: now}
+		}
+		// 同一批中的相同命令合并,以最后一次上报的判定为准
+		if err := events.InsertReports([]storage.ProcessReport{report("ls", 1), report("cat", 1), report("ls", 2)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := events.InsertReports([]storage.ProcessReport{report("ls", 3)}); err != nil {
+			t.Fatal(err)
+		}
+		hourly := 0
+		if err := db.QueryRow(`select count from process_hourly where hour=?`, now/3600*3600).Scan(&hourly); err != nil || hourly != 4 {
+			t.Fatalf("hourly=%d err=%v", hourly, err)
+		}
+
+		list, err := events.QueryEventLimitOffset(-1, 0)
+		if err != nil || len(list) != 2 || list[0].Count != 3 || list[0].Judge != 3 || list[0].Binary != "/bin/ls" || list[1].Count != 1 {
+			t.Fatalf("events=%+v err=%v", list, err)
+		}
+		if ok, err := events.UpdateStatus(list[0].ID, 1); err != nil || !ok {
+			t.Fatalf("ok=%v err=%v", ok, err)
+		}
+		cmd, status, err := events.QueryCmdById(int(list[0].ID))
+		if err != nil || cmd != "ls" || status != 1 {
+			t.Fatalf("cmd=%s status=%d err=%v", cmd, status, err)
+		}
+		cmds := []string{}
+		err = events.ScanCmdByStatus(1, func(cmd string) error {
+			cmds = append(cmds, cmd)
+			return nil
+		})
+		if err != nil || len(cmds) != 1 {
+			t.Fatalf("cmds=%v err=%v", cmds, err)
+		}
+
+		// 策略文档中的规则,已经上报过的命令只修改状态
+		if err := events.UpsertRule("cat", "/", "/bin/cat", "cat", 2, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := events.UpsertRule("vi", "/", "/bin/vi", "vi", 1, now); err != nil {
+			t.Fatal(err)
+		}
+		rules := map[string]int{}
+		err = events.ScanRules(func(id uint64, cmd string, status int) error {
+			rules[cmd] = status
+			return nil
+		})
+		if err != nil || len(rules) != 3 || rules["ls"] != 1 || rules["cat"] != 2 || rules["vi"] != 1 {
+			t.Fatalf("rules=%v err=%v", rules, err)
+		}
+		if list, err = events.QueryEventLimitOffset(-1, 0); err != nil || len(list) != 3 || list[1].Count != 1 || list[2].Count != 0 {
+			t.Fatalf("events=%+v err=%v", list, err)
+		}
+	})
+}
+
+func TestFileRepository(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		files := storage.NewFileRepository(db)
+
+		// fsid 和 ino 可能超过 int64 的范围
+		fsid, ino := uint64(1)<<63+1, uint64(42)
+		if err := files.InsertPolicy("/etc/passwd", fsid, ino, 2, 0); err != nil {
+			t.Fatal(err)
+		}
+		policies, err := files.QueryPolicyLimitOffset(-1, 0)
+		if err != nil || len(policies) != 1 || policies[0].Fsid != fsid {
+			t.Fatalf("policies=%+v err=%v", policies, err)
+		}
+		id, err := files.QueryPolicyIdByFsidIno(fsid, ino)
+		if err != nil || uint64(id) != policies[0].ID {
+			t.Fatalf("id=%d err=%v", id, err)
+		}
+		if ok, err := files.UpdatePolicyFsidInoById(fsid, ino+1, uint64(id)); err != nil || !ok {
+			t.Fatalf("ok=%v err=%v", ok, err)
+		}
+		if ok, err := files.UpdatePolicyStatusById(1, uint64(id)); err != nil || !ok {
+			t.Fatalf("ok=%v err=%v", ok, err)
+		}
+		if _, err := files.QueryPolicyIdByFsidIno(fsid, ino+1); err != sql.ErrNoRows {
+			t.Fatalf("err=%v", err)
+		}
+		if err := files.UpdatePolicyById(fsid, ino, 4, 0, int(id)); err != nil {
+			t.Fatal(err)
+		}
+		policy, err := files.QueryPolicyById(int(id))
+		if err != nil || policy.Perm != 4 || policy.Ino != ino {
+			t.Fatalf("policy=%+v err=%v", policy, err)
+		}
+
+		if err := files.InsertEvents([]file.Event{{Path: "/etc/passwd", Fsid: fsid, Ino: ino, Perm: 2, Policy: uint64(id), Timestamp: time.Now().Unix()}}, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		events, err := files.QueryEventLimitOffset(10, 0)
+		if err != nil || len(events) != 1 || events[0].Policy != uint64(id) {
+			t.Fatalf("events=%+v err=%v", events, err)
+		}
+		if err := files.UpdateEventStatusById(1, int(events[0].ID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := files.DeleteEventById(int(events[0].ID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := files.DeletePolicyById(int(id)); err != nil {
+			t.Fatal(err)
+		}
+		if policies, err := files.QueryPolicyLimitOffset(-1, 0); err != nil || len(policies) != 0 {
+			t.Fatalf("policies=%+v err=%v", policies, err)
+		}
+	})
+}
+
+func TestFilePolicyPattern(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		files := storage.NewFileRepository(db)
+
+		if err := files.InsertPolicy("/etc/passwd", 1, 2, 2, file.StatusPolicyNormal); err != nil {
+			t.Fatal(err)
+		}
+		id, err := files.InsertPattern("/etc/ssh/*", file.KindGlob, 2, file.StatusPolicyNormal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent := uint64(id)
+		if err := files.InsertChildPolicy(parent, "/etc/ssh/sshd_config", 1, 3, 2, file.StatusPolicyNormal); err != nil {
+			t.Fatal(err)
+		}
+		if err := files.InsertChildPolicy(parent, "/etc/ssh/ssh_config", 1, 4, 2, file.StatusPolicyConflict); err != nil {
+			t.Fatal(err)
+		}
+
+		policies, err := files.QueryPolicyByParentLimitOffset(0, -1, 0)
+		if err != nil || len(policies) != 2 || policies[1].Kind != file.KindGlob || policies[1].Fsid != 0 {
+			t.Fatalf("policies=%+v err=%v", policies, err)
+		}
+		children, err := files.QueryPolicyByParentLimitOffset(parent, -1, 0)
+		if err != nil || len(children) != 2 || children[0].Parent != parent || children[0].Kind != file.KindFile {
+			t.Fatalf("children=%+v err=%v", children, err)
+		}
+		if policies, err := files.QueryPolicyLimitOffset(-1, 0); err != nil || len(policies) != 4 {
+			t.Fatalf("policies=%+v err=%v", policies, err)
+		}
+
+		// 路径数量超过一条语句的参数上限时分批查询
+		paths := []string{}
+		for i := 0; i < 600; i++ {
+			paths = append(paths, fmt.Sprintf("/etc/ssh/%d", i))
+		}
+		paths = append(paths, "/etc/ssh/sshd_config", "/etc/ssh/ssh_config", "/etc/passwd")
+		protected, err := files.QueryPolicyPathsByPaths(parent, paths)
+		if err != nil || !reflect.DeepEqual(protected, map[string]bool{"/etc/passwd": true}) {
+			t.Fatalf("protected=%v err=%v", protected, err)
+		}
+		if protected, err = files.QueryPolicyPathsByPaths(parent+1, paths); err != nil || len(protected) != 3 {
+			t.Fatalf("protected by other pattern=%v err=%v", protected, err)
+		}
+
+		expansions, err := files.QueryPolicyExpansions()
+		expected := file.Expansion{Total: 2, Normal: 1, Conflict: 1}
+		if err != nil || len(expansions) != 1 || expansions[parent] != expected {
+			t.Fatalf("expansions=%+v err=%v", expansions, err)
+		}
+
+		if err := files.DeletePolicyByParent(parent); err != nil {
+			t.Fatal(err)
+		}
+		if policies, err := files.QueryPolicyLimitOffset(-1, 0); err != nil || len(policies) != 2 {
+			t.Fatalf("policies=%+v err=%v", policies, err)
+		}
+	})
+}
+
+func TestFileEventDeduplication(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		files := storage.NewFileRepository(db)
+		now := time.Now().Unix()
+		hit := func(path string, perm int, policy uint64, timestamp int64) file.Event {
+			return file.Event{Path: path, Perm: perm, Policy: policy, Timestamp: timestamp}
+		}
+
+		// 同一批和窗口内的相同事件合并为一行,权限不同时单独记录
+		batch := []file.Event{hit("/etc/passwd", 2, 1, now), hit("/etc/passwd", 2, 1, now+1), hit("/etc/passwd", 4, 1, now)}
+		if err := files.InsertEvents(batch, 60, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := files.InsertEvents([]file.Event{hit("/etc/passwd", 2, 1, now+30)}, 60, nil); err != nil {
+			t.Fatal(err)
+		}
+		events, err := files.QueryEventLimitOffset(-1, 0)
+		if err != nil || len(events) != 2 || events[0].Count != 3 || events[0].First != now || events[0].Timestamp != now+30 {
+			t.Fatalf("events=%+v err=%v", events, err)
+		}
+
+		// 超出窗口或已读的事件不再合并
+		if err := files.UpdateEventStatusById(1, int(events[0].ID)); err != nil {
+			t.Fatal(err)
+		}
+		if err := files.InsertEvents([]file.Event{hit("/etc/passwd", 2, 1, now+40), hit("/etc/passwd", 4, 1, now+120)}, 60, nil); err != nil {
+			t.Fatal(err)
+		}
+		if events, err = files.QueryEventLimitOffset(-1, 0); err != nil || len(events) != 4 {
+			t.Fatalf("events=%+v err=%v", events, err)
+		}
+
+		// 限流时不记录事件,访问次数由调用方写入汇总事件
+		allowed := 1
+		allow := func(e file.Event) bool {
+			allowed--
+			return allowed >= 0
+		}
+		batch = []file.Event{hit("/etc/shadow", 2, 2, now), hit("/etc/shadow", 4, 2, now), hit("/etc/shadow", 4, 2, now), hit("/etc/shadow", 6, 2, now)}
+		if err := files.InsertEvents(batch, 60, allow); err != nil {
+			t.Fatal(err)
+		}
+		if events, err = files.QueryEventLimitOffset(-1, 0); err != nil || len(events) != 5 || events[4].Perm != 2 || events[4].Suppressed != 0 {
+			t.Fatalf("events=%+v err=%v", events, err)
+		}
+
+		// 策略跟踪的告警不与访问事件合并
+		alert := hit("/etc/shadow", 2, 2, now)
+		alert.Kind = file.EventKindReapplied
+		if err := files.InsertEvents([]file.Event{alert, hit("/etc/shadow", 2, 2, now)}, 60, nil); err != nil {
+			t.Fatal(err)
+		}
+		if events, err = files.QueryEventLimitOffset(-1, 0); err != nil || len(events) != 6 || events[5].Kind != file.EventKindReapplied || events[4].Count != 2 {
+			t.Fatalf("events=%+v err=%v", events, err)
+		}
+	})
+}
+
+func TestNetRepository(t *testing.T) {
+	backends(t, func(t *testing.T, db *storage.DB) {
+		policies := storage.NewNetRepository(db)
+
+		ids := []int64{}
+		for i := 0; i < 3; i++ {
+			policy := net.Policy{Priority: int8(i)}
+			policy.Addr.Src.Begin, policy.Addr.Src.End = "0.0.0.0", "255.255.255.255"
+			policy.Addr.Dst.Begin, policy.Addr.Dst.End = "0.0.0.0", "255.255.255.255"
+			policy.Port.Dst.Begin, policy.Port.Dst.End = 22, 22
+			id, err := policies.InsertPolicy(&policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if ids[0] == ids[1] || ids[1] == ids[2] {
+			t.Fatalf("ids=%v", ids)
+		}
+
+		policy, err := policies.QueryPolicyById(int(ids[2]))
+		if err != nil || policy.Priority != 2 || policy.Port.Dst.Begin != 22 {
+			t.Fatalf("policy=%+v err=%v", policy, err)
+		}
+		if list, err := policies.QueryPolicyLimitOffset(2, 1); err != nil || len(list) != 2 || list[0].ID != ids[1] {
+			t.Fatalf("policies=%+v err=%v", list, err)
+		}
+		if err := policies.DeletePolicyById(int(ids[0])); err != nil {
+			t.Fatal(err)
+		}
+		if list, err := policies.QueryPolicyLimitOffset(-1, 0); err != nil || len(list) != 2 {
+			t.Fatalf("policies=%+v err=%v", list, err)
+		}
+	})
+}
@@ -0,0 +1,562 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package storage
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// user 在 PostgreSQL 中是保留字,表名和列名都需要加引号
+const (
+	sqlInsertUser               = `insert into "user"(username, salt, password, alias, permissions) values(?,?,?,?,?)`
+	sqlQueryUserCount           = `select count(*) from "user"`
+	sqlQueryAllUser             = `select id, username, alias, permissions from "user" order by id`
+	sqlQueryUserByUsername      = `select id, alias, permissions from "user" where username=?`
+	sqlQueryUserById            = `select username, alias, permissions from "user" where id=?`
+	sqlQueryPasswordByUsername  = `select salt, password from "user" where username=?`
+	sqlQueryPasswordById        = `select salt, password from "user" where id=?`
+	sqlUpdateUser               = `update "user" set username=?, salt=?, password=?, alias=?, permissions=? where id=?`
+	sqlUpdateUserInfo           = `update "user" set username=?, alias=?, permissions=? where id=?`
+	sqlUpdatePasswordByUsername = `update "user" set salt=?, password=? where username=?`
+	sqlDeleteUser               = `delete from "user" where id=?`
+)
+
+const (
+	sqlInsertPasswordHistory = `insert into password_history("user",salt,password,timestamp) values(?,?,?,?)`
+	sqlQueryPasswordHistory  = `select salt, password from password_history where "user"=? order by id desc limit ?`
+	sqlTrimPasswordHistory   = `delete from password_history where "user"=? and id not in (select id from password_history where "user"=? order by id desc limit ?)`
+	sqlDeletePasswordHistory = `delete from password_history where "user"=?`
+)
+
+const (
+	sqlInsertSession         = `insert into session(token,"user",addr,agent,created,accessed,totp) values(?,?,?,?,?,?,?)`
+	sqlQuerySessionByToken   = `select s.id,s.created,s.accessed,s.totp,u.id,u.username,u.alias,u.permissions from session s join "user" u on s."user"=u.id where s.token=?`
+	sqlQueryAllSession       = `select s.id,s."user",u.username,s.addr,s.agent,s.created,s.accessed,s.totp from session s join "user" u on s."user"=u.id order by s.accessed desc, s.id desc`
+	sqlUpdateSessionAccessed = `update session set accessed=? where id=?`
+	sqlUpdateSessionTotp     = `update session set totp=1 where id=?`
+	sqlDeleteSessionById     = `delete from session where id=?`
+	sqlDeleteSessionByUser   = `delete from session where "user"=?`
+	sqlDeleteExpiredSession  = `delete from session where accessed<? or created<?`
+	sqlTrimUserSession       = `delete from session where "user"=? and id not in (select id from session where "user"=? order by accessed desc, id desc limit ?)`
+)
+
+const (
+	sqlUpsertBuiltinRole     = `insert into role(name,permissions,builtin) values(?,?,1) on conflict(name) do update set permissions=excluded.permissions, builtin=1`
+	sqlInsertRole            = `insert into role(name,permissions,builtin) values(?,?,0)`
+	sqlUpdateRole            = `update role set name=?, permissions=? where id=? and builtin=0`
+	sqlDeleteRole            = `delete from role where id=? and builtin=0`
+	sqlUpdateRoleTotp        = `update role set totp=? where id=?`
+	sqlQueryAllRole          = `select id,name,permissions,builtin,totp from role order by id`
+	sqlQueryRoleById         = `select id,name,permissions,builtin,totp from role where id=?`
+	sqlQueryRoleByName       = `select id,name,permissions,builtin,totp from role where name=?`
+	sqlQueryUserPermissions  = `select r.permissions from role r join user_role ur on r.id=ur.role where ur."user"=? order by r.id`
+	sqlQueryRoleNamesByUser  = `select r.name from role r join user_role ur on r.id=ur.role where ur."user"=? order by r.id`
+	sqlQueryAllUserRole      = `select ur."user", r.name from role r join user_role ur on r.id=ur.role order by r.id`
+	sqlInsertUserRole        = `insert into user_role("user",role) values(?,?)`
+	sqlDeleteUserRoleByUser  = `delete from user_role where "user"=?`
+	sqlDeleteUserRoleByRole  = `delete from user_role where role=?`
+	sqlQueryUserTotpRequired = `select count(*) from role r join user_role ur on r.id=ur.role where ur."user"=? and r.totp=1`
+)
+
+const (
+	sqlInsertLoginEvent           = `insert into login_event(username,addr,agent,timestamp,locked,status) values(?,?,?,?,?,0)`
+	sqlQueryLoginEventLimitOffset = `select id,username,addr,agent,timestamp,locked,status from login_event order by id desc limit ? offset ?`
+	sqlUpdateLoginEventStatus     = `update login_event set status=? where id=?`
+)
+
+const (
+	sqlInsertToken       = `insert into token("user",name,token,permissions,created,expires,used,totp) values(?,?,?,?,?,?,0,?) returning id`
+	sqlQueryTokenByHash  = `select t.id,t.permissions,t.expires,t.used,t.totp,u.id,u.username,u.alias,u.permissions from token t join "user" u on t."user"=u.id where t.token=?`
+	sqlQueryUserTokens   = `select id,name,permissions,created,expires,used,totp from token where "user"=? order by id`
+	sqlUpdateTokenUsed   = `update token set used=? where id=?`
+	sqlDeleteToken       = `delete from token where id=? and "user"=?`
+	sqlDeleteTokenByUser = `delete from token where "user"=?`
+)
+
+const (
+	sqlUpsertTotp               = `insert into totp("user",secret,enabled,step) values(?,?,0,0) on conflict("user") do update set secret=excluded.secret, enabled=0, step=0`
+	sqlQueryTotp                = `select secret,enabled,step from totp where "user"=?`
+	sqlEnableTotp               = `update totp set enabled=1, step=? where "user"=?`
+	sqlUpdateTotpStep           = `update totp set step=? where "user"=? and step<?`
+	sqlDeleteTotp               = `delete from totp where "user"=?`
+	sqlInsertRecoveryCode       = `insert into recovery_code("user",code) values(?,?)`
+	sqlQueryRecoveryCodeCount   = `select count(*) from recovery_code where "user"=?`
+	sqlDeleteRecoveryCode       = `delete from recovery_code where "user"=? and code=?`
+	sqlDeleteRecoveryCodeByUser = `delete from recovery_code where "user"=?`
+)
+
+type userRepository struct {
+	db *DB
+}
+
+func NewUserRepository(db *DB) UserRepository {
+	return &userRepository{db: db}
+}
+
+func (r *userRepository) CountUser() (count int, err error) {
+	err = r.db.QueryRow(sqlQueryUserCount).Scan(&count)
+	return
+}
+
+func (r *userRepository) InsertUser(username string, password Password, alias, permissions string) (err error) {
+	_, err = r.db.exec(sqlInsertUser, username, password.Salt, password.Hash, alias, permissions)
+	return
+}
+
+func (r *userRepository) QueryUserByUsername(username string) (user User, err error) {
+	user.Username = username
+	err = r.db.QueryRow(sqlQueryUserByUsername, username).Scan(&user.UserID, &user.AliasName, &user.Permissions)
+	if err != nil {
+		return
+	}
+	user.Roles, err = r.QueryUserRoles(user.UserID)
+	return
+}
+
+func (r *userRepository) QueryUserById(id uint64) (user User, err error) {
+	user.UserID = id
+	err = r.db.QueryRow(sqlQueryUserById, id).Scan(&user.Username, &user.AliasName, &user.Permissions)
+	if err != nil {
+		return
+	}
+	user.Roles, err = r.QueryUserRoles(user.UserID)
+	return
+}
+
+func (r *userRepository) queryAllUserRoles() (roles map[uint64][]string, err error) {
+	roles = map[uint64][]string{}
+	err = r.db.query(sqlQueryAllUserRole, func(rows *sql.Rows) error {
+		id := uint64(0)
+		name := ""
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		roles[id] = append(roles[id], name)
+		return nil
+	})
+	return
+}
+
+func (r *userRepository) ScanAllUser(handle func(user User) error) (err error) {
+	roles, err := r.queryAllUserRoles()
+	if err != nil {
+		return
+	}
+	return r.db.query(sqlQueryAllUser, func(rows *sql.Rows) error {
+		user := User{}
+		if err := rows.Scan(&user.UserID, &user.Username, &user.AliasName, &user.Permissions); err != nil {
+			return err
+		}
+		user.Roles = roles[user.UserID]
+		if user.Roles == nil {
+			user.Roles = []string{}
+		}
+		return handle(user)
+	})
+}
+
+func (r *userRepository) UpdateUser(id uint64, username string, password Password, alias, permissions string, keep int, timestamp int64) (ok bool, err error) {
+	err = r.db.transaction(func(tx *Tx) error {
+		var result sql.Result
+		var err error
+		if password.Hash == "" {
+			result, err = tx.Exec(sqlUpdateUserInfo, username, alias, permissions, id)
+		} else {
+			// 先归档再修改,修改失败时一起回滚
+			if err := archivePassword(tx, id, keep, timestamp); err != nil {
+				if err == sql.ErrNoRows {
+					return nil
+				}
+				return err
+			}
+			result, err = tx.Exec(sqlUpdateUser, username, password.Salt, password.Hash, alias, permissions, id)
+		}
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		ok = affected == 1
+		if !ok || password.Hash == "" {
+			return nil
+		}
+		// 修改密码后原来的会话和令牌都失效
+		for _, query := range []string{sqlDeleteSessionByUser, sqlDeleteTokenByUser} {
+			if _, err = tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (r *userRepository) DeleteUser(id uint64) (ok bool, err error) {
+	err = r.db.transaction(func(tx *Tx) error {
+		result, err := tx.Exec(sqlDeleteUser, id)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		ok = affected == 1
+		for _, query := range []string{sqlDeletePasswordHistory, sqlDeleteSessionByUser, sqlDeleteUserRoleByUser,
+			sqlDeleteTokenByUser, sqlDeleteTotp, sqlDeleteRecoveryCodeByUser} {
+			if _, err = tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (r *userRepository) QueryPasswordByUsername(username string) (password Password, err error) {
+	err = r.db.QueryRow(sqlQueryPasswordByUsername, username).Scan(&password.Salt, &password.Hash)
+	return
+}
+
+func (r *userRepository) QueryPasswordById(id uint64) (password Password, err error) {
+	err = r.db.QueryRow(sqlQueryPasswordById, id).Scan(&password.Salt, &password.Hash)
+	return
+}
+
+func (r *userRepository) UpdatePasswordByUsername(username string, password Password) (err error) {
+	_, err = r.db.exec(sqlUpdatePasswordByUsername, password.Salt, password.Hash, username)
+	return
+}
+
+func (r *userRepository) QueryPasswordHistory(id uint64, limit int) (passwords []Password, err error) {
+	err = r.db.query(sqlQueryPasswordHistory, func(rows *sql.Rows) error {
+		password := Password{}
+		if err := rows.Scan(&password.Salt, &password.Hash); err != nil {
+			return err
+		}
+		passwords = append(passwords, password)
+		return nil
+	}, id, limit)
+	return
+}
+
+func (r *userRepository) ArchivePassword(id uint64, keep int, timestamp int64) (err error) {
+	return r.db.transaction(func(tx *Tx) error {
+		return archivePassword(tx, id, keep, timestamp)
+	})
+}
+
+func archivePassword(tx *Tx, id uint64, keep int, timestamp int64) (err error) {
+	if keep < 0 {
+		keep = 0
+	}
+	password := Password{}
+	if err = tx.QueryRow(sqlQueryPasswordById, id).Scan(&password.Salt, &password.Hash); err != nil {
+		return
+	}
+	if _, err = tx.Exec(sqlInsertPasswordHistory, id, password.Salt, password.Hash, timestamp); err != nil {
+		return
+	}
+	_, err = tx.Exec(sqlTrimPasswordHistory, id, id, keep)
+	return
+}
+
+func splitPermissions(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(text, ",")
+}
+
+func scanRole(row interface{ Scan(...interface{}) error }) (role Role, err error) {
+	permissions := ""
+	if err = row.Scan(&role.ID, &role.Name, &permissions, &role.Builtin, &role.RequireTotp); err != nil {
+		return
+	}
+	role.Permissions = splitPermissions(permissions)
+	return
+}
+
+func (r *userRepository) UpsertBuiltinRole(name string, permissions []string) (err error) {
+	_, err = r.db.exec(sqlUpsertBuiltinRole, name, strings.Join(permissions, ","))
+	return
+}
+
+func (r *userRepository) QueryAllRole() (roles []Role, err error) {
+	err = r.db.query(sqlQueryAllRole, func(rows *sql.Rows) error {
+		role, err := scanRole(rows)
+		if err != nil {
+			return err
+		}
+		roles = append(roles, role)
+		return nil
+	})
+	return
+}
+
+func (r *userRepository) QueryRoleById(id uint64) (role Role, err error) {
+	return scanRole(r.db.QueryRow(sqlQueryRoleById, id))
+}
+
+func (r *userRepository) QueryRoleByName(name string) (role Role, err error) {
+	return scanRole(r.db.QueryRow(sqlQueryRoleByName, name))
+}
+
+func (r *userRepository) InsertRole(name string, permissions []string) (err error) {
+	_, err = r.db.exec(sqlInsertRole, name, strings.Join(permissions, ","))
+	return
+}
+
+func (r *userRepository) UpdateRole(id uint64, name string, permissions []string) (err error) {
+	_, err = r.db.exec(sqlUpdateRole, name, strings.Join(permissions, ","), id)
+	return
+}
+
+func (r *userRepository) DeleteRole(id uint64) (err error) {
+	return r.db.transaction(func(tx *Tx) error {
+		if _, err := tx.Exec(sqlDeleteUserRoleByRole, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(sqlDeleteRole, id)
+		return err
+	})
+}
+
+func (r *userRepository) UpdateRoleTotp(id uint64, required bool) (err error) {
+	affected, err := r.db.exec(sqlUpdateRoleTotp, required, id)
+	if err == nil && affected != 1 {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+func (r *userRepository) QueryUserPermissions(id uint64) (permissions []string, err error) {
+	err = r.db.query(sqlQueryUserPermissions, func(rows *sql.Rows) error {
+		text := ""
+		if err := rows.Scan(&text); err != nil {
+			return err
+		}
+		permissions = append(permissions, splitPermissions(text)...)
+		return nil
+	}, id)
+	return
+}
+
+func (r *userRepository) QueryUserRoles(id uint64) (roles []string, err error) {
+	roles = []string{}
+	err = r.db.query(sqlQueryRoleNamesByUser, func(rows *sql.Rows) error {
+		name := ""
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		roles = append(roles, name)
+		return nil
+	}, id)
+	return
+}
+
+func (r *userRepository) ReplaceUserRoles(id uint64, roles []uint64) (err error) {
+	return r.db.transaction(func(tx *Tx) error {
+		if _, err := tx.Exec(sqlDeleteUserRoleByUser, id); err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if _, err := tx.Exec(sqlInsertUserRole, id, role); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *userRepository) TotpRequired(id uint64) (required bool, err error) {
+	count := 0
+	if err = r.db.QueryRow(sqlQueryUserTotpRequired, id).Scan(&count); err != nil {
+		return
+	}
+	required = count != 0
+	return
+}
+
+func (r *userRepository) InsertSession(token string, user uint64, addr, agent string, now int64, totp bool) (err error) {
+	_, err = r.db.exec(sqlInsertSession, token, user, addr, agent, now, now, totp)
+	return
+}
+
+func (r *userRepository) QuerySessionByToken(token string) (session Session, user User, err error) {
+	err = r.db.QueryRow(sqlQuerySessionByToken, token).Scan(&session.ID, &session.Created, &session.Accessed, &session.Totp,
+		&user.UserID, &user.Username, &user.AliasName, &user.Permissions)
+	if err != nil {
+		return
+	}
+	session.UserID = user.UserID
+	session.Username = user.Username
+	user.Roles, err = r.QueryUserRoles(user.UserID)
+	return
+}
+
+func (r *userRepository) QueryAllSession() (sessions []Session, err error) {
+	err = r.db.query(sqlQueryAllSession, func(rows *sql.Rows) error {
+		session := Session{}
+		err := rows.Scan(&session.ID, &session.UserID, &session.Username, &session.Addr, &session.Agent, &session.Created, &session.Accessed, &session.Totp)
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+	return
+}
+
+func (r *userRepository) TouchSession(id uint64, now int64) (err error) {
+	_, err = r.db.exec(sqlUpdateSessionAccessed, now, id)
+	return
+}
+
+func (r *userRepository) UpdateSessionTotp(id uint64) (err error) {
+	_, err = r.db.exec(sqlUpdateSessionTotp, id)
+	return
+}
+
+func (r *userRepository) DeleteSessionById(id uint64) (err error) {
+	_, err = r.db.exec(sqlDeleteSessionById, id)
+	return
+}
+
+func (r *userRepository) DeleteExpiredSession(accessed, created int64) (err error) {
+	_, err = r.db.exec(sqlDeleteExpiredSession, accessed, created)
+	return
+}
+
+func (r *userRepository) TrimUserSession(user uint64, keep int) (err error) {
+	_, err = r.db.exec(sqlTrimUserSession, user, user, keep)
+	return
+}
+
+func (r *userRepository) QueryTotp(id uint64) (secret string, enabled bool, step int64, err error) {
+	err = r.db.QueryRow(sqlQueryTotp, id).Scan(&secret, &enabled, &step)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (r *userRepository) UpsertTotp(id uint64, secret string) (err error) {
+	_, err = r.db.exec(sqlUpsertTotp, id, secret)
+	return
+}
+
+func (r *userRepository) EnableTotp(id uint64, step int64, codes []string) (err error) {
+	return r.db.transaction(func(tx *Tx) error {
+		if _, err := tx.Exec(sqlEnableTotp, step, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlDeleteRecoveryCodeByUser, id); err != nil {
+			return err
+		}
+		for _, code := range codes {
+			if _, err := tx.Exec(sqlInsertRecoveryCode, id, code); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *userRepository) UpdateTotpStep(id uint64, step int64) (ok bool, err error) {
+	affected, err := r.db.exec(sqlUpdateTotpStep, step, id, step)
+	ok = affected == 1
+	return
+}
+
+func (r *userRepository) DeleteTotp(id uint64) (err error) {
+	return r.db.transaction(func(tx *Tx) error {
+		if _, err := tx.Exec(sqlDeleteTotp, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(sqlDeleteRecoveryCodeByUser, id)
+		return err
+	})
+}
+
+func (r *userRepository) ConsumeRecoveryCode(id uint64, code string) (ok bool, err error) {
+	affected, err := r.db.exec(sqlDeleteRecoveryCode, id, code)
+	ok = affected == 1
+	return
+}
+
+func (r *userRepository) CountRecoveryCode(id uint64) (count int, err error) {
+	err = r.db.QueryRow(sqlQueryRecoveryCodeCount, id).Scan(&count)
+	return
+}
+
+// InsertToken PostgreSQL 不支持 LastInsertId,通过 returning 返回新的 id
+func (r *userRepository) InsertToken(user uint64, name, token string, permissions []string, created, expires int64, totp bool) (id uint64, err error) {
+	err = r.db.QueryRow(sqlInsertToken, user, name, token, strings.Join(permissions, ","), created, expires, totp).Scan(&id)
+	return
+}
+
+func (r *userRepository) QueryTokenByHash(hash string) (token Token, user User, err error) {
+	permissions := ""
+	err = r.db.QueryRow(sqlQueryTokenByHash, hash).Scan(&token.ID, &permissions, &token.Expires, &token.Used, &token.Totp,
+		&user.UserID, &user.Username, &user.AliasName, &user.Permissions)
+	if err != nil {
+		return
+	}
+	token.Permissions = splitPermissions(permissions)
+	user.Roles, err = r.QueryUserRoles(user.UserID)
+	return
+}
+
+func (r *userRepository) QueryUserTokens(user uint64) (tokens []Token, err error) {
+	tokens = []Token{}
+	err = r.db.query(sqlQueryUserTokens, func(rows *sql.Rows) error {
+		token := Token{}
+		permissions := ""
+		if err := rows.Scan(&token.ID, &token.Name, &permissions, &token.Created, &token.Expires, &token.Used, &token.Totp); err != nil {
+			return err
+		}
+		token.Permissions = splitPermissions(permissions)
+		tokens = append(tokens, token)
+		return nil
+	}, user)
+	return
+}
+
+func (r *userRepository) TouchToken(id uint64, now int64) (err error) {
+	_, err = r.db.exec(sqlUpdateTokenUsed, now, id)
+	return
+}
+
+func (r *userRepository) DeleteToken(id, user uint64) (err error) {
+	affected, err := r.db.exec(sqlDeleteToken, id, user)
+	if err == nil && affected != 1 {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+func (r *userRepository) InsertLoginEvent(username, addr, agent string, timestamp int64, locked bool) (err error) {
+	_, err = r.db.exec(sqlInsertLoginEvent, username, addr, agent, timestamp, locked)
+	return
+}
+
+func (r *userRepository) QueryLoginEventLimitOffset(limit, offset int) (events []LoginEvent, err error) {
+	events = []LoginEvent{}
+	err = r.db.query(sqlQueryLoginEventLimitOffset, func(rows *sql.Rows) error {
+		e := LoginEvent{}
+		if err := rows.Scan(&e.ID, &e.Username, &e.Addr, &e.Agent, &e.Timestamp, &e.Locked, &e.Status); err != nil {
+			return err
+		}
+		events = append(events, e)
+		return nil
+	}, r.db.Limit(limit), offset)
+	return
+}
+
+func (r *userRepository) UpdateLoginEventStatus(id uint64, status int) (err error) {
+	_, err = r.db.exec(sqlUpdateLoginEventStatus, status, id)
+	return
+}
@@ -2,12 +2,12 @@
 package telegram
 
 import (
-	"database/sql"
 	"encoding/json"
 	"sync"
 	"syscall"
 	"time"
 	"uranus/internal/config"
+	"uranus/internal/storage"
 	"uranus/pkg/connector"
 	"uranus/pkg/process"
 
@@ -28,7 +28,7 @@ func NewWorker(token string, ownerID int64) *TelegramWorker {
 	return &w
 }
 
-func SetStandaloneMode(db *sql.DB) (err error) {
+func SetStandaloneMode(db *storage.DB) (err error) {
 	cfg, err := config.New(db)
 	if err != nil {
 		logrus.Error(err)
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// v1 接口统一的路径前缀
+const Prefix = "/api/v1"
+
+// 角色权限控制的资源,为空表示所有登录的用户都可以访问
+const (
+	ResourceModule  = "module"
+	ResourcePolicy  = "policy"
+	ResourceEvent   = "event"
+	ResourceUser    = "user"
+	ResourceControl = "control"
+	ResourceAudit   = "audit"
+)
+
+// GET 请求需要读权限,其他请求需要写权限
+const (
+	ActionRead  = "read"
+	ActionWrite = "write"
+)
+
+var Resources = []string{ResourceModule, ResourcePolicy, ResourceEvent, ResourceUser, ResourceControl, ResourceAudit}
+
+type Route struct {
+	// v1 接口的请求方法和不含前缀的路径
+	Method string
+	Path   string
+	// 迁移期间保留的旧版 POST 接口路径,为空时不注册旧版接口
+	Legacy string
+	// 无需登录即可访问
+	Public bool
+	// 路径不使用 v1 前缀,用于 /healthz 等约定俗成的路径
+	Root bool
+	// 访问接口需要的资源权限
+	Resource string
+
+	// 以下字段用于生成接口文档, Request 和 Response 为参数和响应数据的零值
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	Statuses []int
+
+	Handler gin.HandlerFunc
+}
+
+// 中间件保存到请求中的当前接口和路径前缀
+const (
+	contextRoute = "api route"
+	contextBase  = "api base"
+)
+
+// Registry 一个 gin.Engine 上注册的接口,用于权限检查和生成接口文档
+type Registry struct {
+	engine *gin.Engine
+	// 反向代理部署时的路径前缀,例如 /uranus,部署在根路径时为空.
+	// 注册的路由不包含该前缀,请求在交给路由之前去掉前缀
+	base string
+	// 请求方法和路由到接口的映射,旧版接口和 v1 接口指向同一个 Route
+	routes map[string]*Route
+	// 按注册顺序排列的 v1 接口,用于生成接口文档
+	ordered []*Route
+}
+
+// NewRegistry 需要在其他中间件之前调用,之后注册的请求才能通过 Lookup 找到对应的接口
+func NewRegistry(engine *gin.Engine, base string) *Registry {
+	r := &Registry{
+		engine: engine,
+		base:   base,
+		routes: map[string]*Route{},
+	}
+	engine.Use(r.middleware())
+	return r
+}
+
+func key(method, path string) string {
+	return method + " " + path
+}
+
+func (r *Registry) middleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if route, ok := r.routes[key(context.Request.Method, context.FullPath())]; ok {
+			context.Set(contextRoute, route)
+		}
+		context.Set(contextBase, r.base)
+		context.Next()
+	}
+}
+
+// Use 添加对之后注册的接口生效的中间件
+func (r *Registry) Use(middleware ...gin.HandlerFunc) {
+	r.engine.Use(middleware...)
+}
+
+// Base 返回路径前缀
+func (r *Registry) Base() string {
+	return r.base
+}
+
+// Routes 返回 engine 上的全部路由,包括没有通过 Register 注册的路由
+func (r *Registry) Routes() gin.RoutesInfo {
+	return r.engine.Routes()
+}
+
+// Register 同时注册旧版 POST 接口和 v1 接口
+func (r *Registry) Register(routes []Route) {
+	for i := range routes {
+		route := &routes[i]
+		r.engine.Handle(route.Method, route.FullPath(), route.Handler)
+		if route.Legacy != "" {
+			r.engine.POST(route.Legacy, route.Handler)
+			r.routes[key(http.MethodPost, route.Legacy)] = route
+		}
+
+		k := key(route.Method, route.FullPath())
+		if _, ok := r.routes[k]; !ok {
+			r.ordered = append(r.ordered, route)
+		}
+		r.routes[k] = route
+	}
+}
+
+// Lookup 返回当前请求对应的接口,未注册的请求返回 false
+func Lookup(context *gin.Context) (route *Route, ok bool) {
+	value, ok := context.Get(contextRoute)
+	if !ok {
+		return
+	}
+	route, ok = value.(*Route)
+	return
+}
+
+// Base 返回当前请求所在的路径前缀,用于设置 Cookie 的路径
+func Base(context *gin.Context) string {
+	return context.GetString(contextBase)
+}
+
+// FullPath 返回注册到路由的完整路径
+func (r *Route) FullPath() string {
+	if r.Root {
+		return r.Path
+	}
+	return Prefix + r.Path
+}
+
+// LegacyPath 返回旧版权限通配符匹配的路径,存在旧版接口时统一使用旧版路径
+func (r *Route) LegacyPath() string {
+	if r.Legacy != "" {
+		return r.Legacy
+	}
+	return r.FullPath()
+}
+
+// Permission 返回访问接口需要的权限,格式为 resource:action
+func (r *Route) Permission() string {
+	if r.Resource == "" {
+		return ""
+	}
+	action := ActionWrite
+	if r.Method == http.MethodGet {
+		action = ActionRead
+	}
+	return r.Resource + ":" + action
+}
+
+// Permissions 返回所有可以分配给角色的权限
+func Permissions() (permissions []string) {
+	for _, resource := range Resources {
+		permissions = append(permissions, resource+":"+ActionRead, resource+":"+ActionWrite)
+	}
+	return
+}
+
+// Bind 根据请求方法解析参数, GET 和 DELETE 从 query 中读取,其他方法读取 JSON,
+// 最后用路径参数覆盖.只有路径参数的请求可以不带 body
+func Bind(context *gin.Context, obj interface{}) (err error) {
+	switch context.Request.Method {
+	case http.MethodGet, http.MethodDelete:
+		err = context.ShouldBindQuery(obj)
+	default:
+		if context.Request.ContentLength != 0 || len(context.Params) == 0 {
+			err = context.ShouldBindJSON(obj)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if len(context.Params) != 0 {
+		err = context.ShouldBindUri(obj)
+	}
+	return
+}
+
+type localKey struct{}
+
+// WithLocal 标记进程内发起的请求,例如直接访问数据库的 uranusctl.
+// 这类请求不经过网络,能访问数据库的用户视为拥有全部权限
+func WithLocal(request *http.Request, username string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), localKey{}, username))
+}
+
+// Local 返回进程内请求的操作者
+func Local(request *http.Request) (username string, ok bool) {
+	username, ok = request.Context().Value(localKey{}).(string)
+	return
+}
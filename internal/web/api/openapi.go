@@ -0,0 +1,305 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+)
+
+type object = map[string]interface{}
+
+// 所有需要登录的接口都可能返回的状态码
+var protected = []int{
+	render.StatusUnknownError,
+	render.StatusUserNotLoggedIn,
+	render.StatusUserPermissionDenied,
+}
+
+var param = regexp.MustCompile(`:([^/]+)`)
+
+// Document 返回 OpenAPI 3 格式的接口文档
+func (r *Registry) Document(context *gin.Context) {
+	context.JSON(http.StatusOK, r.Spec())
+}
+
+// Spec 根据已注册的接口生成 OpenAPI 3 文档
+func (r *Registry) Spec() map[string]interface{} {
+	paths := object{}
+	for _, route := range r.ordered {
+		path := param.ReplaceAllString(route.FullPath(), "{$1}")
+		addOperation(paths, path, route.Method, operation(route, false))
+		if route.Legacy != "" {
+			addOperation(paths, route.Legacy, http.MethodPost, operation(route, true))
+		}
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "uranus",
+			"version": "v1",
+		},
+		"servers":  []interface{}{object{"url": r.base + "/"}},
+		"paths":    paths,
+		"security": []interface{}{object{"session": []string{}}, object{"token": []string{}}},
+		"components": object{
+			"schemas": object{
+				"Status": statusSchema(),
+			},
+			"securitySchemes": object{
+				"session": object{"type": "apiKey", "in": "cookie", "name": "session"},
+				"token":   object{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func addOperation(paths object, path, method string, op object) {
+	item, ok := paths[path].(object)
+	if !ok {
+		item = object{}
+		paths[path] = item
+	}
+	item[strings.ToLower(method)] = op
+}
+
+func operation(route *Route, legacy bool) (op object) {
+	op = object{
+		"summary":   route.Summary,
+		"responses": responses(route, legacy),
+	}
+	if legacy {
+		op["deprecated"] = true
+	}
+	if route.Public {
+		op["security"] = []interface{}{}
+	}
+	if permission := route.Permission(); permission != "" {
+		op["x-permission"] = permission
+	}
+
+	if route.Request == nil {
+		return
+	}
+	t := reflect.TypeOf(route.Request)
+
+	if legacy {
+		op["requestBody"] = body(schema(t, "json", nil))
+		return
+	}
+
+	parameters := []interface{}{}
+	for _, field := range fields(t) {
+		if name := tagName(field, "uri"); name != "" {
+			parameters = append(parameters, object{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   schema(field.Type, "json", nil),
+			})
+		}
+	}
+
+	switch route.Method {
+	case http.MethodGet, http.MethodDelete:
+		for _, field := range fields(t) {
+			if name := tagName(field, "form"); name != "" {
+				parameters = append(parameters, object{
+					"name":     name,
+					"in":       "query",
+					"required": required(field),
+					"schema":   schema(field.Type, "json", nil),
+				})
+			}
+		}
+	default:
+		op["requestBody"] = body(schema(t, "json", func(field reflect.StructField) bool {
+			return tagName(field, "uri") != ""
+		}))
+	}
+
+	if len(parameters) != 0 {
+		op["parameters"] = parameters
+	}
+	return
+}
+
+func body(s object) object {
+	return object{
+		"required": true,
+		"content": object{
+			"application/json": object{"schema": s},
+		},
+	}
+}
+
+// 按 HTTP 状态码合并接口可能返回的状态码,旧版接口全部返回 200
+func responses(route *Route, legacy bool) object {
+	statuses := append([]int{render.StatusSuccess}, route.Statuses...)
+	if !route.Public {
+		statuses = append(statuses, protected...)
+	}
+
+	grouped := map[int][]int{}
+	for _, status := range statuses {
+		code := http.StatusOK
+		if !legacy {
+			code = render.HTTPStatus(status)
+		}
+		if !contains(grouped[code], status) {
+			grouped[code] = append(grouped[code], status)
+		}
+	}
+
+	result := object{}
+	for code, statuses := range grouped {
+		sort.Ints(statuses)
+		descriptions := []string{}
+		enum := []interface{}{}
+		withData := false
+		for _, status := range statuses {
+			descriptions = append(descriptions, fmt.Sprintf("%d: %s", status, render.Message(status)))
+			enum = append(enum, status)
+			withData = withData || status == render.StatusSuccess
+		}
+
+		properties := object{
+			"status":  object{"type": "integer", "enum": enum},
+			"message": object{"type": "string"},
+		}
+		if withData && route.Response != nil {
+			properties["data"] = schema(reflect.TypeOf(route.Response), "json", nil)
+		}
+
+		result[fmt.Sprint(code)] = object{
+			"description": strings.Join(descriptions, "; "),
+			"content": object{
+				"application/json": object{
+					"schema": object{
+						"type":       "object",
+						"required":   []string{"status", "message"},
+						"properties": properties,
+					},
+				},
+			},
+		}
+	}
+	return result
+}
+
+func statusSchema() object {
+	enum := []interface{}{}
+	descriptions := []string{}
+	for _, status := range render.Statuses() {
+		enum = append(enum, status)
+		descriptions = append(descriptions, fmt.Sprintf("%d: %s", status, render.Message(status)))
+	}
+	return object{
+		"type":        "integer",
+		"enum":        enum,
+		"description": strings.Join(descriptions, "\n"),
+	}
+}
+
+func schema(t reflect.Type, tag string, skip func(reflect.StructField) bool) object {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": schema(t.Elem(), tag, nil)}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": schema(t.Elem(), tag, nil)}
+	case reflect.Struct:
+		properties := object{}
+		requiredFields := []string{}
+		for _, field := range fields(t) {
+			if skip != nil && skip(field) {
+				continue
+			}
+			name := tagName(field, tag)
+			if name == "" {
+				continue
+			}
+			properties[name] = schema(field.Type, tag, nil)
+			if required(field) {
+				requiredFields = append(requiredFields, name)
+			}
+		}
+		s := object{"type": "object", "properties": properties}
+		if len(requiredFields) != 0 {
+			s["required"] = requiredFields
+		}
+		return s
+	default:
+		return object{}
+	}
+}
+
+// 展开匿名嵌入的结构体字段
+func fields(t reflect.Type) (result []reflect.StructField) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			result = append(result, fields(field.Type)...)
+			continue
+		}
+		if field.IsExported() {
+			result = append(result, field)
+		}
+	}
+	return
+}
+
+func tagName(field reflect.StructField, tag string) string {
+	name := strings.Split(field.Tag.Get(tag), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" && tag == "json" {
+		return field.Name
+	}
+	return name
+}
+
+func required(field reflect.StructField) bool {
+	for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/export"
+	"uranus/internal/web/render"
+	"uranus/pkg/connector"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const contextEntry = "audit"
+
+type Worker struct {
+	registry *api.Registry
+	db       *storage.DB
+}
+
+// Change 记录一次配置或策略的修改, Before 为空表示新增, After 为空表示删除
+type Change struct {
+	Key    string      `json:"key"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type Entry struct {
+	ID        uint64 `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Username  string `json:"username"`
+	// 使用 API 令牌访问时的令牌 ID
+	Token  uint64 `json:"token"`
+	Addr   string `json:"addr"`
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	Path   string `json:"path"`
+	// 接口返回的状态
+	Status  int      `json:"status"`
+	Changes []Change `json:"changes"`
+	// hackernel 返回的 code,没有访问 hackernel 时为空
+	Hackernel *int `json:"hackernel"`
+	// 未能得到 hackernel 响应时的错误
+	Error string `json:"error"`
+}
+
+type listRequest struct {
+	Username string `json:"username" form:"username"`
+	Method   string `json:"method" form:"method"`
+	// 按接口路径模糊匹配
+	Route string `json:"route" form:"route"`
+	// success 或 failure,为空时不过滤
+	Outcome string `json:"outcome" form:"outcome" binding:"omitempty,oneof=success failure"`
+	From    int64  `json:"from" form:"from" binding:"min=0"`
+	To      int64  `json:"to" form:"to" binding:"min=0"`
+	Limit   int    `json:"limit" form:"limit" binding:"number"`
+	Offset  int    `json:"offset" form:"offset" binding:"number"`
+}
+
+type exportRequest struct {
+	listRequest
+	export.Request
+}
+
+// Init 注册审计日志中间件.中间件需要记录未通过登录检查的请求,必须在其他中间件之前注册,
+// 审计日志的查询接口在其他模块初始化之后通过 Register 注册
+func Init(registry *api.Registry, db *storage.DB) (w *Worker, err error) {
+	w = &Worker{
+		registry: registry,
+		db:       db,
+	}
+	w.registry.Use(w.middleware())
+	return
+}
+
+func (w *Worker) Register() {
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/audit", Legacy: "/audit/list", Resource: api.ResourceAudit, Handler: w.auditList,
+			Summary: "审计日志列表", Request: listRequest{}, Response: []Entry{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusAuditQueryFailed}},
+		{Method: http.MethodGet, Path: "/audit/export", Legacy: "/audit/export", Resource: api.ResourceAudit, Handler: w.auditExport,
+			Summary: "导出审计日志,支持 ndjson 和 csv 格式", Request: exportRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusAuditQueryFailed}},
+	})
+}
+
+func current(context *gin.Context) *Entry {
+	value, ok := context.Get(contextEntry)
+	if !ok {
+		return nil
+	}
+	return value.(*Entry)
+}
+
+// Actor 记录执行操作的用户,由登录检查调用
+func Actor(context *gin.Context, username string, token uint64) {
+	if entry := current(context); entry != nil {
+		entry.Username = username
+		entry.Token = token
+	}
+}
+
+// Record 记录修改前后的值
+func Record(context *gin.Context, key string, before, after interface{}) {
+	if entry := current(context); entry != nil {
+		entry.Changes = append(entry.Changes, Change{Key: key, Before: before, After: after})
+	}
+}
+
+// Hackernel 记录向 hackernel 发送命令的结果
+func Hackernel(context *gin.Context, err error) {
+	entry := current(context)
+	if entry == nil {
+		return
+	}
+	if code, ok := connector.Code(err); ok {
+		entry.Hackernel = &code
+		return
+	}
+	entry.Error = err.Error()
+}
+
+// SetInteger 修改配置并记录修改前后的值
+func SetInteger(context *gin.Context, c *config.Config, key string, value int) (err error) {
+	var before interface{}
+	if old, err := c.GetInteger(key); err == nil {
+		before = old
+	}
+	if err = c.SetInteger(key, value); err != nil {
+		return
+	}
+	Record(context, key, before, value)
+	return
+}
+
+// 只记录会修改状态的请求
+func (w *Worker) middleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if _, ok := api.Lookup(context); !ok || context.Request.Method == http.MethodGet {
+			context.Next()
+			return
+		}
+
+		entry := &Entry{
+			Timestamp: time.Now().Unix(),
+			Addr:      context.ClientIP(),
+			Method:    context.Request.Method,
+			Route:     context.FullPath(),
+			Path:      context.Request.URL.Path,
+			Changes:   []Change{},
+		}
+		context.Set(contextEntry, entry)
+		context.Next()
+
+		var ok bool
+		if entry.Status, ok = render.Outcome(context); !ok {
+			entry.Status = render.StatusUnknownError
+		}
+		if err := w.insertEntry(entry); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func (w *Worker) auditList(context *gin.Context) {
+	request := listRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	entries := []Entry{}
+	err := w.queryEntries(request, func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		render.Status(context, render.StatusAuditQueryFailed)
+		return
+	}
+	render.Success(context, entries)
+}
+
+var csvHeader = []string{"id", "timestamp", "username", "token", "addr", "method", "route", "path", "status", "changes", "hackernel", "error"}
+
+func csvRecord(row interface{}) []string {
+	entry := row.(Entry)
+	changes, _ := json.Marshal(entry.Changes)
+	hackernel := ""
+	if entry.Hackernel != nil {
+		hackernel = strconv.Itoa(*entry.Hackernel)
+	}
+	return []string{
+		strconv.FormatUint(entry.ID, 10),
+		export.Time(entry.Timestamp),
+		entry.Username,
+		strconv.FormatUint(entry.Token, 10),
+		entry.Addr,
+		entry.Method,
+		entry.Route,
+		entry.Path,
+		strconv.Itoa(entry.Status),
+		string(changes),
+		hackernel,
+		entry.Error,
+	}
+}
+
+// auditExport 按过滤条件导出全部审计日志,逐行写入响应
+func (w *Worker) auditExport(context *gin.Context) {
+	request := exportRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	// 导出时不分页
+	request.Limit = -1
+	request.Offset = 0
+
+	writer, err := export.New(context, "audit", request.Format, csvHeader, csvRecord)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer writer.Flush()
+
+	err = w.queryEntries(request.listRequest, func(entry Entry) error {
+		return writer.Write(entry)
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
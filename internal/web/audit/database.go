@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+const (
+	sqlInsertAudit = `insert into audit_log(timestamp,username,token,addr,method,route,path,status,changes,hackernel,error) values(?,?,?,?,?,?,?,?,?,?,?)`
+	// 过滤条件为空值时不生效, limit 为负数时不限制数量
+	sqlQueryAudit = `select id,timestamp,username,token,addr,method,route,path,status,changes,hackernel,error from audit_log
+where (?='' or username=?) and (?='' or method=?) and (?='' or route like '%'||?||'%')
+and (?='' or (?='success' and status=0) or (?='failure' and status<>0))
+and (?=0 or timestamp>=?) and (?=0 or timestamp<=?)
+order by id desc limit ? offset ?`
+)
+
+func (w *Worker) insertEntry(entry *Entry) (err error) {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return
+	}
+
+	stmt, err := w.db.Prepare(sqlInsertAudit)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	var hackernel sql.NullInt64
+	if entry.Hackernel != nil {
+		hackernel = sql.NullInt64{Int64: int64(*entry.Hackernel), Valid: true}
+	}
+	_, err = stmt.Exec(entry.Timestamp, entry.Username, entry.Token, entry.Addr, entry.Method,
+		entry.Route, entry.Path, entry.Status, string(changes), hackernel, entry.Error)
+	return
+}
+
+// queryEntries 按过滤条件查询审计日志,每一行调用一次 handle
+func (w *Worker) queryEntries(request listRequest, handle func(entry Entry) error) (err error) {
+	stmt, err := w.db.Prepare(sqlQueryAudit)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(request.Username, request.Username, request.Method, request.Method,
+		request.Route, request.Route, request.Outcome, request.Outcome, request.Outcome,
+		request.From, request.From, request.To, request.To, w.db.Limit(request.Limit), request.Offset)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := Entry{}
+		changes := ""
+		hackernel := sql.NullInt64{}
+		err = rows.Scan(&entry.ID, &entry.Timestamp, &entry.Username, &entry.Token, &entry.Addr, &entry.Method,
+			&entry.Route, &entry.Path, &entry.Status, &changes, &hackernel, &entry.Error)
+		if err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(changes), &entry.Changes); err != nil {
+			return
+		}
+		if hackernel.Valid {
+			code := int(hackernel.Int64)
+			entry.Hackernel = &code
+		}
+		if err = handle(entry); err != nil {
+			return
+		}
+	}
+	err = rows.Err()
+	return
+}
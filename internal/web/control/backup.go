@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package control
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"uranus/internal/backup"
+	"uranus/internal/migration"
+	"uranus/internal/web/api"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const restorePath = "/control/backups/:name/restore"
+
+type backupRequest struct {
+	Name string `json:"name" form:"name" uri:"name"`
+}
+
+func (w *Worker) backupCreate(context *gin.Context) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	info, err := backup.Create(w.db, w.backupDir, backup.KindManual)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusControlBackupFailed)
+		return
+	}
+	logrus.Infof("database backed up to %s", info.Name)
+	render.Success(context, info)
+}
+
+func (w *Worker) backupList(context *gin.Context) {
+	infos, err := backup.List(w.backupDir)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusControlBackupFailed)
+		return
+	}
+	render.Success(context, infos)
+}
+
+func (w *Worker) backupDownload(context *gin.Context) {
+	request := backupRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	path, err := backup.Path(w.backupDir, request.Name)
+	if err != nil {
+		render.Status(context, render.StatusControlBackupNotFound)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		render.Status(context, render.StatusControlBackupNotFound)
+		return
+	}
+	context.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", request.Name))
+	context.File(path)
+}
+
+// middleware 恢复数据库期间拒绝其他请求,恢复开始前等待正在处理的请求返回.
+// 审计日志,会话访问时间和登录事件都在请求中写入,需要在这些中间件之前执行
+func (w *Worker) middleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if route, ok := api.Lookup(context); ok && route.Path == restorePath {
+			context.Next()
+			return
+		}
+		if !w.gate.TryRLock() {
+			render.Status(context, render.StatusControlRestoring)
+			context.Abort()
+			return
+		}
+		defer w.gate.RUnlock()
+		context.Next()
+	}
+}
+
+// restore 先备份当前的数据库,停止全部后台模块后用备份替换数据库,
+// 再重新初始化后台模块,初始化时把恢复后的策略发送给 hackernel
+func (w *Worker) restore(context *gin.Context) {
+	request := backupRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	path, err := backup.Path(w.backupDir, request.Name)
+	if err != nil {
+		render.Status(context, render.StatusControlBackupNotFound)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		render.Status(context, render.StatusControlBackupNotFound)
+		return
+	}
+	if err := backup.Check(path); err != nil {
+		logrus.Error(err)
+		var newer *migration.NewerSchemaError
+		if errors.Is(err, backup.ErrCorrupted) || errors.As(err, &newer) {
+			render.Status(context, render.StatusControlRestoreInvalidBackup)
+		} else {
+			render.Status(context, render.StatusControlRestoreFailed)
+		}
+		return
+	}
+
+	// 先于 w.mutex 加锁,持有读锁的备份和重启请求返回后才开始恢复
+	w.gate.Lock()
+	defer w.gate.Unlock()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	previous, err := backup.Create(w.db, w.backupDir, backup.KindRestore)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusControlBackupFailed)
+		return
+	}
+
+	names := []string{}
+	for name := range w.backgrounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.setStopped(name, true)
+		if err := w.backgrounds[name].Stop(); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	// 恢复失败时数据库保持不变,同样需要重新启动后台模块
+	restoreErr := backup.Restore(w.db, path)
+	if restoreErr != nil {
+		logrus.Error(restoreErr)
+	} else {
+		logrus.Infof("database restored from %s, previous database saved to %s", request.Name, previous.Name)
+	}
+
+	restarted := true
+	for _, name := range names {
+		if err := w.backgrounds[name].Init(); err != nil {
+			logrus.Errorf("init %s worker: %v", name, err)
+			restarted = false
+			continue
+		}
+		if err := w.backgrounds[name].Start(); err != nil {
+			logrus.Errorf("start %s worker: %v", name, err)
+			restarted = false
+			continue
+		}
+		w.setStopped(name, false)
+	}
+
+	switch {
+	case restoreErr != nil:
+		render.Status(context, render.StatusControlRestoreFailed)
+	case !restarted:
+		render.Status(context, render.StatusControlRestartFailed)
+	default:
+		render.Success(context, previous)
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"uranus/internal/backup"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recorder 记录请求和后台模块的执行顺序
+type recorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+type fakeBackground struct {
+	*recorder
+}
+
+func (b fakeBackground) Init() error  { return nil }
+func (b fakeBackground) Start() error { b.add("start"); return nil }
+func (b fakeBackground) Stop() error  { b.add("stop"); return nil }
+func (b fakeBackground) Alive() bool  { return true }
+
+func serve(engine http.Handler, method, path string) (status int) {
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	response := struct {
+		Status int `json:"status"`
+	}{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return response.Status
+}
+
+func TestRestoreWithRequestsInFlight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	db, err := storage.Open(filepath.Join(dir, "web.db") + "?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	info, err := backup.Create(db, dir, backup.KindManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := &recorder{}
+	engine := gin.New()
+	registry := api.NewRegistry(engine, "")
+	w, err := Init(registry, db, map[string]Background{"fake": fakeBackground{events}}, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	engine.POST("/write", func(context *gin.Context) {
+		close(started)
+		<-release
+		if _, err := db.Exec(`insert into config(key,integer) values('in flight',1)`); err != nil {
+			t.Error(err)
+		}
+		events.add("write")
+		render.Status(context, render.StatusSuccess)
+	})
+	w.Register()
+
+	writeDone := make(chan int)
+	go func() { writeDone <- serve(engine, http.MethodPost, "/write") }()
+	<-started
+
+	restoreDone := make(chan int)
+	go func() { restoreDone <- serve(engine, http.MethodPost, "/api/v1/control/backups/"+info.Name+"/restore") }()
+	// 恢复等待写锁时不能再获取读锁
+	for deadline := time.Now().Add(5 * time.Second); w.gate.TryRLock(); {
+		w.gate.RUnlock()
+		if time.Now().After(deadline) {
+			t.Fatal("restore did not wait for the request in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if status := serve(engine, http.MethodGet, "/api/v1/control/backups"); status != render.StatusControlRestoring {
+		t.Errorf("request during restore: status=%d", status)
+	}
+
+	close(release)
+	if status := <-writeDone; status != render.StatusSuccess {
+		t.Errorf("write: status=%d", status)
+	}
+	if status := <-restoreDone; status != render.StatusSuccess {
+		t.Errorf("restore: status=%d", status)
+	}
+	if status := serve(engine, http.MethodGet, "/api/v1/control/backups"); status != render.StatusSuccess {
+		t.Errorf("request after restore: status=%d", status)
+	}
+
+	// 正在处理的请求返回后才停止后台模块并替换数据库
+	if len(events.events) != 3 || events.events[0] != "write" {
+		t.Errorf("events: %v", events.events)
+	}
+	n := 0
+	if err := db.QueryRow(`select count(*) from config where key='in flight'`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("write after backup survived restore: n=%d err=%v", n, err)
+	}
+}
@@ -2,28 +2,119 @@
 package control
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"syscall"
 	"time"
+	"uranus/internal/backup"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
 	"uranus/internal/web/render"
 	"uranus/pkg/connector"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
-func Init(engine *gin.Engine, db *sql.DB) (err error) {
-	engine.POST("/control/echo", echo)
-	engine.POST("/control/shutdown", shutdown)
+// Background 可以单独重启的后台模块
+type Background interface {
+	Init() error
+	Start() error
+	Stop() error
+	// 在 watchdog 的周期内收到过 hackernel 的消息
+	Alive() bool
+}
+
+type Worker struct {
+	registry *api.Registry
+	db       *storage.DB
+
+	config      *config.Config
+	started     time.Time
+	mutex       sync.Mutex
+	backgrounds map[string]Background
+	backupDir   string
+	// 重新读取配置文件并应用可以在运行时修改的配置,为空时不能重新加载
+	reload func() error
+	// 恢复数据库时持有写锁,其他请求持有读锁
+	gate sync.RWMutex
+
+	// 重启或恢复数据库时已经停止,还没有重新启动成功的后台模块
+	states  sync.Mutex
+	stopped map[string]bool
+	// 最近一次检查数据库是否可写的时间和结果
+	checked  time.Time
+	database error
+}
+
+// Init backupDir 为空时不能备份和恢复数据库.恢复期间需要阻止其他请求写入数据库,
+// 因此需要在其他模块之前调用, Register 在其他模块之后注册接口
+func Init(registry *api.Registry, db *storage.DB, backgrounds map[string]Background, backupDir string, reload func() error) (w *Worker, err error) {
+	w = &Worker{
+		registry:    registry,
+		db:          db,
+		started:     time.Now(),
+		backgrounds: backgrounds,
+		backupDir:   backupDir,
+		reload:      reload,
+		stopped:     map[string]bool{},
+	}
+	if w.config, err = config.New(db); err != nil {
+		return
+	}
+	w.registry.Use(w.middleware())
 	return
 }
 
+func (w *Worker) Register() {
+	w.registry.Register([]api.Route{
+		{Method: http.MethodPost, Path: "/control/echo", Legacy: "/control/echo", Resource: api.ResourceControl, Handler: echo,
+			Summary: "向 hackernel 发送 echo 请求", Request: echoBody{}, Response: echoBody{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUnknownError}},
+		{Method: http.MethodPost, Path: "/control/shutdown", Legacy: "/control/shutdown", Resource: api.ResourceControl, Handler: shutdown,
+			Summary: "关闭服务"},
+		{Method: http.MethodPost, Path: "/control/reload", Legacy: "/control/reload", Resource: api.ResourceControl, Handler: w.reloadConfig,
+			Summary:  "重新读取配置文件,应用信任的代理, TLS 证书,写入队列,归档目录和定时备份的修改",
+			Statuses: []int{render.StatusControlReloadFailed}},
+		{Method: http.MethodPost, Path: "/control/workers/:name/restart", Legacy: "/control/worker/restart", Resource: api.ResourceControl, Handler: w.restart,
+			Summary: "重启后台模块", Request: restartRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusControlWorkerNotFound, render.StatusControlRestartFailed}},
+		{Method: http.MethodGet, Path: "/control/info", Legacy: "/control/info", Resource: api.ResourceControl, Handler: w.info,
+			Summary: "运行状态", Response: Info{},
+			Statuses: []int{render.StatusControlQueryInfoFailed}},
+		{Method: http.MethodPost, Path: "/control/backup", Legacy: "/control/backup", Resource: api.ResourceControl, Handler: w.backupCreate,
+			Summary: "备份数据库", Response: backup.Info{},
+			Statuses: []int{render.StatusControlBackupFailed}},
+		{Method: http.MethodGet, Path: "/control/backups", Legacy: "/control/backup/list", Resource: api.ResourceControl, Handler: w.backupList,
+			Summary: "备份列表,按时间从新到旧排列", Response: []backup.Info{},
+			Statuses: []int{render.StatusControlBackupFailed}},
+		{Method: http.MethodGet, Path: "/control/backups/:name", Legacy: "/control/backup/download", Resource: api.ResourceControl, Handler: w.backupDownload,
+			Summary: "下载备份文件", Request: backupRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusControlBackupNotFound}},
+		{Method: http.MethodPost, Path: restorePath, Legacy: "/control/restore", Resource: api.ResourceControl, Handler: w.restore,
+			Summary: "从备份恢复数据库,返回恢复前自动创建的备份", Request: backupRequest{}, Response: backup.Info{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusControlBackupNotFound, render.StatusControlBackupFailed,
+				render.StatusControlRestoreInvalidBackup, render.StatusControlRestoreFailed, render.StatusControlRestartFailed}},
+		{Method: http.MethodGet, Path: "/healthz", Root: true, Public: true, Handler: healthz,
+			Summary: "存活检查"},
+		{Method: http.MethodGet, Path: "/readyz", Root: true, Public: true, Handler: w.readyz,
+			Summary: "就绪检查,检查数据库, hackernel 和后台模块的状态", Response: []Check{},
+			Statuses: []int{render.StatusControlNotReady}},
+	})
+}
+
+type echoBody struct {
+	Extra interface{} `json:"extra"`
+}
+
 func echo(context *gin.Context) {
 	// 获取前端请求的参数
-	request := struct {
-		Extra interface{} `json:"extra"`
-	}{}
+	request := echoBody{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
@@ -48,9 +139,7 @@ func echo(context *gin.Context) {
 	}
 
 	// 底层返回的字符串转换后返回给前端
-	response := struct {
-		Extra interface{} `json:"extra"`
-	}{}
+	response := echoBody{}
 	if err := json.Unmarshal([]byte(responseStr), &response); err != nil {
 		render.Status(context, render.StatusUnknownError)
 		return
@@ -58,5 +147,91 @@ func echo(context *gin.Context) {
 	render.Success(context, response)
 }
 
+// shutdown 与收到 SIGTERM 时的处理相同,服务关闭前会等待当前请求返回
 func shutdown(context *gin.Context) {
+	logrus.Warnf("shutdown requested by %s", context.ClientIP())
+	render.Status(context, render.StatusSuccess)
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+}
+
+// 直接访问数据库的 uranusctl 没有需要重新加载的配置
+var errReloadUnsupported = errors.New("reload is not supported without a running service")
+
+// Reload 与重启后台模块和恢复数据库互斥,重新加载时可能需要重建后台模块的写入队列
+func (w *Worker) Reload() (err error) {
+	if w.reload == nil {
+		return errReloadUnsupported
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err = w.reload(); err != nil {
+		return
+	}
+	logrus.Info("configuration reloaded")
+	return
+}
+
+// reloadConfig 与收到 SIGHUP 时的处理相同,配置文件或证书有误时返回失败,继续使用原来的配置
+func (w *Worker) reloadConfig(context *gin.Context) {
+	logrus.Infof("reload requested by %s", context.ClientIP())
+	if err := w.Reload(); err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusControlReloadFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
+
+type restartRequest struct {
+	Name string `json:"name" uri:"name" binding:"required"`
+}
+
+// restart 停止后台模块后重新初始化,初始化时从数据库恢复模块状态和策略
+func (w *Worker) restart(context *gin.Context) {
+	request := restartRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	background, ok := w.backgrounds[request.Name]
+	if !ok {
+		render.Status(context, render.StatusControlWorkerNotFound)
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Stop 失败时模块同样释放了协程和连接,可以继续初始化
+	w.setStopped(request.Name, true)
+	if err := background.Stop(); err != nil {
+		logrus.Error(err)
+	}
+	if err := background.Init(); err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusControlRestartFailed)
+		return
+	}
+	if err := background.Start(); err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusControlRestartFailed)
+		return
+	}
+	w.setStopped(request.Name, false)
+	logrus.Infof("%s worker restarted", request.Name)
+	render.Status(context, render.StatusSuccess)
+}
+
+// setStopped 模块停止后到重新启动成功之前,就绪检查不比较模块的状态
+func (w *Worker) setStopped(name string, stopped bool) {
+	w.states.Lock()
+	defer w.states.Unlock()
+	w.stopped[name] = stopped
+}
+
+func (w *Worker) isStopped(name string) bool {
+	w.states.Lock()
+	defer w.states.Unlock()
+	return w.stopped[name]
 }
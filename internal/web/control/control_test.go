@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package control
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 重新加载在请求中同步执行,失败时返回错误码
+func TestReloadReportsFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := storage.Open(filepath.Join(t.TempDir(), "web.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var failure error
+	reloaded := 0
+	engine := gin.New()
+	registry := api.NewRegistry(engine, "")
+	w, err := Init(registry, db, map[string]Background{}, "", func() error {
+		reloaded++
+		return failure
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Register()
+
+	failure = errors.New("tls: failed to find any PEM data in certificate input")
+	if status := serve(engine, http.MethodPost, "/api/v1/control/reload"); status != render.StatusControlReloadFailed {
+		t.Errorf("failed reload: status=%d", status)
+	}
+	failure = nil
+	if status := serve(engine, http.MethodPost, "/api/v1/control/reload"); status != render.StatusSuccess {
+		t.Errorf("reload: status=%d", status)
+	}
+	if reloaded != 2 {
+		t.Errorf("reloaded=%d", reloaded)
+	}
+}
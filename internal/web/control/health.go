@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package control
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/web/render"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+	"uranus/pkg/process"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sqlInsertHealth = `insert into health(timestamp) values(?)`
+)
+
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// 模块在配置中的状态和最近一次发送给 hackernel 的状态
+type module struct {
+	name   string
+	key    string
+	pushed func() (int, bool)
+}
+
+var modules = []module{
+	{name: "process", key: config.ProcessModuleStatus, pushed: process.Pushed},
+	{name: "file", key: config.FileModuleStatus, pushed: file.Pushed},
+	{name: "net", key: config.NetModuleStatus, pushed: net.Pushed},
+}
+
+// 数据库检查结果的缓存时间,避免频繁的探测与写入事件争用数据库的写锁
+const databaseCheckInterval = 10 * time.Second
+
+// checkDatabase 在事务中写入后回滚,只检查数据库是否可写.结果缓存 databaseCheckInterval
+func (w *Worker) checkDatabase() error {
+	w.states.Lock()
+	defer w.states.Unlock()
+	if !w.checked.IsZero() && time.Since(w.checked) < databaseCheckInterval {
+		return w.database
+	}
+	w.database = w.writeHealth()
+	w.checked = time.Now()
+	return w.database
+}
+
+func (w *Worker) writeHealth() (err error) {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(sqlInsertHealth, time.Now().Unix())
+	return
+}
+
+func (w *Worker) checkModule(m module) (err error) {
+	status, err := w.config.GetInteger(m.key)
+	if err != nil {
+		// 与模块状态接口相同,没有配置时视为关闭
+		err = nil
+		status = process.StatusDisable
+	}
+	pushed, ok := m.pushed()
+	if !ok {
+		return fmt.Errorf("status not pushed to hackernel")
+	}
+	if pushed != status {
+		return fmt.Errorf("status %d in config, %d pushed to hackernel", status, pushed)
+	}
+	return
+}
+
+// checkBackground 只有与 hackernel 通信的模块通过 watchdog 判断是否可用
+func (w *Worker) checkBackground(name string) error {
+	if w.isStopped(name) {
+		return fmt.Errorf("stopped or restarting")
+	}
+	if w.backgrounds[name].Alive() {
+		return nil
+	}
+	for _, m := range modules {
+		if m.name == name {
+			return fmt.Errorf("no osinfo::report received within the watchdog interval")
+		}
+	}
+	return fmt.Errorf("not running")
+}
+
+func healthz(context *gin.Context) {
+	render.Status(context, render.StatusSuccess)
+}
+
+// readyz 所有检查都通过时返回成功,否则返回 503 和每一项检查的结果
+func (w *Worker) readyz(context *gin.Context) {
+	checks := []Check{}
+	add := func(name string, err error) {
+		check := Check{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	add("database", w.checkDatabase())
+
+	hackernel := ping()
+	if hackernel.Reachable {
+		add("hackernel", nil)
+	} else {
+		add("hackernel", fmt.Errorf("%s", hackernel.Error))
+	}
+
+	names := []string{}
+	for name := range w.backgrounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add("worker "+name, w.checkBackground(name))
+	}
+
+	// 模块停止时已经关闭了 hackernel 中的模块,状态与配置不一致,只由上面的检查报告
+	for _, m := range modules {
+		if w.isStopped(m.name) {
+			continue
+		}
+		add("module "+m.name, w.checkModule(m))
+	}
+
+	for _, check := range checks {
+		if !check.OK {
+			render.Data(context, render.StatusControlNotReady, checks)
+			return
+		}
+	}
+	render.Success(context, checks)
+}
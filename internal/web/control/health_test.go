@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package control
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+
+	"github.com/gin-gonic/gin"
+)
+
+type deadBackground struct{}
+
+func (deadBackground) Init() error  { return nil }
+func (deadBackground) Start() error { return nil }
+func (deadBackground) Stop() error  { return nil }
+func (deadBackground) Alive() bool  { return false }
+
+func TestReadyChecks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := storage.Open(filepath.Join(t.TempDir(), "web.db") + "?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Init(api.NewRegistry(gin.New(), ""), db, map[string]Background{"file": deadBackground{}, "janitor": deadBackground{}}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有与 hackernel 通信的模块报告 watchdog 超时
+	if err := w.checkBackground("file"); err == nil || !strings.Contains(err.Error(), "osinfo::report") {
+		t.Errorf("file: %v", err)
+	}
+	if err := w.checkBackground("janitor"); err == nil || strings.Contains(err.Error(), "osinfo::report") {
+		t.Errorf("janitor: %v", err)
+	}
+	w.setStopped("file", true)
+	if err := w.checkBackground("file"); err == nil || !w.isStopped("file") {
+		t.Errorf("stopped file: %v", err)
+	}
+
+	// 缓存时间内不重新写入数据库
+	if err := w.checkDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := w.checkDatabase(); err != nil {
+		t.Errorf("cached: %v", err)
+	}
+	w.checked = time.Now().Add(-databaseCheckInterval)
+	if err := w.checkDatabase(); err == nil {
+		t.Error("closed database reported writable")
+	}
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package control
+
+import (
+	"runtime"
+	"sort"
+	"time"
+	"uranus/internal/background"
+	"uranus/internal/web/render"
+	"uranus/pkg/connector"
+	"uranus/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Hackernel struct {
+	Reachable bool `json:"reachable"`
+	// echo 请求往返的毫秒数
+	Latency float64 `json:"latency"`
+	Error   string  `json:"error"`
+}
+
+type Database struct {
+	OpenConnections int   `json:"openConnections"`
+	InUse           int   `json:"inUse"`
+	Idle            int   `json:"idle"`
+	WaitCount       int64 `json:"waitCount"`
+	// 等待连接的总毫秒数
+	WaitDuration int64 `json:"waitDuration"`
+}
+
+// Ingester 通过队列批量写入事件的后台模块
+type Ingester interface {
+	IngestStats() background.IngestStats
+}
+
+type Info struct {
+	Version  string `json:"version"`
+	BuildDir string `json:"buildDir"`
+	Go       string `json:"go"`
+	// 启动时间戳和运行的秒数
+	Started    int64     `json:"started"`
+	Uptime     int64     `json:"uptime"`
+	Goroutines int       `json:"goroutines"`
+	Workers    []string  `json:"workers"`
+	Hackernel  Hackernel `json:"hackernel"`
+	Database   Database  `json:"database"`
+	// 各模块事件写入队列的状态
+	Ingest map[string]background.IngestStats `json:"ingest"`
+}
+
+func ping() (hackernel Hackernel) {
+	start := time.Now()
+	_, err := connector.Exec(`{"type":"user::test::echo"}`, time.Second)
+	if err != nil {
+		hackernel.Error = err.Error()
+		return
+	}
+	hackernel.Reachable = true
+	hackernel.Latency = float64(time.Since(start).Microseconds()) / 1000
+	return
+}
+
+func (w *Worker) info(context *gin.Context) {
+	if err := w.db.PingContext(context.Request.Context()); err != nil {
+		render.Status(context, render.StatusControlQueryInfoFailed)
+		return
+	}
+	stats := w.db.Stats()
+
+	workers := []string{}
+	ingest := map[string]background.IngestStats{}
+	for name, worker := range w.backgrounds {
+		workers = append(workers, name)
+		if ingester, ok := worker.(Ingester); ok {
+			ingest[name] = ingester.IngestStats()
+		}
+	}
+	sort.Strings(workers)
+
+	render.Success(context, Info{
+		Version:    logger.Version,
+		BuildDir:   logger.BuildDir,
+		Go:         runtime.Version(),
+		Started:    w.started.Unix(),
+		Uptime:     int64(time.Since(w.started).Seconds()),
+		Goroutines: runtime.NumGoroutine(),
+		Workers:    workers,
+		Hackernel:  ping(),
+		Database: Database{
+			OpenConnections: stats.OpenConnections,
+			InUse:           stats.InUse,
+			Idle:            stats.Idle,
+			WaitCount:       stats.WaitCount,
+			WaitDuration:    stats.WaitDuration.Milliseconds(),
+		},
+		Ingest: ingest,
+	})
+}
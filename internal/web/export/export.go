@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// Request 导出接口的公共参数,与列表接口的过滤条件一起使用
+type Request struct {
+	Format string `json:"format" form:"format" binding:"omitempty,oneof=ndjson csv"`
+}
+
+// Limit 导出时没有指定数量则导出全部
+func Limit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+// Writer 逐行写入响应,不在内存中保存整个列表
+type Writer struct {
+	csv    *csv.Writer
+	json   *json.Encoder
+	record func(row interface{}) []string
+}
+
+// New 设置下载的文件名和类型, CSV 格式先写入表头
+func New(context *gin.Context, name, format string, header []string, record func(row interface{}) []string) (w *Writer, err error) {
+	if format == "" {
+		format = FormatNDJSON
+	}
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102150405"), format)
+	context.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	w = &Writer{record: record}
+	switch format {
+	case FormatCSV:
+		context.Header("Content-Type", "text/csv; charset=utf-8")
+		context.Status(http.StatusOK)
+		w.csv = csv.NewWriter(context.Writer)
+		err = w.csv.Write(header)
+	default:
+		context.Header("Content-Type", "application/x-ndjson")
+		context.Status(http.StatusOK)
+		w.json = json.NewEncoder(context.Writer)
+	}
+	return
+}
+
+func (w *Writer) Write(row interface{}) error {
+	if w.csv != nil {
+		record := w.record(row)
+		for i := range record {
+			record[i] = escape(record[i])
+		}
+		return w.csv.Write(record)
+	}
+	return w.json.Encode(row)
+}
+
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return nil
+}
+
+// escape 防止表格软件把路径、命令行等内容当作公式执行
+func escape(field string) string {
+	if field == "" {
+		return field
+	}
+	switch field[0] {
+	case '=', '+', '@', '\t', '\r':
+		return "'" + field
+	case '-':
+		if _, err := strconv.ParseFloat(field, 64); err != nil {
+			return "'" + field
+		}
+	}
+	return field
+}
+
+// Time 导出的时间使用 RFC3339 格式
+func Time(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
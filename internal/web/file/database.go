@@ -1,170 +0,0 @@
-// SPDX-License-Identifier: AGPL-3.0-or-later
-package file
-
-import (
-	"time"
-	"uranus/pkg/file"
-
-	"github.com/sirupsen/logrus"
-)
-
-const (
-	sqlInsertFilePolicy           = `insert into file_policy(path,fsid,ino,perm,timestamp,status) values(?,?,?,?,?,?)`
-	sqlUpdateFilePolicyById       = `update file_policy set fsid=?,ino=?,perm=?,timestamp=?,status=? where id=?`
-	sqlQueryFileEventLimitOffset  = `select id,path,fsid,ino,perm,timestamp,policy,status from file_event limit ? offset ?`
-	sqlQueryFilePolicyById        = `select id,path,fsid,ino,perm,timestamp,status from file_policy where id=?`
-	sqlQueryFilePolicyLimitOffset = `select id,path,fsid,ino,perm,timestamp,status from file_policy limit ? offset ?`
-	sqlDeleteFilePolicyById       = `delete from file_policy where id=?`
-	sqlDeleteFileEventById        = `delete from file_event where id=?`
-	sqlUpdateFileEventStatusById  = `update file_event set status=? where id=?`
-)
-
-func (w *Worker) insertFilePolicy(path string, fsid, ino uint64, perm, status int) (err error) {
-	stmt, err := w.db.Prepare(sqlInsertFilePolicy)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(path, int64(fsid), int64(ino), perm, time.Now().Unix(), status)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	return
-}
-
-func (w *Worker) updateFilePolicyById(fsid, ino uint64, perm, status, id int) (err error) {
-	stmt, err := w.db.Prepare(sqlUpdateFilePolicyById)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(fsid, ino, perm, time.Now().Unix(), status, id)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	return
-}
-
-func (w *Worker) queryFileEventOffsetLimit(limit, offset int) (events []file.Event, err error) {
-	stmt, err := w.db.Prepare(sqlQueryFileEventLimitOffset)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query(limit, offset)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		e := file.Event{}
-		err = rows.Scan(&e.ID, &e.Path, &e.Fsid, &e.Ino, &e.Perm, &e.Timestamp, &e.Policy, &e.Status)
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-		events = append(events, e)
-	}
-	err = rows.Err()
-	return
-}
-
-func (w *Worker) queryFilePolicyById(id int) (event file.Policy, err error) {
-	stmt, err := w.db.Prepare(sqlQueryFilePolicyById)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-
-	err = stmt.QueryRow(id).Scan(&event.ID, &event.Path, &event.Fsid, &event.Ino, &event.Perm, &event.Timestamp, &event.Status)
-	if err != nil {
-		logrus.Error(err)
-	}
-	return
-}
-
-func (w *Worker) queryFilePolicyLimitOffset(limit, offset int) (policies []file.Policy, err error) {
-	stmt, err := w.db.Prepare(sqlQueryFilePolicyLimitOffset)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-	rows, err := stmt.Query(limit, offset)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		policy := file.Policy{}
-		err = rows.Scan(&policy.ID, &policy.Path, &policy.Fsid, &policy.Ino, &policy.Perm, &policy.Timestamp, &policy.Status)
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-		policies = append(policies, policy)
-	}
-	err = rows.Err()
-	if err != nil {
-		logrus.Error(err)
-	}
-	return
-}
-
-func (w *Worker) deleteFilePolicyById(id int) (err error) {
-	stmt, err := w.db.Prepare(sqlDeleteFilePolicyById)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(id)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	return
-}
-
-func (w *Worker) deleteFileEventById(id int) (err error) {
-	stmt, err := w.db.Prepare(sqlDeleteFileEventById)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(id)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	return
-}
-
-func (w *Worker) updateFileEventStatusById(status, id int) (err error) {
-	stmt, err := w.db.Prepare(sqlUpdateFileEventStatusById)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(status, id)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	return
-}
@@ -3,7 +3,16 @@ package file
 
 import (
 	"database/sql"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"uranus/internal/background"
 	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/export"
 	"uranus/internal/web/render"
 	"uranus/pkg/file"
 
@@ -12,34 +21,116 @@ import (
 )
 
 type Worker struct {
-	engine *gin.Engine
-	db     *sql.DB
+	registry *api.Registry
+	files    storage.FileRepository
 
 	config *config.Config
 }
 
-func Init(engine *gin.Engine, db *sql.DB) (err error) {
+type statusBody struct {
+	Status int `json:"status"`
+}
+
+type idRequest struct {
+	ID int `json:"id" uri:"id" binding:"number"`
+}
+
+type listRequest struct {
+	Limit  int `json:"limit" form:"limit" binding:"number"`
+	Offset int `json:"offset" form:"offset" binding:"number"`
+}
+
+type policyListRequest struct {
+	listRequest
+	// 查询目录或通配符策略展开的子策略,为 0 时返回没有所属策略的策略
+	Parent uint64 `json:"parent" form:"parent"`
+}
+
+// policyResponse 目录和通配符策略附带子策略的展开状态
+type policyResponse struct {
+	file.Policy
+	Expansion *file.Expansion `json:"expansion,omitempty"`
+}
+
+type exportRequest struct {
+	listRequest
+	export.Request
+}
+
+type policyAddRequest struct {
+	Path string `json:"path" binding:"required"`
+	Perm int    `json:"perm" binding:"number"`
+	// 0 为文件, 1 为目录及其全部子目录, 2 为通配符
+	Kind int `json:"kind" binding:"min=0,max=2"`
+}
+
+type policyUpdateRequest struct {
+	ID   int `json:"id" uri:"id" binding:"number"`
+	Perm int `json:"perm" binding:"number"`
+}
+
+type eventUpdateRequest struct {
+	Status int `json:"status" binding:"number"`
+	ID     int `json:"id" uri:"id" binding:"number"`
+}
+
+func Init(registry *api.Registry, db *storage.DB) (err error) {
 	config, err := config.New(db)
 	if err != nil {
 		return
 	}
 	w := &Worker{
-		engine: engine,
-		db:     db,
-		config: config,
-	}
-	w.engine.POST("/file/core/status", w.fileCoreStatus)
-	w.engine.POST("/file/core/enable", w.fileCoreEnable)
-	w.engine.POST("/file/core/disable", w.fileCoreDisable)
-	w.engine.POST("/file/policy/add", w.filePolicyAdd)
-	w.engine.POST("/file/policy/update", w.filePolicyUpdate)
-	w.engine.POST("/file/policy/delete", w.filePolicyDelete)
-	w.engine.POST("/file/policy/clear", w.filePolicyClear)
-	w.engine.POST("/file/policy/list", w.filePolicyList)
-	w.engine.POST("/file/policy/query", w.filePolicyQuery)
-	w.engine.POST("/file/event/list", w.fileEventList)
-	w.engine.POST("/file/event/delete", w.fileEventDelete)
-	w.engine.POST("/file/event/update", w.fileEventUpdate)
+		registry: registry,
+		files:    storage.NewFileRepository(db),
+		config:   config,
+	}
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/modules/file", Legacy: "/file/core/status", Resource: api.ResourceModule, Handler: w.fileCoreStatus,
+			Summary: "文件防护模块状态", Response: statusBody{}},
+		{Method: http.MethodPost, Path: "/modules/file/enable", Legacy: "/file/core/enable", Resource: api.ResourceModule, Handler: w.fileCoreEnable,
+			Summary:  "启动文件防护模块",
+			Statuses: []int{render.StatusProcessEnableFailed}},
+		{Method: http.MethodPost, Path: "/modules/file/disable", Legacy: "/file/core/disable", Resource: api.ResourceModule, Handler: w.fileCoreDisable,
+			Summary:  "关闭文件防护模块",
+			Statuses: []int{render.StatusFileDisableFailed}},
+		{Method: http.MethodPost, Path: "/policies/file", Legacy: "/file/policy/add", Resource: api.ResourcePolicy, Handler: w.filePolicyAdd,
+			Summary: "添加文件策略,目录和通配符策略展开为每个文件的子策略", Request: policyAddRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusFileAddPolicyConflict, render.StatusFileAddPolicyFileNotExist, render.StatusFileAddPolicyFailed}},
+		{Method: http.MethodPut, Path: "/policies/file/:id", Legacy: "/file/policy/update", Resource: api.ResourcePolicy, Handler: w.filePolicyUpdate,
+			Summary: "更新文件策略", Request: policyUpdateRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNotFound, render.StatusFileUpdatePolicyConflict, render.StatusFileUpdatePolicyFileNotExist, render.StatusFileUpdatePolicyFailed, render.StatusFileChildPolicyReadOnly}},
+		{Method: http.MethodDelete, Path: "/policies/file/:id", Legacy: "/file/policy/delete", Resource: api.ResourcePolicy, Handler: w.filePolicyDelete,
+			Summary: "删除文件策略", Request: idRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNotFound, render.StatusFileDeletePolicyFailed, render.StatusFileChildPolicyReadOnly}},
+		{Method: http.MethodDelete, Path: "/policies/file", Legacy: "/file/policy/clear", Resource: api.ResourcePolicy, Handler: w.filePolicyClear,
+			Summary: "清空文件策略"},
+		{Method: http.MethodGet, Path: "/policies/file", Legacy: "/file/policy/list", Resource: api.ResourcePolicy, Handler: w.filePolicyList,
+			Summary: "文件策略列表,指定 parent 时返回展开的子策略", Request: policyListRequest{}, Response: []policyResponse{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusFileQueryPolicyListFailed}},
+		{Method: http.MethodGet, Path: "/policies/file/export", Legacy: "/file/policy/export", Resource: api.ResourcePolicy, Handler: w.filePolicyExport,
+			Summary: "导出文件策略,支持 ndjson 和 csv 格式", Request: exportRequest{},
+			Statuses: []int{render.StatusInvalidArgument}},
+		{Method: http.MethodGet, Path: "/policies/file/:id", Legacy: "/file/policy/query", Resource: api.ResourcePolicy, Handler: w.filePolicyQuery,
+			Summary: "查询文件策略", Request: idRequest{}, Response: policyResponse{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNotFound, render.StatusFileQueryPolicyByIdFailed}},
+		{Method: http.MethodGet, Path: "/events/file", Legacy: "/file/event/list", Resource: api.ResourceEvent, Handler: w.fileEventList,
+			Summary: "文件事件列表", Request: listRequest{}, Response: []file.Event{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusProcessQueryEventFailed}},
+		{Method: http.MethodGet, Path: "/events/file/export", Legacy: "/file/event/export", Resource: api.ResourceEvent, Handler: w.fileEventExport,
+			Summary: "导出文件事件,支持 ndjson 和 csv 格式", Request: exportRequest{},
+			Statuses: []int{render.StatusInvalidArgument}},
+		{Method: http.MethodDelete, Path: "/events/file/:id", Legacy: "/file/event/delete", Resource: api.ResourceEvent, Handler: w.fileEventDelete,
+			Summary: "删除文件事件", Request: idRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusFileDeleteEventFailed}},
+		{Method: http.MethodPut, Path: "/events/file/:id", Legacy: "/file/event/update", Resource: api.ResourceEvent, Handler: w.fileEventUpdate,
+			Summary: "更新文件事件状态", Request: eventUpdateRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusFileUpdateEventStatusFailed}},
+		{Method: http.MethodGet, Path: "/settings/file", Legacy: "/file/settings/status", Resource: api.ResourceEvent, Handler: w.settingsStatus,
+			Summary: "文件事件的去重和限流设置", Response: background.FileEventSettings{}},
+		{Method: http.MethodPut, Path: "/settings/file", Legacy: "/file/settings/update", Resource: api.ResourceEvent, Handler: w.settingsUpdate,
+			Summary: "更新文件事件的去重和限流设置,下一批事件写入时生效", Request: background.FileEventSettings{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusFileUpdateSettingsFailed}},
+	})
 	return
 }
 
@@ -49,9 +140,7 @@ func (w *Worker) fileCoreStatus(context *gin.Context) {
 		status = file.StatusDisable
 	}
 
-	response := struct {
-		Status int `json:"status"`
-	}{
+	response := statusBody{
 		Status: status,
 	}
 
@@ -59,12 +148,13 @@ func (w *Worker) fileCoreStatus(context *gin.Context) {
 }
 
 func (w *Worker) fileCoreEnable(context *gin.Context) {
-	if err := w.config.SetInteger(config.FileModuleStatus, file.StatusEnable); err != nil {
+	if err := audit.SetInteger(context, w.config, config.FileModuleStatus, file.StatusEnable); err != nil {
 		render.Status(context, render.StatusProcessEnableFailed)
 		return
 	}
-	ok := file.Enable()
-	if !ok {
+	err := file.Enable()
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusProcessEnableFailed)
 		return
 	}
@@ -72,12 +162,13 @@ func (w *Worker) fileCoreEnable(context *gin.Context) {
 }
 
 func (w *Worker) fileCoreDisable(context *gin.Context) {
-	if err := w.config.SetInteger(config.FileModuleStatus, file.StatusDisable); err != nil {
+	if err := audit.SetInteger(context, w.config, config.FileModuleStatus, file.StatusDisable); err != nil {
 		render.Status(context, render.StatusFileDisableFailed)
 		return
 	}
-	ok := file.Disable()
-	if !ok {
+	err := file.Disable()
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusFileDisableFailed)
 		return
 	}
@@ -85,16 +176,18 @@ func (w *Worker) fileCoreDisable(context *gin.Context) {
 }
 
 func (w *Worker) filePolicyAdd(context *gin.Context) {
-	request := struct {
-		Path string `json:"path" binding:"required"`
-		Perm int    `json:"perm" binding:"number"`
-	}{}
+	request := policyAddRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
+	if request.Kind != file.KindFile {
+		w.filePatternAdd(context, request)
+		return
+	}
 	fsid, ino, status, err := file.SetPolicy(request.Path, request.Perm, file.FlagNew)
+	audit.Record(context, "file policy", nil, file.Policy{Path: request.Path, Fsid: fsid, Ino: ino, Perm: request.Perm, Status: status})
 	if err != nil || status == file.StatusPolicyUnknown {
 		render.Status(context, render.StatusUnknownError)
 		return
@@ -110,8 +203,9 @@ func (w *Worker) filePolicyAdd(context *gin.Context) {
 		return
 	}
 
-	err = w.insertFilePolicy(request.Path, fsid, ino, request.Perm, file.StatusPolicyNormal)
+	err = w.files.InsertPolicy(request.Path, fsid, ino, request.Perm, file.StatusPolicyNormal)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusFileAddPolicyFailed)
 		return
 	}
@@ -119,24 +213,73 @@ func (w *Worker) filePolicyAdd(context *gin.Context) {
 	render.Status(context, render.StatusSuccess)
 }
 
+// filePatternAdd 目录策略要求目录已经存在,通配符策略可以暂时没有匹配的文件
+func (w *Worker) filePatternAdd(context *gin.Context, request policyAddRequest) {
+	if !filepath.IsAbs(request.Path) {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	switch request.Kind {
+	case file.KindDirectory:
+		if info, err := os.Stat(request.Path); err != nil || !info.IsDir() {
+			render.Status(context, render.StatusFileAddPolicyFileNotExist)
+			return
+		}
+	case file.KindGlob:
+		if _, err := filepath.Match(request.Path, ""); err != nil {
+			render.Status(context, render.StatusInvalidArgument)
+			return
+		}
+	}
+
+	id, err := background.AddFilePattern(w.files, request.Path, request.Kind, request.Perm)
+	audit.Record(context, "file policy", nil, file.Policy{ID: uint64(id), Path: request.Path, Perm: request.Perm, Kind: request.Kind})
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusFileAddPolicyFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
+
 func (w *Worker) filePolicyUpdate(context *gin.Context) {
-	request := struct {
-		ID   int `json:"id" binding:"number"`
-		Perm int `json:"perm" binding:"number"`
-	}{}
+	request := policyUpdateRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	policy, err := w.queryFilePolicyById(request.ID)
+	policy, err := w.files.QueryPolicyById(request.ID)
+	if err == sql.ErrNoRows {
+		render.Status(context, render.StatusNotFound)
+		return
+	}
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusUnknownError)
 		return
 	}
+	if policy.Parent != 0 {
+		render.Status(context, render.StatusFileChildPolicyReadOnly)
+		return
+	}
+	if policy.Kind != file.KindFile {
+		err = background.UpdateFilePattern(w.files, policy.ID, request.Perm)
+		after := policy
+		after.Perm = request.Perm
+		audit.Record(context, "file policy", policy, after)
+		if err != nil {
+			logrus.Error(err)
+			render.Status(context, render.StatusFileUpdatePolicyFailed)
+			return
+		}
+		render.Status(context, render.StatusSuccess)
+		return
+	}
 
 	fsid, ino, status, err := file.SetPolicy(policy.Path, request.Perm, file.FlagUpdate)
+	audit.Record(context, "file policy", policy, file.Policy{ID: policy.ID, Path: policy.Path, Fsid: fsid, Ino: ino, Perm: request.Perm, Status: status})
 	if err != nil || status == file.StatusPolicyUnknown {
 		render.Status(context, render.StatusUnknownError)
 		return
@@ -152,7 +295,7 @@ func (w *Worker) filePolicyUpdate(context *gin.Context) {
 		return
 	}
 
-	err = w.updateFilePolicyById(fsid, ino, request.Perm, file.StatusPolicyNormal, request.ID)
+	err = w.files.UpdatePolicyById(fsid, ino, request.Perm, file.StatusPolicyNormal, request.ID)
 	if err != nil {
 		logrus.Error(err)
 		render.Status(context, render.StatusFileUpdatePolicyFailed)
@@ -163,29 +306,49 @@ func (w *Worker) filePolicyUpdate(context *gin.Context) {
 }
 
 func (w *Worker) filePolicyDelete(context *gin.Context) {
-	request := struct {
-		ID int `json:"id" binding:"number"`
-	}{}
+	request := idRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	policy, err := w.queryFilePolicyById(request.ID)
+	policy, err := w.files.QueryPolicyById(request.ID)
+	if err == sql.ErrNoRows {
+		render.Status(context, render.StatusNotFound)
+		return
+	}
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusUnknownError)
 		return
 	}
+	if policy.Parent != 0 {
+		render.Status(context, render.StatusFileChildPolicyReadOnly)
+		return
+	}
+	if policy.Kind != file.KindFile {
+		err = background.DeleteFilePattern(w.files, policy.ID)
+		audit.Record(context, "file policy", policy, nil)
+		if err != nil {
+			logrus.Error(err)
+			render.Status(context, render.StatusFileDeletePolicyFailed)
+			return
+		}
+		render.Status(context, render.StatusSuccess)
+		return
+	}
 
 	_, _, _, err = file.SetPolicy(policy.Path, 0, file.FlagAny)
+	audit.Record(context, "file policy", policy, nil)
 	if err != nil {
 		render.Status(context, render.StatusUnknownError)
 		return
 	}
 
-	err = w.deleteFilePolicyById(request.ID)
+	err = w.files.DeletePolicyById(request.ID)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusFileDeletePolicyFailed)
 		return
 	}
@@ -198,74 +361,181 @@ func (w *Worker) filePolicyClear(context *gin.Context) {
 }
 
 func (w *Worker) filePolicyList(context *gin.Context) {
-	request := struct {
-		Limit  int `json:"limit" binding:"number"`
-		Offset int `json:"offset" binding:"number"`
-	}{}
+	request := policyListRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	policies, err := w.queryFilePolicyLimitOffset(request.Limit, request.Offset)
+	policies, err := w.files.QueryPolicyByParentLimitOffset(request.Parent, request.Limit, request.Offset)
 	if err != nil {
 		logrus.Error(err)
 		render.Status(context, render.StatusFileQueryPolicyListFailed)
 		return
 	}
-	render.Success(context, policies)
+	responses, err := w.policyResponses(policies)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusFileQueryPolicyListFailed)
+		return
+	}
+	render.Success(context, responses)
+}
+
+// policyResponses 为目录和通配符策略加上子策略的统计
+func (w *Worker) policyResponses(policies []file.Policy) (responses []policyResponse, err error) {
+	expansions, err := w.files.QueryPolicyExpansions()
+	if err != nil {
+		return
+	}
+	for _, policy := range policies {
+		response := policyResponse{Policy: policy}
+		if policy.Kind != file.KindFile {
+			expansion := expansions[policy.ID]
+			response.Expansion = &expansion
+		}
+		responses = append(responses, response)
+	}
+	return
+}
+
+var policyHeader = []string{"id", "path", "fsid", "ino", "perm", "timestamp", "status", "kind", "parent"}
+
+func policyRecord(row interface{}) []string {
+	policy := row.(file.Policy)
+	return []string{
+		strconv.FormatUint(policy.ID, 10),
+		policy.Path,
+		strconv.FormatUint(policy.Fsid, 10),
+		strconv.FormatUint(policy.Ino, 10),
+		strconv.Itoa(policy.Perm),
+		export.Time(policy.Timestamp),
+		strconv.Itoa(policy.Status),
+		strconv.Itoa(policy.Kind),
+		strconv.FormatUint(policy.Parent, 10),
+	}
+}
+
+func (w *Worker) filePolicyExport(context *gin.Context) {
+	request := exportRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	writer, err := export.New(context, "file-policy", request.Format, policyHeader, policyRecord)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer writer.Flush()
+
+	err = w.files.ScanPolicyLimitOffset(export.Limit(request.Limit), request.Offset, func(policy file.Policy) error {
+		return writer.Write(policy)
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
 }
 
 func (w *Worker) filePolicyQuery(context *gin.Context) {
-	request := struct {
-		ID int `json:"id" binding:"number"`
-	}{}
+	request := idRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	policy, err := w.queryFilePolicyById(request.ID)
+	policy, err := w.files.QueryPolicyById(request.ID)
+	if err == sql.ErrNoRows {
+		render.Status(context, render.StatusNotFound)
+		return
+	}
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusFileQueryPolicyByIdFailed)
 		return
 	}
-	render.Success(context, policy)
+	responses, err := w.policyResponses([]file.Policy{policy})
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusFileQueryPolicyByIdFailed)
+		return
+	}
+	render.Success(context, responses[0])
 }
 
 func (w *Worker) fileEventList(context *gin.Context) {
-	request := struct {
-		Limit  int `json:"limit" binding:"number"`
-		Offset int `json:"offset" binding:"number"`
-	}{}
+	request := listRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	events, err := w.queryFileEventOffsetLimit(request.Limit, request.Offset)
+	events, err := w.files.QueryEventLimitOffset(request.Limit, request.Offset)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusProcessQueryEventFailed)
 		return
 	}
 	render.Success(context, events)
 }
 
+var eventHeader = []string{"id", "path", "fsid", "ino", "perm", "timestamp", "policy", "status", "count", "first", "suppressed", "kind"}
+
+func eventRecord(row interface{}) []string {
+	e := row.(file.Event)
+	return []string{
+		strconv.FormatUint(e.ID, 10),
+		e.Path,
+		strconv.FormatUint(e.Fsid, 10),
+		strconv.FormatUint(e.Ino, 10),
+		strconv.Itoa(e.Perm),
+		export.Time(e.Timestamp),
+		strconv.FormatUint(e.Policy, 10),
+		strconv.Itoa(e.Status),
+		strconv.Itoa(e.Count),
+		export.Time(e.First),
+		strconv.Itoa(e.Suppressed),
+		strconv.Itoa(e.Kind),
+	}
+}
+
+func (w *Worker) fileEventExport(context *gin.Context) {
+	request := exportRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	writer, err := export.New(context, "file-event", request.Format, eventHeader, eventRecord)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer writer.Flush()
+
+	err = w.files.ScanEventLimitOffset(export.Limit(request.Limit), request.Offset, func(e file.Event) error {
+		return writer.Write(e)
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
 func (w *Worker) fileEventDelete(context *gin.Context) {
-	request := struct {
-		ID int `json:"id" binding:"number"`
-	}{}
+	request := idRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	err := w.deleteFileEventById(request.ID)
+	err := w.files.DeleteEventById(request.ID)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusFileDeleteEventFailed)
 		return
 	}
@@ -273,20 +543,40 @@ func (w *Worker) fileEventDelete(context *gin.Context) {
 }
 
 func (w *Worker) fileEventUpdate(context *gin.Context) {
-	request := struct {
-		Status int `json:"status" binding:"number"`
-		ID     int `json:"id" binding:"number"`
-	}{}
+	request := eventUpdateRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	err := w.updateFileEventStatusById(request.Status, request.ID)
+	err := w.files.UpdateEventStatusById(request.Status, request.ID)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusFileUpdateEventStatusFailed)
 		return
 	}
 	render.Status(context, render.StatusSuccess)
 }
+
+func (w *Worker) settingsStatus(context *gin.Context) {
+	render.Success(context, background.LoadFileEventSettings(w.config))
+}
+
+func (w *Worker) settingsUpdate(context *gin.Context) {
+	request := background.FileEventSettings{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := audit.SetInteger(context, w.config, config.FileEventDedupWindow, request.DedupWindow); err != nil {
+		render.Status(context, render.StatusFileUpdateSettingsFailed)
+		return
+	}
+	if err := audit.SetInteger(context, w.config, config.FileEventRateLimit, request.RateLimit); err != nil {
+		render.Status(context, render.StatusFileUpdateSettingsFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package web
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// web.go 中的 net 是网络防护模块
+type listener = net.Listener
+
+// listen 监听 TCP 地址或 Unix Domain Socket
+func (w *WebWorker) listen() (l listener, err error) {
+	if !strings.HasPrefix(w.addr, unixPrefix) {
+		return net.Listen("tcp", w.addr)
+	}
+
+	name := strings.TrimPrefix(w.addr, unixPrefix)
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	// 删除上次异常退出时遗留的文件
+	if err = os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if l, err = net.Listen("unix", name); err != nil {
+		return
+	}
+
+	if err = w.chownSocket(name); err != nil {
+		l.Close()
+		return
+	}
+	return
+}
+
+func (w *WebWorker) chownSocket(name string) (err error) {
+	mode := w.config.SocketMode
+	if mode == 0 {
+		mode = 0660
+	}
+	if err = os.Chmod(name, mode); err != nil {
+		return
+	}
+	if w.config.SocketGroup == "" {
+		return
+	}
+	group, err := user.LookupGroup(w.config.SocketGroup)
+	if err != nil {
+		return
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return
+	}
+	return os.Chown(name, -1, gid)
+}
+
+// unixRemoteAddr Unix Domain Socket 的连接没有地址,视为来自本机,
+// 需要信任 127.0.0.1 才能使用反向代理传递的客户端地址
+func unixRemoteAddr(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if _, _, err := net.SplitHostPort(request.RemoteAddr); err != nil {
+			request.RemoteAddr = "127.0.0.1:0"
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// basePath 将路径前缀规范为 /uranus 的格式,部署在根路径时返回空字符串
+func basePath(base string) string {
+	base = strings.Trim(base, "/")
+	if base == "" {
+		return ""
+	}
+	return "/" + base
+}
+
+// withBasePath 去掉请求路径的前缀后交给 handler 处理,不带前缀的请求返回 404
+func withBasePath(base string, handler http.Handler) http.Handler {
+	if base == "" {
+		return handler
+	}
+	strip := http.StripPrefix(base, handler)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == base {
+			http.Redirect(writer, request, base+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(request.URL.Path, base+"/") {
+			http.NotFound(writer, request)
+			return
+		}
+		strip.ServeHTTP(writer, request)
+	})
+}
@@ -2,8 +2,13 @@
 package net
 
 import (
-	"database/sql"
+	"net/http"
+	"strconv"
 	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/export"
 	"uranus/internal/web/render"
 	"uranus/pkg/net"
 
@@ -12,28 +17,62 @@ import (
 )
 
 type Worker struct {
-	engine *gin.Engine
-	db     *sql.DB
+	registry *api.Registry
+	policies storage.NetRepository
 
 	config *config.Config
 }
 
-func Init(engine *gin.Engine, db *sql.DB) (err error) {
+type statusBody struct {
+	Status int `json:"status"`
+}
+
+type idRequest struct {
+	ID int `json:"id" uri:"id" binding:"number"`
+}
+
+type listRequest struct {
+	Limit  int `json:"limit" form:"limit" binding:"number"`
+	Offset int `json:"offset" form:"offset" binding:"number"`
+}
+
+type exportRequest struct {
+	listRequest
+	export.Request
+}
+
+func Init(registry *api.Registry, db *storage.DB) (err error) {
 	config, err := config.New(db)
 	if err != nil {
 		return
 	}
 	w := &Worker{
-		engine: engine,
-		db:     db,
-		config: config,
-	}
-	w.engine.POST("/net/core/status", w.netCoreStatus)
-	w.engine.POST("/net/core/enable", w.netCoreEnable)
-	w.engine.POST("/net/core/disable", w.netCoreDisable)
-	w.engine.POST("/net/policy/add", w.netPolicyAdd)
-	w.engine.POST("/net/policy/delete", w.netPolicyDelete)
-	w.engine.POST("/net/policy/list", w.netPolicyList)
+		registry: registry,
+		policies: storage.NewNetRepository(db),
+		config:   config,
+	}
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/modules/net", Legacy: "/net/core/status", Resource: api.ResourceModule, Handler: w.netCoreStatus,
+			Summary: "网络防护模块状态", Response: statusBody{}},
+		{Method: http.MethodPost, Path: "/modules/net/enable", Legacy: "/net/core/enable", Resource: api.ResourceModule, Handler: w.netCoreEnable,
+			Summary:  "启动网络防护模块",
+			Statuses: []int{render.StatusProcessEnableFailed, render.StatusNetEnableFailed}},
+		{Method: http.MethodPost, Path: "/modules/net/disable", Legacy: "/net/core/disable", Resource: api.ResourceModule, Handler: w.netCoreDisable,
+			Summary:  "关闭网络防护模块",
+			Statuses: []int{render.StatusNetDisableFailed}},
+		{Method: http.MethodPost, Path: "/policies/net", Legacy: "/net/policy/add", Resource: api.ResourcePolicy, Handler: w.netPolicyAdd,
+			Summary: "添加网络策略", Request: net.Policy{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNetAddPolicyDatabaseFailed, render.StatusNetAddPolicyFailed}},
+		{Method: http.MethodDelete, Path: "/policies/net/:id", Legacy: "/net/policy/delete", Resource: api.ResourcePolicy, Handler: w.netPolicyDelete,
+			Summary: "删除网络策略", Request: idRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNetDeletePolicyFailed, render.StatusNetDeletePolicyDatabaseFailed}},
+		{Method: http.MethodGet, Path: "/policies/net", Legacy: "/net/policy/list", Resource: api.ResourcePolicy, Handler: w.netPolicyList,
+			Summary: "网络策略列表", Request: listRequest{}, Response: []net.Policy{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNetQueryPolicyListFailed}},
+		{Method: http.MethodGet, Path: "/policies/net/export", Legacy: "/net/policy/export", Resource: api.ResourcePolicy, Handler: w.netPolicyExport,
+			Summary: "导出网络策略,支持 ndjson 和 csv 格式", Request: exportRequest{},
+			Statuses: []int{render.StatusInvalidArgument}},
+	})
 	return
 }
 
@@ -43,9 +82,7 @@ func (w *Worker) netCoreStatus(context *gin.Context) {
 		status = net.StatusDisable
 	}
 
-	response := struct {
-		Status int `json:"status"`
-	}{
+	response := statusBody{
 		Status: status,
 	}
 
@@ -53,12 +90,13 @@ func (w *Worker) netCoreStatus(context *gin.Context) {
 }
 
 func (w *Worker) netCoreEnable(context *gin.Context) {
-	if err := w.config.SetInteger(config.NetModuleStatus, net.StatusEnable); err != nil {
+	if err := audit.SetInteger(context, w.config, config.NetModuleStatus, net.StatusEnable); err != nil {
 		render.Status(context, render.StatusProcessEnableFailed)
 		return
 	}
-	ok := net.Enable()
-	if !ok {
+	err := net.Enable()
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusNetEnableFailed)
 		return
 	}
@@ -66,12 +104,13 @@ func (w *Worker) netCoreEnable(context *gin.Context) {
 }
 
 func (w *Worker) netCoreDisable(context *gin.Context) {
-	if err := w.config.SetInteger(config.NetModuleStatus, net.StatusDisable); err != nil {
+	if err := audit.SetInteger(context, w.config, config.NetModuleStatus, net.StatusDisable); err != nil {
 		render.Status(context, render.StatusNetDisableFailed)
 		return
 	}
-	ok := net.Disable()
-	if !ok {
+	err := net.Disable()
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusNetDisableFailed)
 		return
 	}
@@ -81,19 +120,23 @@ func (w *Worker) netCoreDisable(context *gin.Context) {
 func (w *Worker) netPolicyAdd(context *gin.Context) {
 	request := net.Policy{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	id, err := w.insertNetPolicy(&request)
+	id, err := w.policies.InsertPolicy(&request)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusNetAddPolicyDatabaseFailed)
 		return
 	}
 
 	request.ID = id
-	if ok := net.AddPolicy(request); !ok {
+	audit.Record(context, "net policy", nil, request)
+	err = net.AddPolicy(request)
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusNetAddPolicyFailed)
 		return
 	}
@@ -102,23 +145,27 @@ func (w *Worker) netPolicyAdd(context *gin.Context) {
 }
 
 func (w *Worker) netPolicyDelete(context *gin.Context) {
-	request := struct {
-		ID int `json:"id" binding:"number"`
-	}{}
+	request := idRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	ok := net.DeletePolicy(request.ID)
-	if !ok {
+	if policy, err := w.policies.QueryPolicyById(request.ID); err == nil {
+		audit.Record(context, "net policy", policy, nil)
+	}
+
+	err := net.DeletePolicy(request.ID)
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusNetDeletePolicyFailed)
 		return
 	}
 
-	err := w.deleteNetPolicyById(request.ID)
+	err = w.policies.DeletePolicyById(request.ID)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusNetDeletePolicyDatabaseFailed)
 		return
 	}
@@ -127,17 +174,14 @@ func (w *Worker) netPolicyDelete(context *gin.Context) {
 }
 
 func (w *Worker) netPolicyList(context *gin.Context) {
-	request := struct {
-		Limit  int `json:"limit" binding:"number"`
-		Offset int `json:"offset" binding:"number"`
-	}{}
+	request := listRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	policies, err := w.queryNetPolicyLimitOffset(request.Limit, request.Offset)
+	policies, err := w.policies.QueryPolicyLimitOffset(request.Limit, request.Offset)
 	if err != nil {
 		logrus.Error(err)
 		render.Status(context, render.StatusNetQueryPolicyListFailed)
@@ -145,3 +189,48 @@ func (w *Worker) netPolicyList(context *gin.Context) {
 	}
 	render.Success(context, policies)
 }
+
+var policyHeader = []string{"id", "priority", "addr_src_begin", "addr_src_end", "addr_dst_begin", "addr_dst_end",
+	"protocol_begin", "protocol_end", "port_src_begin", "port_src_end", "port_dst_begin", "port_dst_end", "flags", "response"}
+
+func policyRecord(row interface{}) []string {
+	policy := row.(net.Policy)
+	return []string{
+		strconv.FormatInt(policy.ID, 10),
+		strconv.Itoa(int(policy.Priority)),
+		policy.Addr.Src.Begin,
+		policy.Addr.Src.End,
+		policy.Addr.Dst.Begin,
+		policy.Addr.Dst.End,
+		strconv.Itoa(int(policy.Protocol.Begin)),
+		strconv.Itoa(int(policy.Protocol.End)),
+		strconv.Itoa(int(policy.Port.Src.Begin)),
+		strconv.Itoa(int(policy.Port.Src.End)),
+		strconv.Itoa(int(policy.Port.Dst.Begin)),
+		strconv.Itoa(int(policy.Port.Dst.End)),
+		strconv.Itoa(int(policy.Flags)),
+		strconv.FormatUint(uint64(policy.Response), 10),
+	}
+}
+
+func (w *Worker) netPolicyExport(context *gin.Context) {
+	request := exportRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	writer, err := export.New(context, "net-policy", request.Format, policyHeader, policyRecord)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer writer.Flush()
+
+	err = w.policies.ScanPolicyLimitOffset(export.Limit(request.Limit), request.Offset, func(policy net.Policy) error {
+		return writer.Write(policy)
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
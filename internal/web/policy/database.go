@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package policy
+
+import (
+	"strings"
+	"time"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 数据库中已有的进程信任规则
+type processRule struct {
+	ID     uint64
+	Cmd    string
+	Status int
+}
+
+type filePolicy struct {
+	ID int64
+	FilePolicy
+}
+
+func (w *Worker) queryProcessRules() (rules []processRule, err error) {
+	err = w.processes.ScanRules(func(id uint64, cmd string, status int) error {
+		rules = append(rules, processRule{ID: id, Cmd: cmd, Status: status})
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+	return
+}
+
+// saveProcessRule 已经上报过的命令只修改状态,没有上报过的命令新增一条执行次数为 0 的记录
+func (w *Worker) saveProcessRule(command Command, status int) (err error) {
+	err = w.processes.UpsertRule(command.cmd(), command.Workdir, command.Binary, strings.Join(command.Argv, " "), status, time.Now().Unix())
+	if err != nil {
+		logrus.Error(err)
+	}
+	return
+}
+
+func (w *Worker) updateProcessStatus(id uint64, status int) (err error) {
+	if _, err = w.processes.UpdateStatus(id, status); err != nil {
+		logrus.Error(err)
+	}
+	return
+}
+
+// queryFilePolicies 只返回文件,目录和通配符策略,展开的子策略不属于策略文档
+func (w *Worker) queryFilePolicies() (policies []filePolicy, err error) {
+	err = w.files.ScanPolicyByParentLimitOffset(0, -1, 0, func(policy file.Policy) error {
+		policies = append(policies, filePolicy{ID: int64(policy.ID), FilePolicy: FilePolicy{Path: policy.Path, Perm: policy.Perm, Kind: policy.Kind}})
+		return nil
+	})
+	return
+}
+
+func (w *Worker) queryNetPolicies() (policies []net.Policy, err error) {
+	if policies, err = w.nets.QueryPolicyLimitOffset(-1, 0); err != nil {
+		logrus.Error(err)
+	}
+	return
+}
+
+func (w *Worker) insertNetPolicy(policy *net.Policy) (id int64, err error) {
+	if id, err = w.nets.InsertPolicy(policy); err != nil {
+		logrus.Error(err)
+	}
+	return
+}
+
+func (w *Worker) deleteNetPolicyById(id int64) (err error) {
+	if err = w.nets.DeletePolicyById(int(id)); err != nil {
+		logrus.Error(err)
+	}
+	return
+}
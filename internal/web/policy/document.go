@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+	"uranus/pkg/process"
+
+	"gopkg.in/yaml.v2"
+)
+
+const documentVersion = 1
+
+var errEmptyDocument = errors.New("empty document")
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// Document 描述一台主机的防护配置.导入时没有填写的模块和字段保持不变,
+// 填写了的策略列表会替换数据库中的全部策略,空列表表示删除全部策略
+type Document struct {
+	Version int          `json:"version" yaml:"version"`
+	Process *ProcessPart `json:"process,omitempty" yaml:"process,omitempty"`
+	File    *FilePart    `json:"file,omitempty" yaml:"file,omitempty"`
+	Net     *NetPart     `json:"net,omitempty" yaml:"net,omitempty"`
+}
+
+type ProcessPart struct {
+	Status *int `json:"status,omitempty" yaml:"status,omitempty"`
+	// 进程防护模式和新命令的默认信任状态
+	Judge *int `json:"judge,omitempty" yaml:"judge,omitempty"`
+	Trust *int `json:"trust,omitempty" yaml:"trust,omitempty"`
+	// 信任和不信任的命令,不在列表中的命令恢复为待确认状态
+	Trusted   []Command `json:"trusted" yaml:"trusted"`
+	Untrusted []Command `json:"untrusted" yaml:"untrusted"`
+}
+
+type Command struct {
+	Workdir string   `json:"workdir" yaml:"workdir"`
+	Binary  string   `json:"binary" yaml:"binary"`
+	Argv    []string `json:"argv" yaml:"argv"`
+}
+
+type FilePart struct {
+	Status   *int         `json:"status,omitempty" yaml:"status,omitempty"`
+	Policies []FilePolicy `json:"policies" yaml:"policies"`
+}
+
+// FilePolicy 不包括目录和通配符策略展开的子策略
+type FilePolicy struct {
+	Path string `json:"path" yaml:"path"`
+	Perm int    `json:"perm" yaml:"perm"`
+	Kind int    `json:"kind,omitempty" yaml:"kind,omitempty"`
+}
+
+// 网络策略没有自然的主键,按除 ID 以外的全部字段比较,导入时忽略 ID
+type NetPart struct {
+	Status   *int         `json:"status,omitempty" yaml:"status,omitempty"`
+	Policies []net.Policy `json:"policies" yaml:"policies"`
+}
+
+// cmd 与 hackernel 上报的命令格式相同,各部分用 \u001f 分隔
+func (c Command) cmd() string {
+	return strings.Join(append([]string{c.Workdir, c.Binary}, c.Argv...), "\u001f")
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Workdir, c.Binary}, c.Argv...), " ")
+}
+
+func parseCmd(cmd string) Command {
+	raw := strings.Split(cmd, "\u001f")
+	command := Command{Argv: []string{}}
+	if len(raw) > 0 {
+		command.Workdir = raw[0]
+	}
+	if len(raw) > 1 {
+		command.Binary = raw[1]
+	}
+	if len(raw) > 2 {
+		command.Argv = raw[2:]
+	}
+	return command
+}
+
+// parseDocument JSON 是 YAML 的子集,两种格式都按 YAML 解析,未知字段视为错误
+func parseDocument(data []byte) (document Document, err error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		err = errEmptyDocument
+		return
+	}
+	if err = yaml.UnmarshalStrict(data, &document); err != nil {
+		return
+	}
+	err = document.validate()
+	return
+}
+
+func (d *Document) validate() (err error) {
+	if d.Version != documentVersion {
+		return fmt.Errorf("unsupported version %d", d.Version)
+	}
+
+	if p := d.Process; p != nil {
+		if err = checkRange("process status", p.Status, process.StatusDisable, process.StatusEnable); err != nil {
+			return
+		}
+		if err = checkRange("process judge", p.Judge, process.StatusJudgeDisable, process.StatusJudgeDefense); err != nil {
+			return
+		}
+		if err = checkRange("process trust", p.Trust, process.StatusPending, process.StatusTrusted); err != nil {
+			return
+		}
+		commands := map[string]bool{}
+		for _, command := range append(append([]Command{}, p.Trusted...), p.Untrusted...) {
+			if command.Binary == "" || len(command.Argv) == 0 {
+				return fmt.Errorf("invalid command: %s", command)
+			}
+			if commands[command.cmd()] {
+				return fmt.Errorf("duplicate command: %s", command)
+			}
+			commands[command.cmd()] = true
+		}
+	}
+
+	if f := d.File; f != nil {
+		if err = checkRange("file status", f.Status, file.StatusDisable, file.StatusEnable); err != nil {
+			return
+		}
+		paths := map[string]bool{}
+		for i := range f.Policies {
+			// 数据库中保存的是规范化的路径,否则 /etc/ssh/ 与 /etc/ssh 每次导入都会被删除后重新添加
+			if !strings.HasPrefix(f.Policies[i].Path, "/") {
+				return fmt.Errorf("file policy path must be absolute: %q", f.Policies[i].Path)
+			}
+			f.Policies[i].Path = filepath.Clean(f.Policies[i].Path)
+			policy := f.Policies[i]
+			if paths[policy.Path] {
+				return fmt.Errorf("duplicate file policy: %s", policy.Path)
+			}
+			if err = checkRange("file policy kind", &policy.Kind, file.KindFile, file.KindGlob); err != nil {
+				return
+			}
+			if err = checkRange("file policy perm", &policy.Perm, 0, file.PermAll); err != nil {
+				return
+			}
+			if policy.Kind == file.KindGlob {
+				if _, err := filepath.Match(policy.Path, ""); err != nil {
+					return fmt.Errorf("invalid file policy pattern: %q", policy.Path)
+				}
+			}
+			paths[policy.Path] = true
+		}
+	}
+
+	if n := d.Net; n != nil {
+		if err = checkRange("net status", n.Status, net.StatusDisable, net.StatusEnable); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func checkRange(name string, value *int, min, max int) error {
+	if value != nil && (*value < min || *value > max) {
+		return fmt.Errorf("%s out of range: %d", name, *value)
+	}
+	return nil
+}
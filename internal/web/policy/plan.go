@@ -0,0 +1,377 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"uranus/internal/background"
+	"uranus/internal/config"
+	"uranus/internal/web/audit"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+	"uranus/pkg/process"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errFileConflict     = errors.New("file policy conflict")
+	errFileNotExist     = errors.New("file not exist")
+	errFilePolicyFailed = errors.New("set file policy failed")
+)
+
+// 发送给 hackernel 的策略修改,测试时替换
+var (
+	pushTrustedCmd   = process.SetTrustedCmd
+	pushUntrustedCmd = process.SetUntrustedCmd
+	pushFilePolicy   = file.SetPolicy
+	pushNetPolicy    = net.AddPolicy
+	pushNetDelete    = net.DeletePolicy
+)
+
+// plan 比较策略文档和数据库,按先策略后模块状态的顺序生成修改
+func (w *Worker) plan(context *gin.Context, document Document) (changes []Change, err error) {
+	current, err := w.current()
+	if err != nil {
+		return
+	}
+
+	changes = []Change{}
+	if p := document.Process; p != nil && (p.Trusted != nil || p.Untrusted != nil) {
+		rules, err := w.queryProcessRules()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, w.planCommands(context, rules, p)...)
+	}
+	if f := document.File; f != nil && f.Policies != nil {
+		policies, err := w.queryFilePolicies()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, w.planFilePolicies(context, policies, f.Policies)...)
+	}
+	if n := document.Net; n != nil && n.Policies != nil {
+		changes = append(changes, w.planNetPolicies(context, current.Net.Policies, n.Policies)...)
+	}
+
+	if p := document.Process; p != nil {
+		changes = append(changes, w.planSetting(context, config.ProcessModuleStatus, current.Process.Status, p.Status, func(value int) error {
+			if value == process.StatusEnable {
+				return process.Enable()
+			}
+			return process.Disable()
+		})...)
+		changes = append(changes, w.planSetting(context, config.ProcessProtectionMode, current.Process.Judge, p.Judge, process.UpdateJudge)...)
+		changes = append(changes, w.planSetting(context, config.ProcessCmdDefaultStatus, current.Process.Trust, p.Trust, nil)...)
+	}
+	if f := document.File; f != nil {
+		changes = append(changes, w.planSetting(context, config.FileModuleStatus, current.File.Status, f.Status, func(value int) error {
+			if value == file.StatusEnable {
+				return file.Enable()
+			}
+			return file.Disable()
+		})...)
+	}
+	if n := document.Net; n != nil {
+		changes = append(changes, w.planSetting(context, config.NetModuleStatus, current.Net.Status, n.Status, func(value int) error {
+			if value == net.StatusEnable {
+				return net.Enable()
+			}
+			return net.Disable()
+		})...)
+	}
+	return
+}
+
+func (w *Worker) planSetting(context *gin.Context, key string, before, after *int, push func(value int) error) []Change {
+	if after == nil || *after == *before {
+		return nil
+	}
+	value := *after
+	return []Change{{
+		Target: "setting", Action: ActionUpdate, Key: key, Before: *before, After: value,
+		apply: func() error {
+			if err := audit.SetInteger(context, w.config, key, value); err != nil {
+				return err
+			}
+			if push == nil {
+				return nil
+			}
+			return push(value)
+		},
+	}}
+}
+
+// pushCmd 与手动修改信任状态相同,只有信任的命令需要加入 hackernel 的白名单
+func pushCmd(cmd string, status int) error {
+	if status == process.StatusTrusted {
+		return pushTrustedCmd(cmd)
+	}
+	return pushUntrustedCmd(cmd)
+}
+
+// planCommands 文档中没有的命令恢复为待确认状态
+func (w *Worker) planCommands(context *gin.Context, rules []processRule, desired *ProcessPart) (changes []Change) {
+	existing := map[string]int{}
+	for _, rule := range rules {
+		existing[rule.Cmd] = rule.Status
+	}
+
+	wanted := map[string]bool{}
+	add := func(command Command, status int) {
+		cmd := command.cmd()
+		wanted[cmd] = true
+		before, ok := existing[cmd]
+		if ok && before == status {
+			return
+		}
+		change := Change{Target: "process command", Action: ActionAdd, Key: command.String(), After: status}
+		if ok {
+			change.Action = ActionUpdate
+			change.Before = before
+		}
+		change.apply = func() error {
+			err := pushCmd(cmd, status)
+			if err != nil {
+				return err
+			}
+			if err = w.saveProcessRule(command, status); err != nil {
+				return err
+			}
+			audit.Record(context, "process command", change.Before, status)
+			return nil
+		}
+		changes = append(changes, change)
+	}
+	for _, command := range desired.Trusted {
+		add(command, process.StatusTrusted)
+	}
+	for _, command := range desired.Untrusted {
+		add(command, process.StatusUntrusted)
+	}
+
+	for _, rule := range rules {
+		if wanted[rule.Cmd] {
+			continue
+		}
+		rule := rule
+		changes = append(changes, Change{
+			Target: "process command", Action: ActionDelete, Key: parseCmd(rule.Cmd).String(), Before: rule.Status, After: process.StatusPending,
+			apply: func() error {
+				err := pushUntrustedCmd(rule.Cmd)
+				if err != nil {
+					return err
+				}
+				if err = w.updateProcessStatus(rule.ID, process.StatusPending); err != nil {
+					return err
+				}
+				audit.Record(context, "process command", rule.Status, process.StatusPending)
+				return nil
+			},
+		})
+	}
+	return
+}
+
+// setFilePolicy 把 hackernel 返回的策略状态转换为错误
+func setFilePolicy(path string, perm, flag int) (fsid, ino uint64, err error) {
+	fsid, ino, status, err := pushFilePolicy(path, perm, flag)
+	if err != nil {
+		return
+	}
+	switch status {
+	case file.StatusPolicyConflict:
+		err = errFileConflict
+	case file.StatusPolicyFileNotExist:
+		err = errFileNotExist
+	case file.StatusPolicyUnknown:
+		err = errFilePolicyFailed
+	}
+	return
+}
+
+func (w *Worker) planFilePolicies(context *gin.Context, policies []filePolicy, desired []FilePolicy) (changes []Change) {
+	existing := map[string]filePolicy{}
+	for _, policy := range policies {
+		existing[policy.Path] = policy
+	}
+
+	for _, policy := range desired {
+		policy := policy
+		before, ok := existing[policy.Path]
+		delete(existing, policy.Path)
+		if !ok {
+			changes = append(changes, Change{
+				Target: "file policy", Action: ActionAdd, Key: policy.Path, After: policy,
+				apply: func() error {
+					return w.addFilePolicy(context, policy)
+				},
+			})
+			continue
+		}
+		if before.Perm == policy.Perm && before.Kind == policy.Kind {
+			continue
+		}
+		changes = append(changes, Change{
+			Target: "file policy", Action: ActionUpdate, Key: policy.Path, Before: before.FilePolicy, After: policy,
+			apply: func() error {
+				// 类型不同时删除后重新添加
+				if before.Kind != policy.Kind {
+					if err := w.deleteFilePolicy(context, before); err != nil {
+						return err
+					}
+					return w.addFilePolicy(context, policy)
+				}
+				if policy.Kind != file.KindFile {
+					if err := background.UpdateFilePattern(w.files, uint64(before.ID), policy.Perm); err != nil {
+						return err
+					}
+					audit.Record(context, "file policy", before.FilePolicy, policy)
+					return nil
+				}
+				fsid, ino, err := setFilePolicy(policy.Path, policy.Perm, file.FlagUpdate)
+				if err != nil {
+					return err
+				}
+				if err = w.files.UpdatePolicyById(fsid, ino, policy.Perm, file.StatusPolicyNormal, int(before.ID)); err != nil {
+					return err
+				}
+				audit.Record(context, "file policy", before.FilePolicy, policy)
+				return nil
+			},
+		})
+	}
+
+	for _, policy := range policies {
+		policy := policy
+		if _, ok := existing[policy.Path]; !ok {
+			continue
+		}
+		changes = append(changes, Change{
+			Target: "file policy", Action: ActionDelete, Key: policy.Path, Before: policy.FilePolicy,
+			apply: func() error {
+				return w.deleteFilePolicy(context, policy)
+			},
+		})
+	}
+	return
+}
+
+// addFilePolicy 目录和通配符策略由 background 展开为子策略
+func (w *Worker) addFilePolicy(context *gin.Context, policy FilePolicy) (err error) {
+	if policy.Kind != file.KindFile {
+		if policy.Kind == file.KindDirectory {
+			if info, err := os.Stat(policy.Path); err != nil || !info.IsDir() {
+				return errFileNotExist
+			}
+		}
+		id, err := background.AddFilePattern(w.files, policy.Path, policy.Kind, policy.Perm)
+		if err != nil {
+			return err
+		}
+		audit.Record(context, "file policy", nil, file.Policy{ID: uint64(id), Path: policy.Path, Perm: policy.Perm, Kind: policy.Kind})
+		return nil
+	}
+
+	fsid, ino, err := setFilePolicy(policy.Path, policy.Perm, file.FlagNew)
+	if err != nil {
+		return
+	}
+	if err = w.files.InsertPolicy(policy.Path, fsid, ino, policy.Perm, file.StatusPolicyNormal); err != nil {
+		return
+	}
+	audit.Record(context, "file policy", nil, file.Policy{Path: policy.Path, Fsid: fsid, Ino: ino, Perm: policy.Perm})
+	return
+}
+
+// deleteFilePolicy 目录和通配符策略同时删除全部子策略
+func (w *Worker) deleteFilePolicy(context *gin.Context, policy filePolicy) (err error) {
+	if policy.Kind != file.KindFile {
+		err = background.DeleteFilePattern(w.files, uint64(policy.ID))
+	} else if _, _, _, err = pushFilePolicy(policy.Path, 0, file.FlagAny); err == nil {
+		err = w.files.DeletePolicyById(int(policy.ID))
+	}
+	if err != nil {
+		return
+	}
+	audit.Record(context, "file policy", policy.FilePolicy, nil)
+	return
+}
+
+func describeNetPolicy(policy net.Policy) string {
+	return fmt.Sprintf("priority=%d src=%s-%s:%d-%d dst=%s-%s:%d-%d protocol=%d-%d",
+		policy.Priority,
+		policy.Addr.Src.Begin, policy.Addr.Src.End, policy.Port.Src.Begin, policy.Port.Src.End,
+		policy.Addr.Dst.Begin, policy.Addr.Dst.End, policy.Port.Dst.Begin, policy.Port.Dst.End,
+		policy.Protocol.Begin, policy.Protocol.End)
+}
+
+// planNetPolicies 相同内容的策略可能有多条,按数量比较,先删除再添加
+func (w *Worker) planNetPolicies(context *gin.Context, current, desired []net.Policy) (changes []Change) {
+	existing := map[net.Policy][]net.Policy{}
+	for _, policy := range current {
+		key := policy
+		key.ID = 0
+		existing[key] = append(existing[key], policy)
+	}
+
+	kept := map[int64]bool{}
+	added := []net.Policy{}
+	for _, policy := range desired {
+		policy.ID = 0
+		if remain := existing[policy]; len(remain) > 0 {
+			kept[remain[0].ID] = true
+			existing[policy] = remain[1:]
+			continue
+		}
+		added = append(added, policy)
+	}
+
+	for _, policy := range current {
+		if kept[policy.ID] {
+			continue
+		}
+		policy := policy
+		changes = append(changes, Change{
+			Target: "net policy", Action: ActionDelete, Key: describeNetPolicy(policy), Before: policy,
+			apply: func() error {
+				err := pushNetDelete(int(policy.ID))
+				if err != nil {
+					return err
+				}
+				if err = w.deleteNetPolicyById(policy.ID); err != nil {
+					return err
+				}
+				audit.Record(context, "net policy", policy, nil)
+				return nil
+			},
+		})
+	}
+
+	for _, policy := range added {
+		policy := policy
+		changes = append(changes, Change{
+			Target: "net policy", Action: ActionAdd, Key: describeNetPolicy(policy), After: policy,
+			// hackernel 使用数据库中的 id,先写入数据库,发送失败时删除,下次导入时重新添加
+			apply: func() error {
+				id, err := w.insertNetPolicy(&policy)
+				if err != nil {
+					return err
+				}
+				policy.ID = id
+				if err = pushNetPolicy(policy); err != nil {
+					if cleanup := w.deleteNetPolicyById(id); cleanup != nil {
+						logrus.Errorf("net policy %d: delete after failed push: %v", id, cleanup)
+					}
+					return err
+				}
+				audit.Record(context, "net policy", nil, policy)
+				return nil
+			},
+		})
+	}
+	return
+}
@@ -0,0 +1,320 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"uranus/internal/config"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/render"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+	"uranus/pkg/process"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakePush 替换发送给 hackernel 的修改,记录发送的命令, fail 中的命令返回错误
+type fakePush struct {
+	pushed []string
+	fail   map[string]bool
+}
+
+func (f *fakePush) record(format string, args ...interface{}) error {
+	command := fmt.Sprintf(format, args...)
+	f.pushed = append(f.pushed, command)
+	if f.fail[command] {
+		return errors.New("hackernel rejected " + command)
+	}
+	return nil
+}
+
+func stubPush(t *testing.T) *fakePush {
+	f := &fakePush{fail: map[string]bool{}}
+	trusted, untrusted, policy, add, remove := pushTrustedCmd, pushUntrustedCmd, pushFilePolicy, pushNetPolicy, pushNetDelete
+	t.Cleanup(func() {
+		pushTrustedCmd, pushUntrustedCmd, pushFilePolicy, pushNetPolicy, pushNetDelete = trusted, untrusted, policy, add, remove
+	})
+	pushTrustedCmd = func(cmd string) error { return f.record("trust %s", parseCmd(cmd)) }
+	pushUntrustedCmd = func(cmd string) error { return f.record("untrust %s", parseCmd(cmd)) }
+	pushFilePolicy = func(path string, perm, flag int) (uint64, uint64, int, error) {
+		return 1, 2, file.StatusPolicyNormal, f.record("file %s %d", path, perm)
+	}
+	pushNetPolicy = func(policy net.Policy) error { return f.record("net add %d", policy.Priority) }
+	pushNetDelete = func(id int) error { return f.record("net delete %d", id) }
+	return f
+}
+
+func newTestWorker(t *testing.T) (w *Worker, engine *gin.Engine, db *storage.DB) {
+	gin.SetMode(gin.TestMode)
+	db, err := storage.Open(filepath.Join(t.TempDir(), "web.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	engine = gin.New()
+	registry := api.NewRegistry(engine, "")
+	if err := Init(registry, db); err != nil {
+		t.Fatal(err)
+	}
+	w = &Worker{
+		processes: storage.NewProcessRepository(db),
+		files:     storage.NewFileRepository(db),
+		nets:      storage.NewNetRepository(db),
+	}
+	return
+}
+
+func netPolicy(priority int8, src string) net.Policy {
+	policy := net.Policy{Priority: priority, Flags: 1, Response: 1}
+	policy.Addr.Src.Begin = src
+	policy.Addr.Src.End = src
+	policy.Protocol.Begin = 6
+	policy.Protocol.End = 6
+	return policy
+}
+
+func command(binary string) Command {
+	return Command{Workdir: "/", Binary: binary, Argv: []string{filepath.Base(binary)}}
+}
+
+// seed 写入已有的策略:
+// 进程 ls 信任, cat 不信任, id 信任;文件 /a 和 /c 为文件, /b 为目录;网络 1 两条, 2 一条
+func seed(t *testing.T, w *Worker, db *storage.DB) {
+	for _, rule := range []struct {
+		command Command
+		status  int
+	}{
+		{command("/bin/ls"), process.StatusTrusted},
+		{command("/bin/cat"), process.StatusUntrusted},
+		{command("/bin/id"), process.StatusTrusted},
+	} {
+		if err := w.processes.UpsertRule(rule.command.cmd(), "/", rule.command.Binary, strings.Join(rule.command.Argv, " "), rule.status, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statements := []string{
+		`insert into file_policy(path,fsid,ino,perm,timestamp,status,kind,parent) values('/a',1,1,2,1,0,0,0)`,
+		`insert into file_policy(path,fsid,ino,perm,timestamp,status,kind,parent) values('/b',0,0,2,1,0,1,0)`,
+		`insert into file_policy(path,fsid,ino,perm,timestamp,status,kind,parent) values('/c',1,3,2,1,0,0,0)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, policy := range []net.Policy{netPolicy(1, "10.0.0.1"), netPolicy(1, "10.0.0.1"), netPolicy(2, "10.0.0.2")} {
+		policy := policy
+		if _, err := w.nets.InsertPolicy(&policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func apply(t *testing.T, engine *gin.Engine, document Document, dryRun bool) (status int, changes []Change) {
+	body, err := json.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/v1/policies/document?dryRun=%v", dryRun), strings.NewReader(string(body)))
+	engine.ServeHTTP(recorder, request)
+	response := struct {
+		Status int      `json:"status"`
+		Data   []Change `json:"data"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: %v", recorder.Body.String(), err)
+	}
+	return response.Status, response.Data
+}
+
+// snapshot 返回全部策略和配置,用于确认 dry run 没有修改数据库
+func snapshot(t *testing.T, db *storage.DB) string {
+	queries := []string{
+		`select group_concat(cmd||':'||status, ',') from (select cmd,status from process_event order by id)`,
+		`select group_concat(path||':'||perm||':'||kind, ',') from (select path,perm,kind from file_policy order by id)`,
+		`select group_concat(id||':'||priority, ',') from (select id,priority from net_policy order by id)`,
+		`select count(*) from config`,
+	}
+	result := []string{}
+	for _, query := range queries {
+		var value interface{}
+		if err := db.QueryRow(query).Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, fmt.Sprint(value))
+	}
+	return strings.Join(result, "\n")
+}
+
+func describe(changes []Change) (result []string) {
+	for _, change := range changes {
+		result = append(result, change.Target+" "+change.Action+" "+change.Key)
+	}
+	return
+}
+
+func TestPlanDryRun(t *testing.T) {
+	enable := file.StatusEnable
+	netKey := func(priority int8, src string) string { return describeNetPolicy(netPolicy(priority, src)) }
+
+	tests := []struct {
+		name     string
+		document Document
+		changes  []string
+	}{
+		{
+			// 不在文档中的 cat 恢复为待确认, id 从信任改为不信任
+			name: "process commands",
+			document: Document{Version: documentVersion, Process: &ProcessPart{
+				Trusted:   []Command{command("/bin/ls")},
+				Untrusted: []Command{command("/bin/id"), command("/bin/ps")},
+			}},
+			changes: []string{
+				"process command update / /bin/id id",
+				"process command add / /bin/ps ps",
+				"process command delete / /bin/cat cat",
+			},
+		},
+		{
+			// /b 从目录改为文件时删除后重新添加,整体作为一次修改
+			name: "file policies",
+			document: Document{Version: documentVersion, File: &FilePart{Status: &enable, Policies: []FilePolicy{
+				{Path: "/a", Perm: 2},
+				{Path: "/b/", Perm: 2, Kind: file.KindFile},
+				{Path: "/d", Perm: 4},
+			}}},
+			changes: []string{
+				"file policy update /b",
+				"file policy add /d",
+				"file policy delete /c",
+				"setting update " + config.FileModuleStatus,
+			},
+		},
+		{
+			// 相同的网络策略按数量比较,多余的一条删除,不足的添加
+			name: "net policies",
+			document: Document{Version: documentVersion, Net: &NetPart{Policies: []net.Policy{
+				netPolicy(1, "10.0.0.1"), netPolicy(2, "10.0.0.2"), netPolicy(2, "10.0.0.2"), netPolicy(3, "10.0.0.3"),
+			}}},
+			changes: []string{
+				"net policy delete " + netKey(1, "10.0.0.1"),
+				"net policy add " + netKey(2, "10.0.0.2"),
+				"net policy add " + netKey(3, "10.0.0.3"),
+			},
+		},
+		{
+			name: "unchanged",
+			document: Document{Version: documentVersion, Net: &NetPart{Policies: []net.Policy{
+				netPolicy(2, "10.0.0.2"), netPolicy(1, "10.0.0.1"), netPolicy(1, "10.0.0.1"),
+			}}},
+			changes: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			push := stubPush(t)
+			w, engine, db := newTestWorker(t)
+			seed(t, w, db)
+			before := snapshot(t, db)
+
+			status, changes := apply(t, engine, test.document, true)
+			if status != render.StatusSuccess {
+				t.Fatalf("status=%d", status)
+			}
+			if got := describe(changes); strings.Join(got, "\n") != strings.Join(test.changes, "\n") {
+				t.Errorf("changes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.changes, "\n"))
+			}
+			for _, change := range changes {
+				if change.Applied {
+					t.Errorf("%s applied in dry run", change.Key)
+				}
+			}
+			if after := snapshot(t, db); after != before {
+				t.Errorf("dry run modified database:\n%s\nwant:\n%s", after, before)
+			}
+			if len(push.pushed) != 0 {
+				t.Errorf("dry run pushed %v", push.pushed)
+			}
+		})
+	}
+}
+
+// 遇到第一个失败的修改时停止,之前的修改保留,之后的修改不执行
+func TestPlanApplyStopsAtFailure(t *testing.T) {
+	push := stubPush(t)
+	w, engine, db := newTestWorker(t)
+	seed(t, w, db)
+	push.fail["untrust / /bin/ps ps"] = true
+
+	document := Document{Version: documentVersion, Process: &ProcessPart{
+		Trusted:   []Command{command("/bin/ls")},
+		Untrusted: []Command{command("/bin/id"), command("/bin/ps")},
+	}}
+	status, changes := apply(t, engine, document, false)
+	if status != render.StatusPolicyApplyFailed {
+		t.Fatalf("status=%d", status)
+	}
+	if len(changes) != 3 || !changes[0].Applied || changes[1].Applied || changes[1].Error == "" || changes[2].Applied || changes[2].Error != "" {
+		t.Fatalf("changes=%+v", changes)
+	}
+	if strings.Join(push.pushed, ",") != "untrust / /bin/id id,untrust / /bin/ps ps" {
+		t.Errorf("pushed=%v", push.pushed)
+	}
+
+	rules, err := w.queryProcessRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]int{}
+	for _, rule := range rules {
+		statuses[parseCmd(rule.Cmd).Binary] = rule.Status
+	}
+	want := map[string]int{"/bin/ls": process.StatusTrusted, "/bin/cat": process.StatusUntrusted, "/bin/id": process.StatusUntrusted}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("statuses=%v", statuses)
+	}
+}
+
+// 文件策略的类型改变时删除原来的策略后按新的类型重新添加
+func TestPlanApplyFileKindChange(t *testing.T) {
+	push := stubPush(t)
+	w, engine, db := newTestWorker(t)
+	seed(t, w, db)
+
+	document := Document{Version: documentVersion, File: &FilePart{Policies: []FilePolicy{
+		{Path: "/a", Perm: 2},
+		{Path: "/b", Perm: 2, Kind: file.KindFile},
+		{Path: "/c", Perm: 2},
+	}}}
+	status, changes := apply(t, engine, document, false)
+	if status != render.StatusSuccess || len(changes) != 1 || !changes[0].Applied {
+		t.Fatalf("status=%d changes=%+v", status, changes)
+	}
+	if strings.Join(push.pushed, ",") != "file /b 2" {
+		t.Errorf("pushed=%v", push.pushed)
+	}
+	policies, err := w.queryFilePolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]int{}
+	for _, policy := range policies {
+		kinds[policy.Path] = policy.Kind
+	}
+	if len(kinds) != 3 || kinds["/b"] != file.KindFile {
+		t.Errorf("policies=%+v", policies)
+	}
+}
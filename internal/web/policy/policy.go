@@ -0,0 +1,231 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+	"uranus/pkg/file"
+	"uranus/pkg/net"
+	"uranus/pkg/process"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+type Worker struct {
+	registry  *api.Registry
+	processes storage.ProcessRepository
+	files     storage.FileRepository
+	nets      storage.NetRepository
+
+	config *config.Config
+	// 同一时间只允许一个导入请求修改策略
+	mutex sync.Mutex
+}
+
+type exportRequest struct {
+	Format string `json:"format" form:"format" binding:"omitempty,oneof=yaml json"`
+}
+
+type applyRequest struct {
+	// 只返回需要执行的修改,不修改数据库也不发送给 hackernel
+	DryRun bool `json:"dryRun" form:"dryRun"`
+}
+
+// Change 导入策略文档时需要执行的一项修改
+type Change struct {
+	// setting, process command, file policy 或 net policy
+	Target string      `json:"target"`
+	Action string      `json:"action"`
+	Key    string      `json:"key"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+	// 已经执行成功,执行失败后剩余的修改不再执行
+	Applied bool `json:"applied"`
+	// 执行失败的原因
+	Error string `json:"error,omitempty"`
+
+	apply func() error
+}
+
+func Init(registry *api.Registry, db *storage.DB) (err error) {
+	config, err := config.New(db)
+	if err != nil {
+		return
+	}
+	w := &Worker{
+		registry:  registry,
+		processes: storage.NewProcessRepository(db),
+		files:     storage.NewFileRepository(db),
+		nets:      storage.NewNetRepository(db),
+		config:    config,
+	}
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/policies/document", Legacy: "/policy/document/export", Resource: api.ResourcePolicy, Handler: w.documentExport,
+			Summary: "导出全部防护配置,支持 yaml 和 json 格式", Request: exportRequest{}, Response: Document{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusPolicyQueryFailed}},
+		{Method: http.MethodPut, Path: "/policies/document", Legacy: "/policy/document/apply", Resource: api.ResourcePolicy, Handler: w.documentApply,
+			Summary: "导入防护配置,请求体为 yaml 或 json 格式的策略文档, dryRun 时只返回需要执行的修改", Request: Document{}, Response: []Change{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusPolicyInvalidDocument, render.StatusPolicyQueryFailed, render.StatusPolicyApplyFailed}},
+	})
+	return
+}
+
+func (w *Worker) documentExport(context *gin.Context) {
+	request := exportRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	document, err := w.current()
+	if err != nil {
+		render.Status(context, render.StatusPolicyQueryFailed)
+		return
+	}
+
+	var data []byte
+	contentType := ""
+	switch request.Format {
+	case FormatJSON:
+		contentType = "application/json"
+		data, err = json.MarshalIndent(document, "", "  ")
+	default:
+		request.Format = FormatYAML
+		contentType = "application/yaml"
+		data, err = yaml.Marshal(document)
+	}
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusPolicyQueryFailed)
+		return
+	}
+
+	filename := fmt.Sprintf("policy-%s.%s", time.Now().Format("20060102150405"), request.Format)
+	context.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	context.Data(http.StatusOK, contentType, data)
+}
+
+func (w *Worker) documentApply(context *gin.Context) {
+	request := applyRequest{}
+	if err := context.ShouldBindQuery(&request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	data, err := io.ReadAll(context.Request.Body)
+	if err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	document, err := parseDocument(data)
+	if err != nil {
+		render.Data(context, render.StatusPolicyInvalidDocument, err.Error())
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	changes, err := w.plan(context, document)
+	if err != nil {
+		render.Status(context, render.StatusPolicyQueryFailed)
+		return
+	}
+	if request.DryRun {
+		render.Success(context, changes)
+		return
+	}
+
+	// 按顺序执行,遇到第一个错误时停止.已经执行的修改,包括发送给 hackernel 的策略,不会回滚
+	var failure error
+	for i := range changes {
+		if failure = changes[i].apply(); failure != nil {
+			changes[i].Error = failure.Error()
+			break
+		}
+		changes[i].Applied = true
+	}
+	if len(changes) != 0 {
+		audit.Hackernel(context, failure)
+	}
+	if failure != nil {
+		render.Data(context, render.StatusPolicyApplyFailed, changes)
+		return
+	}
+	render.Success(context, changes)
+}
+
+func (w *Worker) setting(key string, fallback int) *int {
+	value, err := w.config.GetInteger(key)
+	if err != nil {
+		value = fallback
+	}
+	return &value
+}
+
+// current 根据数据库中的配置和策略生成策略文档
+func (w *Worker) current() (document Document, err error) {
+	rules, err := w.queryProcessRules()
+	if err != nil {
+		return
+	}
+	files, err := w.queryFilePolicies()
+	if err != nil {
+		return
+	}
+	nets, err := w.queryNetPolicies()
+	if err != nil {
+		return
+	}
+
+	document = Document{
+		Version: documentVersion,
+		Process: &ProcessPart{
+			Status:    w.setting(config.ProcessModuleStatus, process.StatusDisable),
+			Judge:     w.setting(config.ProcessProtectionMode, process.StatusJudgeDisable),
+			Trust:     w.setting(config.ProcessCmdDefaultStatus, process.StatusPending),
+			Trusted:   []Command{},
+			Untrusted: []Command{},
+		},
+		File: &FilePart{
+			Status:   w.setting(config.FileModuleStatus, file.StatusDisable),
+			Policies: []FilePolicy{},
+		},
+		Net: &NetPart{
+			Status:   w.setting(config.NetModuleStatus, net.StatusDisable),
+			Policies: nets,
+		},
+	}
+	for _, rule := range rules {
+		switch rule.Status {
+		case process.StatusTrusted:
+			document.Process.Trusted = append(document.Process.Trusted, parseCmd(rule.Cmd))
+		case process.StatusUntrusted:
+			document.Process.Untrusted = append(document.Process.Untrusted, parseCmd(rule.Cmd))
+		}
+	}
+	for _, policy := range files {
+		document.File.Policies = append(document.File.Policies, policy.FilePolicy)
+	}
+	if document.Net.Policies == nil {
+		document.Net.Policies = []net.Policy{}
+	}
+	return
+}
@@ -2,51 +2,94 @@
 package process
 
 import (
-	"database/sql"
+	"net/http"
+	"strconv"
 	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/export"
 	"uranus/internal/web/render"
 	"uranus/pkg/process"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 type Worker struct {
-	engine *gin.Engine
-	db     *sql.DB
+	registry *api.Registry
+	events   storage.ProcessRepository
 
 	config *config.Config
 }
 
-type Event struct {
-	ID      uint64 `json:"id"`
-	Workdir string `json:"workdir"`
-	Binary  string `json:"binary"`
-	Argv    string `json:"argv"`
-	Count   uint64 `json:"count"`
-	Judge   uint64 `json:"judge"`
-	Status  uint64 `json:"status"`
+type statusBody struct {
+	Status int `json:"status" binding:"number"`
 }
 
-func Init(engine *gin.Engine, db *sql.DB) (err error) {
+type judgeBody struct {
+	Judge int `json:"judge" binding:"number"`
+}
+
+type listRequest struct {
+	Limit  int `json:"limit" form:"limit" binding:"number"`
+	Offset int `json:"offset" form:"offset" binding:"number"`
+}
+
+type exportRequest struct {
+	listRequest
+	export.Request
+}
+
+type policyUpdateRequest struct {
+	ID     int `json:"id" uri:"id" binding:"number"`
+	Status int `json:"status" binding:"number"`
+}
+
+type Event = storage.ProcessEvent
+
+func Init(registry *api.Registry, db *storage.DB) (err error) {
 	config, err := config.New(db)
 	if err != nil {
 		return
 	}
 	w := &Worker{
-		engine: engine,
-		db:     db,
-		config: config,
-	}
-	w.engine.POST("/process/core/status", w.processCoreStatus)
-	w.engine.POST("/process/core/enable", w.processCoreEnable)
-	w.engine.POST("/process/core/disable", w.processCoreDisable)
-	w.engine.POST("/process/audit/status", w.processAuditStatus)
-	w.engine.POST("/process/audit/update", w.processAuditUpdate)
-	w.engine.POST("/process/event/list", w.processEventList)
-	w.engine.POST("/process/event/delete", w.processEventDelete)
-	w.engine.POST("/process/policy/update", w.processPolicyUpdate)
-	w.engine.POST("/process/trust/update", w.processTrustUpdate)
-	w.engine.POST("/process/trust/status", w.processTrustStatus)
+		registry: registry,
+		events:   storage.NewProcessRepository(db),
+		config:   config,
+	}
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/modules/process", Legacy: "/process/core/status", Resource: api.ResourceModule, Handler: w.processCoreStatus,
+			Summary: "进程防护模块状态", Response: statusBody{}},
+		{Method: http.MethodPost, Path: "/modules/process/enable", Legacy: "/process/core/enable", Resource: api.ResourceModule, Handler: w.processCoreEnable,
+			Summary:  "启动进程防护模块",
+			Statuses: []int{render.StatusProcessEnableFailed}},
+		{Method: http.MethodPost, Path: "/modules/process/disable", Legacy: "/process/core/disable", Resource: api.ResourceModule, Handler: w.processCoreDisable,
+			Summary:  "关闭进程防护模块",
+			Statuses: []int{render.StatusProcessDisableFailed}},
+		{Method: http.MethodGet, Path: "/modules/process/judge", Legacy: "/process/audit/status", Resource: api.ResourceModule, Handler: w.processAuditStatus,
+			Summary: "进程防护模式", Response: judgeBody{}},
+		{Method: http.MethodPut, Path: "/modules/process/judge", Legacy: "/process/audit/update", Resource: api.ResourceModule, Handler: w.processAuditUpdate,
+			Summary: "更新进程防护模式", Request: judgeBody{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusProcessUpdateJudgeFailed}},
+		{Method: http.MethodGet, Path: "/events/process", Legacy: "/process/event/list", Resource: api.ResourceEvent, Handler: w.processEventList,
+			Summary: "进程事件列表", Request: listRequest{}, Response: []Event{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusProcessQueryEventFailed}},
+		{Method: http.MethodGet, Path: "/events/process/export", Legacy: "/process/event/export", Resource: api.ResourceEvent, Handler: w.processEventExport,
+			Summary: "导出进程事件,支持 ndjson 和 csv 格式", Request: exportRequest{},
+			Statuses: []int{render.StatusInvalidArgument}},
+		{Method: http.MethodDelete, Path: "/events/process/:id", Legacy: "/process/event/delete", Resource: api.ResourceEvent, Handler: w.processEventDelete,
+			Summary: "删除进程事件"},
+		{Method: http.MethodPut, Path: "/policies/process/:id", Legacy: "/process/policy/update", Resource: api.ResourcePolicy, Handler: w.processPolicyUpdate,
+			Summary: "更新进程信任状态", Request: policyUpdateRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusProcessUpdatePolicyFailed}},
+		{Method: http.MethodPut, Path: "/modules/process/trust", Legacy: "/process/trust/update", Resource: api.ResourceModule, Handler: w.processTrustUpdate,
+			Summary: "更新进程默认信任状态", Request: statusBody{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusProcessTrustUpdateFailed}},
+		{Method: http.MethodGet, Path: "/modules/process/trust", Legacy: "/process/trust/status", Resource: api.ResourceModule, Handler: w.processTrustStatus,
+			Summary: "进程默认信任状态", Response: statusBody{},
+			Statuses: []int{render.StatusProcessGetTrustStatusFailed}},
+	})
 	return
 }
 
@@ -56,33 +99,33 @@ func (w *Worker) processCoreStatus(context *gin.Context) {
 		status = process.StatusDisable
 	}
 
-	response := struct {
-		Status int `json:"status"`
-	}{
+	response := statusBody{
 		Status: status,
 	}
 
 	render.Success(context, response)
 }
 func (w *Worker) processCoreEnable(context *gin.Context) {
-	if err := w.config.SetInteger(config.ProcessModuleStatus, process.StatusEnable); err != nil {
+	if err := audit.SetInteger(context, w.config, config.ProcessModuleStatus, process.StatusEnable); err != nil {
 		render.Status(context, render.StatusProcessEnableFailed)
 		return
 	}
-	ok := process.Enable()
-	if !ok {
+	err := process.Enable()
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusProcessEnableFailed)
 		return
 	}
 	render.Status(context, render.StatusSuccess)
 }
 func (w *Worker) processCoreDisable(context *gin.Context) {
-	if err := w.config.SetInteger(config.ProcessModuleStatus, process.StatusDisable); err != nil {
+	if err := audit.SetInteger(context, w.config, config.ProcessModuleStatus, process.StatusDisable); err != nil {
 		render.Status(context, render.StatusProcessDisableFailed)
 		return
 	}
-	ok := process.Disable()
-	if !ok {
+	err := process.Disable()
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusProcessDisableFailed)
 		return
 	}
@@ -95,9 +138,7 @@ func (w *Worker) processAuditStatus(context *gin.Context) {
 		judge = process.StatusJudgeDisable
 	}
 
-	response := struct {
-		Judge int `json:"judge" binding:"number"`
-	}{
+	response := judgeBody{
 		Judge: judge,
 	}
 
@@ -105,11 +146,9 @@ func (w *Worker) processAuditStatus(context *gin.Context) {
 }
 
 func (w *Worker) processAuditUpdate(context *gin.Context) {
-	request := struct {
-		Judge int `json:"judge" binding:"number"`
-	}{}
+	request := judgeBody{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
@@ -119,12 +158,13 @@ func (w *Worker) processAuditUpdate(context *gin.Context) {
 		return
 	}
 
-	if err := w.config.SetInteger(config.ProcessProtectionMode, request.Judge); err != nil {
+	if err := audit.SetInteger(context, w.config, config.ProcessProtectionMode, request.Judge); err != nil {
 		render.Status(context, render.StatusProcessUpdateJudgeFailed)
 		return
 	}
-	ok := process.UpdateJudge(request.Judge)
-	if !ok {
+	err := process.UpdateJudge(request.Judge)
+	audit.Hackernel(context, err)
+	if err != nil {
 		render.Status(context, render.StatusProcessUpdateJudgeFailed)
 		return
 	}
@@ -132,40 +172,73 @@ func (w *Worker) processAuditUpdate(context *gin.Context) {
 }
 
 func (w *Worker) processEventList(context *gin.Context) {
-	request := struct {
-		Limit  int `json:"limit" binding:"number"`
-		Offset int `json:"offset" binding:"number"`
-	}{}
+	request := listRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	events, err := w.queryLimitOffset(request.Limit, request.Offset)
+	events, err := w.events.QueryEventLimitOffset(request.Limit, request.Offset)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusProcessQueryEventFailed)
 		return
 	}
 	render.Success(context, events)
 }
 
+var eventHeader = []string{"id", "workdir", "binary", "argv", "count", "judge", "status"}
+
+func eventRecord(row interface{}) []string {
+	e := row.(Event)
+	return []string{
+		strconv.FormatUint(e.ID, 10),
+		e.Workdir,
+		e.Binary,
+		e.Argv,
+		strconv.FormatUint(e.Count, 10),
+		strconv.FormatUint(e.Judge, 10),
+		strconv.FormatUint(e.Status, 10),
+	}
+}
+
+func (w *Worker) processEventExport(context *gin.Context) {
+	request := exportRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	writer, err := export.New(context, "process-event", request.Format, eventHeader, eventRecord)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer writer.Flush()
+
+	err = w.events.ScanEventLimitOffset(export.Limit(request.Limit), request.Offset, func(e Event) error {
+		return writer.Write(e)
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
 func (w *Worker) processPolicyUpdate(context *gin.Context) {
-	request := struct {
-		ID     int `json:"id" binding:"number"`
-		Status int `json:"status" binding:"number"`
-	}{}
+	request := policyUpdateRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	cmd, err := w.queryCmdById(request.ID)
+	cmd, status, err := w.events.QueryCmdById(request.ID)
 	if err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
+	audit.Record(context, "process policy", policyUpdateRequest{ID: request.ID, Status: status}, request)
 
 	switch request.Status {
 	case process.StatusTrusted:
@@ -173,13 +246,17 @@ func (w *Worker) processPolicyUpdate(context *gin.Context) {
 	default:
 		err = process.SetUntrustedCmd(cmd)
 	}
+	audit.Hackernel(context, err)
 
 	if err != nil {
 		render.Status(context, render.StatusProcessUpdatePolicyFailed)
 		return
 	}
 
-	ok := w.updateStatus(uint64(request.ID), request.Status)
+	ok, err := w.events.UpdateStatus(uint64(request.ID), request.Status)
+	if err != nil {
+		logrus.Error(err)
+	}
 	if !ok {
 		render.Status(context, render.StatusProcessUpdatePolicyFailed)
 		return
@@ -193,14 +270,12 @@ func (w *Worker) processEventDelete(context *gin.Context) {
 }
 
 func (w *Worker) processTrustUpdate(context *gin.Context) {
-	request := struct {
-		Status int `json:"status" binding:"number"`
-	}{}
-	if err := context.ShouldBindJSON(&request); err != nil {
+	request := statusBody{}
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
-	if err := w.config.SetInteger(config.ProcessCmdDefaultStatus, request.Status); err != nil {
+	if err := audit.SetInteger(context, w.config, config.ProcessCmdDefaultStatus, request.Status); err != nil {
 		render.Status(context, render.StatusProcessTrustUpdateFailed)
 		return
 	}
@@ -213,9 +288,7 @@ func (w *Worker) processTrustStatus(context *gin.Context) {
 		render.Status(context, render.StatusProcessGetTrustStatusFailed)
 		return
 	}
-	response := struct {
-		Status int `json:"status" binding:"number"`
-	}{
+	response := statusBody{
 		Status: status,
 	}
 	render.Success(context, response)
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// 解析出的客户端地址通过该请求头交给 gin 的 ClientIP,请求中携带的同名请求头会被覆盖
+const clientAddrHeader = "X-Uranus-Client-Addr"
+
+// 按顺序查找客户端地址的请求头,与 gin 的默认设置相同
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+
+// proxies 信任的反向代理地址,重新加载配置时整体替换,不需要重建路由
+type proxies struct {
+	value atomic.Value
+}
+
+// parseProxies 支持单个 IP 地址和 CIDR 格式的网段
+func parseProxies(addrs []string) (cidrs []*net.IPNet, err error) {
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address: %s", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address: %s", addr)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return
+}
+
+func (p *proxies) store(cidrs []*net.IPNet) {
+	p.value.Store(cidrs)
+}
+
+func (p *proxies) trusted(ip net.IP) bool {
+	cidrs, _ := p.value.Load().([]*net.IPNet)
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded 从右向左跳过信任的代理,返回第一个不信任的地址
+func (p *proxies) forwarded(header string) (addr string, ok bool) {
+	if header == "" {
+		return
+	}
+	items := strings.Split(header, ",")
+	for i := len(items) - 1; i >= 0; i-- {
+		item := strings.TrimSpace(items[i])
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return "", false
+		}
+		if i == 0 || !p.trusted(ip) {
+			return item, true
+		}
+	}
+	return
+}
+
+// handler 来自信任的代理的请求使用 X-Forwarded-For 中的客户端地址,
+// 其他请求使用连接的地址,并去掉不可信的 X-Forwarded-Proto
+func (p *proxies) handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request.Header.Del(clientAddrHeader)
+		host, _, err := net.SplitHostPort(strings.TrimSpace(request.RemoteAddr))
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		addr := ip.String()
+		if p.trusted(ip) {
+			for _, name := range forwardedHeaders {
+				if forwarded, ok := p.forwarded(request.Header.Get(name)); ok {
+					addr = forwarded
+					break
+				}
+			}
+		} else {
+			request.Header.Del("X-Forwarded-Proto")
+		}
+		request.Header.Set(clientAddrHeader, addr)
+		handler.ServeHTTP(writer, request)
+	})
+}
@@ -3,6 +3,8 @@ package render
 
 import (
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,6 +13,7 @@ const (
 	StatusSuccess = iota + 0
 	StatusUnknownError
 	StatusInvalidArgument
+	StatusNotFound
 )
 
 const (
@@ -21,6 +24,69 @@ const (
 	StatusUserQueryUserFailed
 	StatusUserUpdateUserFailed
 	StatusUserDeleteUserFailed
+	StatusUserPasswordTooShort
+	StatusUserPasswordReused
+	StatusUserUpdatePasswordPolicyFailed
+	StatusUserQuerySessionFailed
+	StatusUserRevokeSessionFailed
+	StatusUserUpdateSessionPolicyFailed
+	StatusUserQueryRoleFailed
+	StatusUserCreateRoleFailed
+	StatusUserUpdateRoleFailed
+	StatusUserDeleteRoleFailed
+	StatusUserRoleBuiltin
+	StatusUserTotpRequired
+	StatusUserTotpEnrollRequired
+	StatusUserTotpInvalidCode
+	StatusUserTotpAlreadyEnabled
+	StatusUserTotpNotEnrolled
+	StatusUserQueryTotpFailed
+	StatusUserEnrollTotpFailed
+	StatusUserDisableTotpFailed
+	StatusUserCreateTokenFailed
+	StatusUserQueryTokenFailed
+	StatusUserRevokeTokenFailed
+	StatusUserLoginThrottled
+	StatusUserUpdateLoginPolicyFailed
+	StatusUserQueryLoginEventFailed
+	StatusUserUpdateLoginEventFailed
+	StatusUserBootstrapDone
+	StatusUserBootstrapInvalidToken
+	StatusUserUsernameExists
+)
+
+const (
+	StatusAuditQueryFailed = iota + 500
+)
+
+const (
+	StatusControlWorkerNotFound = iota + 600
+	StatusControlRestartFailed
+	StatusControlQueryInfoFailed
+	StatusControlNotReady
+	StatusControlBackupFailed
+	StatusControlBackupNotFound
+	StatusControlRestoreInvalidBackup
+	StatusControlRestoreFailed
+	StatusControlRestoring
+	StatusControlReloadFailed
+)
+
+const (
+	StatusStatsQueryFailed = iota + 700
+	StatusStatsUpdateSettingsFailed
+)
+
+const (
+	StatusPolicyInvalidDocument = iota + 800
+	StatusPolicyQueryFailed
+	StatusPolicyApplyFailed
+)
+
+const (
+	StatusRetentionNotRunning = iota + 900
+	StatusRetentionUpdateSettingsFailed
+	StatusRetentionCompactFailed
 )
 
 const (
@@ -48,6 +114,8 @@ const (
 	StatusFileUpdatePolicyFileNotExist
 	StatusFileUpdatePolicyFailed
 	StatusFileUpdateEventStatusFailed
+	StatusFileUpdateSettingsFailed
+	StatusFileChildPolicyReadOnly
 )
 
 const (
@@ -61,47 +129,175 @@ const (
 )
 
 var messages = map[int]string{
-	StatusSuccess:                       "成功",
-	StatusUnknownError:                  "未知错误",
-	StatusInvalidArgument:               "无效参数",
-	StatusUserNotLoggedIn:               "未登录",
-	StatusUserPermissionDenied:          "无权限",
-	StatusUserLoginFaild:                "登录失败",
-	StatusUserCreateUserFailed:          "创建用户失败",
-	StatusUserQueryUserFailed:           "查询用户失败",
-	StatusUserUpdateUserFailed:          "更新用户失败",
-	StatusUserDeleteUserFailed:          "删除用户失败",
-	StatusProcessEnableFailed:           "启动进程防护模块失败",
-	StatusProcessDisableFailed:          "关闭进程防护模块失败",
-	StatusProcessUpdateJudgeFailed:      "更新进程防护模式失败",
-	StatusProcessUpdatePolicyFailed:     "更新进程策略失败",
-	StatusProcessQueryEventFailed:       "查询进程事件失败",
-	StatusProcessTrustUpdateFailed:      "更新进程默认信任状态失败",
-	StatusProcessGetTrustStatusFailed:   "获取进程默认信任状态失败",
-	StatusFileEnableFailed:              "启动文件防护模块失败",
-	StatusFileDisableFailed:             "关闭文件防护模块失败",
-	StatusFileAddPolicyConflict:         "添加文件策略冲突",
-	StatusFileAddPolicyFileNotExist:     "添加文件策略文件不存在",
-	StatusFileAddPolicyFailed:           "添加文件策略失败",
-	StatusFileDeletePolicyFailed:        "删除文件策略失败",
-	StatusFileQueryPolicyListFailed:     "查询文件策略列表失败",
-	StatusFileQueryPolicyByIdFailed:     "查询文件策略失败",
-	StatusFileQueryEventListFailed:      "查询文件事件列表失败",
-	StatusFileDeleteEventFailed:         "删除文件事件失败",
-	StatusFileUpdatePolicyConflict:      "更新文件策略冲突",
-	StatusFileUpdatePolicyFileNotExist:  "更新文件策略文件不存在",
-	StatusFileUpdatePolicyFailed:        "更新文件策略失败",
-	StatusFileUpdateEventStatusFailed:   "更新文件事件状态失败",
-	StatusNetEnableFailed:               "启动网络防护模块失败",
-	StatusNetDisableFailed:              "关闭网络防护模块失败",
-	StatusNetAddPolicyFailed:            "添加网络策略失败",
-	StatusNetAddPolicyDatabaseFailed:    "添加网络策略数据库失败",
-	StatusNetDeletePolicyFailed:         "删除网络策略失败",
-	StatusNetDeletePolicyDatabaseFailed: "删除网络策略数据库失败",
-	StatusNetQueryPolicyListFailed:      "查询网络策略列表失败",
+	StatusSuccess:                        "成功",
+	StatusUnknownError:                   "未知错误",
+	StatusInvalidArgument:                "无效参数",
+	StatusNotFound:                       "对象不存在",
+	StatusUserNotLoggedIn:                "未登录",
+	StatusUserPermissionDenied:           "无权限",
+	StatusUserLoginFaild:                 "登录失败",
+	StatusUserCreateUserFailed:           "创建用户失败",
+	StatusUserQueryUserFailed:            "查询用户失败",
+	StatusUserUpdateUserFailed:           "更新用户失败",
+	StatusUserDeleteUserFailed:           "删除用户失败",
+	StatusUserPasswordTooShort:           "密码长度不足",
+	StatusUserPasswordReused:             "不能使用最近用过的密码",
+	StatusUserUpdatePasswordPolicyFailed: "更新密码策略失败",
+	StatusUserQuerySessionFailed:         "查询会话失败",
+	StatusUserRevokeSessionFailed:        "注销会话失败",
+	StatusUserUpdateSessionPolicyFailed:  "更新会话策略失败",
+	StatusUserQueryRoleFailed:            "查询角色失败",
+	StatusUserCreateRoleFailed:           "创建角色失败",
+	StatusUserUpdateRoleFailed:           "更新角色失败",
+	StatusUserDeleteRoleFailed:           "删除角色失败",
+	StatusUserRoleBuiltin:                "内置角色不能修改",
+	StatusUserTotpRequired:               "需要输入两步验证码",
+	StatusUserTotpEnrollRequired:         "角色要求开启两步验证",
+	StatusUserTotpInvalidCode:            "验证码错误",
+	StatusUserTotpAlreadyEnabled:         "已开启两步验证",
+	StatusUserTotpNotEnrolled:            "未绑定身份验证器",
+	StatusUserQueryTotpFailed:            "查询两步验证状态失败",
+	StatusUserEnrollTotpFailed:           "开启两步验证失败",
+	StatusUserDisableTotpFailed:          "关闭两步验证失败",
+	StatusUserCreateTokenFailed:          "创建令牌失败",
+	StatusUserQueryTokenFailed:           "查询令牌失败",
+	StatusUserRevokeTokenFailed:          "注销令牌失败",
+	StatusUserLoginThrottled:             "登录失败次数过多,请稍后再试",
+	StatusUserUpdateLoginPolicyFailed:    "更新登录策略失败",
+	StatusUserQueryLoginEventFailed:      "查询登录事件失败",
+	StatusUserUpdateLoginEventFailed:     "更新登录事件状态失败",
+	StatusUserBootstrapDone:              "管理员已存在",
+	StatusUserBootstrapInvalidToken:      "初始化令牌错误",
+	StatusUserUsernameExists:             "用户名已存在",
+	StatusProcessEnableFailed:            "启动进程防护模块失败",
+	StatusProcessDisableFailed:           "关闭进程防护模块失败",
+	StatusProcessUpdateJudgeFailed:       "更新进程防护模式失败",
+	StatusProcessUpdatePolicyFailed:      "更新进程策略失败",
+	StatusProcessQueryEventFailed:        "查询进程事件失败",
+	StatusProcessTrustUpdateFailed:       "更新进程默认信任状态失败",
+	StatusProcessGetTrustStatusFailed:    "获取进程默认信任状态失败",
+	StatusFileEnableFailed:               "启动文件防护模块失败",
+	StatusFileDisableFailed:              "关闭文件防护模块失败",
+	StatusFileAddPolicyConflict:          "添加文件策略冲突",
+	StatusFileAddPolicyFileNotExist:      "添加文件策略文件不存在",
+	StatusFileAddPolicyFailed:            "添加文件策略失败",
+	StatusFileDeletePolicyFailed:         "删除文件策略失败",
+	StatusFileQueryPolicyListFailed:      "查询文件策略列表失败",
+	StatusFileQueryPolicyByIdFailed:      "查询文件策略失败",
+	StatusFileQueryEventListFailed:       "查询文件事件列表失败",
+	StatusFileDeleteEventFailed:          "删除文件事件失败",
+	StatusFileUpdatePolicyConflict:       "更新文件策略冲突",
+	StatusFileUpdatePolicyFileNotExist:   "更新文件策略文件不存在",
+	StatusFileUpdatePolicyFailed:         "更新文件策略失败",
+	StatusFileUpdateEventStatusFailed:    "更新文件事件状态失败",
+	StatusFileUpdateSettingsFailed:       "更新文件事件设置失败",
+	StatusFileChildPolicyReadOnly:        "子策略随所属的目录或通配符策略修改",
+	StatusNetEnableFailed:                "启动网络防护模块失败",
+	StatusNetDisableFailed:               "关闭网络防护模块失败",
+	StatusNetAddPolicyFailed:             "添加网络策略失败",
+	StatusNetAddPolicyDatabaseFailed:     "添加网络策略数据库失败",
+	StatusNetDeletePolicyFailed:          "删除网络策略失败",
+	StatusNetDeletePolicyDatabaseFailed:  "删除网络策略数据库失败",
+	StatusNetQueryPolicyListFailed:       "查询网络策略列表失败",
+	StatusAuditQueryFailed:               "查询审计日志失败",
+	StatusControlWorkerNotFound:          "后台模块不存在",
+	StatusControlRestartFailed:           "重启后台模块失败",
+	StatusControlQueryInfoFailed:         "查询运行状态失败",
+	StatusControlNotReady:                "服务未就绪",
+	StatusControlBackupFailed:            "备份数据库失败",
+	StatusControlBackupNotFound:          "备份不存在",
+	StatusControlRestoreInvalidBackup:    "备份文件损坏或版本过新",
+	StatusControlRestoreFailed:           "恢复数据库失败",
+	StatusControlRestoring:               "正在恢复数据库",
+	StatusControlReloadFailed:            "重新加载配置失败",
+	StatusStatsQueryFailed:               "查询统计数据失败",
+	StatusStatsUpdateSettingsFailed:      "更新统计设置失败",
+	StatusPolicyInvalidDocument:          "策略文档格式错误",
+	StatusPolicyQueryFailed:              "查询策略失败",
+	StatusPolicyApplyFailed:              "部分策略修改失败",
+	StatusRetentionNotRunning:            "事件清理模块没有运行",
+	StatusRetentionUpdateSettingsFailed:  "更新事件保留设置失败",
+	StatusRetentionCompactFailed:         "整理数据库失败",
+}
+
+// 旧版接口始终返回 200, v1 接口返回与 status 对应的 HTTP 状态码,未列出的都是服务端错误,返回 500
+var codes = map[int]int{
+	StatusSuccess:                      http.StatusOK,
+	StatusInvalidArgument:              http.StatusBadRequest,
+	StatusNotFound:                     http.StatusNotFound,
+	StatusUserNotLoggedIn:              http.StatusUnauthorized,
+	StatusUserPermissionDenied:         http.StatusForbidden,
+	StatusUserLoginFaild:               http.StatusUnauthorized,
+	StatusUserPasswordTooShort:         http.StatusBadRequest,
+	StatusUserPasswordReused:           http.StatusBadRequest,
+	StatusUserRoleBuiltin:              http.StatusForbidden,
+	StatusUserTotpRequired:             http.StatusUnauthorized,
+	StatusUserTotpEnrollRequired:       http.StatusForbidden,
+	StatusUserTotpInvalidCode:          http.StatusBadRequest,
+	StatusUserTotpAlreadyEnabled:       http.StatusConflict,
+	StatusUserTotpNotEnrolled:          http.StatusBadRequest,
+	StatusUserLoginThrottled:           http.StatusTooManyRequests,
+	StatusUserBootstrapDone:            http.StatusConflict,
+	StatusUserBootstrapInvalidToken:    http.StatusUnauthorized,
+	StatusUserUsernameExists:           http.StatusConflict,
+	StatusFileAddPolicyConflict:        http.StatusConflict,
+	StatusFileAddPolicyFileNotExist:    http.StatusNotFound,
+	StatusFileUpdatePolicyConflict:     http.StatusConflict,
+	StatusFileUpdatePolicyFileNotExist: http.StatusNotFound,
+	StatusFileChildPolicyReadOnly:      http.StatusConflict,
+	StatusControlWorkerNotFound:        http.StatusNotFound,
+	StatusControlNotReady:              http.StatusServiceUnavailable,
+	StatusControlBackupNotFound:        http.StatusNotFound,
+	StatusControlRestoreInvalidBackup:  http.StatusBadRequest,
+	StatusControlRestoring:             http.StatusServiceUnavailable,
+	StatusPolicyInvalidDocument:        http.StatusBadRequest,
+	StatusRetentionNotRunning:          http.StatusServiceUnavailable,
+}
+
+// Statuses 返回所有状态码,用于生成接口文档
+func Statuses() (statuses []int) {
+	for status := range messages {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	return
+}
+
+func Message(status int) string {
+	return messages[status]
+}
+
+// HTTPStatus 返回 v1 接口中 status 对应的 HTTP 状态码
+func HTTPStatus(status int) int {
+	if code, ok := codes[status]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
+
+// 当前请求返回的状态,用于审计日志记录请求结果
+const contextStatus = "status"
+
+// Outcome 返回当前请求已经返回的状态
+func Outcome(context *gin.Context) (status int, ok bool) {
+	value, ok := context.Get(contextStatus)
+	if !ok {
+		return
+	}
+	status, ok = value.(int)
+	return
+}
+
+// 旧版接口都是 /api/ 以外的 POST 接口
+func code(context *gin.Context, status int) int {
+	if context.Request.Method == http.MethodPost && !strings.HasPrefix(context.FullPath(), "/api/") {
+		return http.StatusOK
+	}
+	return HTTPStatus(status)
 }
 
 func Success(context *gin.Context, data interface{}) {
+	context.Set(contextStatus, StatusSuccess)
 	response := struct {
 		Status  int         `json:"status"`
 		Message string      `json:"message"`
@@ -114,7 +310,23 @@ func Success(context *gin.Context, data interface{}) {
 	context.JSON(http.StatusOK, response)
 }
 
+// Data 返回非成功状态时同时携带数据
+func Data(context *gin.Context, status int, data interface{}) {
+	context.Set(contextStatus, status)
+	response := struct {
+		Status  int         `json:"status"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}{
+		Status:  status,
+		Message: messages[status],
+		Data:    data,
+	}
+	context.JSON(code(context, status), response)
+}
+
 func Status(context *gin.Context, status int) {
+	context.Set(contextStatus, status)
 	response := struct {
 		Status  int    `json:"status"`
 		Message string `json:"message"`
@@ -122,5 +334,5 @@ func Status(context *gin.Context, status int) {
 		Status:  status,
 		Message: messages[status],
 	}
-	context.JSON(http.StatusOK, response)
+	context.JSON(code(context, status), response)
 }
@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package retention
+
+import (
+	"net/http"
+	"uranus/internal/background"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Janitor 清理事件的后台模块,只在 uranus-web 中运行
+type Janitor interface {
+	State() background.JanitorState
+	Trigger() bool
+	Compact() (reclaimed int64, err error)
+}
+
+type Worker struct {
+	registry *api.Registry
+	db       *storage.DB
+	config   *config.Config
+	janitor  Janitor
+}
+
+// Init janitor 为 nil 时只能查看和修改设置
+func Init(registry *api.Registry, db *storage.DB, janitor Janitor) (err error) {
+	config, err := config.New(db)
+	if err != nil {
+		return
+	}
+	w := &Worker{
+		registry: registry,
+		db:       db,
+		config:   config,
+		janitor:  janitor,
+	}
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/retention", Legacy: "/retention/status", Resource: api.ResourceEvent, Handler: w.status,
+			Summary: "事件清理的运行状态", Response: background.JanitorState{}, Statuses: []int{render.StatusRetentionNotRunning}},
+		{Method: http.MethodPost, Path: "/retention/run", Legacy: "/retention/run", Resource: api.ResourceEvent, Handler: w.run,
+			Summary: "立即清理过期事件", Statuses: []int{render.StatusRetentionNotRunning}},
+		{Method: http.MethodPost, Path: "/retention/compact", Legacy: "/retention/compact", Resource: api.ResourceControl, Handler: w.compact,
+			Summary: "切换到增量回收并整理数据库,期间写入会等待", Response: compactResponse{},
+			Statuses: []int{render.StatusRetentionCompactFailed}},
+		{Method: http.MethodGet, Path: "/settings/retention", Legacy: "/retention/settings/status", Resource: api.ResourceEvent, Handler: w.settingsStatus,
+			Summary: "事件保留设置", Response: background.RetentionSettings{}},
+		{Method: http.MethodPut, Path: "/settings/retention", Legacy: "/retention/settings/update", Resource: api.ResourceEvent, Handler: w.settingsUpdate,
+			Summary: "更新事件保留设置", Request: background.RetentionSettings{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusRetentionUpdateSettingsFailed}},
+	})
+	return
+}
+
+func (w *Worker) status(context *gin.Context) {
+	if w.janitor == nil {
+		render.Status(context, render.StatusRetentionNotRunning)
+		return
+	}
+	state := w.janitor.State()
+	if !state.Running {
+		render.Status(context, render.StatusRetentionNotRunning)
+		return
+	}
+	render.Success(context, state)
+}
+
+func (w *Worker) run(context *gin.Context) {
+	if w.janitor == nil || !w.janitor.Trigger() {
+		render.Status(context, render.StatusRetentionNotRunning)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
+
+type compactResponse struct {
+	// 整理前数据库中的空闲页数
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+func (w *Worker) compact(context *gin.Context) {
+	janitor := w.janitor
+	if janitor == nil {
+		// uranusctl -local 不运行清理模块,直接整理数据库
+		janitor = background.NewJanitorWorker(w.db, "")
+	}
+	reclaimed, err := janitor.Compact()
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusRetentionCompactFailed)
+		return
+	}
+	render.Success(context, compactResponse{Reclaimed: reclaimed})
+}
+
+func (w *Worker) settingsStatus(context *gin.Context) {
+	render.Success(context, background.LoadRetentionSettings(w.config))
+}
+
+func boolean(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func (w *Worker) settingsUpdate(context *gin.Context) {
+	request := background.RetentionSettings{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	values := []struct {
+		key   string
+		value int
+	}{
+		{config.RetentionInterval, request.Interval},
+		{config.RetentionBatchSize, request.BatchSize},
+		{config.RetentionArchive, boolean(request.Archive)},
+		{config.FileEventMaxAge, request.File.MaxAge},
+		{config.FileEventMaxRows, request.File.MaxRows},
+		{config.FileEventKeepUnread, boolean(request.File.KeepUnread)},
+		{config.ProcessEventMaxAge, request.Process.MaxAge},
+		{config.ProcessEventMaxRows, request.Process.MaxRows},
+		{config.ProcessEventKeepUnread, boolean(request.Process.KeepUnread)},
+		{config.LoginEventMaxAge, request.Login.MaxAge},
+		{config.LoginEventMaxRows, request.Login.MaxRows},
+		{config.LoginEventKeepUnread, boolean(request.Login.KeepUnread)},
+		{config.AuditLogMaxAge, request.Audit.MaxAge},
+		{config.AuditLogMaxRows, request.Audit.MaxRows},
+	}
+	for _, v := range values {
+		if err := audit.SetInteger(context, w.config, v.key, v.value); err != nil {
+			render.Status(context, render.StatusRetentionUpdateSettingsFailed)
+			return
+		}
+	}
+	render.Status(context, render.StatusSuccess)
+}
@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package stats
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sqlQueryHourlyEvents = `select 'process',hour,count from process_hourly where hour>=? union all select 'file',timestamp/3600*3600 as hour,sum(count) from file_event where timestamp>=? and kind=0 group by hour order by 2,1`
+	sqlQueryTopBinaries  = `select "binary",sum(count) as total,count(*) from process_event group by "binary" order by total desc limit ?`
+	sqlQueryTopPaths     = `select path,sum(count) as total,max(timestamp) from file_event where kind=0 group by path order by total desc limit ?`
+	sqlQueryJudges       = `select judge,status,count(*),sum(count) from process_event group by judge,status order by judge,status`
+	sqlQueryPending      = `select (select count(*) from process_event where status=0),(select count(*) from file_event where status=0),(select count(*) from login_event where status=0)`
+	sqlQueryPolicies     = `select (select count(*) from process_event where status=2),(select count(*) from process_event where status=1),(select count(*) from file_policy where parent=0),(select count(*) from net_policy)`
+)
+
+func (w *Worker) query(query string, scan func(rows *sql.Rows) error, args ...interface{}) (err error) {
+	stmt, err := w.db.Prepare(query)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func (w *Worker) queryHourlyEvents(since int64) (counts []HourlyCount, err error) {
+	counts = []HourlyCount{}
+	err = w.query(sqlQueryHourlyEvents, func(rows *sql.Rows) error {
+		count := HourlyCount{}
+		if err := rows.Scan(&count.Module, &count.Hour, &count.Count); err != nil {
+			return err
+		}
+		counts = append(counts, count)
+		return nil
+	}, since, since)
+	return
+}
+
+func (w *Worker) queryTopBinaries(limit int) (counts []BinaryCount, err error) {
+	counts = []BinaryCount{}
+	err = w.query(sqlQueryTopBinaries, func(rows *sql.Rows) error {
+		count := BinaryCount{}
+		if err := rows.Scan(&count.Binary, &count.Count, &count.Commands); err != nil {
+			return err
+		}
+		counts = append(counts, count)
+		return nil
+	}, limit)
+	return
+}
+
+func (w *Worker) queryTopPaths(limit int) (counts []PathCount, err error) {
+	counts = []PathCount{}
+	err = w.query(sqlQueryTopPaths, func(rows *sql.Rows) error {
+		count := PathCount{}
+		if err := rows.Scan(&count.Path, &count.Count, &count.Last); err != nil {
+			return err
+		}
+		counts = append(counts, count)
+		return nil
+	}, limit)
+	return
+}
+
+func (w *Worker) queryJudges() (counts []JudgeCount, err error) {
+	counts = []JudgeCount{}
+	err = w.query(sqlQueryJudges, func(rows *sql.Rows) error {
+		count := JudgeCount{}
+		if err := rows.Scan(&count.Judge, &count.Status, &count.Commands, &count.Count); err != nil {
+			return err
+		}
+		counts = append(counts, count)
+		return nil
+	})
+	return
+}
+
+func (w *Worker) queryPending() (pending Pending, err error) {
+	err = w.db.QueryRow(sqlQueryPending).Scan(&pending.Process, &pending.File, &pending.Login)
+	if err != nil {
+		logrus.Error(err)
+	}
+	return
+}
+
+func (w *Worker) queryPolicies() (policies Policies, err error) {
+	err = w.db.QueryRow(sqlQueryPolicies).Scan(&policies.ProcessTrusted, &policies.ProcessUntrusted, &policies.File, &policies.Net)
+	if err != nil {
+		logrus.Error(err)
+	}
+	return
+}
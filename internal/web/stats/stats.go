@@ -0,0 +1,255 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultCacheDuration = 30
+
+type Worker struct {
+	registry *api.Registry
+	db       *storage.DB
+
+	config *config.Config
+	mutex  sync.Mutex
+	cache  map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	data    interface{}
+	expires time.Time
+}
+
+// 每小时的事件数量, Hour 为整点的时间戳
+type HourlyCount struct {
+	Module string `json:"module"`
+	Hour   int64  `json:"hour"`
+	Count  int64  `json:"count"`
+}
+
+type BinaryCount struct {
+	Binary string `json:"binary"`
+	// 执行次数和不同命令行的数量
+	Count    int64 `json:"count"`
+	Commands int64 `json:"commands"`
+}
+
+type PathCount struct {
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+	// 最后一次触发的时间戳
+	Last int64 `json:"last"`
+}
+
+type JudgeCount struct {
+	Judge    int   `json:"judge"`
+	Status   int   `json:"status"`
+	Commands int64 `json:"commands"`
+	Count    int64 `json:"count"`
+}
+
+// 等待处理的事件数量
+type Pending struct {
+	// 等待确认是否信任的命令
+	Process int64 `json:"process"`
+	// 未读的文件事件和登录失败事件
+	File  int64 `json:"file"`
+	Login int64 `json:"login"`
+}
+
+type Policies struct {
+	ProcessTrusted   int64 `json:"processTrusted"`
+	ProcessUntrusted int64 `json:"processUntrusted"`
+	File             int64 `json:"file"`
+	Net              int64 `json:"net"`
+}
+
+type hourlyRequest struct {
+	// 统计最近多少小时,默认 24 小时
+	Hours int `json:"hours" form:"hours" binding:"min=0,max=8760"`
+}
+
+type topRequest struct {
+	// 默认返回前 10 个
+	Limit int `json:"limit" form:"limit" binding:"min=0,max=1000"`
+}
+
+type settings struct {
+	// 统计结果缓存的秒数, 0 表示不缓存
+	CacheDuration int `json:"cacheDuration" binding:"min=0"`
+}
+
+func Init(registry *api.Registry, db *storage.DB) (err error) {
+	config, err := config.New(db)
+	if err != nil {
+		return
+	}
+	w := &Worker{
+		registry: registry,
+		db:       db,
+		config:   config,
+		cache:    map[string]cacheEntry{},
+	}
+	statuses := []int{render.StatusInvalidArgument, render.StatusStatsQueryFailed}
+	w.registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/stats/events", Legacy: "/stats/events", Resource: api.ResourceEvent, Handler: w.hourlyEvents,
+			Summary: "每小时各模块的事件数量", Request: hourlyRequest{}, Response: []HourlyCount{}, Statuses: statuses},
+		{Method: http.MethodGet, Path: "/stats/binaries", Legacy: "/stats/binaries", Resource: api.ResourceEvent, Handler: w.topBinaries,
+			Summary: "执行次数最多的程序", Request: topRequest{}, Response: []BinaryCount{}, Statuses: statuses},
+		{Method: http.MethodGet, Path: "/stats/paths", Legacy: "/stats/paths", Resource: api.ResourceEvent, Handler: w.topPaths,
+			Summary: "触发次数最多的受保护文件", Request: topRequest{}, Response: []PathCount{}, Statuses: statuses},
+		{Method: http.MethodGet, Path: "/stats/judges", Legacy: "/stats/judges", Resource: api.ResourceEvent, Handler: w.judges,
+			Summary: "按判定结果和信任状态统计进程事件", Response: []JudgeCount{}, Statuses: statuses},
+		{Method: http.MethodGet, Path: "/stats/pending", Legacy: "/stats/pending", Resource: api.ResourceEvent, Handler: w.pending,
+			Summary: "等待处理的事件数量", Response: Pending{}, Statuses: statuses},
+		{Method: http.MethodGet, Path: "/stats/policies", Legacy: "/stats/policies", Resource: api.ResourcePolicy, Handler: w.policies,
+			Summary: "各模块的策略数量", Response: Policies{}, Statuses: statuses},
+		{Method: http.MethodGet, Path: "/settings/stats", Legacy: "/stats/settings/status", Resource: api.ResourceEvent, Handler: w.settingsStatus,
+			Summary: "统计设置", Response: settings{}},
+		{Method: http.MethodPut, Path: "/settings/stats", Legacy: "/stats/settings/update", Resource: api.ResourceEvent, Handler: w.settingsUpdate,
+			Summary: "更新统计设置", Request: settings{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusStatsUpdateSettingsFailed}},
+	})
+	return
+}
+
+func (w *Worker) cacheDuration() time.Duration {
+	seconds, err := w.config.GetInteger(config.StatsCacheDuration)
+	if err != nil {
+		seconds = defaultCacheDuration
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cached 相同的请求在缓存有效期内直接返回上次的结果.旧版接口的参数在 body 中,
+// 因此按解析后的参数区分请求
+func (w *Worker) cached(context *gin.Context, request interface{}, query func() (interface{}, error)) {
+	key := context.FullPath() + " " + fmt.Sprint(request)
+	duration := w.cacheDuration()
+	now := time.Now()
+
+	if duration > 0 {
+		w.mutex.Lock()
+		entry, ok := w.cache[key]
+		w.mutex.Unlock()
+		if ok && now.Before(entry.expires) {
+			render.Success(context, entry.data)
+			return
+		}
+	}
+
+	data, err := query()
+	if err != nil {
+		render.Status(context, render.StatusStatsQueryFailed)
+		return
+	}
+
+	if duration > 0 {
+		w.mutex.Lock()
+		for k, entry := range w.cache {
+			if now.After(entry.expires) {
+				delete(w.cache, k)
+			}
+		}
+		w.cache[key] = cacheEntry{data: data, expires: now.Add(duration)}
+		w.mutex.Unlock()
+	}
+	render.Success(context, data)
+}
+
+func (w *Worker) hourlyEvents(context *gin.Context) {
+	request := hourlyRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	if request.Hours == 0 {
+		request.Hours = 24
+	}
+
+	w.cached(context, request, func() (interface{}, error) {
+		since := time.Now().Unix()/3600*3600 - int64(request.Hours-1)*3600
+		return w.queryHourlyEvents(since)
+	})
+}
+
+func (w *Worker) topBinaries(context *gin.Context) {
+	request := topRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	if request.Limit == 0 {
+		request.Limit = 10
+	}
+
+	w.cached(context, request, func() (interface{}, error) {
+		return w.queryTopBinaries(request.Limit)
+	})
+}
+
+func (w *Worker) topPaths(context *gin.Context) {
+	request := topRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	if request.Limit == 0 {
+		request.Limit = 10
+	}
+
+	w.cached(context, request, func() (interface{}, error) {
+		return w.queryTopPaths(request.Limit)
+	})
+}
+
+func (w *Worker) judges(context *gin.Context) {
+	w.cached(context, nil, func() (interface{}, error) {
+		return w.queryJudges()
+	})
+}
+
+func (w *Worker) pending(context *gin.Context) {
+	w.cached(context, nil, func() (interface{}, error) {
+		return w.queryPending()
+	})
+}
+
+func (w *Worker) policies(context *gin.Context) {
+	w.cached(context, nil, func() (interface{}, error) {
+		return w.queryPolicies()
+	})
+}
+
+func (w *Worker) settingsStatus(context *gin.Context) {
+	render.Success(context, settings{CacheDuration: int(w.cacheDuration() / time.Second)})
+}
+
+func (w *Worker) settingsUpdate(context *gin.Context) {
+	request := settings{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := audit.SetInteger(context, w.config, config.StatsCacheDuration, request.CacheDuration); err != nil {
+		render.Status(context, render.StatusStatsUpdateSettingsFailed)
+		return
+	}
+
+	w.mutex.Lock()
+	w.cache = map[string]cacheEntry{}
+	w.mutex.Unlock()
+	render.Status(context, render.StatusSuccess)
+}
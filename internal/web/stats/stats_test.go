@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 旧版接口的参数在 body 中,不同参数的请求不能共用缓存
+func TestCacheKeyLegacyBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := storage.Open(filepath.Join(t.TempDir(), "web.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Exec(`insert into process_event(cmd,workdir,"binary",argv,count,judge,status,timestamp) values(?,'/',?,'',1,1,0,0)`,
+			fmt.Sprint(i), fmt.Sprintf("/bin/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine := gin.New()
+	registry := api.NewRegistry(engine, "")
+	if err := Init(registry, db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{1, 2, 3, 1} {
+		request := httptest.NewRequest(http.MethodPost, "/stats/binaries", strings.NewReader(fmt.Sprintf(`{"limit":%d}`, limit)))
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		response := struct {
+			Data []BinaryCount `json:"data"`
+		}{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Data) != limit {
+			t.Errorf("limit %d: got %d binaries", limit, len(response.Data))
+		}
+	}
+}
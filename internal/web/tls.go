@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 自签名证书的有效期
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+type TLSConfig struct {
+	// 证书和私钥文件,都为空时使用 HTTP
+	Cert string
+	Key  string
+	// 客户端证书的 CA 文件,不为空时要求客户端提供由该 CA 签发的证书
+	ClientCA string
+	// HTTP 跳转 HTTPS 的监听地址,为空时不监听
+	Redirect string
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+// certificate 保存当前使用的证书, Reload 后新的连接使用新证书,已建立的连接不受影响
+type certificate struct {
+	config TLSConfig
+	value  atomic.Value
+}
+
+func (c *certificate) current() *tls.Config {
+	return c.value.Load().(*tls.Config)
+}
+
+func (c *certificate) load() (err error) {
+	pair, err := tls.LoadX509KeyPair(c.config.Cert, c.config.Key)
+	if err != nil {
+		return
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{pair},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if c.config.ClientCA != "" {
+		data, err := os.ReadFile(c.config.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", c.config.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	c.value.Store(config)
+	return
+}
+
+// serverConfig 返回给 http.Server 使用的配置,每次握手时读取当前的证书
+func (c *certificate) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &c.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.current(), nil
+		},
+	}
+}
+
+// generateSelfSigned 证书和私钥都不存在时生成自签名证书
+func generateSelfSigned(config TLSConfig, addr string) (err error) {
+	_, certErr := os.Stat(config.Cert)
+	_, keyErr := os.Stat(config.Key)
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"uranus"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	if err = writePem(config.Key, "PRIVATE KEY", privateKey, 0600); err != nil {
+		return
+	}
+	if err = writePem(config.Cert, "CERTIFICATE", der, 0644); err != nil {
+		return
+	}
+	logrus.Warnf("self-signed certificate generated: %s", config.Cert)
+	return
+}
+
+func writePem(name, kind string, data []byte, perm os.FileMode) (err error) {
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	return pem.Encode(file, &pem.Block{Type: kind, Bytes: data})
+}
+
+// redirectHandler 将 HTTP 请求跳转到 HTTPS 监听的端口
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + request.URL.RequestURI()
+		http.Redirect(writer, request, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"crypto/subtle"
+	"sync"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 首次运行时没有用户,启动时生成一次性的初始化令牌并输出到日志,
+// 持有令牌的人才能创建第一个管理员
+type bootstrap struct {
+	mutex sync.Mutex
+	token string
+}
+
+type bootstrapStatus struct {
+	// 为 true 时需要创建管理员
+	Required bool `json:"required"`
+}
+
+type bootstrapRequest struct {
+	Token     string `json:"token" binding:"required"`
+	Username  string `json:"username" binding:"required"`
+	Password  string `json:"password" binding:"required"`
+	AliasName string `json:"aliasName" binding:"required"`
+}
+
+func (w *Worker) initBootstrap() (err error) {
+	if !w.noUser() {
+		return
+	}
+	w.bootstrap.token, err = newSessionToken()
+	if err != nil {
+		return
+	}
+	logrus.Warnf("no user exists, create the administrator with bootstrap token: %s", w.bootstrap.token)
+	return
+}
+
+func (w *Worker) bootstrapStatus(context *gin.Context) {
+	w.bootstrap.mutex.Lock()
+	defer w.bootstrap.mutex.Unlock()
+	render.Success(context, bootstrapStatus{Required: w.bootstrap.token != ""})
+}
+
+func (w *Worker) bootstrapAdmin(context *gin.Context) {
+	request := bootstrapRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	audit.Actor(context, request.Username, 0)
+	w.bootstrap.mutex.Lock()
+	defer w.bootstrap.mutex.Unlock()
+
+	if w.bootstrap.token == "" || !w.noUser() {
+		render.Status(context, render.StatusUserBootstrapDone)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(w.bootstrap.token), []byte(request.Token)) != 1 {
+		render.Status(context, render.StatusUserBootstrapInvalidToken)
+		return
+	}
+
+	if !w.checkPasswordPolicy(context, 0, request.Password) {
+		return
+	}
+	if err := w.createUser(request.Username, request.Password, request.AliasName, ""); err != nil {
+		render.Status(context, render.StatusUserCreateUserFailed)
+		return
+	}
+	user, err := w.users.QueryUserByUsername(request.Username)
+	if err != nil {
+		render.Status(context, render.StatusUserCreateUserFailed)
+		return
+	}
+	if _, err := w.assignRoles(user.UserID, []string{RoleAdmin}); err != nil {
+		logrus.Error(err)
+		w.deleteUser(user.UserID)
+		render.Status(context, render.StatusUserCreateUserFailed)
+		return
+	}
+
+	w.bootstrap.token = ""
+	user.Roles = []string{RoleAdmin}
+	audit.Record(context, "user", nil, user)
+	logrus.Infof("administrator %s created", request.Username)
+	render.Status(context, render.StatusSuccess)
+}
@@ -2,156 +2,128 @@
 package user
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-
-	"github.com/google/uuid"
+	"database/sql"
+	"time"
+	"uranus/internal/storage"
 )
 
-const (
-	sqlCreateUserTable         = `create table if not exists user(id integer primary key autoincrement, username text not null unique, salt text not null, password text not null, alias text, permissions text)`
-	sqlInsertUser              = `insert into user(username, salt, password, alias, permissions) values(?,?,?,?,?)`
-	sqlQueryUserCount          = `select count(*) from user`
-	sqlQueryAllUser            = `select id, username, alias, permissions from user`
-	sqlQueryUserByUsername     = `select id, alias, permissions from user where username=?`
-	sqlQueryPasswordByUsername = `select salt, password from user where username=?`
-	sqlUpdateUser              = `update user set username=?, salt=?, password=?, alias=?, permissions=? where id=?`
-	sqlDeleteUser              = `delete from user where id=?`
-)
+// 用户相关的数据保存在 storage.UserRepository 中,这里只处理密码哈希等需要在保存前后计算的部分
 
-func (w *Worker) initUserTable() (err error) {
-	_, err = w.db.Exec(sqlCreateUserTable)
-	if err != nil {
-		return
+func (w *Worker) initBuiltinRoles() (err error) {
+	for _, role := range builtinRoles() {
+		if err = w.users.UpsertBuiltinRole(role.Name, role.Permissions); err != nil {
+			return
+		}
 	}
 	return
 }
 
 func (w *Worker) noUser() bool {
-	stmt, err := w.db.Prepare(sqlQueryUserCount)
+	count, err := w.users.CountUser()
 	if err != nil {
 		return false
 	}
-	defer stmt.Close()
-
-	count := int(0)
-	if err = stmt.QueryRow().Scan(&count); err != nil {
-		return false
-	}
 	return count == 0
 }
 
 func (w *Worker) createUser(username, password, alias, permissions string) (err error) {
-	salt := uuid.NewString()
-	sum := sha256.Sum256([]byte(salt + password))
-	hash := hex.EncodeToString(sum[:])
-
-	stmt, err := w.db.Prepare(sqlInsertUser)
+	hash, err := hashPassword(password)
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
+	return w.users.InsertUser(username, storage.Password{Hash: hash}, alias, permissions)
+}
 
-	_, err = stmt.Exec(username, salt, hash, alias, permissions)
+// usernameExists 检查用户名是否已经被 id 以外的用户使用
+func (w *Worker) usernameExists(username string, id uint64) (exists bool, err error) {
+	user, err := w.users.QueryUserByUsername(username)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
 	if err != nil {
 		return
 	}
+	exists = user.UserID != id
 	return
-
 }
 
-func (w *Worker) checkUserPassword(username, password string) (ok bool, err error) {
-	stmt, err := w.db.Prepare(sqlQueryPasswordByUsername)
-	if err != nil {
+func (w *Worker) checkUserPassword(username, password string) (ok, outdated bool, err error) {
+	saved, err := w.users.QueryPasswordByUsername(username)
+	if err == sql.ErrNoRows {
+		// 用户不存在时同样计算一次哈希,避免通过响应时间判断用户名是否存在
+		verifyPassword(dummyPassword, "", password)
 		return
 	}
-	defer stmt.Close()
-	salt := ""
-	hash := ""
-	if err = stmt.QueryRow(username).Scan(&salt, &hash); err != nil {
+	if err != nil {
 		return
 	}
-	sum := sha256.Sum256([]byte(salt + password))
-	ok = (hash == hex.EncodeToString(sum[:]))
+	ok, outdated, err = verifyPassword(saved.Hash, saved.Salt, password)
 	return
 }
 
-func (w *Worker) queryUserByUsername(username string) (user User, err error) {
-	user.Username = username
-	stmt, err := w.db.Prepare(sqlQueryUserByUsername)
+func (w *Worker) updatePassword(username, password string) (err error) {
+	hash, err := hashPassword(password)
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
+	return w.users.UpdatePasswordByUsername(username, storage.Password{Hash: hash})
+}
 
-	if err = stmt.QueryRow(user.Username).Scan(&user.UserID, &user.AliasName, &user.Permissions); err != nil {
+// passwordReused 检查新密码是否与当前密码或最近 history-1 次使用过的密码相同
+func (w *Worker) passwordReused(id uint64, password string, history int) (reused bool, err error) {
+	if history <= 0 {
 		return
 	}
-	return
-}
 
-func (w *Worker) queryAllUser() (users []User, err error) {
-	stmt, err := w.db.Prepare(sqlQueryAllUser)
-	if err != nil {
+	saved, err := w.users.QueryPasswordById(id)
+	if err == sql.ErrNoRows {
+		err = nil
 		return
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query()
 	if err != nil {
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		user := User{}
-		err = rows.Scan(&user.UserID, &user.Username, &user.AliasName, &user.Permissions)
-		if err != nil {
-			return
-		}
-		users = append(users, user)
+	if reused, _, err = verifyPassword(saved.Hash, saved.Salt, password); err != nil || reused {
+		return
 	}
-	err = rows.Err()
+
+	passwords, err := w.users.QueryPasswordHistory(id, history-1)
 	if err != nil {
 		return
 	}
+	for _, saved := range passwords {
+		if reused, _, err = verifyPassword(saved.Hash, saved.Salt, password); err != nil || reused {
+			return
+		}
+	}
 	return
 }
 
-func (w *Worker) updateUserInfo(id uint64, username, password, alias, permissions string) bool {
-	stmt, err := w.db.Prepare(sqlUpdateUser)
-	if err != nil {
-		return false
-	}
-	defer stmt.Close()
-
-	salt := uuid.NewString()
-	sum := sha256.Sum256([]byte(salt + password))
-	hash := hex.EncodeToString(sum[:])
+func (w *Worker) queryAllUser() (users []User, err error) {
+	err = w.users.ScanAllUser(func(user User) error {
+		users = append(users, user)
+		return nil
+	})
+	return
+}
 
-	result, err := stmt.Exec(username, salt, hash, alias, permissions, id)
-	if err != nil {
-		return false
-	}
-	affected, err := result.RowsAffected()
-	if err != nil {
-		return false
+// updateUserInfo password 为空时不修改密码,否则修改成功时原来的密码写入历史记录,只保留最近 History-1 条
+func (w *Worker) updateUserInfo(id uint64, username, password, alias, permissions string) bool {
+	saved := storage.Password{}
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return false
+		}
+		saved.Hash = hash
 	}
-	return affected == 1
+	ok, err := w.users.UpdateUser(id, username, saved, alias, permissions,
+		w.passwordPolicy().History-1, time.Now().Unix())
+	return err == nil && ok
 }
 
 func (w *Worker) deleteUser(id uint64) bool {
-	stmt, err := w.db.Prepare(sqlDeleteUser)
-	if err != nil {
-		return false
-	}
-	defer stmt.Close()
-
-	result, err := stmt.Exec(id)
-	if err != nil {
-		return false
-	}
-	affected, err := result.RowsAffected()
-	if err != nil {
-		return false
-	}
-	return affected == 1
+	ok, err := w.users.DeleteUser(id)
+	return err == nil && ok
 }
@@ -0,0 +1,247 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLoginMaxFailures     = 5
+	defaultLoginMaxAddrFailures = 20
+	defaultLoginLockoutDuration = 15 * 60
+)
+
+// 清理过期失败记录的最短间隔,避免每次失败都遍历全部记录
+const loginSweepInterval = time.Minute
+
+const (
+	LoginEventUnread = 0
+	LoginEventRead   = 1
+)
+
+// 登录失败事件, Locked 表示这次失败导致用户名或地址被锁定
+type LoginEvent = storage.LoginEvent
+
+type loginPolicy struct {
+	// 同一个用户名连续失败 MaxFailures 次后锁定
+	MaxFailures int `json:"maxFailures" binding:"min=1"`
+	// 同一个地址连续失败 MaxAddrFailures 次后锁定
+	MaxAddrFailures int `json:"maxAddrFailures" binding:"min=1"`
+	// 锁定的秒数,也是失败次数清零的时间
+	LockoutDuration int `json:"lockoutDuration" binding:"min=60"`
+}
+
+type loginEventListRequest struct {
+	Limit  int `json:"limit" form:"limit" binding:"number"`
+	Offset int `json:"offset" form:"offset" binding:"number"`
+}
+
+type loginEventUpdateRequest struct {
+	ID     uint64 `json:"id" uri:"id" binding:"number"`
+	Status int    `json:"status" binding:"number"`
+}
+
+type loginAttempt struct {
+	failures int
+	last     time.Time
+}
+
+// 记录最近的登录失败次数.失败后需要等待的时间随失败次数指数增长,
+// 达到上限后锁定,锁定期间不再接受登录请求
+type loginThrottle struct {
+	mutex    sync.Mutex
+	attempts map[string]*loginAttempt
+	// 上一次清理过期记录的时间
+	swept time.Time
+}
+
+func backoff(failures, max int, lockout time.Duration) time.Duration {
+	if failures >= max {
+		return lockout
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-1))) * time.Second
+	if delay > lockout {
+		delay = lockout
+	}
+	return delay
+}
+
+// wait 返回还需要等待的时间
+func (t *loginThrottle) wait(key string, max int, lockout time.Duration) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	attempt, ok := t.attempts[key]
+	if !ok {
+		return 0
+	}
+	remain := time.Until(attempt.last.Add(backoff(attempt.failures, max, lockout)))
+	if remain < 0 {
+		return 0
+	}
+	return remain
+}
+
+// fail 记录一次失败,返回是否因此被锁定
+func (t *loginThrottle) fail(key string, max int, lockout time.Duration) (locked bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.swept) >= loginSweepInterval {
+		t.sweep(now, lockout)
+	}
+
+	attempt, ok := t.attempts[key]
+	if !ok {
+		attempt = &loginAttempt{}
+		t.attempts[key] = attempt
+	}
+	attempt.failures++
+	attempt.last = now
+	return attempt.failures == max
+}
+
+// sweep 删除超过锁定时间的记录,调用方持有锁
+func (t *loginThrottle) sweep(now time.Time, lockout time.Duration) {
+	for k, attempt := range t.attempts {
+		if now.Sub(attempt.last) > lockout {
+			delete(t.attempts, k)
+		}
+	}
+	t.swept = now
+}
+
+func (t *loginThrottle) reset(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.attempts, key)
+}
+
+func (w *Worker) loginPolicy() (policy loginPolicy) {
+	var err error
+	if policy.MaxFailures, err = w.config.GetInteger(config.LoginMaxFailures); err != nil {
+		policy.MaxFailures = defaultLoginMaxFailures
+	}
+	if policy.MaxAddrFailures, err = w.config.GetInteger(config.LoginMaxAddrFailures); err != nil {
+		policy.MaxAddrFailures = defaultLoginMaxAddrFailures
+	}
+	if policy.LockoutDuration, err = w.config.GetInteger(config.LoginLockoutDuration); err != nil {
+		policy.LockoutDuration = defaultLoginLockoutDuration
+	}
+	return
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+func addrKey(addr string) string {
+	return "addr:" + addr
+}
+
+// loginThrottled 检查用户名和地址是否需要等待,需要等待时返回错误状态
+func (w *Worker) loginThrottled(context *gin.Context, username string) bool {
+	policy := w.loginPolicy()
+	lockout := time.Duration(policy.LockoutDuration) * time.Second
+	wait := w.throttle.wait(userKey(username), policy.MaxFailures, lockout)
+	if addr := w.throttle.wait(addrKey(context.ClientIP()), policy.MaxAddrFailures, lockout); addr > wait {
+		wait = addr
+	}
+	if wait == 0 {
+		return false
+	}
+
+	context.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	render.Status(context, render.StatusUserLoginThrottled)
+	return true
+}
+
+// loginFailed 记录登录失败事件,锁定时输出警告
+func (w *Worker) loginFailed(context *gin.Context, username string) {
+	policy := w.loginPolicy()
+	lockout := time.Duration(policy.LockoutDuration) * time.Second
+	addr := context.ClientIP()
+	locked := w.throttle.fail(userKey(username), policy.MaxFailures, lockout)
+	if w.throttle.fail(addrKey(addr), policy.MaxAddrFailures, lockout) {
+		locked = true
+	}
+	if locked {
+		logrus.Warnf("login locked: username=%s addr=%s", username, addr)
+	}
+
+	if err := w.users.InsertLoginEvent(username, addr, context.Request.UserAgent(), time.Now().Unix(), locked); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (w *Worker) loginSucceeded(context *gin.Context, username string) {
+	w.throttle.reset(userKey(username))
+	w.throttle.reset(addrKey(context.ClientIP()))
+}
+
+func (w *Worker) loginPolicyStatus(context *gin.Context) {
+	render.Success(context, w.loginPolicy())
+}
+
+func (w *Worker) loginPolicyUpdate(context *gin.Context) {
+	request := loginPolicy{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := audit.SetInteger(context, w.config, config.LoginMaxFailures, request.MaxFailures); err != nil {
+		render.Status(context, render.StatusUserUpdateLoginPolicyFailed)
+		return
+	}
+	if err := audit.SetInteger(context, w.config, config.LoginMaxAddrFailures, request.MaxAddrFailures); err != nil {
+		render.Status(context, render.StatusUserUpdateLoginPolicyFailed)
+		return
+	}
+	if err := audit.SetInteger(context, w.config, config.LoginLockoutDuration, request.LockoutDuration); err != nil {
+		render.Status(context, render.StatusUserUpdateLoginPolicyFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
+
+func (w *Worker) loginEventList(context *gin.Context) {
+	request := loginEventListRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	events, err := w.users.QueryLoginEventLimitOffset(request.Limit, request.Offset)
+	if err != nil {
+		render.Status(context, render.StatusUserQueryLoginEventFailed)
+		return
+	}
+	render.Success(context, events)
+}
+
+func (w *Worker) loginEventUpdate(context *gin.Context) {
+	request := loginEventUpdateRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := w.users.UpdateLoginEventStatus(request.ID, request.Status); err != nil {
+		render.Status(context, render.StatusUserUpdateLoginEventFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/web/render"
+)
+
+// elapse 将全部失败记录提前 d,模拟等待
+func elapse(w *Worker, d time.Duration) {
+	w.throttle.mutex.Lock()
+	defer w.throttle.mutex.Unlock()
+	for _, attempt := range w.throttle.attempts {
+		attempt.last = attempt.last.Add(-d)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	lockout := 15 * time.Minute
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, lockout},
+		{6, lockout},
+	}
+	for _, test := range tests {
+		if got := backoff(test.failures, 5, lockout); got != test.want {
+			t.Errorf("backoff(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+	if got := backoff(20, 30, time.Minute); got != time.Minute {
+		t.Errorf("backoff is not capped by lockout: %v", got)
+	}
+}
+
+// 过期的失败记录最多每隔 loginSweepInterval 清理一次
+func TestLoginThrottleSweep(t *testing.T) {
+	throttle := loginThrottle{attempts: map[string]*loginAttempt{}}
+	lockout := time.Minute
+	for i := 0; i < 100; i++ {
+		throttle.fail(userKey(strconv.Itoa(i)), 5, lockout)
+	}
+	for _, attempt := range throttle.attempts {
+		attempt.last = attempt.last.Add(-2 * lockout)
+	}
+
+	throttle.fail(userKey("alice"), 5, lockout)
+	if len(throttle.attempts) != 101 {
+		t.Fatalf("swept within the interval: %d", len(throttle.attempts))
+	}
+	throttle.swept = throttle.swept.Add(-loginSweepInterval)
+	throttle.fail(userKey("alice"), 5, lockout)
+	if len(throttle.attempts) != 1 || throttle.attempts[userKey("alice")].failures != 2 {
+		t.Fatalf("attempts=%d", len(throttle.attempts))
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	w, engine := newTestWorker(t)
+	if err := w.createUser("alice", "alice-password", "A", "{*}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.config.SetInteger(config.LoginMaxFailures, 3); err != nil {
+		t.Fatal(err)
+	}
+	lockout := time.Duration(defaultLoginLockoutDuration) * time.Second
+	attempt := func(password string) (status int, retry string) {
+		request := `{"username":"alice","password":"` + password + `"}`
+		_, status, _ = serve(engine, http.MethodPost, "/api/v1/session", request, nil)
+		w.throttle.mutex.Lock()
+		defer w.throttle.mutex.Unlock()
+		if attempt, ok := w.throttle.attempts[userKey("alice")]; ok {
+			retry = time.Until(attempt.last.Add(backoff(attempt.failures, 3, lockout))).Round(time.Second).String()
+		}
+		return
+	}
+
+	// 失败后在等待时间内再次登录被拒绝,即使密码正确
+	if status, _ := attempt("wrong"); status != render.StatusUserLoginFaild {
+		t.Fatalf("first failure: status=%d", status)
+	}
+	if status, _ := attempt("alice-password"); status != render.StatusUserLoginThrottled {
+		t.Fatalf("during backoff: status=%d", status)
+	}
+	elapse(w, time.Second)
+	if status, _ := attempt("wrong"); status != render.StatusUserLoginFaild {
+		t.Fatalf("second failure: status=%d", status)
+	}
+	elapse(w, 2*time.Second)
+	if status, retry := attempt("wrong"); status != render.StatusUserLoginFaild || retry != lockout.String() {
+		t.Fatalf("third failure: status=%d retry=%s", status, retry)
+	}
+
+	// 达到上限后锁定,锁定时间内不接受登录
+	elapse(w, lockout/2)
+	if status, _ := attempt("alice-password"); status != render.StatusUserLoginThrottled {
+		t.Fatalf("locked: status=%d", status)
+	}
+	events, err := w.users.QueryLoginEventLimitOffset(-1, 0)
+	if err != nil || len(events) != 3 {
+		t.Fatalf("events=%+v err=%v", events, err)
+	}
+	locked := 0
+	for _, event := range events {
+		if event.Locked {
+			locked++
+		}
+	}
+	if locked != 1 {
+		t.Errorf("%d locked events", locked)
+	}
+
+	// 锁定结束后可以登录,登录成功后失败次数清零
+	elapse(w, lockout/2)
+	login(t, engine, "alice", "alice-password")
+	if wait := w.throttle.wait(userKey("alice"), 3, lockout); wait != 0 {
+		t.Errorf("wait after success = %v", wait)
+	}
+	if status, retry := attempt("wrong"); status != render.StatusUserLoginFaild || retry != time.Second.String() {
+		t.Errorf("failure after reset: status=%d retry=%s", status, retry)
+	}
+}
+
+// 初始化令牌只能使用一次,创建管理员后不再接受
+func TestBootstrapTokenSingleUse(t *testing.T) {
+	w, engine := newTestWorker(t)
+	token := w.bootstrap.token
+	if token == "" {
+		t.Fatal("bootstrap token not generated")
+	}
+	setup := func(token, username string) int {
+		body := `{"token":"` + token + `","username":"` + username + `","password":"admin-password","aliasName":"A"}`
+		_, status, _ := serve(engine, http.MethodPost, "/api/v1/setup", body, nil)
+		return status
+	}
+
+	if status := setup("wrong", "admin"); status != render.StatusUserBootstrapInvalidToken {
+		t.Fatalf("wrong token: status=%d", status)
+	}
+	if status := setup(token, "admin"); status != render.StatusSuccess {
+		t.Fatalf("setup: status=%d", status)
+	}
+	if roles, err := w.users.QueryUserRoles(1); err != nil || len(roles) != 1 || roles[0] != RoleAdmin {
+		t.Errorf("roles=%v err=%v", roles, err)
+	}
+	login(t, engine, "admin", "admin-password")
+
+	if status := setup(token, "second"); status != render.StatusUserBootstrapDone {
+		t.Errorf("reused token: status=%d", status)
+	}
+	if _, err := w.users.QueryUserByUsername("second"); err == nil {
+		t.Error("second administrator created")
+	}
+	if w.bootstrap.token != "" {
+		t.Error("bootstrap token kept after use")
+	}
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// 密码使用 argon2id 哈希,以 PHC 字符串格式保存:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+const (
+	argonPrefix  = "$argon2id$"
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// dummyPassword 用户不存在时用于校验的固定哈希,参数与当前配置相同,校验耗时与存在的用户一致
+var dummyPassword = encodeArgon(make([]byte, argonSaltLen), make([]byte, argonKeyLen))
+
+func hashPassword(password string) (encoded string, err error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	encoded = encodeArgon(salt, key)
+	return
+}
+
+func encodeArgon(salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argonPrefix, argon2.Version,
+		argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPassword 校验密码, outdated 表示哈希使用了旧算法或旧参数,需要重新计算.
+// 旧版本使用 sha256(salt + password) 保存密码, salt 为单独的一列
+func verifyPassword(encoded, salt, password string) (ok, outdated bool, err error) {
+	if !strings.HasPrefix(encoded, argonPrefix) {
+		sum := sha256.Sum256([]byte(salt + password))
+		ok = subtle.ConstantTimeCompare([]byte(encoded), []byte(hex.EncodeToString(sum[:]))) == 1
+		outdated = true
+		return
+	}
+
+	version := 0
+	memory := uint32(0)
+	time := uint32(0)
+	threads := uint8(0)
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 {
+		err = errInvalidHash
+		return
+	}
+	if _, err = fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return
+	}
+	rawSalt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return
+	}
+
+	key := argon2.IDKey([]byte(password), rawSalt, time, memory, threads, uint32(len(hash)))
+	ok = subtle.ConstantTimeCompare(hash, key) == 1
+	outdated = version != argon2.Version || memory != argonMemory || time != argonTime ||
+		threads != argonThreads || len(hash) != argonKeyLen
+	return
+}
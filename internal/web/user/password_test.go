@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"uranus/internal/storage"
+	"uranus/internal/web/render"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	encoded, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, argonPrefix) {
+		t.Fatalf("encoded=%s", encoded)
+	}
+	legacy := sha256.Sum256([]byte("salt" + "correct horse"))
+	// 参数比当前配置低的 argon2id 哈希需要重新计算
+	weak := strings.Replace(encoded, fmt.Sprintf("t=%d", argonTime), "t=1", 1)
+
+	tests := []struct {
+		name     string
+		encoded  string
+		salt     string
+		password string
+		ok       bool
+		outdated bool
+		err      bool
+	}{
+		{"argon2id", encoded, "", "correct horse", true, false, false},
+		{"argon2id wrong password", encoded, "", "wrong horse", false, false, false},
+		{"argon2id old parameters", weak, "", "wrong horse", false, true, false},
+		{"legacy sha256", hex.EncodeToString(legacy[:]), "salt", "correct horse", true, true, false},
+		{"legacy sha256 wrong password", hex.EncodeToString(legacy[:]), "salt", "wrong horse", false, true, false},
+		{"legacy sha256 wrong salt", hex.EncodeToString(legacy[:]), "pepper", "correct horse", false, true, false},
+		{"malformed", argonPrefix + "v=19", "", "correct horse", false, false, true},
+		// 用户不存在时使用的哈希按当前参数完整计算,不匹配任何密码
+		{"dummy", dummyPassword, "", "correct horse", false, false, false},
+		{"dummy empty password", dummyPassword, "", "", false, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, outdated, err := verifyPassword(test.encoded, test.salt, test.password)
+			if ok != test.ok || outdated != test.outdated || (err != nil) != test.err {
+				t.Errorf("ok=%v outdated=%v err=%v", ok, outdated, err)
+			}
+		})
+	}
+}
+
+// 旧版 sha256 密码登录成功后透明地升级为 argon2id
+func TestLoginUpgradesLegacyPassword(t *testing.T) {
+	w, engine := newTestWorker(t)
+	legacy := sha256.Sum256([]byte("salt" + "legacy-password"))
+	if err := w.users.InsertUser("legacy", storage.Password{Salt: "salt", Hash: hex.EncodeToString(legacy[:])}, "L", "{*}"); err != nil {
+		t.Fatal(err)
+	}
+
+	login(t, engine, "legacy", "legacy-password")
+	saved, err := w.users.QueryPasswordByUsername("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(saved.Hash, argonPrefix) {
+		t.Fatalf("password not upgraded: %+v", saved)
+	}
+	if ok, outdated, err := verifyPassword(saved.Hash, saved.Salt, "legacy-password"); !ok || outdated || err != nil {
+		t.Errorf("ok=%v outdated=%v err=%v", ok, outdated, err)
+	}
+	login(t, engine, "legacy", "legacy-password")
+	if _, status, _ := serve(engine, http.MethodPost, "/api/v1/session", `{"username":"legacy","password":"wrong-password"}`, nil); status != render.StatusUserLoginFaild {
+		t.Errorf("wrong password: status=%d", status)
+	}
+}
+
+// 默认检查最近 3 次使用的密码,包括当前密码,修改失败时不写入历史记录
+func TestUserUpdatePasswordHistory(t *testing.T) {
+	w, engine := newTestWorker(t)
+	for _, name := range []string{"admin", "alice", "bob"} {
+		if err := w.createUser(name, name+"-password-0", name, "{*}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := login(t, engine, "admin", "admin-password-0")
+	alice, err := w.users.QueryUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(username, password string) int {
+		body := fmt.Sprintf(`{"username":%q,"password":%q,"aliasName":"alice","permissions":"{*}"}`, username, password)
+		_, status, _ := serve(engine, http.MethodPut, fmt.Sprintf("/api/v1/users/%d", alice.UserID), body, admin)
+		return status
+	}
+	history := func() int {
+		passwords, err := w.users.QueryPasswordHistory(alice.UserID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(passwords)
+	}
+
+	steps := []struct {
+		username string
+		password string
+		status   int
+		history  int
+	}{
+		{"alice", "alice-password-0", render.StatusUserPasswordReused, 0},
+		{"alice", "alice-password-1", render.StatusSuccess, 1},
+		{"alice", "alice-password-0", render.StatusUserPasswordReused, 1},
+		{"alice", "alice-password-1", render.StatusUserPasswordReused, 1},
+		// 用户名冲突时修改失败,密码不归档
+		{"bob", "alice-password-2", render.StatusUserUsernameExists, 1},
+		{"alice", "alice-password-2", render.StatusSuccess, 2},
+		{"alice", "alice-password-3", render.StatusSuccess, 2},
+		// 超出历史记录的密码可以再次使用
+		{"alice", "alice-password-0", render.StatusSuccess, 2},
+	}
+	for i, step := range steps {
+		if status := update(step.username, step.password); status != step.status {
+			t.Fatalf("step %d: status=%d, want %d", i, status, step.status)
+		}
+		if n := history(); n != step.history {
+			t.Fatalf("step %d: history=%d, want %d", i, n, step.history)
+		}
+	}
+	login(t, engine, "alice", "alice-password-0")
+}
+
+// 不提交密码时只修改用户信息和角色,密码和历史记录不变
+func TestUserUpdateWithoutPassword(t *testing.T) {
+	w, engine := newTestWorker(t)
+	for _, name := range []string{"admin", "alice"} {
+		if err := w.createUser(name, name+"-password", name, "{*}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := login(t, engine, "admin", "admin-password")
+	alice, err := w.users.QueryUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := w.users.QueryPasswordById(alice.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"username":"alice","aliasName":"Alice","permissions":"","roles":["viewer"]}`
+	if code, status, _ := serve(engine, http.MethodPut, fmt.Sprintf("/api/v1/users/%d", alice.UserID), body, admin); code != http.StatusOK || status != render.StatusSuccess {
+		t.Fatalf("update: code=%d status=%d", code, status)
+	}
+	if roles, err := w.users.QueryUserRoles(alice.UserID); err != nil || len(roles) != 1 || roles[0] != RoleViewer {
+		t.Errorf("roles=%v err=%v", roles, err)
+	}
+	if updated, err := w.users.QueryUserById(alice.UserID); err != nil || updated.AliasName != "Alice" {
+		t.Errorf("user=%+v err=%v", updated, err)
+	}
+	if after, err := w.users.QueryPasswordById(alice.UserID); err != nil || after != before {
+		t.Errorf("password changed: err=%v", err)
+	}
+	if passwords, err := w.users.QueryPasswordHistory(alice.UserID, 10); err != nil || len(passwords) != 0 {
+		t.Errorf("history=%d err=%v", len(passwords), err)
+	}
+	login(t, engine, "alice", "alice-password")
+}
+
+// 修改密码后用户原来的会话和令牌失效,不修改密码时保持不变
+func TestUserUpdatePasswordRevokesSessions(t *testing.T) {
+	w, engine := newTestWorker(t)
+	for _, name := range []string{"admin", "alice"} {
+		if err := w.createUser(name, name+"-password", name, "{*}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := login(t, engine, "admin", "admin-password")
+	alice, err := w.users.QueryUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := login(t, engine, "alice", "alice-password")
+	if _, err := w.users.InsertToken(alice.UserID, "script", hashSessionToken("uranus_alice"), nil, time.Now().Unix(), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	token := http.Header{"Authorization": {"Bearer uranus_alice"}}
+	alive := func(header http.Header) bool {
+		_, status, _ := serve(engine, http.MethodGet, "/api/v1/session", "", header)
+		return status == render.StatusSuccess
+	}
+	update := func(password string) {
+		body := fmt.Sprintf(`{"username":"alice","password":%q,"aliasName":"alice","permissions":"{*}"}`, password)
+		if _, status, _ := serve(engine, http.MethodPut, fmt.Sprintf("/api/v1/users/%d", alice.UserID), body, admin); status != render.StatusSuccess {
+			t.Fatalf("update: status=%d", status)
+		}
+	}
+
+	update("")
+	if !alive(session) || !alive(token) {
+		t.Fatal("session or token revoked without a password change")
+	}
+	update("alice-password-1")
+	if alive(session) || alive(token) {
+		t.Error("session or token still valid after the password was reset")
+	}
+	if !alive(admin) {
+		t.Error("other users' sessions revoked")
+	}
+	login(t, engine, "alice", "alice-password-1")
+}
+
+// 用户不存在时同样计算哈希,响应时间与密码错误相近
+func TestCheckMissingUserPassword(t *testing.T) {
+	w, _ := newTestWorker(t)
+	if err := w.createUser("alice", "alice-password", "A", "{*}"); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := func(username string) time.Duration {
+		start := time.Now()
+		if ok, _, _ := w.checkUserPassword(username, "wrong-password"); ok {
+			t.Fatalf("%s: wrong password accepted", username)
+		}
+		return time.Since(start)
+	}
+	existing, missing := elapsed("alice"), elapsed("nobody")
+	if _, _, err := w.checkUserPassword("nobody", "wrong-password"); err != sql.ErrNoRows {
+		t.Errorf("missing user: err=%v", err)
+	}
+	if missing < existing/4 {
+		t.Errorf("missing user checked in %v, existing user in %v", missing, existing)
+	}
+}
@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"database/sql"
+	"strings"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobwas/glob"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+type Role = storage.Role
+
+type roleAddRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+type roleUpdateRequest struct {
+	ID          uint64   `json:"id" uri:"id" binding:"number"`
+	Name        string   `json:"name" binding:"required"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+type roleDeleteRequest struct {
+	ID uint64 `json:"id" uri:"id" binding:"number"`
+}
+
+// 内置角色,每次启动时同步权限
+func builtinRoles() []Role {
+	viewer := []string{}
+	operator := []string{}
+	for _, resource := range []string{api.ResourceModule, api.ResourcePolicy, api.ResourceEvent} {
+		viewer = append(viewer, resource+":"+api.ActionRead)
+		operator = append(operator, resource+":"+api.ActionRead, resource+":"+api.ActionWrite)
+	}
+	return []Role{
+		{Name: RoleViewer, Permissions: viewer, Builtin: true},
+		{Name: RoleOperator, Permissions: operator, Builtin: true},
+		{Name: RoleAdmin, Permissions: api.Permissions(), Builtin: true},
+	}
+}
+
+func validPermissions(permissions []string) bool {
+	valid := map[string]bool{}
+	for _, permission := range api.Permissions() {
+		valid[permission] = true
+	}
+	for _, permission := range permissions {
+		if !valid[permission] {
+			return false
+		}
+	}
+	return true
+}
+
+// authorize 检查用户是否有访问接口的权限.分配了角色的用户按角色的权限检查,
+// 没有分配角色的用户使用旧版的路径通配符
+func (w *Worker) authorize(user User, route *api.Route, path string) bool {
+	if len(user.Roles) == 0 {
+		g, err := glob.Compile(user.Permissions)
+		if err != nil {
+			return false
+		}
+		return g.Match(path)
+	}
+
+	if route == nil {
+		return false
+	}
+	required := route.Permission()
+	if required == "" {
+		return true
+	}
+
+	permissions, err := w.users.QueryUserPermissions(user.UserID)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+	for _, permission := range permissions {
+		if permission == required {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRoles 根据角色名查询角色 id,角色名不存在时返回 false
+func (w *Worker) resolveRoles(roles []string) (ids []uint64, ok bool, err error) {
+	ids = []uint64{}
+	for _, name := range roles {
+		role, err := w.users.QueryRoleByName(name)
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		ids = append(ids, role.ID)
+	}
+	ok = true
+	return
+}
+
+// assignRoles 替换用户的角色,角色名不存在时返回 false
+func (w *Worker) assignRoles(id uint64, roles []string) (ok bool, err error) {
+	ids, ok, err := w.resolveRoles(roles)
+	if !ok {
+		return
+	}
+	err = w.users.ReplaceUserRoles(id, ids)
+	ok = err == nil
+	return
+}
+
+func (w *Worker) roleList(context *gin.Context) {
+	roles, err := w.users.QueryAllRole()
+	if err != nil {
+		render.Status(context, render.StatusUserQueryRoleFailed)
+		return
+	}
+	render.Success(context, roles)
+}
+
+func (w *Worker) roleAdd(context *gin.Context) {
+	request := roleAddRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	if !validPermissions(request.Permissions) {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := w.users.InsertRole(strings.TrimSpace(request.Name), request.Permissions); err != nil {
+		render.Status(context, render.StatusUserCreateRoleFailed)
+		return
+	}
+	audit.Record(context, "role", nil, request)
+	render.Status(context, render.StatusSuccess)
+}
+
+func (w *Worker) roleUpdate(context *gin.Context) {
+	request := roleUpdateRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	if !validPermissions(request.Permissions) {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	role, err := w.users.QueryRoleById(request.ID)
+	if err != nil {
+		render.Status(context, render.StatusUserUpdateRoleFailed)
+		return
+	}
+	if role.Builtin {
+		render.Status(context, render.StatusUserRoleBuiltin)
+		return
+	}
+
+	if err := w.users.UpdateRole(request.ID, strings.TrimSpace(request.Name), request.Permissions); err != nil {
+		render.Status(context, render.StatusUserUpdateRoleFailed)
+		return
+	}
+	audit.Record(context, "role", role, request)
+	render.Status(context, render.StatusSuccess)
+}
+
+func (w *Worker) roleDelete(context *gin.Context) {
+	request := roleDeleteRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	role, err := w.users.QueryRoleById(request.ID)
+	if err != nil {
+		render.Status(context, render.StatusUserDeleteRoleFailed)
+		return
+	}
+	if role.Builtin {
+		render.Status(context, render.StatusUserRoleBuiltin)
+		return
+	}
+
+	if err := w.users.DeleteRole(request.ID); err != nil {
+		render.Status(context, render.StatusUserDeleteRoleFailed)
+		return
+	}
+	audit.Record(context, "role", role, nil)
+	render.Status(context, render.StatusSuccess)
+}
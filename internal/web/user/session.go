@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSessionIdleTimeout     = 30 * 60
+	defaultSessionAbsoluteTimeout = 12 * 60 * 60
+	defaultSessionMaxPerUser      = 5
+
+	// 访问时间的更新间隔,避免每个请求都写数据库
+	sessionTouchInterval = 30
+)
+
+const (
+	contextUser    = "user"
+	contextSession = "session"
+	// 当前会话是否通过了两步验证
+	contextTotp = "totp"
+	// 使用令牌访问时的令牌 ID 和权限范围
+	contextToken = "token"
+	contextScope = "scope"
+)
+
+type Session = storage.Session
+
+type sessionPolicy struct {
+	// 超过 IdleTimeout 秒未访问的会话失效
+	IdleTimeout int `json:"idleTimeout" binding:"min=60"`
+	// 创建超过 AbsoluteTimeout 秒的会话失效
+	AbsoluteTimeout int `json:"absoluteTimeout" binding:"min=60"`
+	// 每个用户同时存在的会话数量上限,超出时注销最久未访问的会话, 0 表示不限制
+	MaxPerUser int `json:"maxPerUser" binding:"min=0"`
+}
+
+type sessionRevokeRequest struct {
+	ID uint64 `json:"id" uri:"id" binding:"number"`
+}
+
+// Current 返回当前请求登录的用户,只在需要登录的接口中有效
+func Current(context *gin.Context) (user User, ok bool) {
+	value, ok := context.Get(contextUser)
+	if !ok {
+		return
+	}
+	user, ok = value.(User)
+	return
+}
+
+func newSessionToken() (token string, err error) {
+	buffer := make([]byte, 32)
+	if _, err = rand.Read(buffer); err != nil {
+		return
+	}
+	token = hex.EncodeToString(buffer)
+	return
+}
+
+// 数据库中只保存会话令牌的哈希
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (w *Worker) sessionPolicy() (policy sessionPolicy) {
+	var err error
+	if policy.IdleTimeout, err = w.config.GetInteger(config.SessionIdleTimeout); err != nil {
+		policy.IdleTimeout = defaultSessionIdleTimeout
+	}
+	if policy.AbsoluteTimeout, err = w.config.GetInteger(config.SessionAbsoluteTimeout); err != nil {
+		policy.AbsoluteTimeout = defaultSessionAbsoluteTimeout
+	}
+	if policy.MaxPerUser, err = w.config.GetInteger(config.SessionMaxPerUser); err != nil {
+		policy.MaxPerUser = defaultSessionMaxPerUser
+	}
+	return
+}
+
+// startSession 为用户创建会话,同时清理过期的会话和超出数量上限的会话, totp 表示登录时通过了两步验证
+func (w *Worker) startSession(context *gin.Context, user User, totp bool) (token string, err error) {
+	policy := w.sessionPolicy()
+	now := time.Now().Unix()
+
+	if err = w.users.DeleteExpiredSession(now-int64(policy.IdleTimeout), now-int64(policy.AbsoluteTimeout)); err != nil {
+		return
+	}
+
+	if policy.MaxPerUser > 0 {
+		if err = w.users.TrimUserSession(user.UserID, policy.MaxPerUser-1); err != nil {
+			return
+		}
+	}
+
+	token, err = newSessionToken()
+	if err != nil {
+		return
+	}
+	err = w.users.InsertSession(hashSessionToken(token), user.UserID, context.ClientIP(), context.Request.UserAgent(), now, totp)
+	return
+}
+
+// resumeSession 根据 cookie 查询会话对应的用户,会话过期时删除会话
+func (w *Worker) resumeSession(context *gin.Context) (user User, ok bool) {
+	token, err := context.Cookie("session")
+	if err != nil {
+		return
+	}
+
+	session, user, err := w.users.QuerySessionByToken(hashSessionToken(token))
+	if err != nil {
+		return
+	}
+
+	policy := w.sessionPolicy()
+	now := time.Now().Unix()
+	if now-session.Accessed > int64(policy.IdleTimeout) || now-session.Created > int64(policy.AbsoluteTimeout) {
+		if err := w.users.DeleteSessionById(session.ID); err != nil {
+			logrus.Error(err)
+		}
+		return
+	}
+
+	if now-session.Accessed >= sessionTouchInterval {
+		if err := w.users.TouchSession(session.ID, now); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	context.Set(contextUser, user)
+	context.Set(contextSession, session.ID)
+	context.Set(contextTotp, session.Totp)
+	ok = true
+	return
+}
+
+func (w *Worker) sessionList(context *gin.Context) {
+	sessions, err := w.users.QueryAllSession()
+	if err != nil {
+		render.Status(context, render.StatusUserQuerySessionFailed)
+		return
+	}
+
+	current := context.GetUint64(contextSession)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	render.Success(context, sessions)
+}
+
+func (w *Worker) sessionRevoke(context *gin.Context) {
+	request := sessionRevokeRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := w.users.DeleteSessionById(request.ID); err != nil {
+		render.Status(context, render.StatusUserRevokeSessionFailed)
+		return
+	}
+	audit.Record(context, "session", request.ID, nil)
+	render.Status(context, render.StatusSuccess)
+}
+
+func (w *Worker) sessionPolicyStatus(context *gin.Context) {
+	render.Success(context, w.sessionPolicy())
+}
+
+func (w *Worker) sessionPolicyUpdate(context *gin.Context) {
+	request := sessionPolicy{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := audit.SetInteger(context, w.config, config.SessionIdleTimeout, request.IdleTimeout); err != nil {
+		render.Status(context, render.StatusUserUpdateSessionPolicyFailed)
+		return
+	}
+	if err := audit.SetInteger(context, w.config, config.SessionAbsoluteTimeout, request.AbsoluteTimeout); err != nil {
+		render.Status(context, render.StatusUserUpdateSessionPolicyFailed)
+		return
+	}
+	if err := audit.SetInteger(context, w.config, config.SessionMaxPerUser, request.MaxPerUser); err != nil {
+		render.Status(context, render.StatusUserUpdateSessionPolicyFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"strings"
+	"time"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 令牌以固定前缀开头,便于在日志和代码仓库中识别泄露的令牌
+const tokenPrefix = "uranus_"
+
+type Token = storage.Token
+
+type tokenAddRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Permissions []string `json:"permissions"`
+	Expires     int64    `json:"expires" binding:"min=0"`
+}
+
+type tokenAddResponse struct {
+	ID uint64 `json:"id"`
+	// 令牌明文只在创建时返回一次
+	Token string `json:"token"`
+}
+
+type tokenRevokeRequest struct {
+	ID uint64 `json:"id" uri:"id" binding:"number"`
+}
+
+// bearerToken 返回 Authorization 头中的令牌,不存在时返回空字符串
+func bearerToken(context *gin.Context) string {
+	header := context.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// resumeToken 根据令牌查询所属的用户,过期的令牌视为无效
+func (w *Worker) resumeToken(context *gin.Context, raw string) (user User, ok bool) {
+	token, user, err := w.users.QueryTokenByHash(hashSessionToken(raw))
+	if err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	if token.Expires != 0 && now >= token.Expires {
+		return
+	}
+
+	if now-token.Used >= sessionTouchInterval {
+		if err := w.users.TouchToken(token.ID, now); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	context.Set(contextUser, user)
+	context.Set(contextToken, token.ID)
+	context.Set(contextScope, token.Permissions)
+	context.Set(contextTotp, token.Totp)
+	ok = true
+	return
+}
+
+// authorizeScope 检查令牌的权限范围,使用会话登录时不限制.
+// 限制了范围的令牌只能访问范围内的接口,不需要权限的个人设置接口也不能访问
+func authorizeScope(context *gin.Context, route *api.Route) bool {
+	value, ok := context.Get(contextScope)
+	if !ok {
+		return true
+	}
+	scope := value.([]string)
+	if len(scope) == 0 {
+		return true
+	}
+
+	if route == nil {
+		return false
+	}
+	required := route.Permission()
+	if required == "" {
+		return false
+	}
+	for _, permission := range scope {
+		if permission == required {
+			return true
+		}
+	}
+	return false
+}
+
+// 令牌和两步验证只能通过会话管理,避免令牌创建权限更大的令牌或者替换用户的身份验证器
+func sessionOnly(context *gin.Context) bool {
+	if _, ok := context.Get(contextToken); ok {
+		render.Status(context, render.StatusUserPermissionDenied)
+		return false
+	}
+	return true
+}
+
+func (w *Worker) tokenList(context *gin.Context) {
+	if !sessionOnly(context) {
+		return
+	}
+
+	current, _ := Current(context)
+	tokens, err := w.users.QueryUserTokens(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserQueryTokenFailed)
+		return
+	}
+	render.Success(context, tokens)
+}
+
+func (w *Worker) tokenAdd(context *gin.Context) {
+	if !sessionOnly(context) {
+		return
+	}
+
+	request := tokenAddRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	now := time.Now().Unix()
+	if !validPermissions(request.Permissions) || (request.Expires != 0 && request.Expires <= now) {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	current, _ := Current(context)
+	if !context.GetBool(contextTotp) {
+		required, err := w.users.TotpRequired(current.UserID)
+		if err != nil {
+			render.Status(context, render.StatusUserCreateTokenFailed)
+			return
+		}
+		if required {
+			render.Status(context, render.StatusUserTotpEnrollRequired)
+			return
+		}
+	}
+
+	raw, err := newSessionToken()
+	if err != nil {
+		render.Status(context, render.StatusUserCreateTokenFailed)
+		return
+	}
+	raw = tokenPrefix + raw
+
+	id, err := w.users.InsertToken(current.UserID, strings.TrimSpace(request.Name), hashSessionToken(raw), request.Permissions, now, request.Expires, context.GetBool(contextTotp))
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUserCreateTokenFailed)
+		return
+	}
+	audit.Record(context, "token", nil, Token{ID: id, Name: strings.TrimSpace(request.Name), Permissions: request.Permissions, Created: now, Expires: request.Expires, Totp: context.GetBool(contextTotp)})
+	render.Success(context, tokenAddResponse{ID: id, Token: raw})
+}
+
+func (w *Worker) tokenRevoke(context *gin.Context) {
+	if !sessionOnly(context) {
+		return
+	}
+
+	request := tokenRevokeRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	current, _ := Current(context)
+	if err := w.users.DeleteToken(request.ID, current.UserID); err != nil {
+		render.Status(context, render.StatusUserRevokeTokenFailed)
+		return
+	}
+	audit.Record(context, "token", request.ID, nil)
+	render.Status(context, render.StatusSuccess)
+}
@@ -0,0 +1,432 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// RFC 6238 TOTP, HMAC-SHA1, 30 秒步长, 6 位验证码
+const (
+	totpIssuer    = "uranus"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1
+	totpSecretLen = 20
+
+	recoveryCodeCount = 10
+
+	// 输入密码后完成两步验证的时限
+	totpChallengeTimeout = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type totpChallenge struct {
+	user    string
+	expires time.Time
+}
+
+// 通过密码验证,等待输入验证码的登录请求
+type totpChallenges struct {
+	mutex      sync.Mutex
+	challenges map[string]totpChallenge
+}
+
+func (c *totpChallenges) add(username string) (token string, err error) {
+	token, err = newSessionToken()
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for key, challenge := range c.challenges {
+		if now.After(challenge.expires) {
+			delete(c.challenges, key)
+		}
+	}
+	c.challenges[hashSessionToken(token)] = totpChallenge{user: username, expires: now.Add(totpChallengeTimeout)}
+	return
+}
+
+func (c *totpChallenges) take(token string) (username string, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := hashSessionToken(token)
+	challenge, ok := c.challenges[key]
+	if !ok {
+		return
+	}
+	delete(c.challenges, key)
+	if time.Now().After(challenge.expires) {
+		ok = false
+		return
+	}
+	username = challenge.user
+	return
+}
+
+type totpStatus struct {
+	Enabled bool `json:"enabled"`
+	// 用户的角色要求开启两步验证
+	Required bool `json:"required"`
+	// 剩余可用的恢复码数量
+	RecoveryCodes int `json:"recoveryCodes"`
+}
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	// otpauth:// 格式的 URI,前端生成二维码供身份验证器扫描
+	URI string `json:"uri"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type totpVerifyResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type totpLoginRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	// 身份验证器生成的验证码或者恢复码
+	Code string `json:"code" binding:"required"`
+}
+
+type totpChallengeResponse struct {
+	Challenge string `json:"challenge"`
+}
+
+type roleTotpRequest struct {
+	ID          uint64 `json:"id" uri:"id" binding:"number"`
+	RequireTotp bool   `json:"requireTotp"`
+}
+
+func totpCode(secret []byte, step int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// verifyTotp 校验验证码,允许前后一个步长的时钟误差,返回验证码对应的步长用于防止重放
+func verifyTotp(secret, code string, now time.Time) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return
+	}
+	current := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step = current + int64(i)
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+func newRecoveryCode() (code string, err error) {
+	buffer := make([]byte, 5)
+	if _, err = rand.Read(buffer); err != nil {
+		return
+	}
+	raw := strings.ToLower(totpEncoding.EncodeToString(buffer))
+	code = raw[:4] + "-" + raw[4:]
+	return
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor 校验验证码或恢复码,恢复码只能使用一次
+func (w *Worker) checkSecondFactor(id uint64, code string) (ok bool, err error) {
+	secret, enabled, _, err := w.users.QueryTotp(id)
+	if err != nil || !enabled {
+		return
+	}
+
+	code = strings.TrimSpace(code)
+	if step, valid := verifyTotp(secret, code, time.Now()); valid {
+		return w.users.UpdateTotpStep(id, step)
+	}
+
+	return w.users.ConsumeRecoveryCode(id, hashRecoveryCode(code))
+}
+
+func (w *Worker) userLoginTotp(context *gin.Context) {
+	request := totpLoginRequest{}
+	deleteSession(context)
+
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	username, ok := w.challenges.take(request.Challenge)
+	if !ok {
+		render.Status(context, render.StatusUserLoginFaild)
+		return
+	}
+	audit.Actor(context, username, 0)
+
+	if w.loginThrottled(context, username) {
+		return
+	}
+
+	user, err := w.users.QueryUserByUsername(username)
+	if err != nil {
+		render.Status(context, render.StatusUnknownError)
+		return
+	}
+
+	ok, err = w.checkSecondFactor(user.UserID, request.Code)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUnknownError)
+		return
+	}
+	if !ok {
+		w.loginFailed(context, username)
+		render.Status(context, render.StatusUserLoginFaild)
+		return
+	}
+
+	session, err := w.startSession(context, user, true)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUnknownError)
+		return
+	}
+	w.loginSucceeded(context, username)
+	updateSession(context, session)
+	render.Status(context, render.StatusSuccess)
+}
+
+func (w *Worker) totpStatus(context *gin.Context) {
+	current, _ := Current(context)
+	_, enabled, _, err := w.users.QueryTotp(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserQueryTotpFailed)
+		return
+	}
+	required, err := w.users.TotpRequired(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserQueryTotpFailed)
+		return
+	}
+	count, err := w.users.CountRecoveryCode(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserQueryTotpFailed)
+		return
+	}
+	render.Success(context, totpStatus{Enabled: enabled, Required: required, RecoveryCodes: count})
+}
+
+// totpEnroll 生成新的密钥,验证通过后才会生效
+func (w *Worker) totpEnroll(context *gin.Context) {
+	if !sessionOnly(context) {
+		return
+	}
+
+	current, _ := Current(context)
+	_, enabled, _, err := w.users.QueryTotp(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserEnrollTotpFailed)
+		return
+	}
+	if enabled {
+		render.Status(context, render.StatusUserTotpAlreadyEnabled)
+		return
+	}
+
+	buffer := make([]byte, totpSecretLen)
+	if _, err := rand.Read(buffer); err != nil {
+		render.Status(context, render.StatusUserEnrollTotpFailed)
+		return
+	}
+	secret := totpEncoding.EncodeToString(buffer)
+	if err := w.users.UpsertTotp(current.UserID, secret); err != nil {
+		render.Status(context, render.StatusUserEnrollTotpFailed)
+		return
+	}
+	render.Success(context, totpEnrollResponse{Secret: secret, URI: totpURI(current.Username, secret)})
+}
+
+// totpVerify 使用验证码确认绑定,开启两步验证并生成恢复码
+func (w *Worker) totpVerify(context *gin.Context) {
+	if !sessionOnly(context) {
+		return
+	}
+
+	request := totpCodeRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	current, _ := Current(context)
+	secret, enabled, _, err := w.users.QueryTotp(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserEnrollTotpFailed)
+		return
+	}
+	if enabled {
+		render.Status(context, render.StatusUserTotpAlreadyEnabled)
+		return
+	}
+	if secret == "" {
+		render.Status(context, render.StatusUserTotpNotEnrolled)
+		return
+	}
+
+	step, ok := verifyTotp(secret, strings.TrimSpace(request.Code), time.Now())
+	if !ok {
+		render.Status(context, render.StatusUserTotpInvalidCode)
+		return
+	}
+
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			render.Status(context, render.StatusUserEnrollTotpFailed)
+			return
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	if err := w.users.EnableTotp(current.UserID, step, hashes); err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUserEnrollTotpFailed)
+		return
+	}
+	audit.Record(context, "totp", nil, current.Username)
+
+	// 当前会话已经通过验证码验证
+	if err := w.users.UpdateSessionTotp(context.GetUint64(contextSession)); err != nil {
+		logrus.Error(err)
+	}
+	render.Success(context, totpVerifyResponse{RecoveryCodes: codes})
+}
+
+func (w *Worker) totpDisable(context *gin.Context) {
+	if !sessionOnly(context) {
+		return
+	}
+
+	request := totpCodeRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	current, _ := Current(context)
+	required, err := w.users.TotpRequired(current.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUserDisableTotpFailed)
+		return
+	}
+	if required {
+		render.Status(context, render.StatusUserTotpEnrollRequired)
+		return
+	}
+
+	ok, err := w.checkSecondFactor(current.UserID, request.Code)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUserDisableTotpFailed)
+		return
+	}
+	if !ok {
+		render.Status(context, render.StatusUserTotpInvalidCode)
+		return
+	}
+
+	if err := w.users.DeleteTotp(current.UserID); err != nil {
+		render.Status(context, render.StatusUserDisableTotpFailed)
+		return
+	}
+	audit.Record(context, "totp", current.Username, nil)
+	render.Status(context, render.StatusSuccess)
+}
+
+// totpReset 管理员为丢失身份验证器和恢复码的用户关闭两步验证
+func (w *Worker) totpReset(context *gin.Context) {
+	request := userDeleteRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := w.users.DeleteTotp(request.UserID); err != nil {
+		render.Status(context, render.StatusUserDisableTotpFailed)
+		return
+	}
+	audit.Record(context, "totp", request.UserID, nil)
+	render.Status(context, render.StatusSuccess)
+}
+
+func (w *Worker) roleTotpUpdate(context *gin.Context) {
+	request := roleTotpRequest{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	role, err := w.users.QueryRoleById(request.ID)
+	if err != nil {
+		render.Status(context, render.StatusUserUpdateRoleFailed)
+		return
+	}
+	if err := w.users.UpdateRoleTotp(request.ID, request.RequireTotp); err != nil {
+		render.Status(context, render.StatusUserUpdateRoleFailed)
+		return
+	}
+	audit.Record(context, "role totp", role.RequireTotp, request.RequireTotp)
+	render.Status(context, render.StatusSuccess)
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 中 SHA1 的测试向量,取 8 位验证码的后 6 位
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := totpCode(secret, test.unix/totpPeriod); code != test.code {
+			t.Errorf("unix=%d code=%s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+// 允许前后一个步长的误差,返回验证码实际对应的步长
+func TestVerifyTotp(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := strings.ToLower(totpEncoding.EncodeToString(key))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name string
+		step int64
+		ok   bool
+	}{
+		{"current", current, true},
+		{"previous", current - 1, true},
+		{"next", current + 1, true},
+		{"too old", current - 2, false},
+		{"too new", current + 2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := verifyTotp(secret, totpCode(key, test.step), now)
+			if ok != test.ok || (ok && step != test.step) {
+				t.Errorf("step=%d ok=%v", step, ok)
+			}
+		})
+	}
+	if _, ok := verifyTotp("not base32!", "050471", now); ok {
+		t.Errorf("malformed secret accepted")
+	}
+}
+
+// 验证码和恢复码都只能使用一次,使用过的验证码之前的步长也不再接受
+func TestCheckSecondFactorReplay(t *testing.T) {
+	w, _ := newTestWorker(t)
+	if err := w.createUser("alice", "alice-password", "alice", "{*}"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := w.users.QueryUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	if err := w.users.UpsertTotp(alice.UserID, secret); err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := time.Now().Unix() / totpPeriod
+	if err := w.users.EnableTotp(alice.UserID, current-2, []string{hashRecoveryCode(recovery)}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"current code", totpCode(key, current), true},
+		{"replayed code", totpCode(key, current), false},
+		{"earlier code", totpCode(key, current-1), false},
+		{"wrong code", "000000x", false},
+		// 恢复码忽略大小写和空格
+		{"recovery code", " " + strings.ToUpper(recovery) + " ", true},
+		{"reused recovery code", recovery, false},
+	}
+	for _, step := range steps {
+		ok, err := w.checkSecondFactor(alice.UserID, step.code)
+		if err != nil || ok != step.ok {
+			t.Fatalf("%s: ok=%v err=%v", step.name, ok, err)
+		}
+	}
+	count, err := w.users.CountRecoveryCode(alice.UserID)
+	if err != nil || count != 0 {
+		t.Errorf("count=%d err=%v", count, err)
+	}
+}
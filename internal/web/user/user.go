@@ -4,118 +4,257 @@ package user
 import (
 	"database/sql"
 	"net/http"
+	"strconv"
+	"strings"
+	"uranus/internal/config"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
+	"uranus/internal/web/export"
 	"uranus/internal/web/render"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gobwas/glob"
-	"github.com/google/uuid"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPasswordMinLength = 8
+	defaultPasswordHistory   = 3
 )
 
 type Worker struct {
-	engine *gin.Engine
-	db     *sql.DB
+	registry *api.Registry
+	users    storage.UserRepository
+	config   *config.Config
+
+	challenges totpChallenges
+	throttle   loginThrottle
+	bootstrap  bootstrap
+}
 
-	onlineUserMax int
-	loggedUser    *lru.Cache
+func Init(registry *api.Registry, db *storage.DB) (err error) {
+	_, err = newWorker(registry, db)
+	return
 }
 
-func Init(engine *gin.Engine, db *sql.DB) (err error) {
-	onlineUserMax := 10
-	loggedUser, err := lru.New(onlineUserMax)
+func newWorker(registry *api.Registry, db *storage.DB) (w *Worker, err error) {
+	config, err := config.New(db)
 	if err != nil {
 		return
 	}
 
-	w := &Worker{
-		loggedUser:    loggedUser,
-		onlineUserMax: onlineUserMax,
-		engine:        engine,
-		db:            db,
+	w = &Worker{
+		registry: registry,
+		users:    storage.NewUserRepository(db),
+		config:   config,
+		challenges: totpChallenges{
+			challenges: map[string]totpChallenge{},
+		},
+		throttle: loginThrottle{
+			attempts: map[string]*loginAttempt{},
+		},
 	}
 
-	w.engine.Use(w.middleware())
-
-	w.engine.POST("/user/login", w.userLogin)
-	w.engine.POST("/user/alive", w.userAlive)
-	w.engine.POST("/user/info", w.userInfo)
-	w.engine.POST("/user/logout", w.userLogout)
-	w.engine.POST("/user/add", w.userAdd)
-	w.engine.POST("/user/delete", w.userDelete)
-	w.engine.POST("/user/update", w.userUpdate)
-	w.engine.POST("/user/list", w.userList)
-
-	if err = w.initUserTable(); err != nil {
+	w.registry.Use(w.middleware())
+
+	w.registry.Register([]api.Route{
+		{Method: http.MethodPost, Path: "/session", Legacy: "/user/login", Public: true, Handler: w.userLogin,
+			Summary: "登录,开启两步验证的用户需要继续提交验证码", Request: loginRequest{}, Response: totpChallengeResponse{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserLoginFaild, render.StatusUserLoginThrottled,
+				render.StatusUserTotpRequired, render.StatusUnknownError}},
+		{Method: http.MethodPost, Path: "/session/totp", Legacy: "/user/login/totp", Public: true, Handler: w.userLoginTotp,
+			Summary: "提交两步验证码完成登录", Request: totpLoginRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserLoginFaild, render.StatusUserLoginThrottled, render.StatusUnknownError}},
+		{Method: http.MethodGet, Path: "/setup", Legacy: "/user/setup/status", Public: true, Handler: w.bootstrapStatus,
+			Summary: "是否需要创建管理员", Response: bootstrapStatus{}},
+		{Method: http.MethodPost, Path: "/setup", Legacy: "/user/setup", Public: true, Handler: w.bootstrapAdmin,
+			Summary: "使用启动日志中的初始化令牌创建管理员", Request: bootstrapRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserBootstrapDone, render.StatusUserBootstrapInvalidToken,
+				render.StatusUserPasswordTooShort, render.StatusUserCreateUserFailed}},
+		{Method: http.MethodGet, Path: "/session/alive", Legacy: "/user/alive", Handler: w.userAlive,
+			Summary: "检查登录状态"},
+		{Method: http.MethodGet, Path: "/session", Legacy: "/user/info", Handler: w.userInfo,
+			Summary: "当前登录的用户", Response: User{}},
+		{Method: http.MethodDelete, Path: "/session", Legacy: "/user/logout", Handler: w.userLogout,
+			Summary: "退出登录"},
+		{Method: http.MethodPost, Path: "/users", Legacy: "/user/add", Resource: api.ResourceUser, Handler: w.userAdd,
+			Summary: "添加用户", Request: userAddRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUsernameExists, render.StatusUserCreateUserFailed}},
+		{Method: http.MethodDelete, Path: "/users/:id", Legacy: "/user/delete", Resource: api.ResourceUser, Handler: w.userDelete,
+			Summary: "删除用户", Request: userDeleteRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNotFound, render.StatusUserDeleteUserFailed}},
+		{Method: http.MethodPut, Path: "/users/:id", Legacy: "/user/update", Resource: api.ResourceUser, Handler: w.userUpdate,
+			Summary: "更新用户", Request: userUpdateRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusNotFound, render.StatusUserUsernameExists,
+				render.StatusUserUpdateUserFailed, render.StatusUserCreateUserFailed}},
+		{Method: http.MethodGet, Path: "/users", Legacy: "/user/list", Resource: api.ResourceUser, Handler: w.userList,
+			Summary: "用户列表", Response: []User{},
+			Statuses: []int{render.StatusUserQueryUserFailed}},
+		{Method: http.MethodGet, Path: "/users/export", Legacy: "/user/export", Resource: api.ResourceUser, Handler: w.userExport,
+			Summary: "导出用户列表,支持 ndjson 和 csv 格式", Request: export.Request{},
+			Statuses: []int{render.StatusInvalidArgument}},
+		{Method: http.MethodGet, Path: "/settings/password", Legacy: "/user/password/status", Resource: api.ResourceUser, Handler: w.passwordPolicyStatus,
+			Summary: "密码策略", Response: passwordPolicy{}},
+		{Method: http.MethodPut, Path: "/settings/password", Legacy: "/user/password/update", Resource: api.ResourceUser, Handler: w.passwordPolicyUpdate,
+			Summary: "更新密码策略", Request: passwordPolicy{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUpdatePasswordPolicyFailed}},
+		{Method: http.MethodGet, Path: "/roles", Legacy: "/user/role/list", Resource: api.ResourceUser, Handler: w.roleList,
+			Summary: "角色列表", Response: []Role{},
+			Statuses: []int{render.StatusUserQueryRoleFailed}},
+		{Method: http.MethodPost, Path: "/roles", Legacy: "/user/role/add", Resource: api.ResourceUser, Handler: w.roleAdd,
+			Summary: "添加自定义角色", Request: roleAddRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserCreateRoleFailed}},
+		{Method: http.MethodPut, Path: "/roles/:id", Legacy: "/user/role/update", Resource: api.ResourceUser, Handler: w.roleUpdate,
+			Summary: "更新自定义角色", Request: roleUpdateRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUpdateRoleFailed, render.StatusUserRoleBuiltin}},
+		{Method: http.MethodDelete, Path: "/roles/:id", Legacy: "/user/role/delete", Resource: api.ResourceUser, Handler: w.roleDelete,
+			Summary: "删除自定义角色", Request: roleDeleteRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserDeleteRoleFailed, render.StatusUserRoleBuiltin}},
+		{Method: http.MethodGet, Path: "/sessions", Legacy: "/user/session/list", Resource: api.ResourceUser, Handler: w.sessionList,
+			Summary: "会话列表", Response: []Session{},
+			Statuses: []int{render.StatusUserQuerySessionFailed}},
+		{Method: http.MethodDelete, Path: "/sessions/:id", Legacy: "/user/session/revoke", Resource: api.ResourceUser, Handler: w.sessionRevoke,
+			Summary: "注销会话", Request: sessionRevokeRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserRevokeSessionFailed}},
+		{Method: http.MethodGet, Path: "/settings/session", Legacy: "/user/session/policy/status", Resource: api.ResourceUser, Handler: w.sessionPolicyStatus,
+			Summary: "会话策略", Response: sessionPolicy{}},
+		{Method: http.MethodPut, Path: "/settings/session", Legacy: "/user/session/policy/update", Resource: api.ResourceUser, Handler: w.sessionPolicyUpdate,
+			Summary: "更新会话策略", Request: sessionPolicy{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUpdateSessionPolicyFailed}},
+		{Method: http.MethodGet, Path: "/settings/login", Legacy: "/user/login/policy/status", Resource: api.ResourceUser, Handler: w.loginPolicyStatus,
+			Summary: "登录策略", Response: loginPolicy{}},
+		{Method: http.MethodPut, Path: "/settings/login", Legacy: "/user/login/policy/update", Resource: api.ResourceUser, Handler: w.loginPolicyUpdate,
+			Summary: "更新登录策略", Request: loginPolicy{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUpdateLoginPolicyFailed}},
+		{Method: http.MethodGet, Path: "/events/login", Legacy: "/user/login/event/list", Resource: api.ResourceEvent, Handler: w.loginEventList,
+			Summary: "登录失败事件列表", Request: loginEventListRequest{}, Response: []LoginEvent{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserQueryLoginEventFailed}},
+		{Method: http.MethodPut, Path: "/events/login/:id", Legacy: "/user/login/event/update", Resource: api.ResourceEvent, Handler: w.loginEventUpdate,
+			Summary: "更新登录失败事件状态", Request: loginEventUpdateRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUpdateLoginEventFailed}},
+		{Method: http.MethodGet, Path: "/totp", Legacy: "/user/totp/status", Handler: w.totpStatus,
+			Summary: "两步验证状态", Response: totpStatus{},
+			Statuses: []int{render.StatusUserQueryTotpFailed}},
+		{Method: http.MethodPost, Path: "/totp/enroll", Legacy: "/user/totp/enroll", Handler: w.totpEnroll,
+			Summary: "生成两步验证密钥", Response: totpEnrollResponse{},
+			Statuses: []int{render.StatusUserPermissionDenied, render.StatusUserTotpAlreadyEnabled, render.StatusUserEnrollTotpFailed}},
+		{Method: http.MethodPost, Path: "/totp/verify", Legacy: "/user/totp/verify", Handler: w.totpVerify,
+			Summary: "确认绑定并开启两步验证,返回一次性恢复码", Request: totpCodeRequest{}, Response: totpVerifyResponse{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserPermissionDenied, render.StatusUserTotpInvalidCode, render.StatusUserTotpNotEnrolled,
+				render.StatusUserTotpAlreadyEnabled, render.StatusUserEnrollTotpFailed}},
+		{Method: http.MethodPost, Path: "/totp/disable", Legacy: "/user/totp/disable", Handler: w.totpDisable,
+			Summary: "关闭两步验证", Request: totpCodeRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserPermissionDenied, render.StatusUserTotpInvalidCode,
+				render.StatusUserTotpEnrollRequired, render.StatusUserDisableTotpFailed}},
+		{Method: http.MethodDelete, Path: "/users/:id/totp", Legacy: "/user/totp/reset", Resource: api.ResourceUser, Handler: w.totpReset,
+			Summary: "关闭指定用户的两步验证", Request: userDeleteRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserDisableTotpFailed}},
+		{Method: http.MethodGet, Path: "/tokens", Legacy: "/user/token/list", Handler: w.tokenList,
+			Summary: "当前用户的 API 令牌列表", Response: []Token{},
+			Statuses: []int{render.StatusUserPermissionDenied, render.StatusUserQueryTokenFailed}},
+		{Method: http.MethodPost, Path: "/tokens", Legacy: "/user/token/add", Handler: w.tokenAdd,
+			Summary: "创建 API 令牌,令牌只在创建时返回一次", Request: tokenAddRequest{}, Response: tokenAddResponse{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserPermissionDenied,
+				render.StatusUserTotpEnrollRequired, render.StatusUserCreateTokenFailed}},
+		{Method: http.MethodDelete, Path: "/tokens/:id", Legacy: "/user/token/revoke", Handler: w.tokenRevoke,
+			Summary: "注销 API 令牌", Request: tokenRevokeRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserPermissionDenied, render.StatusUserRevokeTokenFailed}},
+		{Method: http.MethodPut, Path: "/roles/:id/totp", Legacy: "/user/role/totp", Resource: api.ResourceUser, Handler: w.roleTotpUpdate,
+			Summary: "设置角色是否要求两步验证", Request: roleTotpRequest{},
+			Statuses: []int{render.StatusInvalidArgument, render.StatusUserUpdateRoleFailed}},
+	})
+
+	if err = w.initBuiltinRoles(); err != nil {
+		return
+	}
+	if err = w.initBootstrap(); err != nil {
 		return
 	}
 	return
-
 }
 
-type User struct {
-	UserID      uint64 `json:"userID"`
-	Username    string `json:"username"`
-	AliasName   string `json:"aliasName"`
-	Permissions string `json:"permissions"`
-}
+type User = storage.User
 
 func (w *Worker) middleware() gin.HandlerFunc {
 	return func(context *gin.Context) {
-		if context.Request.Method == http.MethodGet {
+		path := context.Request.URL.Path
+		route, registered := api.Lookup(context)
+		if registered {
+			path = route.LegacyPath()
+		}
+		// 未注册的 GET 请求由前端静态文件处理
+		if !registered && context.Request.Method == http.MethodGet {
 			context.Next()
 			return
 		}
-		if context.Request.URL.Path == "/user/login" {
+		if registered && route.Public {
 			context.Next()
 			return
 		}
-		session, err := context.Cookie("session")
-		if err != nil {
-			render.Status(context, render.StatusUserNotLoggedIn)
-			context.Abort()
+		if username, local := api.Local(context.Request); local {
+			audit.Actor(context, username, 0)
+			context.Next()
 			return
 		}
-
-		user, ok := w.loggedUser.Get(session)
+		var user User
+		var ok bool
+		if token := bearerToken(context); token != "" {
+			user, ok = w.resumeToken(context, token)
+		} else {
+			user, ok = w.resumeSession(context)
+		}
 		if !ok {
 			render.Status(context, render.StatusUserNotLoggedIn)
 			context.Abort()
 			return
 		}
 
-		g, err := glob.Compile(user.(User).Permissions)
-		if err != nil {
+		audit.Actor(context, user.Username, context.GetUint64(contextToken))
+
+		if !w.authorize(user, route, path) || !authorizeScope(context, route) {
 			render.Status(context, render.StatusUserPermissionDenied)
 			context.Abort()
 			return
 		}
-		if !g.Match(context.Request.URL.Path) {
-			render.Status(context, render.StatusUserPermissionDenied)
-			context.Abort()
-			return
+
+		// 角色要求两步验证时,未通过两步验证的会话只能访问不需要权限的接口,用于绑定身份验证器
+		if route != nil && route.Resource != "" && !context.GetBool(contextTotp) {
+			required, err := w.users.TotpRequired(user.UserID)
+			if err != nil {
+				logrus.Error(err)
+			}
+			if err != nil || required {
+				render.Status(context, render.StatusUserTotpEnrollRequired)
+				context.Abort()
+				return
+			}
 		}
 		context.Next()
 	}
 }
 
+type loginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
 func (w *Worker) userLogin(context *gin.Context) {
-	request := struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-	}{}
+	request := loginRequest{}
 	deleteSession(context)
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
-	if w.noUser() {
-		w.createUser(request.Username, request.Password, request.Username, `{*}`)
+	audit.Actor(context, request.Username, 0)
+	if w.loginThrottled(context, request.Username) {
+		return
 	}
 
-	ok, err := w.checkUserPassword(request.Username, request.Password)
+	ok, outdated, err := w.checkUserPassword(request.Username, request.Password)
 	if err == sql.ErrNoRows {
+		w.loginFailed(context, request.Username)
 		render.Status(context, render.StatusUserLoginFaild)
 		return
 	}
@@ -126,17 +265,46 @@ func (w *Worker) userLogin(context *gin.Context) {
 	}
 
 	if !ok {
+		w.loginFailed(context, request.Username)
 		render.Status(context, render.StatusUserLoginFaild)
 		return
 	}
 
-	response, err := w.queryUserByUsername(request.Username)
+	// 登录成功时将旧算法保存的密码升级为当前算法
+	if outdated {
+		if err := w.updatePassword(request.Username, request.Password); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	response, err := w.users.QueryUserByUsername(request.Username)
+	if err != nil {
+		render.Status(context, render.StatusUnknownError)
+		return
+	}
+
+	_, enabled, _, err := w.users.QueryTotp(response.UserID)
+	if err != nil {
+		render.Status(context, render.StatusUnknownError)
+		return
+	}
+	if enabled {
+		challenge, err := w.challenges.add(response.Username)
+		if err != nil {
+			render.Status(context, render.StatusUnknownError)
+			return
+		}
+		render.Data(context, render.StatusUserTotpRequired, totpChallengeResponse{Challenge: challenge})
+		return
+	}
+
+	session, err := w.startSession(context, response, false)
 	if err != nil {
+		logrus.Error(err)
 		render.Status(context, render.StatusUnknownError)
 		return
 	}
-	session := uuid.NewString()
-	w.loggedUser.Add(session, response)
+	w.loginSucceeded(context, request.Username)
 	updateSession(context, session)
 	render.Status(context, render.StatusSuccess)
 }
@@ -146,46 +314,75 @@ func (w *Worker) userAlive(context *gin.Context) {
 }
 
 func (w *Worker) userInfo(context *gin.Context) {
-	session, err := context.Cookie("session")
-	if err != nil {
-		render.Status(context, render.StatusUserNotLoggedIn)
-		return
-	}
-
-	current, ok := w.loggedUser.Get(session)
+	current, ok := Current(context)
 	if !ok {
 		render.Status(context, render.StatusUserNotLoggedIn)
 		return
 	}
-	updateSession(context, session)
 	render.Success(context, current)
 }
 
 func (w *Worker) userLogout(context *gin.Context) {
-	session, _ := context.Cookie("session")
-	w.loggedUser.Remove(session)
+	if err := w.users.DeleteSessionById(context.GetUint64(contextSession)); err != nil {
+		logrus.Error(err)
+	}
 
 	deleteSession(context)
 	render.Status(context, render.StatusSuccess)
 }
 
+type userAddRequest struct {
+	Username    string   `json:"username" binding:"required"`
+	Password    string   `json:"password" binding:"required"`
+	AliasName   string   `json:"aliasName" binding:"required"`
+	Permissions string   `json:"permissions"`
+	Roles       []string `json:"roles"`
+}
+
 func (w *Worker) userAdd(context *gin.Context) {
-	request := struct {
-		Username    string `json:"username" binding:"required"`
-		Password    string `json:"password" binding:"required"`
-		AliasName   string `json:"aliasName" binding:"required"`
-		Permissions string `json:"permissions" binding:"required"`
-	}{}
-
-	if err := context.ShouldBindJSON(&request); err != nil {
+	request := userAddRequest{}
+
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
+	if !w.checkPasswordPolicy(context, 0, request.Password) {
+		return
+	}
+
+	exists, err := w.usernameExists(request.Username, 0)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUserCreateUserFailed)
+		return
+	}
+	if exists {
+		render.Status(context, render.StatusUserUsernameExists)
+		return
+	}
+
 	if err := w.createUser(request.Username, request.Password, request.AliasName, request.Permissions); err != nil {
 		render.Status(context, render.StatusUserCreateUserFailed)
 		return
 	}
+
+	user, err := w.users.QueryUserByUsername(request.Username)
+	if err != nil {
+		render.Status(context, render.StatusUserCreateUserFailed)
+		return
+	}
+	ok, err := w.assignRoles(user.UserID, request.Roles)
+	if err != nil {
+		logrus.Error(err)
+	}
+	if !ok {
+		w.deleteUser(user.UserID)
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+	user.Roles = request.Roles
+	audit.Record(context, "user", nil, user)
 	render.Status(context, render.StatusSuccess)
 }
 
@@ -198,15 +395,60 @@ func (w *Worker) userList(context *gin.Context) {
 	render.Success(context, users)
 }
 
+var userHeader = []string{"userID", "username", "aliasName", "permissions", "roles"}
+
+func userRecord(row interface{}) []string {
+	user := row.(User)
+	return []string{
+		strconv.FormatUint(user.UserID, 10),
+		user.Username,
+		user.AliasName,
+		user.Permissions,
+		strings.Join(user.Roles, ";"),
+	}
+}
+
+func (w *Worker) userExport(context *gin.Context) {
+	request := export.Request{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	writer, err := export.New(context, "user", request.Format, userHeader, userRecord)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer writer.Flush()
+
+	err = w.users.ScanAllUser(func(user User) error {
+		return writer.Write(user)
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+type userDeleteRequest struct {
+	UserID uint64 `json:"userID" uri:"id" binding:"number"`
+}
+
 func (w *Worker) userDelete(context *gin.Context) {
-	request := struct {
-		UserID uint64 `json:"userID" binding:"number"`
-	}{}
+	request := userDeleteRequest{}
 
-	if err := context.ShouldBindJSON(&request); err != nil {
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
+	user, err := w.users.QueryUserById(request.UserID)
+	if err == sql.ErrNoRows {
+		render.Status(context, render.StatusNotFound)
+		return
+	}
+	if err == nil {
+		audit.Record(context, "user", user, nil)
+	}
 	if ok := w.deleteUser(request.UserID); !ok {
 		render.Status(context, render.StatusUserDeleteUserFailed)
 		return
@@ -214,33 +456,165 @@ func (w *Worker) userDelete(context *gin.Context) {
 	render.Status(context, render.StatusSuccess)
 }
 
+type userUpdateRequest struct {
+	UserID   uint64 `json:"userID" uri:"id" binding:"number"`
+	Username string `json:"username" binding:"required"`
+	// 为空时不修改密码
+	Password    string   `json:"password"`
+	AliasName   string   `json:"aliasName" binding:"required"`
+	Permissions string   `json:"permissions"`
+	Roles       []string `json:"roles"`
+}
+
 func (w *Worker) userUpdate(context *gin.Context) {
-	request := struct {
-		UserID      uint64 `json:"userID" binding:"number"`
-		Username    string `json:"username" binding:"required"`
-		Password    string `json:"password" binding:"required"`
-		AliasName   string `json:"aliasName" binding:"required"`
-		Permissions string `json:"permissions" binding:"required"`
-	}{}
-
-	if err := context.ShouldBindJSON(&request); err != nil {
+	request := userUpdateRequest{}
+
+	if err := api.Bind(context, &request); err != nil {
 		render.Status(context, render.StatusInvalidArgument)
 		return
 	}
 
+	if request.Password != "" && !w.checkPasswordPolicy(context, request.UserID, request.Password) {
+		return
+	}
+
+	before, err := w.users.QueryUserById(request.UserID)
+	if err == sql.ErrNoRows {
+		render.Status(context, render.StatusNotFound)
+		return
+	}
+	if err != nil {
+		render.Status(context, render.StatusUserUpdateUserFailed)
+		return
+	}
+
+	exists, err := w.usernameExists(request.Username, request.UserID)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUserUpdateUserFailed)
+		return
+	}
+	if exists {
+		render.Status(context, render.StatusUserUsernameExists)
+		return
+	}
+
+	// 修改用户信息之前检查角色名,避免角色名错误时用户已经被修改并注销了会话
+	var roles []uint64
+	if request.Roles != nil {
+		var ok bool
+		roles, ok, err = w.resolveRoles(request.Roles)
+		if err != nil {
+			logrus.Error(err)
+			render.Status(context, render.StatusUserUpdateUserFailed)
+			return
+		}
+		if !ok {
+			render.Status(context, render.StatusInvalidArgument)
+			return
+		}
+	}
+
 	if ok := w.updateUserInfo(request.UserID, request.Username, request.Password, request.AliasName, request.Permissions); !ok {
-		render.Status(context, render.StatusUserCreateUserFailed)
+		render.Status(context, render.StatusUserUpdateUserFailed)
 		return
 	}
+
+	if roles != nil {
+		if err := w.users.ReplaceUserRoles(request.UserID, roles); err != nil {
+			logrus.Error(err)
+			render.Status(context, render.StatusUserUpdateUserFailed)
+			return
+		}
+	}
+
+	// 不记录密码
+	if after, err := w.users.QueryUserById(request.UserID); err == nil {
+		audit.Record(context, "user", before, after)
+	}
 	render.Status(context, render.StatusSuccess)
 }
 
+type passwordPolicy struct {
+	// 密码最小长度
+	MinLength int `json:"minLength" binding:"min=1"`
+	// 最近 History 次使用过的密码不能再次使用,包括当前密码, 0 表示不检查
+	History int `json:"history" binding:"min=0"`
+}
+
+func (w *Worker) passwordPolicy() (policy passwordPolicy) {
+	var err error
+	if policy.MinLength, err = w.config.GetInteger(config.PasswordMinLength); err != nil {
+		policy.MinLength = defaultPasswordMinLength
+	}
+	if policy.History, err = w.config.GetInteger(config.PasswordHistory); err != nil {
+		policy.History = defaultPasswordHistory
+	}
+	return
+}
+
+// checkPasswordPolicy 检查密码是否满足密码策略,不满足时返回错误状态, id 为 0 表示新用户
+func (w *Worker) checkPasswordPolicy(context *gin.Context, id uint64, password string) bool {
+	policy := w.passwordPolicy()
+	if len([]rune(password)) < policy.MinLength {
+		render.Status(context, render.StatusUserPasswordTooShort)
+		return false
+	}
+
+	if id == 0 {
+		return true
+	}
+	reused, err := w.passwordReused(id, password, policy.History)
+	if err != nil {
+		logrus.Error(err)
+		render.Status(context, render.StatusUnknownError)
+		return false
+	}
+	if reused {
+		render.Status(context, render.StatusUserPasswordReused)
+		return false
+	}
+	return true
+}
+
+func (w *Worker) passwordPolicyStatus(context *gin.Context) {
+	render.Success(context, w.passwordPolicy())
+}
+
+func (w *Worker) passwordPolicyUpdate(context *gin.Context) {
+	request := passwordPolicy{}
+	if err := api.Bind(context, &request); err != nil {
+		render.Status(context, render.StatusInvalidArgument)
+		return
+	}
+
+	if err := audit.SetInteger(context, w.config, config.PasswordMinLength, request.MinLength); err != nil {
+		render.Status(context, render.StatusUserUpdatePasswordPolicyFailed)
+		return
+	}
+	if err := audit.SetInteger(context, w.config, config.PasswordHistory, request.History); err != nil {
+		render.Status(context, render.StatusUserUpdatePasswordPolicyFailed)
+		return
+	}
+	render.Status(context, render.StatusSuccess)
+}
+
+// secure 判断客户端是否使用 HTTPS 访问,由信任的反向代理终止 TLS 时读取 X-Forwarded-Proto.
+// 不是来自信任的代理的 X-Forwarded-Proto 在交给路由之前已经去掉
+func secure(context *gin.Context) bool {
+	if context.Request.TLS != nil {
+		return true
+	}
+	return strings.EqualFold(context.GetHeader("X-Forwarded-Proto"), "https")
+}
+
+// 会话 cookie 禁止脚本访问,使用 TLS 时只通过 HTTPS 发送
 func updateSession(context *gin.Context, session string) {
 	context.SetSameSite(http.SameSiteStrictMode)
-	context.SetCookie("session", session, 0, "/", "", false, false)
+	context.SetCookie("session", session, 0, api.Base(context)+"/", "", secure(context), true)
 }
 
 func deleteSession(context *gin.Context) {
 	context.SetSameSite(http.SameSiteStrictMode)
-	context.SetCookie("session", "deleted", -1, "/", "", false, false)
+	context.SetCookie("session", "deleted", -1, api.Base(context)+"/", "", secure(context), true)
 }
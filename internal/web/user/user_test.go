@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+	"uranus/internal/web/api"
+	"uranus/internal/web/render"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestWorker(t *testing.T) (w *Worker, engine *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	db, err := storage.Open(filepath.Join(t.TempDir(), "web.db") + "?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	engine = gin.New()
+	registry := api.NewRegistry(engine, "")
+	if w, err = newWorker(registry, db); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// serve 返回 HTTP 状态码,响应中的 status 和设置的 Cookie
+func serve(engine http.Handler, method, path, body string, header http.Header) (code, status int, cookie string) {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, request)
+
+	response := struct {
+		Status int `json:"status"`
+	}{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if cookies := recorder.Result().Cookies(); len(cookies) > 0 {
+		cookie = cookies[len(cookies)-1].String()
+	}
+	return recorder.Code, response.Status, cookie
+}
+
+func login(t *testing.T, engine http.Handler, username, password string) http.Header {
+	_, status, cookie := serve(engine, http.MethodPost, "/api/v1/session", `{"username":"`+username+`","password":"`+password+`"}`, nil)
+	if status != render.StatusSuccess || cookie == "" {
+		t.Fatalf("login %s: status=%d", username, status)
+	}
+	return http.Header{"Cookie": {cookie}}
+}
+
+func TestMiddlewareUnknownRoute(t *testing.T) {
+	w, engine := newTestWorker(t)
+	if err := w.createUser("legacy", "legacy-password", "L", "{*}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.createUser("admin", "admin-password", "A", ""); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := w.users.QueryUserByUsername("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.assignRoles(admin.UserID, []string{RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status, _ := serve(engine, http.MethodPost, "/does/not/exist", "", nil); status != render.StatusUserNotLoggedIn {
+		t.Errorf("anonymous: status=%d", status)
+	}
+
+	t.Run("session", func(t *testing.T) {
+		// 旧版通配符权限的用户访问未注册的路径时由路由返回 404
+		if code, _, _ := serve(engine, http.MethodPost, "/does/not/exist", "", login(t, engine, "legacy", "legacy-password")); code != http.StatusNotFound {
+			t.Errorf("legacy user: code=%d", code)
+		}
+		if _, status, _ := serve(engine, http.MethodPost, "/does/not/exist", "", login(t, engine, "admin", "admin-password")); status != render.StatusUserPermissionDenied {
+			t.Errorf("admin: status=%d", status)
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		legacy, err := w.users.QueryUserByUsername("legacy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().Unix()
+		if _, err := w.users.InsertToken(legacy.UserID, "all", hashSessionToken("uranus_all"), nil, now, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.users.InsertToken(legacy.UserID, "scoped", hashSessionToken("uranus_scoped"), []string{"policy:read"}, now, 0, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if code, _, _ := serve(engine, http.MethodPost, "/does/not/exist", "", http.Header{"Authorization": {"Bearer uranus_all"}}); code != http.StatusNotFound {
+			t.Errorf("token: code=%d", code)
+		}
+		if _, status, _ := serve(engine, http.MethodPost, "/does/not/exist", "", http.Header{"Authorization": {"Bearer uranus_scoped"}}); status != render.StatusUserPermissionDenied {
+			t.Errorf("scoped token: status=%d", status)
+		}
+	})
+}
+
+// 用户不存在和用户名冲突是客户端错误, v1 接口返回 404 和 409,旧版接口仍然返回 200
+func TestUserClientErrorCodes(t *testing.T) {
+	w, engine := newTestWorker(t)
+	for _, name := range []string{"admin", "alice"} {
+		if err := w.createUser(name, name+"-password", name, "{*}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := login(t, engine, "admin", "admin-password")
+	alice, err := w.users.QueryUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := func(username string) string {
+		return `{"username":"` + username + `","password":"new-password","aliasName":"A","permissions":"{*}"}`
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		status int
+	}{
+		{"add existing", http.MethodPost, "/api/v1/users", body("alice"), http.StatusConflict, render.StatusUserUsernameExists},
+		{"rename to existing", http.MethodPut, fmt.Sprintf("/api/v1/users/%d", alice.UserID), body("admin"), http.StatusConflict, render.StatusUserUsernameExists},
+		{"update missing", http.MethodPut, "/api/v1/users/1000", body("bob"), http.StatusNotFound, render.StatusNotFound},
+		{"delete missing", http.MethodDelete, "/api/v1/users/1000", "", http.StatusNotFound, render.StatusNotFound},
+		{"legacy delete missing", http.MethodPost, "/user/delete", `{"userID":1000}`, http.StatusOK, render.StatusNotFound},
+		{"rename", http.MethodPut, fmt.Sprintf("/api/v1/users/%d", alice.UserID), body("bob"), http.StatusOK, render.StatusSuccess},
+	}
+	for _, test := range tests {
+		if code, status, _ := serve(engine, test.method, test.path, test.body, admin); code != test.code || status != test.status {
+			t.Errorf("%s: code=%d status=%d", test.name, code, status)
+		}
+	}
+}
+
+// 角色在令牌创建之后才要求两步验证时,未通过两步验证创建的令牌不能再访问需要权限的接口
+func TestTokenTotpRequiredLater(t *testing.T) {
+	w, engine := newTestWorker(t)
+	if err := w.createUser("admin", "admin-password", "A", ""); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := w.users.QueryUserByUsername("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.assignRoles(admin.UserID, []string{RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	if _, err := w.users.InsertToken(admin.UserID, "plain", hashSessionToken("uranus_plain"), nil, now, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.users.InsertToken(admin.UserID, "verified", hashSessionToken("uranus_verified"), nil, now, 0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	if _, status, _ := serve(engine, http.MethodGet, "/api/v1/users", "", bearer("uranus_plain")); status != render.StatusSuccess {
+		t.Fatalf("before: status=%d", status)
+	}
+
+	role, err := w.users.QueryRoleByName(RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.users.UpdateRoleTotp(role.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _ := serve(engine, http.MethodGet, "/api/v1/users", "", bearer("uranus_plain")); status != render.StatusUserTotpEnrollRequired {
+		t.Errorf("plain: status=%d", status)
+	}
+	if _, status, _ := serve(engine, http.MethodGet, "/api/v1/users", "", bearer("uranus_verified")); status != render.StatusSuccess {
+		t.Errorf("verified: status=%d", status)
+	}
+}
+
+// 令牌不能绑定或关闭两步验证,限制了范围的令牌也不能访问范围外不需要权限的接口
+func TestTokenCannotManageTotp(t *testing.T) {
+	w, engine := newTestWorker(t)
+	if err := w.createUser("admin", "admin-password", "A", "{*}"); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := w.users.QueryUserByUsername("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	if _, err := w.users.InsertToken(admin.UserID, "scoped", hashSessionToken("uranus_scoped"), []string{"event:read"}, now, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.users.InsertToken(admin.UserID, "full", hashSessionToken("uranus_full"), nil, now, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"uranus_scoped", http.MethodPost, "/api/v1/totp/enroll", "", render.StatusUserPermissionDenied},
+		{"uranus_scoped", http.MethodPost, "/api/v1/totp/verify", `{"code":"123456"}`, render.StatusUserPermissionDenied},
+		{"uranus_scoped", http.MethodPost, "/api/v1/totp/disable", `{"code":"123456"}`, render.StatusUserPermissionDenied},
+		{"uranus_scoped", http.MethodGet, "/api/v1/totp", "", render.StatusUserPermissionDenied},
+		{"uranus_scoped", http.MethodGet, "/api/v1/events/login", "", render.StatusSuccess},
+		{"uranus_full", http.MethodPost, "/api/v1/totp/enroll", "", render.StatusUserPermissionDenied},
+		{"uranus_full", http.MethodPost, "/api/v1/totp/disable", `{"code":"123456"}`, render.StatusUserPermissionDenied},
+		{"uranus_full", http.MethodGet, "/api/v1/totp", "", render.StatusSuccess},
+	}
+	for _, test := range tests {
+		header := http.Header{"Authorization": {"Bearer " + test.token}}
+		if _, status, _ := serve(engine, test.method, test.path, test.body, header); status != test.status {
+			t.Errorf("%s %s %s: status=%d", test.token, test.method, test.path, status)
+		}
+	}
+	if _, enabled, _, err := w.users.QueryTotp(admin.UserID); err != nil || enabled {
+		t.Errorf("enabled=%v err=%v", enabled, err)
+	}
+}
+
+// 角色名不存在时不修改用户,也不注销用户的会话
+func TestUserUpdateUnknownRole(t *testing.T) {
+	w, engine := newTestWorker(t)
+	for _, name := range []string{"admin", "alice"} {
+		if err := w.createUser(name, name+"-password", name, "{*}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := login(t, engine, "admin", "admin-password")
+	session := login(t, engine, "alice", "alice-password")
+	alice, err := w.users.QueryUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"username":"bob","password":"new-password","aliasName":"B","permissions":"{*}","roles":["missing"]}`
+	if _, status, _ := serve(engine, http.MethodPut, fmt.Sprintf("/api/v1/users/%d", alice.UserID), body, admin); status != render.StatusInvalidArgument {
+		t.Fatalf("status=%d", status)
+	}
+	if user, err := w.users.QueryUserById(alice.UserID); err != nil || user.Username != "alice" {
+		t.Errorf("user=%+v err=%v", user, err)
+	}
+	if _, status, _ := serve(engine, http.MethodGet, "/api/v1/users", "", session); status != render.StatusSuccess {
+		t.Errorf("session: status=%d", status)
+	}
+}
@@ -3,79 +3,262 @@ package web
 
 import (
 	"context"
-	"database/sql"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"uranus/internal/storage"
 
+	"uranus/internal/web/api"
+	"uranus/internal/web/audit"
 	"uranus/internal/web/control"
 	"uranus/internal/web/file"
 	"uranus/internal/web/net"
+	"uranus/internal/web/policy"
 	"uranus/internal/web/process"
+	"uranus/internal/web/retention"
+	"uranus/internal/web/stats"
 	"uranus/internal/web/user"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
+type Config struct {
+	// 监听地址, unix: 开头时监听 Unix Domain Socket,例如 unix:/run/uranus/web.sock
+	Listen string
+	// Unix Domain Socket 文件的权限和所属组,所属组为空时不修改
+	SocketMode  os.FileMode
+	SocketGroup string
+	// 信任的反向代理地址,来自这些地址的请求使用 X-Forwarded-For 中的客户端地址
+	TrustedProxies []string
+	// 反向代理部署时的路径前缀,例如 /uranus/
+	BasePath string
+	// 数据库备份目录,为空时不能备份和恢复
+	Backup string
+
+	TLS TLSConfig
+}
+
 type WebWorker struct {
-	addr   string
-	server *http.Server
-	wg     sync.WaitGroup
-	db     *sql.DB
+	addr     string
+	registry *api.Registry
+	server   *http.Server
+	wg       sync.WaitGroup
+	db       *storage.DB
+
+	config      Config
+	tls         TLSConfig
+	certificate *certificate
+	redirect    *http.Server
+	proxies     proxies
+
+	backgrounds map[string]control.Background
+	control     *control.Worker
+	reload      func() error
 }
 
-func NewWorker(addr string, db *sql.DB) *WebWorker {
+func NewWorker(config Config, db *storage.DB) *WebWorker {
 	w := WebWorker{
-		addr: addr,
-		db:   db,
+		addr:   config.Listen,
+		db:     db,
+		config: config,
+		tls:    config.TLS,
 	}
 	return &w
 }
 
-func (w *WebWorker) serve() {
+func (w *WebWorker) serve(listener listener) {
 	defer w.wg.Done()
-	if err := w.server.ListenAndServe(); err != http.ErrServerClosed {
+	var err error
+	if w.certificate != nil {
+		err = w.server.ServeTLS(listener, "", "")
+	} else {
+		err = w.server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
 		logrus.Error(err)
 		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 	}
 }
 
+func (w *WebWorker) serveRedirect() {
+	defer w.wg.Done()
+	if err := w.redirect.ListenAndServe(); err != http.ErrServerClosed {
+		logrus.Error(err)
+		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	}
+}
+
+func (w *WebWorker) initTLS() (err error) {
+	if !w.tls.Enabled() {
+		return
+	}
+	if err = generateSelfSigned(w.tls, w.addr); err != nil {
+		return
+	}
+	w.certificate = &certificate{config: w.tls}
+	if err = w.certificate.load(); err != nil {
+		return
+	}
+	w.server.TLSConfig = w.certificate.serverConfig()
+
+	if w.tls.Redirect != "" {
+		w.redirect = &http.Server{
+			Addr:    w.tls.Redirect,
+			Handler: redirectHandler(w.addr),
+		}
+	}
+	return
+}
+
+// AddBackground 添加可以通过控制接口重启的后台模块,需要在 Init 之前调用
+func (w *WebWorker) AddBackground(name string, background control.Background) {
+	if w.backgrounds == nil {
+		w.backgrounds = map[string]control.Background{}
+	}
+	w.backgrounds[name] = background
+}
+
+// OnReload 设置重新加载配置时执行的函数,需要在 Init 之前调用
+func (w *WebWorker) OnReload(reload func() error) {
+	w.reload = reload
+}
+
+// Reload 重新读取配置文件,与控制接口的重新加载相同,返回失败的原因
+func (w *WebWorker) Reload() error {
+	return w.control.Reload()
+}
+
+// Apply 使用新的配置替换信任的反向代理并重新加载证书,失败时继续使用原来的配置.
+// 监听地址等其他配置需要重启服务才能生效
+func (w *WebWorker) Apply(config Config) (err error) {
+	if config.Listen != w.config.Listen || config.BasePath != w.config.BasePath || config.Backup != w.config.Backup ||
+		config.SocketMode != w.config.SocketMode || config.SocketGroup != w.config.SocketGroup ||
+		config.TLS.Enabled() != w.tls.Enabled() || config.TLS.Redirect != w.tls.Redirect {
+		logrus.Warn("listen, socket, base, backup and tls.redirect changes take effect after restart")
+	}
+	cidrs, err := parseProxies(config.TrustedProxies)
+	if err != nil {
+		return
+	}
+
+	if w.certificate != nil {
+		certificate := &certificate{config: config.TLS}
+		if err = generateSelfSigned(config.TLS, w.addr); err != nil {
+			return
+		}
+		if err = certificate.load(); err != nil {
+			return
+		}
+		w.certificate.config = config.TLS
+		w.certificate.value.Store(certificate.current())
+		w.tls = config.TLS
+		logrus.Info("certificate reloaded")
+	}
+
+	w.proxies.store(cidrs)
+	w.config.TrustedProxies = config.TrustedProxies
+	return
+}
+
+// Handler 返回处理请求的 Handler,需要在 Init 之后调用
+func (w *WebWorker) Handler() http.Handler {
+	return w.server.Handler
+}
+
 func (w *WebWorker) Init() (err error) {
 	gin.SetMode(gin.ReleaseMode)
 
+	// 客户端地址由 proxies 解析,重新加载配置时不需要修改 gin 的设置
+	cidrs, err := parseProxies(w.config.TrustedProxies)
+	if err != nil {
+		return
+	}
+	w.proxies.store(cidrs)
 	engine := gin.New()
-	engine.GET("/*filename", front)
+	if err = engine.SetTrustedProxies(nil); err != nil {
+		return
+	}
+	engine.TrustedPlatform = clientAddrHeader
+	engine.NoRoute(front)
+	// 其他模块的中间件和接口都需要注册在 registry 之后
+	registry := api.NewRegistry(engine, basePath(w.config.BasePath))
+	w.registry = registry
+
+	controlWorker, err := control.Init(registry, w.db, w.backgrounds, w.config.Backup, w.reload)
+	if err != nil {
+		return
+	}
+	w.control = controlWorker
 
-	if err = user.Init(engine, w.db); err != nil {
+	auditWorker, err := audit.Init(registry, w.db)
+	if err != nil {
 		return
 	}
 
-	if err = process.Init(engine, w.db); err != nil {
+	if err = user.Init(registry, w.db); err != nil {
 		return
 	}
 
-	if err = file.Init(engine, w.db); err != nil {
+	if err = process.Init(registry, w.db); err != nil {
 		return
 	}
 
-	if err = net.Init(engine, w.db); err != nil {
+	if err = file.Init(registry, w.db); err != nil {
 		return
 	}
 
-	control.Init(engine, w.db)
+	if err = net.Init(registry, w.db); err != nil {
+		return
+	}
 
+	if err = policy.Init(registry, w.db); err != nil {
+		return
+	}
+
+	if err = stats.Init(registry, w.db); err != nil {
+		return
+	}
+
+	janitor, _ := w.backgrounds["janitor"].(retention.Janitor)
+	if err = retention.Init(registry, w.db, janitor); err != nil {
+		return
+	}
+
+	controlWorker.Register()
+	auditWorker.Register()
+
+	registry.Register([]api.Route{
+		{Method: http.MethodGet, Path: "/openapi.json", Public: true, Handler: registry.Document,
+			Summary: "OpenAPI 3 接口文档"},
+	})
+
+	handler := w.proxies.handler(withBasePath(registry.Base(), engine))
+	if strings.HasPrefix(w.addr, unixPrefix) {
+		handler = unixRemoteAddr(handler)
+	}
 	w.server = &http.Server{
 		Addr:    w.addr,
-		Handler: engine,
+		Handler: handler,
 	}
+	err = w.initTLS()
 	return
 }
 
 func (w *WebWorker) Start() (err error) {
+	listener, err := w.listen()
+	if err != nil {
+		return
+	}
 	w.wg.Add(1)
-	go w.serve()
+	go w.serve(listener)
+	if w.redirect != nil {
+		w.wg.Add(1)
+		go w.serveRedirect()
+	}
 	return
 }
 
@@ -83,6 +266,9 @@ func (w *WebWorker) Stop() (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	w.server.Shutdown(ctx)
+	if w.redirect != nil {
+		w.redirect.Shutdown(ctx)
+	}
 	w.wg.Wait()
 	return
 }
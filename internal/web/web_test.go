@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"uranus/internal/migration"
+	"uranus/internal/storage"
+)
+
+func TestOpenAPICoversAllRoutes(t *testing.T) {
+	db, err := storage.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := migration.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWorker(Config{Listen: "127.0.0.1:0"}, db)
+	if err := w.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	w.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("openapi.json status=%d", recorder.Code)
+	}
+
+	spec := struct {
+		Paths map[string]map[string]struct {
+			Summary   string                 `json:"summary"`
+			Responses map[string]interface{} `json:"responses"`
+		} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	param := regexp.MustCompile(`:([^/]+)`)
+	for _, route := range w.registry.Routes() {
+		path := param.ReplaceAllString(route.Path, "{$1}")
+		operation, ok := spec.Paths[path][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("%s %s is not described in the OpenAPI document", route.Method, route.Path)
+			continue
+		}
+		if operation.Summary == "" {
+			t.Errorf("%s %s has no summary", route.Method, route.Path)
+		}
+		if _, ok := operation.Responses["200"]; !ok {
+			t.Errorf("%s %s has no success response", route.Method, route.Path)
+		}
+	}
+}
+
+// 只使用信任的代理传递的客户端地址和协议,重新加载后立即按新的代理地址解析
+func TestProxiesReload(t *testing.T) {
+	var p proxies
+	var addr, proto string
+	handler := p.handler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		addr = request.Header.Get(clientAddrHeader)
+		proto = request.Header.Get("X-Forwarded-Proto")
+	}))
+	send := func(remote string) {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = remote
+		request.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set(clientAddrHeader, "198.51.100.1")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	tests := []struct {
+		proxies []string
+		remote  string
+		addr    string
+		proto   string
+	}{
+		{[]string{"10.0.0.1"}, "192.0.2.1:1234", "192.0.2.1", ""},
+		{[]string{"10.0.0.1"}, "10.0.0.1:1234", "10.0.0.2", "https"},
+		{[]string{"10.0.0.0/24"}, "10.0.0.1:1234", "203.0.113.7", "https"},
+		{nil, "10.0.0.1:1234", "10.0.0.1", ""},
+	}
+	for _, test := range tests {
+		cidrs, err := parseProxies(test.proxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.store(cidrs)
+		send(test.remote)
+		if addr != test.addr || proto != test.proto {
+			t.Errorf("proxies=%v remote=%s: addr=%s proto=%s", test.proxies, test.remote, addr, proto)
+		}
+	}
+
+	if _, err := parseProxies([]string{"not an address"}); err == nil {
+		t.Error("invalid proxy accepted")
+	}
+}
@@ -19,6 +19,10 @@ var contentType = map[string]string{
 }
 
 func front(context *gin.Context) {
+	if context.Request.Method != http.MethodGet {
+		context.Status(http.StatusNotFound)
+		return
+	}
 	filepath := context.Request.URL.String()
 	if filepath == "/" {
 		filepath = filepath + "index.html"
@@ -2,6 +2,8 @@
 package connector
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -89,3 +91,43 @@ func (c *Connector) Recv() (msg string, err error) {
 	msg = string(buffer[0:n])
 	return
 }
+
+// CodeError 表示 hackernel 返回了非 0 的 code
+type CodeError int
+
+func (e CodeError) Error() string {
+	return fmt.Sprintf("hackernel code %d", int(e))
+}
+
+// Code 返回 err 中 hackernel 返回的 code, err 为空时返回 0,
+// 未能得到 hackernel 响应时 ok 为 false
+func Code(err error) (code int, ok bool) {
+	if err == nil {
+		return 0, true
+	}
+	var e CodeError
+	if errors.As(err, &e) {
+		return int(e), true
+	}
+	return
+}
+
+// Call 发送请求并解析响应中的 code, code 不为 0 时返回 CodeError
+func Call(request string, timeout time.Duration) (err error) {
+	tmp, err := Exec(request, timeout)
+	if err != nil {
+		return
+	}
+
+	response := struct {
+		Code  int         `json:"code"`
+		Extra interface{} `json:"extra"`
+	}{}
+	if err = json.Unmarshal([]byte(tmp), &response); err != nil {
+		return
+	}
+	if response.Code != 0 {
+		err = CodeError(response.Code)
+	}
+	return
+}
@@ -4,6 +4,7 @@ package file
 import (
 	"encoding/json"
 	"errors"
+	"sync/atomic"
 	"time"
 	"uranus/pkg/connector"
 
@@ -28,11 +29,36 @@ const (
 	StatusPolicyFileNotExist = 3
 )
 
+// 目录策略保护目录下全部层级的文件,通配符策略按 filepath.Match 的规则匹配文件.
+// 两种策略由后台展开为每个文件的子策略
+const (
+	KindFile      = 0
+	KindDirectory = 1
+	KindGlob      = 2
+)
+
 const (
 	StatusEventUnread = 0
 	StatusEventRead   = 1
 )
 
+// 策略的权限按位组合,低 4 位禁止读,写,删除和重命名,高 4 位审计对应的操作
+const PermAll = 255
+
+// 文件事件的类型,除访问外都是策略跟踪产生的告警
+const (
+	// hackernel 上报的访问
+	EventKindAccess = 0
+	// 文件被替换或重新创建后重新设置了策略
+	EventKindReapplied = 1
+	// 文件被删除,重新创建后恢复保护
+	EventKindRemoved = 2
+	// 文件改变后重新设置策略失败
+	EventKindReapplyFailed = 3
+	// 限流汇总, Count 为 First 所在的一分钟内因限流没有记录的访问次数
+	EventKindSuppressed = 4
+)
+
 var (
 	ErrorEnable  = errors.New("file protection enable failed")
 	ErrorDisable = errors.New("file protection disable failed")
@@ -46,6 +72,18 @@ type Policy struct {
 	Perm      int    `json:"perm"`
 	Timestamp int64  `json:"timestamp"`
 	Status    int    `json:"status"`
+	Kind      int    `json:"kind"`
+	// 目录和通配符策略展开的子策略中为所属策略的 id
+	Parent uint64 `json:"parent"`
+}
+
+// Expansion 目录和通配符策略展开的子策略数量,按状态统计
+type Expansion struct {
+	Total    int `json:"total"`
+	Normal   int `json:"normal"`
+	Unknown  int `json:"unknown"`
+	Conflict int `json:"conflict"`
+	NotExist int `json:"notExist"`
 }
 
 type Event struct {
@@ -57,6 +95,12 @@ type Event struct {
 	Timestamp int64  `json:"timestamp"`
 	Policy    uint64 `json:"policy"`
 	Status    int    `json:"status"`
+	// 合并的访问次数和第一次访问的时间, Timestamp 为最后一次访问的时间
+	Count int   `json:"count"`
+	First int64 `json:"first"`
+	// 旧版本中该事件之后因限流没有记录的访问次数,现在改为单独的限流汇总事件
+	Suppressed int `json:"suppressed"`
+	Kind       int `json:"kind"`
 }
 
 func SetPolicy(path string, perm, flag int) (fsid, ino uint64, status int, err error) {
@@ -103,50 +147,30 @@ func SetPolicy(path string, perm, flag int) (fsid, ino uint64, status int, err e
 	return
 }
 
-func Enable() bool {
-	tmp, err := connector.Exec(`{"type":"user::file::enable"}`, time.Second)
-	if err != nil {
-		return false
-	}
+// 最近一次成功发送给 hackernel 的模块状态, -1 表示还没有发送过
+var pushed int32 = -1
 
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+// Pushed 返回最近一次成功发送给 hackernel 的模块状态
+func Pushed() (status int, ok bool) {
+	status = int(atomic.LoadInt32(&pushed))
+	ok = status >= 0
+	return
 }
 
-func Disable() bool {
-	tmp, err := connector.Exec(`{"type":"user::file::disable"}`, time.Second)
-	if err != nil {
-		return false
+func Enable() (err error) {
+	if err = connector.Call(`{"type":"user::file::enable"}`, time.Second); err == nil {
+		atomic.StoreInt32(&pushed, StatusEnable)
 	}
-
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+	return
 }
 
-func ClearPolicy() bool {
-	tmp, err := connector.Exec(`{"type":"user::file::clear"}`, time.Second)
-	if err != nil {
-		return false
+func Disable() (err error) {
+	if err = connector.Call(`{"type":"user::file::disable"}`, time.Second); err == nil {
+		atomic.StoreInt32(&pushed, StatusDisable)
 	}
+	return
+}
 
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+func ClearPolicy() (err error) {
+	return connector.Call(`{"type":"user::file::clear"}`, time.Second)
 }
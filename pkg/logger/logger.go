@@ -11,8 +11,10 @@ import (
 
 type logFormatter struct{}
 
+// 构建时通过 -ldflags 设置
 var (
 	BuildDir string = "Undefined"
+	Version  string = "Undefined"
 )
 
 func InitLogrusFormat() {
@@ -4,6 +4,7 @@ package net
 import (
 	"encoding/json"
 	"errors"
+	"sync/atomic"
 	"time"
 	"uranus/pkg/connector"
 )
@@ -50,7 +51,7 @@ type Policy struct {
 	Response uint32 `json:"response"`
 }
 
-func AddPolicy(policy Policy) bool {
+func AddPolicy(policy Policy) (err error) {
 	request := struct {
 		Type string `json:"type"`
 		*Policy
@@ -61,25 +62,12 @@ func AddPolicy(policy Policy) bool {
 
 	bytes, err := json.Marshal(request)
 	if err != nil {
-		return false
+		return
 	}
-
-	tmp, err := connector.Exec(string(bytes), time.Second)
-	if err != nil {
-		return false
-	}
-
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err = json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+	return connector.Call(string(bytes), time.Second)
 }
 
-func DeletePolicy(id int) bool {
+func DeletePolicy(id int) (err error) {
 	request := struct {
 		Type string `json:"type"`
 		ID   int    `json:"id"`
@@ -90,68 +78,35 @@ func DeletePolicy(id int) bool {
 
 	bytes, err := json.Marshal(request)
 	if err != nil {
-		return false
-	}
-
-	tmp, err := connector.Exec(string(bytes), time.Second)
-	if err != nil {
-		return false
-	}
-
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
+		return
 	}
-	return response.Code == 0
+	return connector.Call(string(bytes), time.Second)
 }
 
-func Enable() bool {
-	tmp, err := connector.Exec(`{"type":"user::net::enable"}`, time.Second)
-	if err != nil {
-		return false
-	}
+// 最近一次成功发送给 hackernel 的模块状态, -1 表示还没有发送过
+var pushed int32 = -1
 
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+// Pushed 返回最近一次成功发送给 hackernel 的模块状态
+func Pushed() (status int, ok bool) {
+	status = int(atomic.LoadInt32(&pushed))
+	ok = status >= 0
+	return
 }
 
-func Disable() bool {
-	tmp, err := connector.Exec(`{"type":"user::net::disable"}`, time.Second)
-	if err != nil {
-		return false
+func Enable() (err error) {
+	if err = connector.Call(`{"type":"user::net::enable"}`, time.Second); err == nil {
+		atomic.StoreInt32(&pushed, StatusEnable)
 	}
-
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+	return
 }
 
-func ClearPolicy() bool {
-	tmp, err := connector.Exec(`{"type":"user::net::clear"}`, time.Second)
-	if err != nil {
-		return false
+func Disable() (err error) {
+	if err = connector.Call(`{"type":"user::net::disable"}`, time.Second); err == nil {
+		atomic.StoreInt32(&pushed, StatusDisable)
 	}
+	return
+}
 
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(tmp), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+func ClearPolicy() (err error) {
+	return connector.Call(`{"type":"user::net::clear"}`, time.Second)
 }
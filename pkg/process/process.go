@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 	"uranus/pkg/connector"
 
@@ -51,78 +52,45 @@ func SplitCmd(cmd string) (workdir, binary, argv string, err error) {
 	return
 }
 
-func UpdateJudge(judge int) bool {
+func UpdateJudge(judge int) (err error) {
 	request := map[string]interface{}{
 		"type":  "user::proc::judge",
 		"judge": judge,
 	}
 
 	bytes, err := json.Marshal(request)
-	if err != nil || len(bytes) > 1024 {
-		return false
-	}
-
-	responseStr, err := connector.Exec(string(bytes), time.Second)
 	if err != nil {
-		return false
-	}
-
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(responseStr), &response); err != nil {
-		return false
+		return
 	}
-	return response.Code == 0
+	return connector.Call(string(bytes), time.Second)
 }
 
-func Enable() bool {
-	responseStr, err := connector.Exec(`{"type":"user::proc::enable"}`, time.Second)
-	if err != nil {
-		return false
-	}
+// 最近一次成功发送给 hackernel 的模块状态, -1 表示还没有发送过
+var pushed int32 = -1
 
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(responseStr), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+// Pushed 返回最近一次成功发送给 hackernel 的模块状态
+func Pushed() (status int, ok bool) {
+	status = int(atomic.LoadInt32(&pushed))
+	ok = status >= 0
+	return
 }
 
-func Disable() bool {
-	responseStr, err := connector.Exec(`{"type":"user::proc::disable"}`, time.Second)
-	if err != nil {
-		return false
+func Enable() (err error) {
+	if err = connector.Call(`{"type":"user::proc::enable"}`, time.Second); err == nil {
+		atomic.StoreInt32(&pushed, StatusEnable)
 	}
-
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(responseStr), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+	return
 }
 
-func ClearPolicy() bool {
-	responseStr, err := connector.Exec(`{"type":"user::proc::trusted::clear"}`, time.Second)
-	if err != nil {
-		return false
+func Disable() (err error) {
+	if err = connector.Call(`{"type":"user::proc::disable"}`, time.Second); err == nil {
+		atomic.StoreInt32(&pushed, StatusDisable)
 	}
+	return
+}
 
-	response := struct {
-		Code  int         `json:"code"`
-		Extra interface{} `json:"extra"`
-	}{}
-	if err := json.Unmarshal([]byte(responseStr), &response); err != nil {
-		return false
-	}
-	return response.Code == 0
+func ClearPolicy() (err error) {
+	return connector.Call(`{"type":"user::proc::trusted::clear"}`, time.Second)
 }
 
 func SetTrustedCmd(cmd string) (err error) {
@@ -135,9 +103,7 @@ func SetTrustedCmd(cmd string) (err error) {
 		return
 	}
 
-	// TODO: 更细致的判断是否执行成功
-	_, err = connector.Exec(string(b), time.Second)
-	if err != nil {
+	if err = connector.Call(string(b), time.Second); err != nil {
 		logrus.Error(err)
 		return
 	}
@@ -154,9 +120,7 @@ func SetUntrustedCmd(cmd string) (err error) {
 		return
 	}
 
-	// TODO: 更细致的判断是否执行成功
-	_, err = connector.Exec(string(b), time.Second)
-	if err != nil {
+	if err = connector.Call(string(b), time.Second); err != nil {
 		logrus.Error(err)
 		return
 	}
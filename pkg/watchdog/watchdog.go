@@ -2,18 +2,23 @@
 package watchdog
 
 import (
+	"sync"
 	"time"
 )
 
 type Watchdog struct {
 	interval time.Duration
 	timer    *time.Timer
+
+	mutex sync.Mutex
+	last  time.Time
 }
 
 func New(interval time.Duration, callback func()) *Watchdog {
 	w := Watchdog{
 		interval: interval,
 		timer:    time.AfterFunc(interval, callback),
+		last:     time.Now(),
 	}
 	return &w
 }
@@ -25,4 +30,15 @@ func (w *Watchdog) Stop() {
 func (w *Watchdog) Kick() {
 	w.timer.Stop()
 	w.timer.Reset(w.interval)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.last = time.Now()
+}
+
+// Alive 返回最近一个周期内是否调用过 Kick
+func (w *Watchdog) Alive() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return time.Since(w.last) < w.interval
 }
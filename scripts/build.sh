@@ -1,11 +1,14 @@
 #!/bin/bash
 root=$(dirname $(cd $(dirname $0);pwd))
+version=$(git -C $root describe --tags --always --dirty 2>/dev/null || echo Undefined)
 
 for module in `ls $root/cmd`
 do
         path="$root/cmd/$module"
         cd $path
+        # 目录名以 uranus 开头时直接作为二进制名,例如 uranusctl
         bin="$path/uranus-$module"
+        [[ $module == uranus* ]] && bin="$path/$module"
         printf "[%s][build] %s\n" $(date +"%H:%M:%S") $bin
-        go build -o $bin -ldflags="-X 'uranus/pkg/logger.BuildDir=$root/'"
+        go build -o $bin -ldflags="-X 'uranus/pkg/logger.BuildDir=$root/' -X 'uranus/pkg/logger.Version=$version'"
 done
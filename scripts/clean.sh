@@ -5,7 +5,9 @@ for module in `ls $root/cmd`
 do
         path="$root/cmd/$module"
         cd $path
+        # 目录名以 uranus 开头时直接作为二进制名,例如 uranusctl
         bin="$path/uranus-$module"
+        [[ $module == uranus* ]] && bin="$path/$module"
         printf "[%s][remove] %s\n" $(date +"%H:%M:%S") $bin
         rm $bin
 done